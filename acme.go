@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/infobits-io/infobits-speedtest/pkg/speedtest"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager creates an autocert manager that provisions and renews
+// certificates for the configured domains
+func newACMEManager(ac speedtest.ACMEConfig) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(ac.Domains...),
+		Cache:      autocert.DirCache(ac.CacheDir),
+		Email:      ac.Email,
+	}
+}
+
+// serveACMEChallenges answers HTTP-01 challenges on the plain HTTP port, on
+// the interface the server listens on. Requests that are not challenges fall
+// through to handler.
+func serveACMEChallenges(m *autocert.Manager, cfg speedtest.Config, handler http.Handler) {
+	addr := net.JoinHostPort(cfg.BindHost(), strconv.Itoa(cfg.ACME.HTTPPort))
+	srv := &http.Server{
+		Addr:     addr,
+		Handler:  m.HTTPHandler(handler),
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+	setTimeouts(srv, cfg.Timeouts)
+
+	logger.Info("Serving ACME HTTP-01 challenges", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil {
+		logger.Error("ACME challenge listener stopped", "err", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/infobits-io/infobits-speedtest/pkg/speedtest"
+)
+
+// discoveryTimeout is how long the client listens for servers on the LAN
+const discoveryTimeout = 2 * time.Second
+
+// runClient implements the client subcommand
+func runClient(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	server := fs.String("server", "", "URL of the speedtest server to test against, or a comma-separated list to pick the closest from; found on the LAN through mDNS when empty")
+	streams := fs.Int("streams", 4, "Parallel download and upload streams")
+	duration := fs.Duration("duration", 10*time.Second, "Length of the download and upload phases")
+	jsonOut := fs.Bool("json", false, "Print the result as JSON")
+	submit := fs.Bool("submit", false, "Store the result on the server via /api/results")
+	apiKey := fs.String("api-key", os.Getenv(speedtest.EnvPrefix+"API_KEY"), "API key sent with submitted results")
+	discover := fs.Bool("discover", false, "List speedtest servers advertised on the LAN and exit")
+	auto := fs.Bool("auto", false, "Also consider the servers each -server lists via /api/servers, and test against the closest")
+	fs.Parse(args)
+
+	candidates := speedtest.SplitList(*server)
+	if *discover || len(candidates) == 0 {
+		servers, err := speedtest.Discover(context.Background(), discoveryTimeout)
+		if err != nil {
+			return fmt.Errorf("discovering servers: %w", err)
+		}
+		if *discover {
+			for _, s := range servers {
+				fmt.Printf("%s\t%s\n", s.Name, s.URL)
+			}
+			return nil
+		}
+		if len(servers) == 0 {
+			fs.Usage()
+			return errors.New("no server found on the LAN, pass -server")
+		}
+		for _, s := range servers {
+			candidates = append(candidates, s.URL)
+			if !*jsonOut {
+				fmt.Fprintf(os.Stderr, "Found %s at %s\n", s.Name, s.URL)
+			}
+		}
+	} else if *auto {
+		candidates = listedServers(candidates)
+	}
+
+	if len(candidates) > 1 {
+		best, err := speedtest.SelectServer(context.Background(), candidates)
+		if err != nil {
+			return fmt.Errorf("selecting a server: %w", err)
+		}
+		candidates = []string{best.URL}
+		if !*jsonOut {
+			fmt.Fprintf(os.Stderr, "Selected %s (%.1f ms)\n", best.URL, best.Latency)
+		}
+	}
+	c, err := speedtest.NewClient(candidates[0], *streams, *duration)
+	if err != nil {
+		return err
+	}
+	c.Submit, c.APIKey = *submit, *apiKey
+
+	var progress io.Writer = os.Stderr
+	if *jsonOut {
+		progress = nil
+	}
+	res, err := c.Run(context.Background(), progress)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	fmt.Printf("Server:   %s\n", res.Server)
+	fmt.Printf("Latency:  %.1f ms (jitter %.1f ms)\n", res.Latency, res.Jitter)
+	if res.ICMPLatency > 0 {
+		fmt.Printf("ICMP:     %.1f ms (jitter %.1f ms)\n", res.ICMPLatency, res.ICMPJitter)
+	}
+	fmt.Printf("Download: %.2f Mbps", res.Download)
+	if res.ServerDownload > 0 {
+		fmt.Printf(" (server measured %.2f Mbps)", res.ServerDownload)
+	}
+	fmt.Printf("\nUpload:   %.2f Mbps", res.Upload)
+	if res.ServerUpload > 0 {
+		fmt.Printf(" (server measured %.2f Mbps)", res.ServerUpload)
+	}
+	fmt.Println()
+	if res.RPM > 0 {
+		fmt.Printf("Responsiveness: %.0f RPM\n", res.RPM)
+	}
+	if res.BufferbloatGrade != "" {
+		fmt.Printf("Loaded:   %.1f ms downloading, %.1f ms uploading (bufferbloat grade %s)\n", res.DownloadLatency, res.UploadLatency, res.BufferbloatGrade)
+	}
+	return nil
+}
+
+// listedServers adds the servers each of urls lists via /api/servers,
+// leaving out duplicates. Servers that cannot be listed stay candidates.
+func listedServers(urls []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	add := func(u string) {
+		u = strings.TrimSuffix(u, "/")
+		if !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	for _, u := range urls {
+		add(u)
+		listed, err := speedtest.ListServers(context.Background(), u)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not list servers of %s: %v\n", u, err)
+			continue
+		}
+		for _, l := range listed {
+			add(l)
+		}
+	}
+	return out
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// Runtime figures published next to expvar's memstats and cmdline
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("gomaxprocs", expvar.Func(func() any { return runtime.GOMAXPROCS(0) }))
+	expvar.Publish("num_cpu", expvar.Func(func() any { return runtime.NumCPU() }))
+	expvar.Publish("cgo_calls", expvar.Func(func() any { return runtime.NumCgoCall() }))
+	started := time.Now()
+	expvar.Publish("uptime_seconds", expvar.Func(func() any { return int64(time.Since(started).Seconds()) }))
+}
+
+// serveDebug serves pprof profiles under /debug/pprof/ and expvar's runtime
+// metrics on /debug/vars. It runs on its own listener so debug data never
+// shows up on the public port.
+func serveDebug(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	srv := &http.Server{
+		Addr:     addr,
+		Handler:  mux,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+	logger.Info("Serving pprof and expvar", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil {
+		logger.Error("Debug listener stopped", "err", err)
+	}
+}
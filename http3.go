@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server creates a QUIC server exposing the same handlers as the TCP server
+func newHTTP3Server(addr string, tlsConfig *tls.Config, handler http.Handler) *http3.Server {
+	return &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig.Clone()),
+	}
+}
+
+// advertiseHTTP3 adds an Alt-Svc header to TCP responses so browsers can
+// switch to the QUIC listener on subsequent requests
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := h3.SetQUICHeaders(w.Header()); err != nil {
+			logger.Error("Setting Alt-Svc header failed", "err", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/infobits-io/infobits-speedtest/pkg/speedtest"
+)
+
+// listFlag collects the values of a flag that may be repeated
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// openListeners opens every configured listen address, or the port on all
+// interfaces when none are configured, reuse_port times for TCP addresses.
+// Sockets passed in by systemd take the place of all of them.
+func openListeners(cfg speedtest.Config) ([]net.Listener, error) {
+	lns, err := systemdListeners()
+	if err != nil || lns != nil {
+		return lns, err
+	}
+
+	addrs := cfg.Listen
+	if len(addrs) == 0 {
+		// Without a host the listener accepts both IPv4 and IPv6 clients
+		addrs = []string{fmt.Sprintf(":%d", cfg.Port)}
+	}
+	for _, addr := range addrs {
+		network, address, err := speedtest.ParseListenAddr(addr)
+		var opened []net.Listener
+		if err == nil {
+			opened, err = listen(network, address, cfg.ReusePort)
+		}
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("listening on %s: %w", addr, err)
+		}
+		lns = append(lns, opened...)
+	}
+	return lns, nil
+}
+
+// listen opens one listener on address, or n sharing a TCP address through
+// SO_REUSEPORT. The kernel then spreads new connections across them, so
+// many-core servers accept on several cores at once.
+func listen(network, address string, n int) ([]net.Listener, error) {
+	if network == "unix" {
+		removeStaleSocket(address)
+	}
+	if network == "unix" || n <= 1 {
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePort}
+	lns := make([]net.Listener, 0, n)
+	for range n {
+		ln, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run,
+// which would otherwise keep the new listener from binding. A socket some
+// process still accepts connections on is left alone, so a second instance
+// fails to bind instead of taking over a live one's path, and so are other
+// files at path.
+func removeStaleSocket(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(path)
+	}
+}
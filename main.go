@@ -1,271 +1,270 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
-	"fmt"
-	"io"
 	"log"
-	"math"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"time"
-)
 
-// Configuration
-const (
-	maxFileSize       = 500 * 1024 * 1024 // 500 MB max file size
-	fixedDownloadSize = 32 * 1024 * 1024  // Fixed 32 MB download size
-	fixedUploadSize   = 32 * 1024 * 1024  // Fixed 32 MB upload size (changed from 500 bytes)
+	"github.com/infobits-io/infobits-speedtest/pkg/speedtest"
+	"github.com/quic-go/quic-go/http3"
 )
 
-// Initialize logger
-var logger = log.New(os.Stdout, "[SPEEDTEST] ", log.LstdFlags)
-
-func main() {
-	// Parse command-line flags
-	port := flag.Int("port", 8080, "Port to serve on")
-	flag.Parse()
-
-	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/ping", handlePing)
-	http.HandleFunc("/testfile", handleTestFile)
-	http.HandleFunc("/upload", handleUpload)
+// shutdownTimeout is how long running requests get to finish when the
+// server is stopped
+const shutdownTimeout = 10 * time.Second
 
-	// Set up static file serving
-	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+// Server logger, set up in main from the logging options
+var logger *slog.Logger
 
-	// Start the server
-	addr := fmt.Sprintf(":%d", *port)
-	logger.Printf("Starting server on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
-}
-
-// serveHome serves the home page
-func serveHome(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+func main() {
+	// Subcommands run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		if err := runClient(os.Args[2:]); err != nil {
+			log.Fatalf("Client test failed: %v", err)
+		}
 		return
 	}
-
-	http.ServeFile(w, r, "static/index.html")
-}
-
-// handlePing responds to ping requests to measure latency
-func handlePing(w http.ResponseWriter, r *http.Request) {
-	// Set headers to prevent caching
-	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
-
-	// Just return 200 OK with no content for ping test
-	w.WriteHeader(http.StatusOK)
-}
-
-// handleTestFile generates and streams random data for the download test
-func handleTestFile(w http.ResponseWriter, r *http.Request) {
-	// Always use fixed download size of 32MB, ignore any size parameter
-	size := fixedDownloadSize
-
-	// Check if we need to throttle for testing purposes
-	throttleStr := r.URL.Query().Get("throttle")
-	var throttleKBps int = 0 // No throttling by default
-
-	if throttleStr != "" {
-		parsedThrottle, err := strconv.Atoi(throttleStr)
-		if err == nil && parsedThrottle > 0 {
-			throttleKBps = parsedThrottle
-			logger.Printf("Throttling download to %d KBps", throttleKBps)
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := runService(os.Args[2:]); err != nil {
+			log.Fatalf("Service command failed: %v", err)
 		}
-	}
-
-	// Set appropriate headers
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.Itoa(size))
-	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
-
-	// Create a buffer for sending data in chunks
-	chunkSize := 64 * 1024 // 64KB chunks for efficient streaming
-	buffer := make([]byte, chunkSize)
-
-	// Pre-fill buffer with random data to avoid regenerating it for each chunk
-	_, err := rand.Read(buffer)
-	if err != nil {
-		logger.Printf("Error generating random data: %v", err)
-		http.Error(w, "Error generating test data", http.StatusInternalServerError)
 		return
 	}
 
-	// Stream random data
-	bytesRemaining := size
-	startTime := time.Now()
-
-	for bytesRemaining > 0 {
-		currentChunkSize := int(math.Min(float64(chunkSize), float64(bytesRemaining)))
-
-		// Write the chunk to the response
-		_, err := w.Write(buffer[:currentChunkSize])
-		if err != nil {
-			// Client probably disconnected, that's OK
-			logger.Printf("Error writing response: %v", err)
-			return
-		}
-
-		bytesRemaining -= currentChunkSize
-
-		// Flush to ensure data is sent immediately
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
-		}
+	runServer(os.Args[1:], nil)
+}
 
-		// Apply throttling if requested
-		if throttleKBps > 0 {
-			// Calculate how long this chunk should take to send at the throttled rate
-			elapsed := time.Since(startTime).Milliseconds()
-			expectedTime := int64((size - bytesRemaining) * 1000 / (throttleKBps * 1024))
+// runServer parses the server flags in args and serves until a fatal error,
+// or until stop is closed. It then lets running requests finish and shuts
+// the server down, delivering queued notifications.
+func runServer(args []string, stop <-chan struct{}) {
+	cfg := speedtest.DefaultConfig()
 
-			if elapsed < expectedTime {
-				// Sleep to maintain the throttled rate
-				time.Sleep(time.Duration(expectedTime-elapsed) * time.Millisecond)
-			}
+	// Parse command-line flags
+	configPath := flag.String("config", os.Getenv(speedtest.EnvPrefix+"CONFIG"), "Path to a YAML config file")
+	port := flag.Int("port", cfg.Port, "Port to serve on")
+	staticDir := flag.String("static-dir", "", "Serve the web UI from this directory instead of the embedded copy")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (enables HTTPS)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	http3Flag := flag.Bool("http3", false, "Also serve over HTTP/3 (QUIC); requires TLS")
+	acmeDomain := flag.String("acme-domain", "", "Comma-separated domains to obtain Let's Encrypt certificates for")
+	trustedProxyList := flag.String("trusted-proxies", "", "Comma-separated CIDRs of reverse proxies whose X-Forwarded-For/X-Real-IP headers are trusted")
+	schedule := flag.String("schedule", "", "Cron expression for automatic tests against -schedule-server, e.g. \"0 * * * *\"")
+	scheduleServer := flag.String("schedule-server", "", "URL of the server tested on -schedule")
+	reportTo := flag.String("report-to", "", "Send every stored result to the collector at this URL, e.g. https://speedtest.example.com")
+	mesh := flag.String("mesh", "", "Cron expression for mesh tests against the hub or every peer in servers")
+	corsOrigins := flag.String("cors-origins", "", "Comma-separated origins allowed to run tests from other domains, e.g. https://app.example.com")
+	allowEmbed := flag.String("allow-embed", "", "Comma-separated origins allowed to embed the web UI in a frame, or * for any")
+	apiKeys := flag.String("api-keys", "", "Comma-separated API keys protecting the results and admin APIs")
+	chunkSize := flag.Int("chunk-size", cfg.ChunkSize, "Bytes per write when streaming downloads")
+	maxFileSize := flag.Int64("max-file-size", cfg.MaxFileSize, "Largest accepted upload in bytes; duration-mode uploads without a size are only limited by time")
+	uploadBufferSize := flag.Int("upload-buffer-size", cfg.UploadBufferSize, "Bytes per read when receiving uploads")
+	payloadFile := flag.String("payload-file", "", "Serve download data from this file, generated when missing, instead of memory")
+	flushEvery := flag.Int("flush-every", cfg.FlushEvery, "Flush downloads every this many chunks (0 never flushes)")
+	maxConcurrent := flag.Int("max-concurrent", 0, "Maximum tests transferring data at the same time (0 for unlimited)")
+	logLevel := flag.String("log-level", cfg.Log.Level, "Log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", cfg.Log.Format, "Log format: text or json")
+	accessLog := flag.String("access-log", "", "Write an access log with per-request throughput to this file")
+	resultLog := flag.String("result-log", "", "Append every finished test to this file")
+	var listen listFlag
+	flag.Var(&listen, "listen", "Address to listen on instead of -port: host:port or unix:///path.sock (repeatable)")
+	reusePort := flag.Int("reuse-port", 0, "Open this many listeners per TCP address with SO_REUSEPORT to spread accepts over cores (Linux only)")
+	retain := flag.String("retain", "", "Delete results older than this, e.g. 90d, 12w or 720h")
+	debugAddr := flag.String("debug-addr", "", "Serve pprof and expvar on this address, e.g. localhost:6060")
+	flag.CommandLine.Parse(args)
+
+	// Settings are layered: defaults, config file, environment, then flags
+	if *configPath != "" {
+		if err := speedtest.LoadConfigFile(*configPath, &cfg); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
 		}
 	}
-}
-
-// handleUpload processes upload requests for the upload speed test
-func handleUpload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if err := speedtest.ApplyEnv(&cfg); err != nil {
+		log.Fatalf("Failed to read environment: %v", err)
 	}
-
-	// For upload test, we use the same size as download (32MB)
-	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
-
-	// Check if we need to simulate latency for more accurate testing
-	simulateLatencyStr := r.URL.Query().Get("latency")
-	var simulateLatencyMs int = 0
-
-	if simulateLatencyStr != "" {
-		parsedLatency, err := strconv.Atoi(simulateLatencyStr)
-		if err == nil && parsedLatency > 0 {
-			simulateLatencyMs = parsedLatency
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "static-dir":
+			cfg.StaticDir = *staticDir
+		case "tls-cert":
+			cfg.TLS.Cert = *tlsCert
+		case "tls-key":
+			cfg.TLS.Key = *tlsKey
+		case "http3":
+			cfg.HTTP3 = *http3Flag
+		case "acme-domain":
+			cfg.ACME.Domains = speedtest.SplitList(*acmeDomain)
+		case "schedule":
+			cfg.Schedule.Cron = *schedule
+		case "schedule-server":
+			cfg.Schedule.Server = *scheduleServer
+		case "mesh":
+			cfg.Mesh.Cron = *mesh
+		case "report-to":
+			cfg.Report.To = *reportTo
+		case "cors-origins":
+			cfg.CORSOrigins = speedtest.SplitList(*corsOrigins)
+		case "allow-embed":
+			cfg.Headers.AllowEmbed = speedtest.SplitList(*allowEmbed)
+		case "api-keys":
+			cfg.APIKeys = speedtest.SplitList(*apiKeys)
+		case "chunk-size":
+			cfg.ChunkSize = *chunkSize
+		case "max-file-size":
+			cfg.MaxFileSize = *maxFileSize
+		case "upload-buffer-size":
+			cfg.UploadBufferSize = *uploadBufferSize
+		case "payload-file":
+			cfg.PayloadFile = *payloadFile
+		case "flush-every":
+			cfg.FlushEvery = *flushEvery
+		case "max-concurrent":
+			cfg.MaxConcurrent = *maxConcurrent
+		case "trusted-proxies":
+			cfg.TrustedProxies = speedtest.SplitList(*trustedProxyList)
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		case "access-log":
+			cfg.AccessLog.File = *accessLog
+		case "result-log":
+			cfg.ResultLog.File = *resultLog
+		case "listen":
+			cfg.Listen = listen
+		case "reuse-port":
+			cfg.ReusePort = *reusePort
+		case "retain":
+			cfg.Results.Retain = *retain
+		case "debug-addr":
+			cfg.DebugAddr = *debugAddr
 		}
+	})
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	// Check if throttling is requested
-	throttleStr := r.URL.Query().Get("throttle")
-	var throttleKBps int = 0
-
-	if throttleStr != "" {
-		parsedThrottle, err := strconv.Atoi(throttleStr)
-		if err == nil && parsedThrottle > 0 {
-			throttleKBps = parsedThrottle
-		}
+	var err error
+	if cfg.Logger, err = speedtest.NewLogger(cfg.Log); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
 	}
+	logger = cfg.Log.ModuleLogger(cfg.Logger, "server")
+	// Fatal errors from here on go through the configured logger too
+	slog.SetDefault(logger)
 
-	// Start timing the upload
-	startTime := time.Now()
-
-	// Create a rate-limited reader if throttling is requested
-	var reader io.Reader = r.Body
-	if throttleKBps > 0 {
-		// Implement a simple rate-limiting reader
-		bytesPerSecond := throttleKBps * 1024
-		reader = &throttledReader{
-			r:              r.Body,
-			bytesPerSecond: bytesPerSecond,
-			lastRead:       time.Now(),
-			bytesRead:      0,
-		}
+	if cfg.WebFS, err = newWebFS(cfg.StaticDir); err != nil {
+		log.Fatalf("Failed to load static files: %v", err)
 	}
 
-	// Read the uploaded data (using the fixed size)
-	var byteCount int64
-	buffer := make([]byte, 8192) // Use a reasonable buffer size
-	totalRead := int64(0)
-
-	for {
-		n, err := reader.Read(buffer)
-		if err != nil && err != io.EOF {
-			logger.Printf("Error reading upload data: %v", err)
-			http.Error(w, "Upload failed", http.StatusInternalServerError)
-			return
-		}
-
-		totalRead += int64(n)
+	server := speedtest.New(cfg)
+	if cfg.Log.Requests {
+		server.Use(server.RequestLogger())
+	}
+	if err := server.Start(); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+	handler := server.Handler()
 
-		// For the test, we count up to fixedUploadSize bytes
-		if totalRead <= int64(fixedUploadSize) {
-			byteCount = totalRead
-		} else {
-			byteCount = int64(fixedUploadSize)
-		}
+	// Profiling stays on its own listener, away from the public port
+	if cfg.DebugAddr != "" {
+		go serveDebug(cfg.DebugAddr)
+	}
 
-		if err == io.EOF {
-			break
+	// Start the server. Addr is only used by HTTP/3, which binds the same
+	// interface as the TCP listeners opened below.
+	srv := &http.Server{
+		Addr:        net.JoinHostPort(cfg.BindHost(), strconv.Itoa(cfg.ServePort())),
+		Handler:     handler,
+		ErrorLog:    slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ConnState:   server.ConnState,
+		ConnContext: server.ConnContext,
+	}
+	setTimeouts(srv, cfg.Timeouts)
+
+	switch {
+	case cfg.ACME.Enabled():
+		m := newACMEManager(cfg.ACME)
+		srv.TLSConfig = m.TLSConfig()
+		go serveACMEChallenges(m, cfg, handler)
+		logger.Info("Using ACME certificates", "domains", cfg.ACME.Domains)
+	case cfg.TLS.Enabled():
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
 		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
 
-	// Simulate additional latency if requested
-	if simulateLatencyMs > 0 {
-		time.Sleep(time.Duration(simulateLatencyMs) * time.Millisecond)
+	// Serve the same handlers over QUIC and advertise it to TCP clients
+	var h3 *http3.Server
+	if cfg.HTTP3 {
+		h3 = newHTTP3Server(srv.Addr, srv.TLSConfig, handler)
+		srv.Handler = advertiseHTTP3(h3, handler)
+		go func() {
+			logger.Info("Starting HTTP/3 server (UDP)", "addr", srv.Addr)
+			if err := h3.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
 	}
 
-	// Calculate upload duration
-	duration := time.Since(startTime).Seconds()
-
-	// Send response with upload information
-	w.Header().Set("Content-Type", "application/json")
-	response := map[string]interface{}{
-		"success":  true,
-		"size":     byteCount,
-		"duration": duration,
+	lns, err := openListeners(cfg)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
 	}
-
-	json.NewEncoder(w).Encode(response)
-}
-
-// throttledReader implements a rate-limited reader
-type throttledReader struct {
-	r              io.Reader
-	bytesPerSecond int
-	lastRead       time.Time
-	bytesRead      int
-}
-
-func (t *throttledReader) Read(p []byte) (n int, err error) {
-	n, err = t.r.Read(p)
-	t.bytesRead += n
-
-	// Calculate expected time for bytes read so far
-	expectedDuration := time.Duration(float64(t.bytesRead) / float64(t.bytesPerSecond) * float64(time.Second))
-	actualDuration := time.Since(t.lastRead)
-
-	// If we're reading too fast, sleep to maintain the rate limit
-	if actualDuration < expectedDuration {
-		time.Sleep(expectedDuration - actualDuration)
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warn("Notifying systemd failed", "err", err)
+	}
+	go systemdWatchdog()
+
+	// Decided up front, since Serve fills in TLSConfig for HTTP/2
+	useTLS := srv.TLSConfig != nil
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			if useTLS {
+				logger.Info("Starting HTTPS server", "addr", ln.Addr().String())
+				errs <- srv.ServeTLS(ln, "", "")
+				return
+			}
+			logger.Info("Starting server", "addr", ln.Addr().String())
+			errs <- srv.Serve(ln)
+		}(ln)
+	}
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-stop:
 	}
 
-	return n, err
-}
-
-// ensureDir makes sure a directory exists, creating it if necessary
-func ensureDir(dir string) error {
-	return os.MkdirAll(dir, 0755)
+	logger.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("Requests still running at shutdown", "err", err)
+	}
+	if h3 != nil {
+		h3.Close()
+	}
+	if err := server.Close(); err != nil {
+		logger.Warn("Closing server failed", "err", err)
+	}
 }
 
-// init function to ensure necessary directories exist at startup
-func init() {
-	// Ensure static directory exists
-	staticDir := filepath.Join(".", "static")
-	if err := ensureDir(staticDir); err != nil {
-		log.Fatalf("Failed to create static directory: %v", err)
-	}
+// setTimeouts makes srv give up on clients as t configures
+func setTimeouts(srv *http.Server, t speedtest.TimeoutConfig) {
+	srv.ReadHeaderTimeout = time.Duration(t.ReadHeader) * time.Second
+	srv.ReadTimeout = time.Duration(t.Read) * time.Second
+	srv.WriteTimeout = time.Duration(t.Write) * time.Second
+	srv.IdleTimeout = time.Duration(t.Idle) * time.Second
 }
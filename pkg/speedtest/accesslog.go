@@ -0,0 +1,212 @@
+package speedtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// commonLogTime is the timestamp layout of the Common Log Format
+const commonLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogEntry is one request in the JSON access log
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	BytesIn    int64     `json:"bytes_in"`  // Request body bytes read
+	BytesOut   int64     `json:"bytes_out"` // Response body bytes written
+	DurationMs float64   `json:"duration_ms"`
+	Mbps       float64   `json:"mbps"` // Bytes in and out over the duration
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// accessLog writes one line per request to the access log file and syslog
+type accessLog struct {
+	format string        // common or json
+	out    *rotatingFile // Nil when the access log only goes to syslog
+	syslog *syslogWriter // Nil unless the access log goes to syslog
+}
+
+// openAccessLog opens the configured access log, or returns nil when neither
+// a file nor syslog is configured for it
+func openAccessLog(cfg AccessLogConfig, syslog *syslogWriter) (*accessLog, error) {
+	if cfg.File == "" && syslog == nil {
+		return nil, nil
+	}
+	a := &accessLog{format: cfg.Format, syslog: syslog}
+	if cfg.File != "" {
+		var err error
+		if a.out, err = openRotatingFile(cfg.File, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxBackups); err != nil {
+			return nil, fmt.Errorf("opening access log: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// close closes the log file
+func (a *accessLog) close() error {
+	if a == nil || a.out == nil {
+		return nil
+	}
+	return a.out.close()
+}
+
+// logAccess writes every request passing through next to the access log
+// once it is done
+func (s *Server) logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingBody{r: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		elapsed := time.Since(start)
+		entry := accessLogEntry{
+			Time:       start,
+			ClientIP:   s.clientIP(r),
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Proto:      r.Proto,
+			Status:     rec.status,
+			BytesIn:    body.count,
+			BytesOut:   rec.bytes,
+			DurationMs: float64(elapsed.Microseconds()) / 1000,
+			UserAgent:  r.UserAgent(),
+		}
+		if secs := elapsed.Seconds(); secs > 0 {
+			entry.Mbps = float64(entry.BytesIn+entry.BytesOut) * 8 / secs / 1e6
+		}
+		s.access.write(entry)
+	})
+}
+
+// write formats and appends one entry. Write errors are dropped; the access
+// log must never fail a request.
+func (a *accessLog) write(e accessLogEntry) {
+	var line []byte
+	if a.format == "json" {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		// Common Log Format, followed by the duration in milliseconds and
+		// the throughput in Mbps
+		line = fmt.Appendf(nil, "%s - - [%s] %q %d %d %.3f %.2f\n",
+			e.ClientIP, e.Time.Format(commonLogTime),
+			e.Method+" "+e.Path+" "+e.Proto,
+			e.Status, e.BytesOut, e.DurationMs, e.Mbps)
+	}
+	if a.out != nil {
+		a.out.Write(line)
+	}
+	a.syslog.send(syslogInfo, "access", string(bytes.TrimSuffix(line, []byte("\n"))))
+}
+
+// rotatingFile is an append-only file that is renamed to name.1 once it
+// grows past maxSize, or on the first write of a new day when daily is set,
+// shifting older copies up to name.<maxBackups>
+type rotatingFile struct {
+	mu         sync.Mutex
+	name       string
+	maxSize    int64 // Bytes; 0 never rotates
+	maxBackups int
+	daily      bool
+	header     []byte // Written at the top of every new file
+	f          *os.File
+	size       int64
+	day        string // Date of the last write, in local time
+}
+
+// openRotatingFile opens name for appending
+func openRotatingFile(name string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	rf.day = info.ModTime().Format(time.DateOnly)
+	if rf.size == 0 && len(rf.header) > 0 {
+		n, err := rf.f.Write(rf.header)
+		rf.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	today := time.Now().Format(time.DateOnly)
+	// A file holding no more than its header is never rotated
+	if written := rf.size > int64(len(rf.header)); written &&
+		((rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize) || (rf.daily && rf.day != today)) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	rf.day = today
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. Must be called
+// with the lock held.
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.name, i), fmt.Sprintf("%s.%d", rf.name, i+1))
+		}
+		os.Rename(rf.name, rf.name+".1")
+	} else {
+		os.Remove(rf.name)
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	r     io.ReadCloser
+	count int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.count += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	return b.r.Close()
+}
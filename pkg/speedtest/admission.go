@@ -0,0 +1,142 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// admissionError is the JSON body of a 429 response refusing a test
+type admissionError struct {
+	Error         string `json:"error"`
+	RetryAfter    int    `json:"retry_after"`              // Seconds until the client should try again
+	QueuePosition int    `json:"queue_position,omitempty"` // Place in line for a test slot, 1-based
+	Active        int    `json:"active,omitempty"`
+	Max           int    `json:"max,omitempty"`
+}
+
+// refuseTest answers a request that may not start a test right now
+func refuseTest(w http.ResponseWriter, retryAfter time.Duration, body admissionError) {
+	body.RetryAfter = int(math.Ceil(retryAfter.Seconds()))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(body.RetryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(body)
+}
+
+// admitTest decides whether the request may start a new test, writing a 429
+// response when it may not. An admitted test holds a slot until releaseTest.
+func (s *Server) admitTest(w http.ResponseWriter, r *http.Request) bool {
+	ip := s.clientIP(r)
+
+	// Check capacity first, so waiting in the queue doesn't use up the client's rate limit
+	if s.slots != nil {
+		ok, pos := s.slots.acquire(ip)
+		if !ok {
+			testsQueued.Inc()
+			active, _ := s.slots.usage()
+			refuseTest(w, busyRetryAfter, admissionError{
+				Error:         "Server busy",
+				QueuePosition: pos,
+				Active:        active,
+				Max:           s.slots.max,
+			})
+			return false
+		}
+	}
+
+	if s.limiter != nil {
+		ok, retryAfter := s.limiter.allow(ip)
+		if !ok {
+			s.releaseTest()
+			s.refuseRateLimited(w, retryAfter)
+			return false
+		}
+	}
+
+	return true
+}
+
+// refuseRateLimited answers a client that has used up its tests per hour
+func (s *Server) refuseRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	rateLimited.Inc()
+	refuseTest(w, retryAfter, admissionError{
+		Error: fmt.Sprintf("Rate limit of %d tests per hour exceeded", s.cfg.RateLimit.TestsPerHour),
+	})
+}
+
+// refuseStream answers a stream its session has no room for, as beginStream
+// decided with err
+func refuseStream(w http.ResponseWriter, session *testSession, err error) {
+	if err == errSessionUsedUp {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	refuseTest(w, time.Second, admissionError{
+		Error:  err.Error(),
+		Active: session.streams,
+		Max:    session.streams,
+	})
+}
+
+// requestSession returns the live session the request's session parameter
+// names, provided the request comes from the client that created it
+func (s *Server) requestSession(r *http.Request) (*testSession, bool) {
+	return s.sessions.lookup(r.URL.Query().Get("session"), s.clientIP(r))
+}
+
+// admitSession lets a stream of session through. A session that gave up its
+// test slot after idling is admitted again like a new test.
+func (s *Server) admitSession(w http.ResponseWriter, r *http.Request, session *testSession) bool {
+	if session.hasSlot() {
+		return true
+	}
+	if !s.admitTest(w, r) {
+		return false
+	}
+	s.sessions.reclaimSlot(session)
+	return true
+}
+
+// releaseTest frees the slot held by an admitted test
+func (s *Server) releaseTest() {
+	if s.slots != nil {
+		s.slots.release()
+	}
+}
+
+// limitTests admits /testfile and /upload requests made outside a session as
+// tests of their own. Streams of an existing session were admitted together
+// with the session, so a multi-stream browser test counts once, as long as
+// the session holds its test slot. Requests naming a session that doesn't
+// exist or isn't theirs are turned away before they take a slot or a test
+// from the rate limit. HEAD requests transfer nothing and pass freely.
+func (s *Server) limitTests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			next(w, r)
+			return
+		}
+		if r.URL.Query().Get("session") != "" {
+			session, ok := s.requestSession(r)
+			if !ok {
+				http.Error(w, "Unknown session", http.StatusNotFound)
+				return
+			}
+			if s.admitSession(w, r, session) {
+				next(w, r)
+			}
+			return
+		}
+
+		if !s.admitTest(w, r) {
+			return
+		}
+		defer s.releaseTest()
+		next(w, r)
+	}
+}
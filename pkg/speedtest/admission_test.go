@@ -0,0 +1,118 @@
+package speedtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newAdmissionServer returns a server admitting max tests at once and
+// perHour tests per client IP and hour
+func newAdmissionServer(max, perHour int) *Server {
+	s := &Server{slots: newConcurrencyLimiter(max), limiter: newIPRateLimiter(perHour)}
+	s.cfg.RateLimit.TestsPerHour = perHour
+	s.sessions = newSessionRegistry(s.slots, time.Minute)
+	return s
+}
+
+// serveLimited runs a GET of target through limitTests from ip, reporting
+// the response status and whether the handler ran
+func serveLimited(s *Server, target, ip string) (int, bool) {
+	ran := false
+	r := httptest.NewRequest("GET", target, nil)
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	s.limitTests(func(w http.ResponseWriter, r *http.Request) {
+		ran = true
+	})(w, r)
+	return w.Code, ran
+}
+
+func TestLimitTestsUnknownSession(t *testing.T) {
+	s := newAdmissionServer(1, 1)
+	session, err := s.sessions.create(1, "192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		ip     string
+	}{
+		{"unknown session", "/testfile?session=0123", "192.0.2.1"},
+		{"someone else's session", "/testfile?session=" + session.id, "192.0.2.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, ran := serveLimited(s, tt.target, tt.ip)
+			if code != http.StatusNotFound || ran {
+				t.Errorf("limitTests() = %d, ran %v, want %d, not run", code, ran, http.StatusNotFound)
+			}
+		})
+	}
+
+	// Neither took the slot or a test from the rate limit
+	if active, _ := s.slots.usage(); active != 0 {
+		t.Errorf("%d slots in use, want 0", active)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if ok, _ := s.limiter.allow(ip); !ok {
+			t.Errorf("rate limit of %s was charged", ip)
+		}
+	}
+}
+
+func TestLimitTestsSession(t *testing.T) {
+	s := newAdmissionServer(1, 10)
+	if ok, _ := s.slots.acquire("192.0.2.1"); !ok {
+		t.Fatal("no slot for the session")
+	}
+	session, err := s.sessions.create(4, "192.0.2.1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/testfile?session=" + session.id
+
+	if code, ran := serveLimited(s, target, "192.0.2.1"); !ran {
+		t.Fatalf("session stream refused with %d", code)
+	}
+
+	// Having given up its slot after idling, the session takes it back
+	s.sessions.releaseSlot(session)
+	if code, ran := serveLimited(s, target, "192.0.2.1"); !ran || !session.hasSlot() {
+		t.Fatalf("idle session re-admitted = %d, holds slot %v, want run and holding", code, session.hasSlot())
+	}
+
+	// Others have to wait for the slot, and get it before the session
+	// when it idles again
+	if code, _ := serveLimited(s, "/testfile", "192.0.2.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("standalone test while the session runs = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	s.sessions.releaseSlot(session)
+	if code, ran := serveLimited(s, "/testfile", "192.0.2.2"); !ran {
+		t.Fatalf("queued standalone test refused with %d", code)
+	}
+	s.slots.acquire("192.0.2.2")
+	if code, ran := serveLimited(s, target, "192.0.2.1"); code != http.StatusTooManyRequests || ran {
+		t.Errorf("idle session on a busy server = %d, ran %v, want %d", code, ran, http.StatusTooManyRequests)
+	}
+}
+
+func TestRefuseStream(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errStreamsRunning, http.StatusTooManyRequests},
+		{errSessionUsedUp, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		refuseStream(w, &testSession{streams: 4}, tt.err)
+		if w.Code != tt.want {
+			t.Errorf("refuseStream(%v) = %d, want %d", tt.err, w.Code, tt.want)
+		}
+	}
+}
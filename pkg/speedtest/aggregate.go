@@ -0,0 +1,258 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/netip"
+	"sort"
+)
+
+const (
+	maxStatsGroups  = 100 // Subnets and networks listed by /api/stats, busiest first
+	statsIPv4Prefix = 24  // Subnet size results from IPv4 clients are grouped by
+	statsIPv6Prefix = 48  // Subnet size results from IPv6 clients are grouped by
+)
+
+// metricStats summarizes one measurement over a set of results
+type metricStats struct {
+	Mean   float64 `json:"mean"`
+	Min    float64 `json:"min"`
+	P10    float64 `json:"p10"`
+	P25    float64 `json:"p25"`
+	Median float64 `json:"median"`
+	P75    float64 `json:"p75"`
+	P90    float64 `json:"p90"`
+	Max    float64 `json:"max"`
+}
+
+// groupStats are the medians of the results of one day, subnet or network
+type groupStats struct {
+	Count    int     `json:"count"`
+	Download float64 `json:"download"` // Median Mbps
+	Upload   float64 `json:"upload"`   // Median Mbps
+	Latency  float64 `json:"latency"`  // Median milliseconds
+}
+
+// dayStats summarizes the results of one day
+type dayStats struct {
+	Date string `json:"date"` // UTC, as YYYY-MM-DD
+	groupStats
+}
+
+// subnetStats summarizes the results of one client subnet
+type subnetStats struct {
+	Subnet string `json:"subnet"`
+	groupStats
+}
+
+// segmentStats summarizes the results of one named segment
+type segmentStats struct {
+	Name string `json:"name"`
+	groupStats
+}
+
+// agentStats summarizes the results reported by one agent
+type agentStats struct {
+	Agent string `json:"agent"`
+	groupStats
+}
+
+// networkStats summarizes the results of one autonomous system
+type networkStats struct {
+	ASN  uint   `json:"asn"`
+	Name string `json:"name,omitempty"`
+	groupStats
+}
+
+// aggregateStats is the body of /api/stats
+type aggregateStats struct {
+	Count    int            `json:"count"`
+	Download metricStats    `json:"download"` // Mbps
+	Upload   metricStats    `json:"upload"`   // Mbps
+	Latency  metricStats    `json:"latency"`  // Milliseconds
+	Jitter   metricStats    `json:"jitter"`   // Milliseconds
+	Days     []dayStats     `json:"days"`
+	Subnets  []subnetStats  `json:"subnets"`
+	Segments []segmentStats `json:"segments"` // Only results from a named segment
+	Agents   []agentStats   `json:"agents"`   // Only results reported by agents
+	Networks []networkStats `json:"networks"` // Only results with a known ASN
+}
+
+// handleAggregateStats summarizes the stored results matching the from, to
+// and ip filters for capacity planning: percentiles of each measurement plus
+// counts and medians per day, client subnet, named segment, agent and network
+func (s *Server) handleAggregateStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := parseResultFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Limit, f.Offset, f.Ascending = 0, 0, true
+
+	results, _, err := s.results.query(f)
+	if err != nil {
+		s.log("results").Error("Reading results failed", "err", err)
+		http.Error(w, "Could not read results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(aggregateResults(results))
+}
+
+// aggregateResults computes the statistics of results, which are ordered
+// oldest first
+func aggregateResults(results []testResult) aggregateStats {
+	stats := aggregateStats{
+		Count:    len(results),
+		Download: summarize(results, func(res testResult) float64 { return res.Download }),
+		Upload:   summarize(results, func(res testResult) float64 { return res.Upload }),
+		Latency:  summarize(results, func(res testResult) float64 { return res.Latency }),
+		Jitter:   summarize(results, func(res testResult) float64 { return res.Jitter }),
+		Days:     []dayStats{},
+		Subnets:  []subnetStats{},
+		Segments: []segmentStats{},
+		Agents:   []agentStats{},
+		Networks: []networkStats{},
+	}
+
+	var days []string
+	byDay := map[string][]testResult{}
+	bySubnet := map[string][]testResult{}
+	bySegment := map[string][]testResult{}
+	byAgent := map[string][]testResult{}
+	byASN := map[uint][]testResult{}
+	names := map[uint]string{}
+	for _, res := range results {
+		day := res.Timestamp.UTC().Format("2006-01-02")
+		if _, ok := byDay[day]; !ok {
+			days = append(days, day)
+		}
+		byDay[day] = append(byDay[day], res)
+
+		if subnet := clientSubnet(res.ClientIP); subnet != "" {
+			bySubnet[subnet] = append(bySubnet[subnet], res)
+		}
+		if res.Segment != "" {
+			bySegment[res.Segment] = append(bySegment[res.Segment], res)
+		}
+		if res.Agent != "" {
+			byAgent[res.Agent] = append(byAgent[res.Agent], res)
+		}
+		if res.ISP != nil && res.ISP.ASN != 0 {
+			byASN[res.ISP.ASN] = append(byASN[res.ISP.ASN], res)
+			names[res.ISP.ASN] = res.ISP.Name
+		}
+	}
+
+	// Results are ordered, so the days are too
+	for _, day := range days {
+		stats.Days = append(stats.Days, dayStats{Date: day, groupStats: summarizeGroup(byDay[day])})
+	}
+	for subnet, group := range bySubnet {
+		stats.Subnets = append(stats.Subnets, subnetStats{Subnet: subnet, groupStats: summarizeGroup(group)})
+	}
+	sort.Slice(stats.Subnets, func(i, j int) bool {
+		a, b := stats.Subnets[i], stats.Subnets[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Subnet < b.Subnet)
+	})
+	if len(stats.Subnets) > maxStatsGroups {
+		stats.Subnets = stats.Subnets[:maxStatsGroups]
+	}
+	for name, group := range bySegment {
+		stats.Segments = append(stats.Segments, segmentStats{Name: name, groupStats: summarizeGroup(group)})
+	}
+	sort.Slice(stats.Segments, func(i, j int) bool {
+		a, b := stats.Segments[i], stats.Segments[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Name < b.Name)
+	})
+	for agent, group := range byAgent {
+		stats.Agents = append(stats.Agents, agentStats{Agent: agent, groupStats: summarizeGroup(group)})
+	}
+	sort.Slice(stats.Agents, func(i, j int) bool { return stats.Agents[i].Agent < stats.Agents[j].Agent })
+	for asn, group := range byASN {
+		stats.Networks = append(stats.Networks, networkStats{ASN: asn, Name: names[asn], groupStats: summarizeGroup(group)})
+	}
+	sort.Slice(stats.Networks, func(i, j int) bool {
+		a, b := stats.Networks[i], stats.Networks[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.ASN < b.ASN)
+	})
+	if len(stats.Networks) > maxStatsGroups {
+		stats.Networks = stats.Networks[:maxStatsGroups]
+	}
+	return stats
+}
+
+// clientSubnet returns the /24 (IPv4) or /48 (IPv6) subnet of a client IP,
+// or "" when it cannot be parsed
+func clientSubnet(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := statsIPv6Prefix
+	if addr.Is4() {
+		bits = statsIPv4Prefix
+	}
+	prefix, err := addr.WithZone("").Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+// summarize computes the statistics of one measurement
+func summarize(results []testResult, value func(testResult) float64) metricStats {
+	if len(results) == 0 {
+		return metricStats{}
+	}
+	values := make([]float64, len(results))
+	sum := 0.0
+	for i, res := range results {
+		values[i] = value(res)
+		sum += values[i]
+	}
+	sort.Float64s(values)
+	return metricStats{
+		Mean:   sum / float64(len(values)),
+		Min:    values[0],
+		P10:    percentile(values, 10),
+		P25:    percentile(values, 25),
+		Median: percentile(values, 50),
+		P75:    percentile(values, 75),
+		P90:    percentile(values, 90),
+		Max:    values[len(values)-1],
+	}
+}
+
+// summarizeGroup computes the count and medians of a group of results
+func summarizeGroup(results []testResult) groupStats {
+	download := make([]float64, len(results))
+	upload := make([]float64, len(results))
+	latency := make([]float64, len(results))
+	for i, res := range results {
+		download[i], upload[i], latency[i] = res.Download, res.Upload, res.Latency
+	}
+	return groupStats{
+		Count:    len(results),
+		Download: median(download),
+		Upload:   median(upload),
+		Latency:  median(latency),
+	}
+}
+
+// percentile returns the p-th percentile of sorted values, interpolating
+// linearly between the closest ranks
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
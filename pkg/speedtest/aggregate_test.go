@@ -0,0 +1,56 @@
+package speedtest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{[]float64{7}, 50, 7},
+		{[]float64{7}, 90, 7},
+		{[]float64{1, 2, 3, 4}, 0, 1},
+		{[]float64{1, 2, 3, 4}, 50, 2.5},
+		{[]float64{1, 2, 3, 4}, 100, 4},
+		{[]float64{10, 20, 30, 40, 50}, 25, 20},
+		{[]float64{10, 20, 30, 40, 50}, 90, 46},
+		{[]float64{10, 20, 30, 40, 50}, 10, 14},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("percentile(%v, %v) = %v, want %v", tt.sorted, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	download := func(res testResult) float64 { return res.Download }
+	tests := []struct {
+		name      string
+		downloads []float64
+		want      metricStats
+	}{
+		{"no results", nil, metricStats{}},
+		{"one result", []float64{42}, metricStats{
+			Mean: 42, Min: 42, P10: 42, P25: 42, Median: 42, P75: 42, P90: 42, Max: 42,
+		}},
+		{"unsorted", []float64{50, 10, 40, 20, 30}, metricStats{
+			Mean: 30, Min: 10, P10: 14, P25: 20, Median: 30, P75: 40, P90: 46, Max: 50,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := make([]testResult, len(tt.downloads))
+			for i, d := range tt.downloads {
+				results[i].Download = d
+			}
+			if got := summarize(results, download); got != tt.want {
+				t.Errorf("summarize() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
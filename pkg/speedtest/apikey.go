@@ -0,0 +1,61 @@
+package speedtest
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// validAPIKey reports whether the request carries one of the configured API
+// keys, either in the X-API-Key header or as the password of HTTP Basic auth
+// (so browsers can log in to protected pages). Always false without keys.
+func (s *Server) validAPIKey(r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		_, key, _ = r.BasicAuth()
+	}
+	return s.validKey(key)
+}
+
+// validKey reports whether key is one of the configured API keys. Always
+// false for an empty key or without keys.
+func (s *Server) validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	valid := false
+	for _, k := range s.cfg.APIKeys {
+		// Compare against every key so timing doesn't reveal which one matched
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// checkAPIKey writes a 401 response unless the request carries a valid API
+// key. Protected endpoints expose stored client IPs and user agents, so
+// without any configured keys they are closed with a 403, like the admin
+// endpoints, which are not served at all then.
+func (s *Server) checkAPIKey(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.cfg.APIKeys) == 0 {
+		http.Error(w, "API keys are not configured", http.StatusForbidden)
+		return false
+	}
+	if s.validAPIKey(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="speedtest"`)
+	http.Error(w, "Valid API key required", http.StatusUnauthorized)
+	return false
+}
+
+// requireAPIKey protects programmatic and admin endpoints
+func (s *Server) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkAPIKey(w, r) {
+			return
+		}
+		next(w, r)
+	}
+}
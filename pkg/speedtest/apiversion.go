@@ -0,0 +1,32 @@
+package speedtest
+
+import (
+	"net/http"
+	"strings"
+)
+
+// APIPrefix is where the versioned HTTP API is served. A later version that
+// changes the protocol gets a prefix of its own, so clients written for this
+// one keep working.
+const APIPrefix = "/api/v1"
+
+// versionedPath maps an endpoint's unversioned path, as served before the API
+// was versioned, to its path under APIPrefix: /api/session to
+// /api/v1/session and /testfile to /api/v1/testfile
+func versionedPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/api/"); ok {
+		return APIPrefix + "/" + rest
+	}
+	return APIPrefix + path
+}
+
+// legacyAPI serves requests to unversioned paths from the versioned
+// endpoints, so frontends and clients deployed before versioning keep working
+func legacyAPI(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = versionedPath(r.URL.Path)
+		r2.URL.RawPath = ""
+		mux.ServeHTTP(w, r2)
+	})
+}
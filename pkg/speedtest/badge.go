@@ -0,0 +1,187 @@
+package speedtest
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strings"
+)
+
+const (
+	badgeWidth        = 540
+	badgeHeight       = 120
+	badgeHeaderHeight = 32
+)
+
+var (
+	badgeBackground = color.RGBA{0xf9, 0xfa, 0xfb, 0xff}
+	badgeHeader     = color.RGBA{0x25, 0x63, 0xeb, 0xff}
+	badgeLabel      = color.RGBA{0x4b, 0x55, 0x63, 0xff}
+	badgeValue      = color.RGBA{0x11, 0x18, 0x27, 0xff}
+	badgeTitle      = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// badgeStat is one column of a result badge
+type badgeStat struct {
+	label string
+	value string
+	unit  string
+}
+
+// badgeStats returns the download, upload and ping columns for a result
+func badgeStats(res testResult) []badgeStat {
+	rate := func(label string, mbps float64) badgeStat {
+		if mbps >= 1000 {
+			return badgeStat{label, fmt.Sprintf("%.2f", mbps/1000), "Gbps"}
+		}
+		return badgeStat{label, fmt.Sprintf("%.2f", mbps), "Mbps"}
+	}
+	return []badgeStat{
+		rate("Download", res.Download),
+		rate("Upload", res.Upload),
+		{"Ping", fmt.Sprintf("%.1f", res.Latency), "ms"},
+	}
+}
+
+// handleResultBadge serves a stored result as an SVG or PNG image that can be
+// embedded in forums and support tickets
+func (s *Server) handleResultBadge(w http.ResponseWriter, r *http.Request, id, format string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res, ok, err := s.results.get(id)
+	if err != nil {
+		s.log("results").Error("Reading results failed", "err", err)
+		http.Error(w, "Could not read results", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Result not found", http.StatusNotFound)
+		return
+	}
+
+	var body []byte
+	switch format {
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		body = renderBadgeSVG(badgeStats(res))
+	case "png":
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, renderBadgePNG(badgeStats(res))); err != nil {
+			s.log("results").Error("Rendering result badge failed", "id", id, "err", err)
+			http.Error(w, "Could not render badge", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		body = buf.Bytes()
+	}
+
+	// Stored results never change
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(body)
+}
+
+// renderBadgeSVG draws the badge as SVG text
+func renderBadgeSVG(stats []badgeStat) []byte {
+	hex := func(c color.RGBA) string {
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %[1]d %[2]d" font-family="-apple-system, Segoe UI, Helvetica, Arial, sans-serif">`+"\n",
+		badgeWidth, badgeHeight)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" rx="8" fill="%s"/>`+"\n", badgeWidth, badgeHeight, hex(badgeBackground))
+	fmt.Fprintf(&b, `<path d="M0 8a8 8 0 0 1 8-8h%d a8 8 0 0 1 8 8v%d H0z" fill="%s"/>`+"\n",
+		badgeWidth-16, badgeHeaderHeight-8, hex(badgeHeader))
+	fmt.Fprintf(&b, `<text x="16" y="22" font-size="15" font-weight="600" fill="%s">Speed Test</text>`+"\n", hex(badgeTitle))
+
+	column := badgeWidth / len(stats)
+	for i, stat := range stats {
+		x := i*column + 16
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="13" fill="%s">%s</text>`+"\n",
+			x, badgeHeaderHeight+24, hex(badgeLabel), stat.label)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" fill="%s"><tspan font-size="26" font-weight="700">%s</tspan><tspan font-size="13" dx="4">%s</tspan></text>`+"\n",
+			x, badgeHeaderHeight+62, hex(badgeValue), stat.value, stat.unit)
+	}
+	b.WriteString("</svg>\n")
+	return []byte(b.String())
+}
+
+// renderBadgePNG draws the badge as an image, using a built-in bitmap font
+// so no font files are needed
+func renderBadgePNG(stats []badgeStat) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, badgeWidth, badgeHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(badgeBackground), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, badgeWidth, badgeHeaderHeight), image.NewUniform(badgeHeader), image.Point{}, draw.Src)
+	drawBitmapText(img, 16, 9, 2, "Speed Test", badgeTitle)
+
+	column := badgeWidth / len(stats)
+	for i, stat := range stats {
+		x := i*column + 16
+		drawBitmapText(img, x, badgeHeaderHeight+14, 2, stat.label, badgeLabel)
+		end := drawBitmapText(img, x, badgeHeaderHeight+44, 3, stat.value, badgeValue)
+		drawBitmapText(img, end+6, badgeHeaderHeight+51, 2, stat.unit, badgeLabel)
+	}
+	return img
+}
+
+// drawBitmapText draws text in upper case with bitmapFont, scaled up by
+// scale, and returns the x coordinate after the last character
+func drawBitmapText(img *image.RGBA, x, y, scale int, text string, c color.RGBA) int {
+	for _, r := range strings.ToUpper(text) {
+		glyph, ok := bitmapFont[r]
+		if !ok {
+			glyph = bitmapFont[' ']
+		}
+		for row, line := range glyph {
+			for col, px := range line {
+				if px != '#' {
+					continue
+				}
+				rect := image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale)
+				draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+			}
+		}
+		x += (bitmapGlyphWidth + 1) * scale
+	}
+	return x
+}
+
+const bitmapGlyphWidth = 5
+
+// bitmapFont is a 5x7 pixel font covering the characters badges use
+var bitmapFont = map[rune][7]string{
+	' ': {".....", ".....", ".....", ".....", ".....", ".....", "....."},
+	'.': {".....", ".....", ".....", ".....", ".....", ".##..", ".##.."},
+	'-': {".....", ".....", ".....", "#####", ".....", ".....", "....."},
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"#####", "...#.", "..#..", "...#.", "....#", "#...#", ".###."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {"..##.", ".#...", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "...#.", ".##.."},
+	'A': {".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'B': {"####.", "#...#", "#...#", "####.", "#...#", "#...#", "####."},
+	'D': {"###..", "#..#.", "#...#", "#...#", "#...#", "#..#.", "###.."},
+	'E': {"#####", "#....", "#....", "####.", "#....", "#....", "#####"},
+	'G': {".###.", "#...#", "#....", "#.###", "#...#", "#...#", ".####"},
+	'I': {".###.", "..#..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'L': {"#....", "#....", "#....", "#....", "#....", "#....", "#####"},
+	'M': {"#...#", "##.##", "#.#.#", "#.#.#", "#...#", "#...#", "#...#"},
+	'N': {"#...#", "#...#", "##..#", "#.#.#", "#..##", "#...#", "#...#"},
+	'O': {".###.", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'P': {"####.", "#...#", "#...#", "####.", "#....", "#....", "#...."},
+	'S': {".####", "#....", "#....", ".###.", "....#", "....#", "####."},
+	'T': {"#####", "..#..", "..#..", "..#..", "..#..", "..#..", "..#.."},
+	'U': {"#...#", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'W': {"#...#", "#...#", "#...#", "#.#.#", "#.#.#", "#.#.#", ".#.#."},
+}
@@ -0,0 +1,59 @@
+package speedtest
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// bandwidthCap is a server-wide budget for test traffic, shared by every
+// transfer so that tests cannot starve other services on the same host
+type bandwidthCap struct {
+	egress  *rate.Limiter // Downloads; nil leaves them uncapped
+	ingress *rate.Limiter // Uploads; nil leaves them uncapped
+}
+
+// newBandwidthCap caps test traffic to cfg, or returns nil when neither
+// direction is capped. burst is the largest write or read transfers make.
+func newBandwidthCap(cfg BandwidthConfig, burst int) *bandwidthCap {
+	if cfg.EgressMbps <= 0 && cfg.IngressMbps <= 0 {
+		return nil
+	}
+	b := &bandwidthCap{}
+	if cfg.EgressMbps > 0 {
+		b.egress = rate.NewLimiter(rate.Limit(cfg.EgressMbps*1e6/8), burst)
+	}
+	if cfg.IngressMbps > 0 {
+		b.ingress = rate.NewLimiter(rate.Limit(cfg.IngressMbps*1e6/8), burst)
+	}
+	return b
+}
+
+// waitBandwidth blocks until n bytes moved in direction fit in the server's
+// bandwidth cap. Downloads wait before writing; uploads wait after reading,
+// which holds back the next read and so slows the sender down.
+func (s *Server) waitBandwidth(ctx context.Context, direction string, n int) error {
+	if s.bandwidth == nil {
+		return nil
+	}
+	limiter := s.bandwidth.ingress
+	if direction == directionDownload {
+		limiter = s.bandwidth.egress
+	}
+	if limiter == nil {
+		return nil
+	}
+
+	// Transfers may move more than the burst at once, e.g. iperf3 blocks
+	for n > 0 {
+		part := min(n, limiter.Burst())
+		start := time.Now()
+		if err := limiter.WaitN(ctx, part); err != nil {
+			return err
+		}
+		s.traceWait(ctx, "bandwidth cap wait", start, part)
+		n -= part
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package speedtest
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// hexColor matches the #rgb and #rrggbb colors accepted as accent color
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// validate checks the logo URL and accent color
+func (b BrandingConfig) validate() error {
+	if b.AccentColor != "" && !hexColor.MatchString(b.AccentColor) {
+		return fmt.Errorf("invalid branding accent_color %q, expected a hex color such as #e4002b", b.AccentColor)
+	}
+	if b.LogoURL != "" && !strings.HasPrefix(b.LogoURL, "/") {
+		if parsed, err := url.Parse(b.LogoURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid branding logo_url %q, expected an http(s) URL or a path", b.LogoURL)
+		}
+	}
+	return nil
+}
+
+// logoOrigin returns the origin the logo is loaded from, or "" when it is
+// served by this server
+func (b BrandingConfig) logoOrigin() string {
+	parsed, err := url.Parse(b.LogoURL)
+	if err != nil || parsed.Host == "" {
+		return ""
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+// brandedPage is what the web UI's page templates are rendered with
+type brandedPage struct {
+	Title       string
+	LogoURL     string
+	FooterText  string
+	AccentColor template.CSS // Checked by validate, so safe to put in a style element
+	AccentHover template.CSS
+}
+
+// serveBranded renders one of the web UI's pages as a template, filling in
+// the branding config. Pages are parsed on each request so edits under
+// -static-dir show up at once.
+func (s *Server) serveBranded(w http.ResponseWriter, r *http.Request, name string) {
+	s.serveBrandedFramed(w, r, name, s.cfg.Headers.AllowEmbed)
+}
+
+// serveBrandedFramed serves a branded page the origins in ancestors may show
+// in a frame
+func (s *Server) serveBrandedFramed(w http.ResponseWriter, r *http.Request, name string, ancestors []string) {
+	tmpl, err := template.ParseFS(s.webFS, name)
+	if err != nil {
+		s.log("http").Error("Parsing page template failed", "page", name, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	b := s.cfg.Branding
+	page := brandedPage{Title: b.Title, LogoURL: b.LogoURL, FooterText: b.FooterText}
+	if b.AccentColor != "" {
+		page.AccentColor = template.CSS(b.AccentColor)
+		page.AccentHover = template.CSS("color-mix(in srgb, " + b.AccentColor + " 85%, black)")
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		s.log("http").Error("Rendering page failed", "page", name, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.setFramedHeaders(w, r, ancestors)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
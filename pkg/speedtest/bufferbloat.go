@@ -0,0 +1,131 @@
+package speedtest
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	loadedPingInterval = 200 * time.Millisecond // How often the server pings a session's WebSocket
+	maxLatencySamples  = 1000                   // Samples kept per test phase
+)
+
+// latencySamples are round trips measured by the server on a session's
+// WebSocket ping channel, sorted by what the session was doing at the time
+type latencySamples struct {
+	idle     []float64 // Milliseconds, no transfer running
+	download []float64 // Milliseconds, download streams running
+	upload   []float64 // Milliseconds, upload streams running
+}
+
+// bufferbloatResult compares latency on an idle and a loaded link. Queues
+// that fill up under load (bufferbloat) show as a large increase.
+type bufferbloatResult struct {
+	Idle          float64 `json:"idle_ms"`
+	Download      float64 `json:"download_ms,omitempty"` // Median latency while downloading
+	Upload        float64 `json:"upload_ms,omitempty"`   // Median latency while uploading
+	DownloadDelta float64 `json:"download_delta_ms,omitempty"`
+	UploadDelta   float64 `json:"upload_delta_ms,omitempty"`
+	Grade         string  `json:"grade"` // A+ to F, from the larger of the two increases
+}
+
+// addLatency records a round trip under the phase the session is in
+func (s *testSession) addLatency(rtt float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	samples := &s.latency.idle
+	switch {
+	case s.download.active > 0:
+		samples = &s.latency.download
+	case s.upload.active > 0:
+		samples = &s.latency.upload
+	}
+	if len(*samples) < maxLatencySamples {
+		*samples = append(*samples, rtt)
+	}
+}
+
+// bufferbloat summarizes the session's latency samples, or returns nil
+// until both idle and loaded latency were measured. Must be called with the
+// session lock held.
+func (l *latencySamples) bufferbloat() *bufferbloatResult {
+	if len(l.idle) == 0 || (len(l.download) == 0 && len(l.upload) == 0) {
+		return nil
+	}
+
+	res := &bufferbloatResult{Idle: median(l.idle)}
+	worst := 0.0
+	if len(l.download) > 0 {
+		res.Download = median(l.download)
+		res.DownloadDelta = max(res.Download-res.Idle, 0)
+		worst = res.DownloadDelta
+	}
+	if len(l.upload) > 0 {
+		res.Upload = median(l.upload)
+		res.UploadDelta = max(res.Upload-res.Idle, 0)
+		worst = max(worst, res.UploadDelta)
+	}
+	res.Grade = bufferbloatGrade(worst)
+	return res
+}
+
+// bufferbloatGrade grades an increase in latency under load, on the scale
+// commonly used by bufferbloat tests
+func bufferbloatGrade(deltaMs float64) string {
+	switch {
+	case deltaMs < 5:
+		return "A+"
+	case deltaMs < 30:
+		return "A"
+	case deltaMs < 60:
+		return "B"
+	case deltaMs < 200:
+		return "C"
+	case deltaMs < 400:
+		return "D"
+	default:
+		return "F"
+	}
+}
+
+// median returns the median of values without reordering them
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	return percentile(sorted, 50)
+}
+
+// pingSession measures latency on a session's WebSocket ping channel until
+// stop is closed. Browsers answer WebSocket pings by themselves, so the
+// server sees latency while the client's transfers load the link. Pongs are
+// handled by the connection's reader, which must keep reading.
+func (s *Server) pingSession(conn *websocket.Conn, session *testSession, stop <-chan struct{}) {
+	conn.SetPongHandler(func(data string) error {
+		if len(data) == 8 {
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(data))))
+			session.addLatency(float64(time.Since(sent).Microseconds()) / 1000)
+		}
+		return conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+	})
+
+	go func() {
+		ticker := time.NewTicker(loadedPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			payload := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+			if err := conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(wsIdleTimeout)); err != nil {
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,31 @@
+package speedtest
+
+import "sync"
+
+// bufferPools recycles the buffers test transfers read through, so hundreds
+// of concurrent tests don't allocate a fresh buffer per request. Pools hold
+// *[]byte so putting a buffer back doesn't allocate either. Downloads need no
+// pool, since they stream straight from the shared random block.
+type bufferPools struct {
+	upload sync.Pool // Scratch space for reading request bodies
+}
+
+// newBufferPools creates pools of uploadSize byte buffers
+func newBufferPools(uploadSize int) *bufferPools {
+	return &bufferPools{
+		upload: sync.Pool{New: func() interface{} {
+			b := make([]byte, uploadSize)
+			return &b
+		}},
+	}
+}
+
+// getUpload returns a buffer to read upload data into
+func (p *bufferPools) getUpload() *[]byte {
+	return p.upload.Get().(*[]byte)
+}
+
+// putUpload returns a buffer obtained from getUpload
+func (p *bufferPools) putUpload(b *[]byte) {
+	p.upload.Put(b)
+}
@@ -0,0 +1,585 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	clientPings        = 25 // Latency samples, like the web UI
+	clientPingDelay    = 50 * time.Millisecond
+	clientChunkSize    = 8 * 1024 * 1024  // Bytes per /testfile or /upload request
+	clientWarmup       = 2 * time.Second  // Leading part of each transfer phase left out of the result
+	clientMaxQueueWait = 10 * time.Minute // Give up waiting for a busy server after this long
+)
+
+// errCachedResponse means something between client and server answered a
+// test request from a cache, which would make the results meaningless
+var errCachedResponse = errors.New("test response was served by a cache, not the server")
+
+// Client runs speed tests against a remote speedtest server. A Client runs
+// one test at a time. It uses the unversioned endpoint paths, which every
+// server version answers, so it can test servers older than APIPrefix.
+type Client struct {
+	Submit bool   // Store results on the server via /api/results
+	APIKey string // Sent when submitting results, if set
+
+	base     string // Server URL without trailing slash
+	http     *http.Client
+	streams  int
+	duration time.Duration // Length of the download and upload phases
+
+	sessionID string
+	nonce     string // Issued with the session for submitting its result
+}
+
+// ClientResult is the outcome of one test run by a Client
+type ClientResult struct {
+	Server         string    `json:"server"`
+	Timestamp      time.Time `json:"timestamp"`
+	Download       float64   `json:"download"`      // Mbps
+	Upload         float64   `json:"upload"`        // Mbps
+	Latency        float64   `json:"latency"`       // Milliseconds
+	Jitter         float64   `json:"jitter"`        // Milliseconds
+	RPM            float64   `json:"rpm,omitempty"` // HTTP round trips per minute while downloading
+	ServerDownload float64   `json:"server_download,omitempty"`
+	ServerUpload   float64   `json:"server_upload,omitempty"`
+	ICMPLatency    float64   `json:"icmp_latency,omitempty"` // Milliseconds; 0 without ICMP privileges
+	ICMPJitter     float64   `json:"icmp_jitter,omitempty"`
+	// Latency measured by the server while downloading and uploading, and the
+	// resulting bufferbloat grade; empty when the WebSocket channel is blocked
+	DownloadLatency  float64 `json:"download_latency,omitempty"` // Milliseconds
+	UploadLatency    float64 `json:"upload_latency,omitempty"`   // Milliseconds
+	BufferbloatGrade string  `json:"bufferbloat_grade,omitempty"`
+}
+
+// NewClient creates a client for the server at rawURL, using streams
+// parallel transfers for download and upload phases of the given duration
+func NewClient(rawURL string, streams int, duration time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q", rawURL)
+	}
+	if streams <= 0 || streams > maxStreamsPerSession {
+		return nil, fmt.Errorf("streams must be between 1 and %d", maxStreamsPerSession)
+	}
+	if duration <= clientWarmup {
+		return nil, fmt.Errorf("duration must be longer than the %s warm-up", clientWarmup)
+	}
+
+	return &Client{
+		base:     strings.TrimSuffix(u.String(), "/"),
+		http:     &http.Client{},
+		streams:  streams,
+		duration: duration,
+	}, nil
+}
+
+// Run performs a full test: latency, download and upload. Progress messages
+// go to progress unless it is nil.
+func (c *Client) Run(ctx context.Context, progress io.Writer) (ClientResult, error) {
+	logf := func(format string, args ...interface{}) {
+		if progress != nil {
+			fmt.Fprintf(progress, format+"\n", args...)
+		}
+	}
+
+	res := ClientResult{Server: c.base, Timestamp: time.Now().UTC()}
+
+	if err := c.startSession(ctx, logf); err != nil {
+		return res, err
+	}
+	defer c.endSession()
+
+	// Let the server measure latency for the whole test, to see how it grows under load
+	if stop, err := c.keepPingChannel(ctx); err == nil {
+		defer stop()
+	}
+
+	logf("Measuring latency...")
+	rtts, err := c.measureWebSocketPings(ctx)
+	if err != nil || len(rtts) < 5 {
+		rtts, err = c.measureHTTPPings(ctx)
+		if err != nil {
+			return res, fmt.Errorf("measuring latency: %w", err)
+		}
+	}
+	res.Latency, res.Jitter = summarizePings(rtts)
+
+	// HTTP and WebSocket pings include the TCP stack and server; ICMP shows the network alone
+	if rtts, err := c.measureICMPPings(ctx); err == nil {
+		res.ICMPLatency, res.ICMPJitter = summarizePings(rtts)
+	} else {
+		logf("Skipping ICMP ping: %v", err)
+	}
+
+	logf("Measuring download speed and responsiveness...")
+	probeCtx, stopProbes := context.WithCancel(ctx)
+	rpm := make(chan float64, 1)
+	go func() { rpm <- c.measureResponsiveness(probeCtx) }()
+	res.Download, err = c.measureTransfer(ctx, c.download)
+	stopProbes()
+	res.RPM = <-rpm
+	if err != nil {
+		return res, fmt.Errorf("measuring download: %w", err)
+	}
+
+	logf("Measuring upload speed...")
+	if res.Upload, err = c.measureTransfer(ctx, c.upload); err != nil {
+		return res, fmt.Errorf("measuring upload: %w", err)
+	}
+
+	if sum, err := c.sessionSummary(ctx); err == nil {
+		res.ServerDownload = sum.Download.Mbps
+		res.ServerUpload = sum.Upload.Mbps
+		if bb := sum.Bufferbloat; bb != nil {
+			res.DownloadLatency, res.UploadLatency, res.BufferbloatGrade = bb.Download, bb.Upload, bb.Grade
+		}
+	}
+
+	// Submit while the session still exists, so the server attaches its own measurements
+	if c.Submit {
+		if err := c.submitResult(ctx, res); err != nil {
+			return res, fmt.Errorf("submitting result: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// fetchToken gets a one-time test token, or "" when the server doesn't require them
+func (c *Client) fetchToken(ctx context.Context) (string, error) {
+	req, _ := http.NewRequestWithContext(ctx, "POST", c.base+"/api/token", nil)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.Token, nil
+}
+
+// startSession creates the server-side session tying the test's streams
+// together, waiting in line while the server is busy
+func (c *Client) startSession(ctx context.Context, logf func(string, ...interface{})) error {
+	deadline := time.Now().Add(clientMaxQueueWait)
+	for {
+		token, err := c.fetchToken(ctx)
+		if err != nil {
+			return err
+		}
+
+		u := fmt.Sprintf("%s/api/session?streams=%d", c.base, c.streams)
+		if token != "" {
+			u += "&token=" + url.QueryEscape(token)
+		}
+		req, _ := http.NewRequestWithContext(ctx, "POST", u, nil)
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusCreated:
+			var sum sessionSummary
+			err := json.NewDecoder(resp.Body).Decode(&sum)
+			resp.Body.Close()
+			c.sessionID, c.nonce = sum.ID, sum.ResultNonce
+			return err
+
+		case http.StatusTooManyRequests:
+			var refusal admissionError
+			json.NewDecoder(resp.Body).Decode(&refusal)
+			resp.Body.Close()
+			if refusal.QueuePosition == 0 {
+				return fmt.Errorf("server refused test: %s", refusal.Error)
+			}
+			if time.Now().After(deadline) {
+				return errors.New("server stayed busy for too long")
+			}
+			logf("Server busy, position %d in queue...", refusal.QueuePosition)
+			select {
+			case <-time.After(time.Duration(refusal.RetryAfter) * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+		default:
+			resp.Body.Close()
+			return fmt.Errorf("creating session: %s", resp.Status)
+		}
+	}
+}
+
+// endSession releases the session's slot on the server
+func (c *Client) endSession() {
+	req, _ := http.NewRequest("DELETE", c.base+"/api/session/"+c.sessionID, nil)
+	if resp, err := c.http.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// sessionSummary fetches the server's view of the session
+func (c *Client) sessionSummary(ctx context.Context) (sessionSummary, error) {
+	var sum sessionSummary
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.base+"/api/session/"+c.sessionID, nil)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return sum, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return sum, fmt.Errorf("fetching session: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sum)
+	return sum, err
+}
+
+// measureWebSocketPings measures round trips over the /ws/ping channel
+func (c *Client) measureWebSocketPings(ctx context.Context) ([]float64, error) {
+	wsURL := "ws" + strings.TrimPrefix(c.base, "http") + "/ws/ping"
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var rtts []float64
+	for i := 0; i < clientPings; i++ {
+		start := time.Now()
+		if err := conn.WriteJSON(pingFrame{Seq: int64(i)}); err != nil {
+			return rtts, err
+		}
+		var echo pingFrame
+		if err := conn.ReadJSON(&echo); err != nil {
+			return rtts, err
+		}
+		rtts = append(rtts, float64(time.Since(start).Microseconds())/1000)
+		time.Sleep(clientPingDelay)
+	}
+	return rtts, nil
+}
+
+// keepPingChannel opens the session's WebSocket ping channel, over which the
+// server pings the client throughout the test. The returned func closes it.
+func (c *Client) keepPingChannel(ctx context.Context) (func(), error) {
+	wsURL := "ws" + strings.TrimPrefix(c.base, "http") + "/ws/ping?session=" + c.sessionID
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading answers the server's pings
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	return func() { conn.Close() }, nil
+}
+
+// measureHTTPPings measures round trips of requests to /ping
+func (c *Client) measureHTTPPings(ctx context.Context) ([]float64, error) {
+	var rtts []float64
+	// The first request also pays for connection setup
+	for i := -1; i < clientPings; i++ {
+		buster := newCacheBuster()
+		req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/ping?t=%s", c.base, buster), nil)
+		start := time.Now()
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return rtts, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err := checkFresh(resp, buster); err != nil {
+				return rtts, err
+			}
+			if i >= 0 {
+				rtts = append(rtts, float64(time.Since(start).Microseconds())/1000)
+			}
+		}
+		time.Sleep(clientPingDelay)
+	}
+	return rtts, nil
+}
+
+// measureResponsiveness sends back-to-back requests to /ping until ctx is
+// done, and returns how many round trips per minute complete (RPM), the way
+// Apple's networkQuality reports responsiveness. It is meant to run while a
+// transfer saturates the connection; samples from its warm-up are left out.
+func (c *Client) measureResponsiveness(ctx context.Context) float64 {
+	select {
+	case <-ctx.Done():
+		return 0
+	case <-time.After(clientWarmup):
+	}
+
+	var rtts []float64
+	for ctx.Err() == nil {
+		buster := newCacheBuster()
+		req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/ping?t=%s", c.base, buster), nil)
+		start := time.Now()
+		resp, err := c.http.Do(req)
+		if err != nil {
+			time.Sleep(clientPingDelay)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && checkFresh(resp, buster) == nil {
+			rtts = append(rtts, float64(time.Since(start).Microseconds())/1000)
+		}
+	}
+	return responsivenessRPM(rtts)
+}
+
+// responsivenessRPM turns round-trip times in milliseconds into round trips
+// per minute, from the mean after trimming the slowest and fastest 5%
+func responsivenessRPM(rtts []float64) float64 {
+	if len(rtts) < 5 {
+		return 0
+	}
+	sorted := append([]float64{}, rtts...)
+	sort.Float64s(sorted)
+	cut := len(sorted) / 20
+	var sum float64
+	for _, rtt := range sorted[cut : len(sorted)-cut] {
+		sum += rtt
+	}
+	return 60000 / (sum / float64(len(sorted)-2*cut))
+}
+
+// summarizePings turns round-trip times into latency and jitter the same way
+// the web UI does: the median after trimming the top and bottom 10%, and the
+// trimmed mean difference between consecutive pings
+func summarizePings(rtts []float64) (latency, jitter float64) {
+	if len(rtts) == 0 {
+		return 0, 0
+	}
+
+	trimmed := func(values []float64) []float64 {
+		sorted := append([]float64{}, values...)
+		sort.Float64s(sorted)
+		cut := len(sorted) / 10
+		return sorted[cut : len(sorted)-cut]
+	}
+
+	pings := trimmed(rtts)
+	mid := len(pings) / 2
+	if len(pings)%2 == 0 {
+		latency = (pings[mid-1] + pings[mid]) / 2
+	} else {
+		latency = pings[mid]
+	}
+
+	var diffs []float64
+	for i := 1; i < len(rtts); i++ {
+		d := rtts[i] - rtts[i-1]
+		if d < 0 {
+			d = -d
+		}
+		diffs = append(diffs, d)
+	}
+	if len(diffs) > 0 {
+		diffs = trimmed(diffs)
+		for _, d := range diffs {
+			jitter += d
+		}
+		jitter /= float64(len(diffs))
+	}
+	return latency, jitter
+}
+
+// measureTransfer runs transfer on all streams for the configured duration
+// and returns the combined rate in Mbps, leaving out the warm-up period
+func (c *Client) measureTransfer(ctx context.Context, transfer func(context.Context, *atomic.Int64) error) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.duration)
+	defer cancel()
+
+	var counted atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, c.streams)
+	for i := 0; i < c.streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := transfer(ctx, &counted); err != nil && ctx.Err() == nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	// Measure from the end of the warm-up until the phase ends
+	var startBytes int64
+	select {
+	case <-time.After(clientWarmup):
+		startBytes = counted.Load()
+	case <-ctx.Done():
+	}
+	start := time.Now()
+	<-ctx.Done()
+	elapsed := time.Since(start)
+	total := counted.Load() - startBytes
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		if total == 0 {
+			return 0, err
+		}
+	default:
+	}
+	if elapsed <= 0 {
+		return 0, nil
+	}
+	return float64(total) * 8 / elapsed.Seconds() / 1e6, nil
+}
+
+// download fetches one chunk from /testfile, counting bytes as they arrive
+func (c *Client) download(ctx context.Context, counted *atomic.Int64) error {
+	buster := newCacheBuster()
+	u := fmt.Sprintf("%s/testfile?size=%d&session=%s&t=%s", c.base, clientChunkSize, c.sessionID, buster)
+	req, _ := http.NewRequestWithContext(ctx, "GET", u, nil)
+	// Asking for identity also stops the transport from transparently
+	// decompressing, which would count bytes that never crossed the network
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", resp.Status)
+	}
+	if err := checkFresh(resp, buster); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		counted.Add(int64(n))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// newCacheBuster returns a unique value for the t parameter of a test request
+func newCacheBuster() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(mathrand.Uint64(), 36)
+}
+
+// checkFresh verifies that the server itself answered a test request, by
+// checking that it echoed the request's cache buster
+func checkFresh(resp *http.Response, buster string) error {
+	if resp.Header.Get("X-Cache-Buster") != buster {
+		return errCachedResponse
+	}
+	return nil
+}
+
+// countingReader counts bytes as the HTTP client reads them
+type countingReader struct {
+	r       io.Reader
+	counted *atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.counted.Add(int64(n))
+	return n, err
+}
+
+// uploadPayload is random data sent by every upload request
+var uploadPayload = sync.OnceValue(func() []byte {
+	b := make([]byte, clientChunkSize)
+	rand.Read(b)
+	return b
+})
+
+// upload sends one chunk to /upload, counting bytes as they are sent
+func (c *Client) upload(ctx context.Context, counted *atomic.Int64) error {
+	payload := uploadPayload()
+	u := fmt.Sprintf("%s/upload?size=%d&session=%s", c.base, len(payload), c.sessionID)
+	body := &countingReader{r: bytes.NewReader(payload), counted: counted}
+	req, _ := http.NewRequestWithContext(ctx, "POST", u, body)
+	req.ContentLength = int64(len(payload))
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// submitResult stores the result on the tested server
+func (c *Client) submitResult(ctx context.Context, res ClientResult) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"download": res.Download,
+		"upload":   res.Upload,
+		"latency":  res.Latency,
+		"jitter":   res.Jitter,
+		"rpm":      res.RPM,
+		"session":  c.sessionID,
+		"nonce":    c.nonce,
+	})
+	req, _ := http.NewRequestWithContext(ctx, "POST", c.base+"/api/results", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// ipFamily reports whether ip is an IPv4 or IPv6 address. IPv4-mapped IPv6
+// addresses count as IPv4, since that is what the client actually used.
+func ipFamily(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if addr.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+// alternateFamily describes where the client can repeat the test over the
+// other address family
+type alternateFamily struct {
+	Family string `json:"family"`
+	URL    string `json:"url"`
+}
+
+// alternateFor returns the configured host for the family the client did not
+// use, or nil when there is none
+func (s *Server) alternateFor(family string) *alternateFamily {
+	switch family {
+	case familyIPv4:
+		if s.cfg.DualStack.IPv6URL != "" {
+			return &alternateFamily{Family: familyIPv6, URL: s.cfg.DualStack.IPv6URL}
+		}
+	case familyIPv6:
+		if s.cfg.DualStack.IPv4URL != "" {
+			return &alternateFamily{Family: familyIPv4, URL: s.cfg.DualStack.IPv4URL}
+		}
+	}
+	return nil
+}
+
+// clientInfo is what /api/clientinfo reports about the caller's connection
+type clientInfo struct {
+	IP        string           `json:"ip"`
+	Family    string           `json:"family"`
+	Location  *geoLocation     `json:"location,omitempty"`
+	ISP       *ispInfo         `json:"isp,omitempty"`
+	Alternate *alternateFamily `json:"alternate,omitempty"`
+	NAT       *natInfo         `json:"nat,omitempty"` // Only when the STUN responder runs
+}
+
+// handleClientInfo tells the browser what the server knows about its connection
+func (s *Server) handleClientInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := s.clientIP(r)
+	family := ipFamily(ip)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(clientInfo{
+		IP:        ip,
+		Family:    family,
+		Location:  s.geoIP.locate(ip),
+		ISP:       s.geoIP.isp(ip),
+		Alternate: s.alternateFor(family),
+		NAT:       s.stun.lookup(ip),
+	})
+}
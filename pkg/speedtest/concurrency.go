@@ -0,0 +1,90 @@
+package speedtest
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	busyRetryAfter = 5 * time.Second  // How soon a client refused for lack of slots should retry
+	queueTimeout   = 15 * time.Second // Queued clients that stop retrying lose their place
+)
+
+// queuedClient is a client waiting for a free test slot
+type queuedClient struct {
+	ip       string
+	lastSeen time.Time
+}
+
+// concurrencyLimiter caps how many tests transfer data at the same time. Clients
+// that are turned away join a queue and get free slots in the order they arrived,
+// as long as they keep retrying.
+type concurrencyLimiter struct {
+	mu     sync.Mutex
+	max    int
+	active int
+	queue  []queuedClient
+}
+
+// newConcurrencyLimiter allows max tests at the same time
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	return &concurrencyLimiter{max: max}
+}
+
+// acquire takes a slot for ip. When none is available, or clients queued
+// earlier are waiting for them, ip is queued and its 1-based position returned.
+func (l *concurrencyLimiter) acquire(ip string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget clients that gave up
+	now := time.Now()
+	kept := l.queue[:0]
+	for _, c := range l.queue {
+		if now.Sub(c.lastSeen) <= queueTimeout {
+			kept = append(kept, c)
+		}
+	}
+	l.queue = kept
+
+	pos := -1
+	for i, c := range l.queue {
+		if c.ip == ip {
+			pos = i
+			break
+		}
+	}
+
+	// Free slots go to the head of the queue first
+	free := l.max - l.active
+	if (pos >= 0 && pos < free) || (pos < 0 && len(l.queue) < free) {
+		if pos >= 0 {
+			l.queue = append(l.queue[:pos], l.queue[pos+1:]...)
+		}
+		l.active++
+		return true, 0
+	}
+
+	if pos < 0 {
+		l.queue = append(l.queue, queuedClient{ip: ip})
+		pos = len(l.queue) - 1
+	}
+	l.queue[pos].lastSeen = now
+	return false, pos + 1
+}
+
+// release returns a slot taken by acquire
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active > 0 {
+		l.active--
+	}
+}
+
+// usage reports the slots in use and the number of queued clients
+func (l *concurrencyLimiter) usage() (active, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active, len(l.queue)
+}
@@ -0,0 +1,82 @@
+package speedtest
+
+import "testing"
+
+func TestConcurrencyLimiter(t *testing.T) {
+	type step struct {
+		release bool   // Release a slot instead of acquiring one
+		ip      string // Client acquiring a slot
+		ok      bool
+		pos     int
+	}
+	tests := []struct {
+		name  string
+		max   int
+		steps []step
+	}{
+		{"under the limit", 2, []step{
+			{ip: "a", ok: true},
+			{ip: "b", ok: true},
+		}},
+		{"queue in arrival order", 1, []step{
+			{ip: "a", ok: true},
+			{ip: "b", pos: 1},
+			{ip: "c", pos: 2},
+			{ip: "b", pos: 1},
+			{ip: "c", pos: 2},
+		}},
+		{"head of the queue goes first", 1, []step{
+			{ip: "a", ok: true},
+			{ip: "b", pos: 1},
+			{ip: "c", pos: 2},
+			{release: true},
+			{ip: "c", pos: 2},
+			{ip: "d", pos: 3},
+			{ip: "b", ok: true},
+			{ip: "c", pos: 1},
+			{release: true},
+			{ip: "c", ok: true},
+		}},
+		{"free slots for everyone queued", 2, []step{
+			{ip: "a", ok: true},
+			{ip: "b", ok: true},
+			{ip: "c", pos: 1},
+			{ip: "d", pos: 2},
+			{release: true},
+			{release: true},
+			{ip: "d", ok: true},
+			{ip: "e", pos: 2},
+			{ip: "c", ok: true},
+		}},
+		{"release without slots", 1, []step{
+			{release: true},
+			{ip: "a", ok: true},
+			{ip: "b", pos: 1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newConcurrencyLimiter(tt.max)
+			for i, s := range tt.steps {
+				if s.release {
+					l.release()
+					continue
+				}
+				ok, pos := l.acquire(s.ip)
+				if ok != s.ok || pos != s.pos {
+					t.Fatalf("step %d: acquire(%q) = %v, %d, want %v, %d", i, s.ip, ok, pos, s.ok, s.pos)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrencyUsage(t *testing.T) {
+	l := newConcurrencyLimiter(1)
+	l.acquire("a")
+	l.acquire("b")
+	l.acquire("c")
+	if active, queued := l.usage(); active != 1 || queued != 2 {
+		t.Errorf("usage() = %d, %d, want 1, 2", active, queued)
+	}
+}
@@ -0,0 +1,1172 @@
+package speedtest
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all tunable server settings
+type Config struct {
+	Port             int             `yaml:"port"`
+	Listen           []string        `yaml:"listen"`     // host:port or unix:///path.sock addresses used instead of port
+	ReusePort        int             `yaml:"reuse_port"` // TCP listeners per address sharing it with SO_REUSEPORT; 0 or 1 opens one
+	StaticDir        string          `yaml:"static_dir"`
+	MaxFileSize      int64           `yaml:"max_file_size"`
+	DownloadSize     int64           `yaml:"download_size"`
+	MaxDownloadSize  int64           `yaml:"max_download_size"`
+	MaxDuration      int             `yaml:"max_duration"`       // Longest duration-mode test in seconds
+	ChunkSize        int             `yaml:"chunk_size"`         // Size of each download write
+	FlushEvery       int             `yaml:"flush_every"`        // Flush downloads every this many chunks; 0 never flushes
+	UploadBufferSize int             `yaml:"upload_buffer_size"` // Size of pooled upload read buffers
+	PayloadFile      string          `yaml:"payload_file"`       // Download data is mapped from this file, generated when missing; empty keeps it in memory
+	PayloadSizeMB    int             `yaml:"payload_size_mb"`    // Size of the payload file
+	Warmup           WarmupConfig    `yaml:"warmup"`
+	ThrottleKBps     float64         `yaml:"throttle_kbps"`
+	ThrottleBurstKB  int             `yaml:"throttle_burst_kb"` // How far a throttled transfer may run ahead; 0 means one chunk
+	Timeouts         TimeoutConfig   `yaml:"timeouts"`
+	TLS              TLSConfig       `yaml:"tls"`
+	ACME             ACMEConfig      `yaml:"acme"`
+	HTTP3            bool            `yaml:"http3"`
+	DebugAddr        string          `yaml:"debug_addr"` // Serves pprof and expvar when set; keep it off public interfaces
+	UDP              UDPConfig       `yaml:"udp"`
+	WebRTC           WebRTCConfig    `yaml:"webrtc"`
+	STUN             STUNConfig      `yaml:"stun"`
+	IPerf3           IPerf3Config    `yaml:"iperf3"`
+	GRPC             GRPCConfig      `yaml:"grpc"`
+	Results          ResultsConfig   `yaml:"results"`
+	Webhooks         WebhookConfig   `yaml:"webhooks"`
+	MQTT             MQTTConfig      `yaml:"mqtt"`
+	InfluxDB         InfluxDBConfig  `yaml:"influxdb"`
+	GeoIP            GeoIPConfig     `yaml:"geoip"`
+	DualStack        DualStackConfig `yaml:"dual_stack"`
+	// Named network segments, such as office floors or VLANs, results are tagged with
+	Segments []Segment `yaml:"segments"`
+	// Peer servers the web UI offers to test against, making this instance a portal
+	Servers []PeerServer `yaml:"servers"`
+	// Let web UIs on other origins, such as a portal listing this server, run tests here
+	CrossOrigin bool `yaml:"cross_origin"`
+	// Origins allowed to use the test endpoints, e.g. https://app.example.com
+	// or https://*.example.com; when set, only these origins are allowed
+	CORSOrigins   []string        `yaml:"cors_origins"`
+	MDNS          MDNSConfig      `yaml:"mdns"`
+	RateLimit     RateLimitConfig `yaml:"rate_limit"`
+	MaxConcurrent int             `yaml:"max_concurrent"` // Tests transferring at once; 0 is unlimited
+	Bandwidth     BandwidthConfig `yaml:"bandwidth"`
+	Tokens        TokenConfig     `yaml:"tokens"`
+	// Keys granting access to the results and admin APIs. While empty those APIs answer 403 Forbidden.
+	APIKeys  []string       `yaml:"api_keys"`
+	Schedule ScheduleConfig `yaml:"schedule"`
+	Mesh     MeshConfig     `yaml:"mesh"`
+	Monitor  MonitorConfig  `yaml:"monitor"`
+	Report   ReportConfig   `yaml:"report"`
+	// Reverse proxies (CIDRs or IPs) allowed to report the client address
+	// in X-Forwarded-For / X-Real-IP
+	TrustedProxies []string        `yaml:"trusted_proxies"`
+	Log            LogConfig       `yaml:"log"`
+	AccessLog      AccessLogConfig `yaml:"access_log"`
+	ResultLog      ResultLogConfig `yaml:"result_log"`
+	Syslog         SyslogConfig    `yaml:"syslog"`
+	Tracing        TracingConfig   `yaml:"tracing"`
+	Headers        HeadersConfig   `yaml:"headers"`
+	Branding       BrandingConfig  `yaml:"branding"`
+
+	// Set by programs embedding the server rather than read from the config file
+	WebFS  fs.FS        `yaml:"-"` // Web UI files; nil serves only the API endpoints
+	Logger *slog.Logger `yaml:"-"` // Defaults to NewLogger with the Log options
+}
+
+// WarmupConfig sets how much of the start of an upload is left out of its
+// trimmed throughput, to skip TCP slow start. The warm-up lasts until both
+// limits are passed; 0 disables a limit and both at 0 disable trimming.
+type WarmupConfig struct {
+	Seconds float64 `yaml:"seconds"`
+	Bytes   int64   `yaml:"bytes"`
+}
+
+// TimeoutConfig limits how long the HTTP server waits on clients, in seconds,
+// so stalled connections don't stay open forever. 0 disables a limit. Read
+// and Write cover whole requests, test transfers included, so they are off
+// by default.
+type TimeoutConfig struct {
+	ReadHeader int `yaml:"read_header"` // Receiving a request's headers
+	Read       int `yaml:"read"`        // Receiving a whole request, body included
+	Write      int `yaml:"write"`       // From the end of the request headers until the response is sent
+	Idle       int `yaml:"idle"`        // Keep-alive connections waiting for the next request
+}
+
+// TLSConfig points at the certificate used to serve HTTPS
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// Enabled reports whether HTTPS should be served
+func (t TLSConfig) Enabled() bool {
+	return t.Cert != "" && t.Key != ""
+}
+
+// ACMEConfig enables automatic certificates from Let's Encrypt
+type ACMEConfig struct {
+	Domains  []string `yaml:"domains"`
+	Email    string   `yaml:"email"`
+	CacheDir string   `yaml:"cache_dir"`
+	HTTPPort int      `yaml:"http_port"`
+}
+
+// Enabled reports whether certificates should be provisioned automatically
+func (a ACMEConfig) Enabled() bool {
+	return len(a.Domains) > 0
+}
+
+// UDPConfig controls the optional UDP packet-loss and jitter listener
+type UDPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"`
+}
+
+// WebRTCConfig controls the optional WebRTC data channel probe
+type WebRTCConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Port     int    `yaml:"port"`      // UDP port peer connections are made to
+	PublicIP string `yaml:"public_ip"` // Address offered to browsers; defaults to the one they reached the server on
+}
+
+// STUNConfig controls the optional STUN responder for NAT type detection
+type STUNConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"` // Also answers on the next port up
+}
+
+// IPerf3Config controls the optional listener for iperf3 clients
+type IPerf3Config struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"`
+}
+
+// GRPCConfig controls the optional gRPC API listener
+type GRPCConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"`
+}
+
+// ResultsConfig controls how completed test results are stored
+type ResultsConfig struct {
+	// Path of a JSON Lines file results are appended to. Empty keeps them in memory only.
+	Path string `yaml:"path"`
+	// PostgreSQL or MySQL database to store results in instead, as a
+	// postgres:// or mysql:// DSN
+	DSN string `yaml:"dsn"`
+	// How long results are kept, e.g. 90d, 12w or 720h. Empty keeps them forever.
+	Retain string `yaml:"retain"`
+	// Upper bound on stored results; the oldest are deleted beyond it. 0 for no bound.
+	MaxCount int `yaml:"max_count"`
+	// Only accept submitted results carrying the one-time nonce issued with
+	// their test session, unless they come with an API key. On by default.
+	RequireNonce bool `yaml:"require_nonce"`
+}
+
+// WebhookConfig posts every finished test to other services, such as
+// ticketing or chat systems. With any threshold set, only results crossing
+// one of them are posted.
+type WebhookConfig struct {
+	URLs            []string `yaml:"urls"`
+	MinDownloadMbps float64  `yaml:"min_download_mbps"` // Notify when download falls below; 0 disables
+	MinUploadMbps   float64  `yaml:"min_upload_mbps"`   // Notify when upload falls below; 0 disables
+	MaxLatencyMs    float64  `yaml:"max_latency_ms"`    // Notify when latency rises above; 0 disables
+	Timeout         int      `yaml:"timeout"`           // Seconds to wait for each webhook
+}
+
+// hasThresholds reports whether only results crossing a threshold are posted
+func (w WebhookConfig) hasThresholds() bool {
+	return w.MinDownloadMbps > 0 || w.MinUploadMbps > 0 || w.MaxLatencyMs > 0
+}
+
+// MQTTConfig publishes every finished test to an MQTT broker, for home
+// automation and IoT monitoring
+type MQTTConfig struct {
+	Broker   string `yaml:"broker"` // mqtt://host:1883 or mqtts://host:8883; empty disables
+	Topic    string `yaml:"topic"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	ClientID string `yaml:"client_id"`
+	QoS      int    `yaml:"qos"`    // 0 or 1
+	Retain   bool   `yaml:"retain"` // Keep the latest result on the broker for new subscribers
+	// Announce download, upload and ping sensors to Home Assistant through
+	// MQTT discovery messages under DiscoveryPrefix
+	Discovery       bool   `yaml:"discovery"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+}
+
+// InfluxDBConfig writes every finished test to an InfluxDB v2 bucket
+type InfluxDBConfig struct {
+	URL         string `yaml:"url"` // e.g. http://influxdb:8086; empty disables
+	Org         string `yaml:"org"`
+	Bucket      string `yaml:"bucket"`
+	Token       string `yaml:"token"` // API token with write access to the bucket
+	Measurement string `yaml:"measurement"`
+}
+
+// GeoIPConfig points at MaxMind databases used to locate clients
+type GeoIPConfig struct {
+	// Path of a GeoLite2/GeoIP2 City database (.mmdb). Empty disables location lookups.
+	CityDB string `yaml:"city_db"`
+	// Path of a GeoLite2 ASN database (.mmdb). Empty disables ISP lookups.
+	ASNDB string `yaml:"asn_db"`
+}
+
+// DualStackConfig points at hostnames reachable over a single address family,
+// so the web UI can repeat the test over the family the client did not use
+type DualStackConfig struct {
+	IPv4URL string `yaml:"ipv4_url"` // e.g. https://v4.speedtest.example.com
+	IPv6URL string `yaml:"ipv6_url"` // e.g. https://v6.speedtest.example.com
+}
+
+// Enabled reports whether an alternate-family host is configured
+func (d DualStackConfig) Enabled() bool {
+	return d.IPv4URL != "" || d.IPv6URL != ""
+}
+
+// Segment names the networks of a part of the site, e.g. an office floor or
+// VLAN. Results from clients in one of them are tagged with its name.
+type Segment struct {
+	Name  string   `yaml:"name"`
+	CIDRs []string `yaml:"cidrs"`
+}
+
+// PeerServer is another speedtest server listed by /api/servers
+type PeerServer struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`      // e.g. https://ams.speedtest.example.com
+	Location string `yaml:"location"` // Free text shown next to the name
+}
+
+// MDNSConfig advertises the server on the local network as a
+// _speedtest._tcp service
+type MDNSConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Name    string `yaml:"name"` // Instance name; the hostname when empty
+}
+
+// RateLimitConfig caps how many tests a single client IP may start
+type RateLimitConfig struct {
+	// Tests per IP per hour; a multi-stream browser test counts once. 0 disables the limit.
+	TestsPerHour int `yaml:"tests_per_hour"`
+}
+
+// BandwidthConfig caps the test traffic of the whole server, shared by all
+// transfers. 0 leaves a direction uncapped.
+type BandwidthConfig struct {
+	EgressMbps  float64 `yaml:"egress_mbps"`  // Downloads sent to clients
+	IngressMbps float64 `yaml:"ingress_mbps"` // Uploads received from clients
+}
+
+// TokenConfig controls the signed one-time tokens clients need to start a test
+type TokenConfig struct {
+	Required bool   `yaml:"required"`
+	Secret   string `yaml:"secret"` // HMAC key; random per start when empty
+	TTL      int    `yaml:"ttl"`    // Seconds a token stays valid
+}
+
+// ScheduleConfig runs periodic client-mode tests against another server,
+// turning this instance into a connection monitor
+type ScheduleConfig struct {
+	Cron     string `yaml:"cron"`     // Standard 5-field cron expression; empty disables
+	Server   string `yaml:"server"`   // URL of the server to test against
+	Streams  int    `yaml:"streams"`  // Parallel streams per direction
+	Duration int    `yaml:"duration"` // Seconds per download and upload phase
+}
+
+// MonitorConfig raises alerts when scheduled or mesh tests breach a
+// threshold, and clears them once the link is healthy again. Alerts are
+// logged, and sent to whichever destinations are configured.
+type MonitorConfig struct {
+	MinDownloadMbps float64 `yaml:"min_download_mbps"` // 0 disables
+	MinUploadMbps   float64 `yaml:"min_upload_mbps"`   // 0 disables
+	MaxLatencyMs    float64 `yaml:"max_latency_ms"`    // 0 disables
+	// Consecutive tests breaching a threshold before its alert fires, and
+	// passing it before the alert clears, so one odd test does not flap
+	FailAfter    int `yaml:"fail_after"`
+	RecoverAfter int `yaml:"recover_after"`
+	// Percent a value must be back inside a threshold to count as passing
+	Margin float64 `yaml:"margin"`
+
+	Webhooks  []string    `yaml:"webhooks"`   // URLs alerts are posted to
+	MQTTTopic string      `yaml:"mqtt_topic"` // Topic on the mqtt broker; empty disables
+	Email     EmailConfig `yaml:"email"`
+}
+
+// enabled reports whether any threshold is set
+func (m MonitorConfig) enabled() bool {
+	return m.MinDownloadMbps > 0 || m.MinUploadMbps > 0 || m.MaxLatencyMs > 0
+}
+
+// EmailConfig sends mail through an SMTP server, using STARTTLS when the
+// server offers it
+type EmailConfig struct {
+	SMTP     string   `yaml:"smtp"` // host:port; empty disables
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// MeshConfig has several instances test each other on a schedule, building
+// a matrix of the links between them. Spokes test only the hub; without a
+// hub every instance tests every peer in servers.
+type MeshConfig struct {
+	Cron     string `yaml:"cron"`     // Standard 5-field cron expression; empty disables
+	Name     string `yaml:"name"`     // This instance in the matrix; defaults to the host name
+	Hub      string `yaml:"hub"`      // URL of the hub a spoke tests against
+	Streams  int    `yaml:"streams"`  // Parallel streams per direction
+	Duration int    `yaml:"duration"` // Seconds per download and upload phase
+}
+
+// ReportConfig turns the server into an agent sending every result it stores
+// to a central collector, another instance that gathers the results of all
+// sites
+type ReportConfig struct {
+	To     string `yaml:"to"`      // Base URL of the collector, e.g. https://speedtest.example.com
+	APIKey string `yaml:"api_key"` // One of the collector's API keys
+	Name   string `yaml:"name"`    // This agent in the collector's results; defaults to the host name
+}
+
+// LogConfig controls where and how the server logs
+type LogConfig struct {
+	Prefix   string            `yaml:"prefix"` // Starts every line of text output
+	File     string            `yaml:"file"`
+	Format   string            `yaml:"format"`   // text or json
+	Level    string            `yaml:"level"`    // debug, info, warn or error
+	Levels   map[string]string `yaml:"levels"`   // Overrides Level for some of LogModules
+	Requests bool              `yaml:"requests"` // Log every HTTP request
+}
+
+// AccessLogConfig sets up the access log, one line per request with its
+// size, duration and throughput. An empty File disables it.
+type AccessLogConfig struct {
+	File       string `yaml:"file"`
+	Format     string `yaml:"format"`      // common or json
+	MaxSizeMB  int    `yaml:"max_size_mb"` // Rotate once the file grows past this; 0 never rotates
+	MaxBackups int    `yaml:"max_backups"` // Rotated files kept as file.1 to file.N
+}
+
+// ResultLogConfig sets up the result log, one line per finished test for
+// operators who want a plain file rather than a database. An empty File
+// disables it.
+type ResultLogConfig struct {
+	File       string `yaml:"file"`
+	Format     string `yaml:"format"`      // jsonl or csv
+	MaxSizeMB  int    `yaml:"max_size_mb"` // Rotate once the file grows past this; 0 never rotates
+	MaxBackups int    `yaml:"max_backups"` // Rotated files kept as file.1 to file.N
+	Daily      bool   `yaml:"daily"`       // Also rotate at the first test of each day
+}
+
+// SyslogConfig sends test events, and optionally the access log, to a
+// syslog server as RFC 5424 messages
+type SyslogConfig struct {
+	Address   string `yaml:"address"`  // udp://host:514, tcp://host:514 or tls://host:6514; empty disables
+	Facility  string `yaml:"facility"` // e.g. daemon or local0
+	AppName   string `yaml:"app_name"`
+	CAFile    string `yaml:"ca_file"`    // PEM certificates to verify a TLS server with instead of the system roots
+	AccessLog bool   `yaml:"access_log"` // Send access log lines too
+}
+
+// HeadersConfig sets the security headers sent with the web UI's pages and
+// static files
+type HeadersConfig struct {
+	HSTSMaxAge     int      `yaml:"hsts_max_age"` // Seconds; only sent over HTTPS, 0 sends no HSTS
+	CSP            string   `yaml:"csp"`          // Replaces the default Content-Security-Policy; "off" sends none
+	AllowEmbed     []string `yaml:"allow_embed"`  // Origins allowed to show the UI in a frame, * for any
+	ReferrerPolicy string   `yaml:"referrer_policy"`
+}
+
+// BrandingConfig white-labels the web UI. Empty fields keep the defaults.
+type BrandingConfig struct {
+	Title       string `yaml:"title"`        // Replaces "Infobits Speed Test" in the page titles and heading
+	LogoURL     string `yaml:"logo_url"`     // Image shown above the heading
+	AccentColor string `yaml:"accent_color"` // Hex color of buttons and links, e.g. #e4002b
+	FooterText  string `yaml:"footer_text"`  // Replaces the footer tagline
+}
+
+// TracingConfig sends OpenTelemetry traces of requests and transfers to an
+// OTLP/HTTP collector. An empty Endpoint disables tracing.
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint"` // e.g. http://localhost:4318
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"` // Share of traces kept, 0 to 1, unless the caller's trace is sampled
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	return Config{
+		Port:             8080,
+		StaticDir:        "",                 // Serve the embedded web UI
+		MaxFileSize:      500 * 1024 * 1024,  // 500 MB max file size
+		DownloadSize:     32 * 1024 * 1024,   // 32 MB download size
+		MaxDownloadSize:  1024 * 1024 * 1024, // 1 GB cap on requested download sizes
+		MaxDuration:      60,                 // Duration-mode tests run for up to a minute
+		ChunkSize:        64 * 1024,          // 64KB chunks for efficient streaming
+		FlushEvery:       1,                  // Push every chunk out immediately
+		UploadBufferSize: 64 * 1024,          // 64KB reads from upload bodies
+		PayloadSizeMB:    256,                // Payload file size, when one is set
+		ThrottleKBps:     0,                  // No throttling by default
+		ThrottleBurstKB:  0,                  // Throttled transfers send one chunk at a time
+		Timeouts: TimeoutConfig{
+			ReadHeader: 10,
+			Idle:       120,
+		},
+		ACME: ACMEConfig{
+			CacheDir: "acme-cache",
+			HTTPPort: 80,
+		},
+		UDP: UDPConfig{
+			Port: 8081,
+		},
+		WebRTC: WebRTCConfig{
+			Port: 8082,
+		},
+		STUN: STUNConfig{
+			Port: 3478,
+		},
+		IPerf3: IPerf3Config{
+			Port: 5201,
+		},
+		GRPC: GRPCConfig{
+			Port: 9090,
+		},
+		Webhooks: WebhookConfig{
+			Timeout: 10,
+		},
+		MQTT: MQTTConfig{
+			Topic:           "speedtest/results",
+			ClientID:        "infobits-speedtest",
+			DiscoveryPrefix: "homeassistant",
+		},
+		InfluxDB: InfluxDBConfig{
+			Measurement: "speedtest",
+		},
+		Results: ResultsConfig{
+			RequireNonce: true,
+		},
+		Tokens: TokenConfig{
+			TTL: 60,
+		},
+		Schedule: ScheduleConfig{
+			Streams:  4,
+			Duration: 10,
+		},
+		Mesh: MeshConfig{
+			Streams:  4,
+			Duration: 10,
+		},
+		Monitor: MonitorConfig{
+			FailAfter:    2,
+			RecoverAfter: 2,
+			Margin:       10,
+		},
+		Log: LogConfig{
+			Prefix: "[SPEEDTEST] ",
+			Format: "text",
+			Level:  "info",
+		},
+		Tracing: TracingConfig{
+			ServiceName: "infobits-speedtest",
+			SampleRatio: 1,
+		},
+		AccessLog: AccessLogConfig{
+			Format:     "common",
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+		},
+		ResultLog: ResultLogConfig{
+			Format:     "jsonl",
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+		},
+		Syslog: SyslogConfig{
+			Facility: "local0",
+			AppName:  "speedtest",
+		},
+		Headers: HeadersConfig{
+			HSTSMaxAge:     31536000,
+			ReferrerPolicy: "no-referrer",
+		},
+	}
+}
+
+// LoadConfigFile reads a YAML config file on top of the given defaults
+func LoadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// EnvPrefix is prepended to every environment variable the server reads
+const EnvPrefix = "SPEEDTEST_"
+
+// ApplyEnv overrides config values with SPEEDTEST_* environment variables.
+// It is applied after the config file and before command-line flags.
+func ApplyEnv(cfg *Config) error {
+	ints := map[string]*int{
+		"PORT":                   &cfg.Port,
+		"CHUNK_SIZE":             &cfg.ChunkSize,
+		"FLUSH_EVERY":            &cfg.FlushEvery,
+		"MAX_DURATION":           &cfg.MaxDuration,
+		"UPLOAD_BUFFER_SIZE":     &cfg.UploadBufferSize,
+		"PAYLOAD_SIZE_MB":        &cfg.PayloadSizeMB,
+		"THROTTLE_BURST_KB":      &cfg.ThrottleBurstKB,
+		"ACME_HTTP_PORT":         &cfg.ACME.HTTPPort,
+		"UDP_PORT":               &cfg.UDP.Port,
+		"WEBRTC_PORT":            &cfg.WebRTC.Port,
+		"STUN_PORT":              &cfg.STUN.Port,
+		"IPERF3_PORT":            &cfg.IPerf3.Port,
+		"GRPC_PORT":              &cfg.GRPC.Port,
+		"RATE_LIMIT":             &cfg.RateLimit.TestsPerHour,
+		"MAX_CONCURRENT":         &cfg.MaxConcurrent,
+		"REUSE_PORT":             &cfg.ReusePort,
+		"TIMEOUT_READ_HEADER":    &cfg.Timeouts.ReadHeader,
+		"TIMEOUT_READ":           &cfg.Timeouts.Read,
+		"TIMEOUT_WRITE":          &cfg.Timeouts.Write,
+		"TIMEOUT_IDLE":           &cfg.Timeouts.Idle,
+		"TOKEN_TTL":              &cfg.Tokens.TTL,
+		"WEBHOOK_TIMEOUT":        &cfg.Webhooks.Timeout,
+		"MQTT_QOS":               &cfg.MQTT.QoS,
+		"SCHEDULE_STREAMS":       &cfg.Schedule.Streams,
+		"SCHEDULE_DURATION":      &cfg.Schedule.Duration,
+		"MONITOR_FAIL_AFTER":     &cfg.Monitor.FailAfter,
+		"MONITOR_RECOVER_AFTER":  &cfg.Monitor.RecoverAfter,
+		"MESH_STREAMS":           &cfg.Mesh.Streams,
+		"MESH_DURATION":          &cfg.Mesh.Duration,
+		"ACCESS_LOG_MAX_SIZE_MB": &cfg.AccessLog.MaxSizeMB,
+		"ACCESS_LOG_MAX_BACKUPS": &cfg.AccessLog.MaxBackups,
+		"RESULT_LOG_MAX_SIZE_MB": &cfg.ResultLog.MaxSizeMB,
+		"RESULT_LOG_MAX_BACKUPS": &cfg.ResultLog.MaxBackups,
+		"HEADERS_HSTS_MAX_AGE":   &cfg.Headers.HSTSMaxAge,
+		"RESULTS_MAX_COUNT":      &cfg.Results.MaxCount,
+	}
+	for name, dst := range ints {
+		if v, ok := os.LookupEnv(EnvPrefix + name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s: %w", EnvPrefix, name, err)
+			}
+			*dst = n
+		}
+	}
+
+	int64s := map[string]*int64{
+		"MAX_FILE_SIZE":     &cfg.MaxFileSize,
+		"DOWNLOAD_SIZE":     &cfg.DownloadSize,
+		"MAX_DOWNLOAD_SIZE": &cfg.MaxDownloadSize,
+		"WARMUP_BYTES":      &cfg.Warmup.Bytes,
+	}
+	for name, dst := range int64s {
+		if v, ok := os.LookupEnv(EnvPrefix + name); ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s: %w", EnvPrefix, name, err)
+			}
+			*dst = n
+		}
+	}
+
+	floats := map[string]*float64{
+		"THROTTLE_KBPS":             &cfg.ThrottleKBps,
+		"WARMUP_SECONDS":            &cfg.Warmup.Seconds,
+		"BANDWIDTH_EGRESS_MBPS":     &cfg.Bandwidth.EgressMbps,
+		"BANDWIDTH_INGRESS_MBPS":    &cfg.Bandwidth.IngressMbps,
+		"WEBHOOK_MIN_DOWNLOAD_MBPS": &cfg.Webhooks.MinDownloadMbps,
+		"WEBHOOK_MIN_UPLOAD_MBPS":   &cfg.Webhooks.MinUploadMbps,
+		"WEBHOOK_MAX_LATENCY_MS":    &cfg.Webhooks.MaxLatencyMs,
+		"MONITOR_MIN_DOWNLOAD_MBPS": &cfg.Monitor.MinDownloadMbps,
+		"MONITOR_MIN_UPLOAD_MBPS":   &cfg.Monitor.MinUploadMbps,
+		"MONITOR_MAX_LATENCY_MS":    &cfg.Monitor.MaxLatencyMs,
+		"MONITOR_MARGIN":            &cfg.Monitor.Margin,
+		"TRACING_SAMPLE_RATIO":      &cfg.Tracing.SampleRatio,
+	}
+	for name, dst := range floats {
+		if v, ok := os.LookupEnv(EnvPrefix + name); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s: %w", EnvPrefix, name, err)
+			}
+			*dst = f
+		}
+	}
+
+	strs := map[string]*string{
+		"STATIC_DIR":              &cfg.StaticDir,
+		"PAYLOAD_FILE":            &cfg.PayloadFile,
+		"TLS_CERT":                &cfg.TLS.Cert,
+		"TLS_KEY":                 &cfg.TLS.Key,
+		"ACME_EMAIL":              &cfg.ACME.Email,
+		"ACME_CACHE":              &cfg.ACME.CacheDir,
+		"WEBRTC_PUBLIC_IP":        &cfg.WebRTC.PublicIP,
+		"RESULTS_PATH":            &cfg.Results.Path,
+		"RESULTS_DSN":             &cfg.Results.DSN,
+		"RESULTS_RETAIN":          &cfg.Results.Retain,
+		"GEOIP_CITY_DB":           &cfg.GeoIP.CityDB,
+		"GEOIP_ASN_DB":            &cfg.GeoIP.ASNDB,
+		"DUAL_STACK_IPV4_URL":     &cfg.DualStack.IPv4URL,
+		"DUAL_STACK_IPV6_URL":     &cfg.DualStack.IPv6URL,
+		"TOKEN_SECRET":            &cfg.Tokens.Secret,
+		"MDNS_NAME":               &cfg.MDNS.Name,
+		"MQTT_BROKER":             &cfg.MQTT.Broker,
+		"MQTT_TOPIC":              &cfg.MQTT.Topic,
+		"MQTT_USERNAME":           &cfg.MQTT.Username,
+		"MQTT_PASSWORD":           &cfg.MQTT.Password,
+		"MQTT_CLIENT_ID":          &cfg.MQTT.ClientID,
+		"INFLUXDB_URL":            &cfg.InfluxDB.URL,
+		"INFLUXDB_ORG":            &cfg.InfluxDB.Org,
+		"INFLUXDB_BUCKET":         &cfg.InfluxDB.Bucket,
+		"INFLUXDB_TOKEN":          &cfg.InfluxDB.Token,
+		"INFLUXDB_MEASUREMENT":    &cfg.InfluxDB.Measurement,
+		"SCHEDULE":                &cfg.Schedule.Cron,
+		"SCHEDULE_SERVER":         &cfg.Schedule.Server,
+		"MESH":                    &cfg.Mesh.Cron,
+		"MESH_NAME":               &cfg.Mesh.Name,
+		"MESH_HUB":                &cfg.Mesh.Hub,
+		"MONITOR_MQTT_TOPIC":      &cfg.Monitor.MQTTTopic,
+		"MONITOR_SMTP":            &cfg.Monitor.Email.SMTP,
+		"MONITOR_SMTP_USERNAME":   &cfg.Monitor.Email.Username,
+		"MONITOR_SMTP_PASSWORD":   &cfg.Monitor.Email.Password,
+		"MONITOR_EMAIL_FROM":      &cfg.Monitor.Email.From,
+		"REPORT_TO":               &cfg.Report.To,
+		"REPORT_API_KEY":          &cfg.Report.APIKey,
+		"REPORT_NAME":             &cfg.Report.Name,
+		"LOG_PREFIX":              &cfg.Log.Prefix,
+		"LOG_FILE":                &cfg.Log.File,
+		"LOG_FORMAT":              &cfg.Log.Format,
+		"LOG_LEVEL":               &cfg.Log.Level,
+		"DEBUG_ADDR":              &cfg.DebugAddr,
+		"HEADERS_CSP":             &cfg.Headers.CSP,
+		"BRANDING_TITLE":          &cfg.Branding.Title,
+		"BRANDING_LOGO_URL":       &cfg.Branding.LogoURL,
+		"BRANDING_ACCENT_COLOR":   &cfg.Branding.AccentColor,
+		"BRANDING_FOOTER_TEXT":    &cfg.Branding.FooterText,
+		"HEADERS_REFERRER_POLICY": &cfg.Headers.ReferrerPolicy,
+		"ACCESS_LOG_FILE":         &cfg.AccessLog.File,
+		"ACCESS_LOG_FORMAT":       &cfg.AccessLog.Format,
+		"RESULT_LOG_FILE":         &cfg.ResultLog.File,
+		"RESULT_LOG_FORMAT":       &cfg.ResultLog.Format,
+		"SYSLOG_ADDRESS":          &cfg.Syslog.Address,
+		"SYSLOG_FACILITY":         &cfg.Syslog.Facility,
+		"SYSLOG_APP_NAME":         &cfg.Syslog.AppName,
+		"SYSLOG_CA_FILE":          &cfg.Syslog.CAFile,
+		"TRACING_ENDPOINT":        &cfg.Tracing.Endpoint,
+		"TRACING_SERVICE_NAME":    &cfg.Tracing.ServiceName,
+	}
+	for name, dst := range strs {
+		if v, ok := os.LookupEnv(EnvPrefix + name); ok {
+			*dst = v
+		}
+	}
+
+	bools := map[string]*bool{
+		"UDP_ENABLED":           &cfg.UDP.Enabled,
+		"WEBRTC_ENABLED":        &cfg.WebRTC.Enabled,
+		"STUN_ENABLED":          &cfg.STUN.Enabled,
+		"IPERF3_ENABLED":        &cfg.IPerf3.Enabled,
+		"GRPC_ENABLED":          &cfg.GRPC.Enabled,
+		"RESULTS_REQUIRE_NONCE": &cfg.Results.RequireNonce,
+		"CROSS_ORIGIN":          &cfg.CrossOrigin,
+		"MDNS_ENABLED":          &cfg.MDNS.Enabled,
+		"MQTT_RETAIN":           &cfg.MQTT.Retain,
+		"MQTT_DISCOVERY":        &cfg.MQTT.Discovery,
+		"RESULT_LOG_DAILY":      &cfg.ResultLog.Daily,
+		"SYSLOG_ACCESS_LOG":     &cfg.Syslog.AccessLog,
+		"HTTP3":                 &cfg.HTTP3,
+		"TOKENS_REQUIRED":       &cfg.Tokens.Required,
+		"LOG_REQUESTS":          &cfg.Log.Requests,
+	}
+	for name, dst := range bools {
+		if v, ok := os.LookupEnv(EnvPrefix + name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s: %w", EnvPrefix, name, err)
+			}
+			*dst = b
+		}
+	}
+
+	if v, ok := os.LookupEnv(EnvPrefix + "ACME_DOMAIN"); ok {
+		cfg.ACME.Domains = SplitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "LISTEN"); ok {
+		cfg.Listen = SplitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "TRUSTED_PROXIES"); ok {
+		cfg.TrustedProxies = SplitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "CORS_ORIGINS"); ok {
+		cfg.CORSOrigins = SplitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "HEADERS_ALLOW_EMBED"); ok {
+		cfg.Headers.AllowEmbed = SplitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "API_KEYS"); ok {
+		cfg.APIKeys = SplitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "SERVERS"); ok {
+		// Entries are URLs, optionally named as name=url
+		cfg.Servers = nil
+		for _, entry := range SplitList(v) {
+			peer := PeerServer{URL: entry}
+			if name, u, ok := strings.Cut(entry, "="); ok && !strings.Contains(name, "://") {
+				peer = PeerServer{Name: strings.TrimSpace(name), URL: strings.TrimSpace(u)}
+			}
+			if peer.Name == "" {
+				if parsed, err := url.Parse(peer.URL); err == nil {
+					peer.Name = parsed.Host
+				}
+			}
+			cfg.Servers = append(cfg.Servers, peer)
+		}
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "SEGMENTS"); ok {
+		// Entries are name=cidr; a name may be repeated for several networks
+		cfg.Segments = nil
+		index := map[string]int{}
+		for _, entry := range SplitList(v) {
+			name, cidr, ok := strings.Cut(entry, "=")
+			if !ok {
+				return fmt.Errorf("invalid %sSEGMENTS entry %q, expected name=cidr", EnvPrefix, entry)
+			}
+			name, cidr = strings.TrimSpace(name), strings.TrimSpace(cidr)
+			if i, ok := index[name]; ok {
+				cfg.Segments[i].CIDRs = append(cfg.Segments[i].CIDRs, cidr)
+				continue
+			}
+			index[name] = len(cfg.Segments)
+			cfg.Segments = append(cfg.Segments, Segment{Name: name, CIDRs: []string{cidr}})
+		}
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "WEBHOOK_URLS"); ok {
+		cfg.Webhooks.URLs = SplitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "MONITOR_WEBHOOKS"); ok {
+		cfg.Monitor.Webhooks = SplitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "MONITOR_EMAIL_TO"); ok {
+		cfg.Monitor.Email.To = SplitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "LOG_LEVELS"); ok {
+		// Entries are module=level
+		cfg.Log.Levels = map[string]string{}
+		for _, entry := range SplitList(v) {
+			module, level, ok := strings.Cut(entry, "=")
+			if !ok {
+				return fmt.Errorf("invalid %sLOG_LEVELS entry %q, expected module=level", EnvPrefix, entry)
+			}
+			cfg.Log.Levels[strings.TrimSpace(module)] = strings.TrimSpace(level)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the config for values the server cannot run with
+func (c *Config) Validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if c.MaxFileSize <= 0 {
+		return fmt.Errorf("max_file_size must be positive")
+	}
+	if c.DownloadSize <= 0 {
+		return fmt.Errorf("download_size must be positive")
+	}
+	if c.MaxDownloadSize < c.DownloadSize {
+		return fmt.Errorf("max_download_size must be at least download_size")
+	}
+	if c.MaxDuration <= 0 {
+		return fmt.Errorf("max_duration must be positive")
+	}
+	if c.ChunkSize <= 0 {
+		return fmt.Errorf("chunk_size must be positive")
+	}
+	if c.FlushEvery < 0 {
+		return fmt.Errorf("flush_every cannot be negative")
+	}
+	if c.UploadBufferSize <= 0 {
+		return fmt.Errorf("upload_buffer_size must be positive")
+	}
+	// Chunks are cut from the random block or payload file, whichever is used
+	if c.ChunkSize > randomBlockSize {
+		return fmt.Errorf("chunk_size cannot exceed %d", randomBlockSize)
+	}
+	if c.PayloadFile != "" && c.PayloadSizeMB < randomBlockSize/(1024*1024) {
+		return fmt.Errorf("payload_size_mb must be at least %d", randomBlockSize/(1024*1024))
+	}
+	t := c.Timeouts
+	if t.ReadHeader < 0 || t.Read < 0 || t.Write < 0 || t.Idle < 0 {
+		return fmt.Errorf("timeouts cannot be negative")
+	}
+	// Duration-mode tests would always be cut off
+	if (t.Read > 0 && t.Read <= c.MaxDuration) || (t.Write > 0 && t.Write <= c.MaxDuration) {
+		return fmt.Errorf("timeouts.read and timeouts.write must be longer than max_duration")
+	}
+	if c.Warmup.Seconds < 0 || c.Warmup.Bytes < 0 {
+		return fmt.Errorf("warmup cannot be negative")
+	}
+	if c.ThrottleKBps < 0 {
+		return fmt.Errorf("throttle_kbps cannot be negative")
+	}
+	if c.ThrottleBurstKB < 0 {
+		return fmt.Errorf("throttle_burst_kb cannot be negative")
+	}
+	if c.Bandwidth.EgressMbps < 0 || c.Bandwidth.IngressMbps < 0 {
+		return fmt.Errorf("bandwidth caps cannot be negative")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("tls cert and key must be set together")
+	}
+	if c.TLS.Enabled() && c.ACME.Enabled() {
+		return fmt.Errorf("tls cert/key and acme domains are mutually exclusive")
+	}
+	if c.ACME.Enabled() && (c.ACME.HTTPPort <= 0 || c.ACME.HTTPPort > 65535) {
+		return fmt.Errorf("invalid acme http_port %d", c.ACME.HTTPPort)
+	}
+	for _, origin := range c.CORSOrigins {
+		if err := validateOrigin("cors origin", origin); err != nil {
+			return err
+		}
+	}
+	if _, err := ParseRetention(c.Results.Retain); err != nil {
+		return err
+	}
+	if c.Results.MaxCount < 0 {
+		return fmt.Errorf("results max_count cannot be negative")
+	}
+	if c.Results.DSN != "" {
+		if c.Results.Path != "" {
+			return fmt.Errorf("results path and dsn are mutually exclusive")
+		}
+		if _, _, err := sqlDriver(c.Results.DSN); err != nil {
+			return err
+		}
+	}
+	if err := c.Branding.validate(); err != nil {
+		return err
+	}
+	if c.Headers.HSTSMaxAge < 0 {
+		return fmt.Errorf("headers hsts_max_age cannot be negative")
+	}
+	for _, origin := range c.Headers.AllowEmbed {
+		if err := validateOrigin("allow_embed origin", origin); err != nil {
+			return err
+		}
+	}
+	for _, addr := range c.Listen {
+		if _, _, err := ParseListenAddr(addr); err != nil {
+			return err
+		}
+	}
+	if c.ReusePort < 0 || c.ReusePort > 1024 {
+		return fmt.Errorf("reuse_port must be between 0 and 1024")
+	}
+	if c.DebugAddr != "" {
+		if _, _, err := net.SplitHostPort(c.DebugAddr); err != nil {
+			return fmt.Errorf("invalid debug_addr %q: %w", c.DebugAddr, err)
+		}
+	}
+	if c.HTTP3 && !c.TLS.Enabled() && !c.ACME.Enabled() {
+		return fmt.Errorf("http3 requires tls or acme to be configured")
+	}
+	if c.UDP.Enabled && (c.UDP.Port <= 0 || c.UDP.Port > 65535) {
+		return fmt.Errorf("invalid udp port %d", c.UDP.Port)
+	}
+	if c.WebRTC.Enabled && (c.WebRTC.Port <= 0 || c.WebRTC.Port > 65535 || (c.UDP.Enabled && c.WebRTC.Port == c.UDP.Port)) {
+		return fmt.Errorf("invalid webrtc port %d", c.WebRTC.Port)
+	}
+	if c.WebRTC.PublicIP != "" && net.ParseIP(c.WebRTC.PublicIP) == nil {
+		return fmt.Errorf("invalid webrtc public_ip %q", c.WebRTC.PublicIP)
+	}
+	if c.STUN.Enabled {
+		taken := func(port int) bool {
+			return (c.UDP.Enabled && port == c.UDP.Port) || (c.WebRTC.Enabled && port == c.WebRTC.Port)
+		}
+		if c.STUN.Port <= 0 || c.STUN.Port >= 65535 || taken(c.STUN.Port) || taken(c.STUN.Port+1) {
+			return fmt.Errorf("invalid stun port %d, it and the next port must be free", c.STUN.Port)
+		}
+	}
+	if c.IPerf3.Enabled && (c.IPerf3.Port <= 0 || c.IPerf3.Port > 65535 || c.IPerf3.Port == c.ServePort()) {
+		return fmt.Errorf("invalid iperf3 port %d", c.IPerf3.Port)
+	}
+	if c.GRPC.Enabled && (c.GRPC.Port <= 0 || c.GRPC.Port > 65535 || c.GRPC.Port == c.ServePort() ||
+		(c.IPerf3.Enabled && c.GRPC.Port == c.IPerf3.Port)) {
+		return fmt.Errorf("invalid grpc port %d", c.GRPC.Port)
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent cannot be negative")
+	}
+	if c.Tokens.Required && c.Tokens.TTL <= 0 {
+		return fmt.Errorf("tokens ttl must be positive")
+	}
+	if c.Schedule.Cron != "" {
+		if _, err := cron.ParseStandard(c.Schedule.Cron); err != nil {
+			return fmt.Errorf("invalid schedule %q: %w", c.Schedule.Cron, err)
+		}
+		if _, err := NewClient(c.Schedule.Server, c.Schedule.Streams, time.Duration(c.Schedule.Duration)*time.Second); err != nil {
+			return fmt.Errorf("schedule: %w", err)
+		}
+	}
+	if c.Mesh.Cron != "" {
+		if _, err := cron.ParseStandard(c.Mesh.Cron); err != nil {
+			return fmt.Errorf("invalid mesh schedule %q: %w", c.Mesh.Cron, err)
+		}
+		if c.Mesh.Hub == "" && len(c.Servers) == 0 {
+			return fmt.Errorf("mesh needs a hub or peers in servers to test")
+		}
+		if c.Mesh.Streams <= 0 || c.Mesh.Duration <= 0 {
+			return fmt.Errorf("mesh streams and duration must be positive")
+		}
+		targets := []string{c.Mesh.Hub}
+		if c.Mesh.Hub == "" {
+			targets = nil
+			for _, peer := range c.Servers {
+				targets = append(targets, peer.URL)
+			}
+		}
+		for _, target := range targets {
+			if _, err := NewClient(target, c.Mesh.Streams, time.Duration(c.Mesh.Duration)*time.Second); err != nil {
+				return fmt.Errorf("mesh: %w", err)
+			}
+		}
+	}
+	if c.Report.To != "" {
+		if parsed, err := url.Parse(c.Report.To); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid report url %q", c.Report.To)
+		}
+		if c.Report.APIKey == "" {
+			return fmt.Errorf("report api_key must be set")
+		}
+	}
+	if c.RateLimit.TestsPerHour < 0 {
+		return fmt.Errorf("rate_limit tests_per_hour cannot be negative")
+	}
+	for _, u := range c.Webhooks.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid webhook url %q", u)
+		}
+	}
+	if len(c.Webhooks.URLs) > 0 && c.Webhooks.Timeout <= 0 {
+		return fmt.Errorf("webhooks timeout must be positive")
+	}
+	if c.Webhooks.MinDownloadMbps < 0 || c.Webhooks.MinUploadMbps < 0 || c.Webhooks.MaxLatencyMs < 0 {
+		return fmt.Errorf("webhook thresholds cannot be negative")
+	}
+	if c.MQTT.Broker != "" {
+		parsed, err := url.Parse(c.MQTT.Broker)
+		if err != nil || parsed.Hostname() == "" {
+			return fmt.Errorf("invalid mqtt broker %q", c.MQTT.Broker)
+		}
+		switch parsed.Scheme {
+		case "mqtt", "tcp", "mqtts", "ssl", "tls":
+		default:
+			return fmt.Errorf("mqtt broker %q must use mqtt:// or mqtts://", c.MQTT.Broker)
+		}
+		if c.MQTT.Topic == "" || strings.ContainsAny(c.MQTT.Topic, "+#") {
+			return fmt.Errorf("invalid mqtt topic %q", c.MQTT.Topic)
+		}
+		if c.MQTT.QoS != 0 && c.MQTT.QoS != 1 {
+			return fmt.Errorf("mqtt qos must be 0 or 1")
+		}
+		if c.MQTT.Password != "" && c.MQTT.Username == "" {
+			return fmt.Errorf("mqtt password needs a username")
+		}
+		if c.MQTT.Discovery && (c.MQTT.DiscoveryPrefix == "" || strings.ContainsAny(c.MQTT.DiscoveryPrefix, "+#")) {
+			return fmt.Errorf("invalid mqtt discovery_prefix %q", c.MQTT.DiscoveryPrefix)
+		}
+	}
+	if m := c.Monitor; m.MinDownloadMbps < 0 || m.MinUploadMbps < 0 || m.MaxLatencyMs < 0 {
+		return fmt.Errorf("monitor thresholds cannot be negative")
+	}
+	if m := c.Monitor; m.enabled() {
+		if c.Schedule.Cron == "" && c.Mesh.Cron == "" {
+			return fmt.Errorf("monitor needs scheduled or mesh tests")
+		}
+		if m.FailAfter <= 0 || m.RecoverAfter <= 0 {
+			return fmt.Errorf("monitor fail_after and recover_after must be positive")
+		}
+		if m.Margin < 0 || m.Margin >= 100 {
+			return fmt.Errorf("monitor margin must be from 0 to 100 percent")
+		}
+		for _, u := range m.Webhooks {
+			if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("invalid monitor webhook url %q", u)
+			}
+		}
+		if m.MQTTTopic != "" {
+			if c.MQTT.Broker == "" {
+				return fmt.Errorf("monitor mqtt_topic needs an mqtt broker")
+			}
+			if strings.ContainsAny(m.MQTTTopic, "+#") {
+				return fmt.Errorf("invalid monitor mqtt_topic %q", m.MQTTTopic)
+			}
+		}
+		if e := m.Email; e.SMTP != "" {
+			if _, _, err := net.SplitHostPort(e.SMTP); err != nil {
+				return fmt.Errorf("invalid monitor smtp server %q, expected host:port", e.SMTP)
+			}
+			if e.From == "" || len(e.To) == 0 {
+				return fmt.Errorf("monitor email from and to must be set")
+			}
+		}
+	}
+	if c.InfluxDB.URL != "" {
+		if parsed, err := url.Parse(c.InfluxDB.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid influxdb url %q", c.InfluxDB.URL)
+		}
+		if c.InfluxDB.Org == "" || c.InfluxDB.Bucket == "" {
+			return fmt.Errorf("influxdb org and bucket must be set")
+		}
+		if c.InfluxDB.Measurement == "" {
+			return fmt.Errorf("influxdb measurement cannot be empty")
+		}
+	}
+	names := map[string]bool{}
+	for _, seg := range c.Segments {
+		if seg.Name == "" || len(seg.CIDRs) == 0 {
+			return fmt.Errorf("segments need a name and at least one cidr")
+		}
+		if names[seg.Name] {
+			return fmt.Errorf("duplicate segment %s", seg.Name)
+		}
+		names[seg.Name] = true
+	}
+	if _, err := newSegmentMatcher(c.Segments); err != nil {
+		return err
+	}
+	for _, peer := range c.Servers {
+		if parsed, err := url.Parse(peer.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid servers url %q", peer.URL)
+		}
+		if peer.Name == "" {
+			return fmt.Errorf("server %s needs a name", peer.URL)
+		}
+	}
+	for _, u := range []string{c.DualStack.IPv4URL, c.DualStack.IPv6URL} {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid dual_stack url %q", u)
+		}
+	}
+	if c.Tracing.Endpoint != "" {
+		if parsed, err := url.Parse(c.Tracing.Endpoint); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid tracing endpoint %q", c.Tracing.Endpoint)
+		}
+		if c.Tracing.ServiceName == "" {
+			return fmt.Errorf("tracing service_name cannot be empty")
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample_ratio must be between 0 and 1")
+	}
+	if c.AccessLog.Format != "common" && c.AccessLog.Format != "json" {
+		return fmt.Errorf("access_log format must be common or json")
+	}
+	if c.AccessLog.MaxSizeMB < 0 || c.AccessLog.MaxBackups < 0 {
+		return fmt.Errorf("access_log max_size_mb and max_backups cannot be negative")
+	}
+	if c.ResultLog.Format != "jsonl" && c.ResultLog.Format != "csv" {
+		return fmt.Errorf("result_log format must be jsonl or csv")
+	}
+	if c.ResultLog.MaxSizeMB < 0 || c.ResultLog.MaxBackups < 0 {
+		return fmt.Errorf("result_log max_size_mb and max_backups cannot be negative")
+	}
+	if c.Syslog.Address != "" {
+		if parsed, err := url.Parse(c.Syslog.Address); err != nil || (parsed.Scheme != "udp" && parsed.Scheme != "tcp" && parsed.Scheme != "tls") || parsed.Port() == "" {
+			return fmt.Errorf("invalid syslog address %q, expected udp://, tcp:// or tls://host:port", c.Syslog.Address)
+		}
+		if _, ok := syslogFacilities[c.Syslog.Facility]; !ok {
+			return fmt.Errorf("unknown syslog facility %q", c.Syslog.Facility)
+		}
+		if c.Syslog.AppName == "" || len(c.Syslog.AppName) > 48 || strings.ContainsFunc(c.Syslog.AppName, func(r rune) bool { return r <= ' ' || r > '~' }) {
+			return fmt.Errorf("syslog app_name must be 1 to 48 printable ASCII characters without spaces")
+		}
+	} else if c.Syslog.AccessLog {
+		return fmt.Errorf("syslog access_log needs a syslog address")
+	}
+	return c.Log.validate()
+}
+
+// ParseListenAddr splits a listen address into the network and address
+// to pass to net.Listen: unix:///path.sock for a Unix domain socket, or
+// host:port for TCP, where an empty host means all interfaces
+func ParseListenAddr(addr string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if path == "" {
+			return "", "", fmt.Errorf("invalid listen address %q: missing socket path", addr)
+		}
+		return "unix", path, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	return "tcp", addr, nil
+}
+
+// BindHost returns the host every TCP listen address binds to, so the
+// server's other listeners can stay on the same interface. It is empty when
+// the server listens on all interfaces or on several hosts.
+func (c *Config) BindHost() string {
+	host, seen := "", false
+	for _, addr := range c.Listen {
+		network, address, err := ParseListenAddr(addr)
+		if err != nil || network != "tcp" {
+			continue
+		}
+		h, _, _ := net.SplitHostPort(address)
+		if seen && h != host {
+			return ""
+		}
+		host, seen = h, true
+	}
+	return host
+}
+
+// ServePort returns the port clients reach the web UI on: that of the first
+// TCP listen address, or port when none is configured
+func (c *Config) ServePort() int {
+	for _, addr := range c.Listen {
+		network, address, err := ParseListenAddr(addr)
+		if err != nil || network != "tcp" {
+			continue
+		}
+		_, port, _ := net.SplitHostPort(address)
+		if n, err := strconv.Atoi(port); err == nil {
+			return n
+		}
+	}
+	return c.Port
+}
+
+// SplitList parses a comma-separated list, dropping empty entries
+func SplitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
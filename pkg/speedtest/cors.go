@@ -0,0 +1,93 @@
+package speedtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// corsAllowHeaders are the request headers browsers on other origins may send
+const corsAllowHeaders = "Content-Type, Range, X-Speedtest-Token"
+
+// allowCrossOrigin lets the web UI reach an endpoint from the other address
+// family's hostname, from a portal listing this server as a peer, or from a
+// frontend on one of the configured cors_origins. It answers CORS preflight
+// requests itself.
+func (s *Server) allowCrossOrigin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Whether the response carries CORS headers depends on the origin
+		// once origins are listed, allowed or not, so caches must key on it
+		if len(s.cfg.CORSOrigins) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+		allow := s.corsOrigin(r)
+		if allow == "" {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allow)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Cache-Buster, Content-Range, Accept-Ranges")
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", "3600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin value for r, or ""
+// when its origin may not use the test endpoints. Without cors_origins any
+// origin may once cross_origin or dual-stack hosts are configured; with
+// them only those origins and the dual-stack hosts may.
+func (s *Server) corsOrigin(r *http.Request) string {
+	if len(s.cfg.CORSOrigins) == 0 {
+		if s.cfg.DualStack.Enabled() || s.cfg.CrossOrigin {
+			return "*"
+		}
+		return ""
+	}
+
+	origin := r.Header.Get("Origin")
+	allowed := append([]string{s.cfg.DualStack.IPv4URL, s.cfg.DualStack.IPv6URL}, s.cfg.CORSOrigins...)
+	for _, pattern := range allowed {
+		if pattern == "*" {
+			return "*"
+		}
+		if origin != "" && pattern != "" && originMatches(pattern, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// originMatches reports whether origin, such as https://app.example.com,
+// matches an allowed origin. A pattern like https://*.example.com matches
+// any subdomain.
+func originMatches(pattern, origin string) bool {
+	u, err := url.Parse(pattern)
+	if err != nil {
+		return false
+	}
+	if domain, ok := strings.CutPrefix(u.Host, "*."); ok {
+		host, ok := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(u.Scheme)+"://")
+		return ok && strings.HasSuffix(host, "."+strings.ToLower(domain))
+	}
+	return strings.EqualFold(u.Scheme+"://"+u.Host, origin)
+}
+
+// validateOrigin checks an allowed origin, as given to option
+func validateOrigin(option, pattern string) error {
+	if pattern == "*" {
+		return nil
+	}
+	u, err := url.Parse(pattern)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return fmt.Errorf("invalid %s %q, expected * or a scheme and host such as https://example.com", option, pattern)
+	}
+	return nil
+}
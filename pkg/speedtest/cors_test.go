@@ -0,0 +1,72 @@
+package speedtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginMatches(t *testing.T) {
+	tests := []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://app.example.com", "HTTPS://App.Example.com", true},
+		{"https://app.example.com", "http://app.example.com", false},
+		{"https://app.example.com", "https://app.example.com:8443", false},
+		{"https://app.example.com:8443", "https://app.example.com:8443", true},
+		{"https://app.example.com", "https://app.example.com.evil.com", false},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evilexample.com", false},
+		{"https://*.example.com", "http://app.example.com", false},
+		{"https://*.example.com", "https://app.example.com.evil.com", false},
+		{"https://app.example.com", "", false},
+		{"https://app.example.com", "null", false},
+	}
+	for _, tt := range tests {
+		if got := originMatches(tt.pattern, tt.origin); got != tt.want {
+			t.Errorf("originMatches(%q, %q) = %v, want %v", tt.pattern, tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestAllowCrossOrigin(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		crossOrigin bool
+		origin      string
+		allow       string // Expected Access-Control-Allow-Origin
+		vary        bool   // Whether Vary: Origin is expected
+	}{
+		{"nothing configured", nil, false, "https://app.example.com", "", false},
+		{"any origin", nil, true, "https://app.example.com", "*", false},
+		{"listed origin", []string{"https://app.example.com"}, false, "https://app.example.com", "https://app.example.com", true},
+		{"other origin", []string{"https://app.example.com"}, true, "https://evil.com", "", true},
+		{"no origin", []string{"https://app.example.com"}, false, "", "", true},
+		{"wildcard listed", []string{"*"}, false, "https://evil.com", "*", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			s.cfg.CORSOrigins, s.cfg.CrossOrigin = tt.origins, tt.crossOrigin
+
+			r := httptest.NewRequest("GET", "/api/v1/ping", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			s.allowCrossOrigin(func(http.ResponseWriter, *http.Request) {})(w, r)
+
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allow)
+			}
+			if vary := w.Header().Get("Vary") == "Origin"; vary != tt.vary {
+				t.Errorf("Vary: Origin sent = %v, want %v", vary, tt.vary)
+			}
+		})
+	}
+}
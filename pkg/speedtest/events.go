@@ -0,0 +1,144 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionEventInterval = 250 * time.Millisecond // How often progress events are sent during transfers
+	sessionKeepAlive     = 15 * time.Second       // Idle streams get a comment this often, so proxies keep them open
+)
+
+// Phases of a test session, as reported in its events
+const (
+	phaseIdle     = "idle"
+	phaseProbe    = "probe"
+	phaseDownload = "download"
+	phaseUpload   = "upload"
+)
+
+// directionProgress is one direction of a progress event
+type directionProgress struct {
+	Bytes         int64   `json:"bytes"`
+	ActiveStreams int     `json:"active_streams"`
+	Mbps          float64 `json:"mbps"` // Rate since the previous progress event
+}
+
+// sessionProgress is the data of a progress event
+type sessionProgress struct {
+	Phase    string            `json:"phase"`
+	Download directionProgress `json:"download"`
+	Upload   directionProgress `json:"upload"`
+}
+
+// progressSnapshot is a consistent view of a session's transfers
+type progressSnapshot struct {
+	phase    string
+	at       time.Time
+	download transferStats
+	upload   transferStats
+}
+
+// snapshot captures the session's phase and transfer counters
+func (s *testSession) snapshot() progressSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	phase := phaseIdle
+	switch {
+	case s.probe.active > 0:
+		phase = phaseProbe
+	case s.download.active > 0:
+		phase = phaseDownload
+	case s.upload.active > 0:
+		phase = phaseUpload
+	}
+	return progressSnapshot{phase: phase, at: time.Now(), download: s.download, upload: s.upload}
+}
+
+// progressSince turns two snapshots into a progress event
+func (p progressSnapshot) progressSince(prev progressSnapshot) sessionProgress {
+	secs := p.at.Sub(prev.at).Seconds()
+	rate := func(cur, old transferStats) directionProgress {
+		dp := directionProgress{Bytes: cur.bytes, ActiveStreams: cur.active}
+		if secs > 0 {
+			dp.Mbps = float64(cur.bytes-old.bytes) * 8 / secs / 1e6
+		}
+		return dp
+	}
+	return sessionProgress{
+		Phase:    p.phase,
+		Download: rate(p.download, prev.download),
+		Upload:   rate(p.upload, prev.upload),
+	}
+}
+
+// handleSessionEvents streams a session's progress as server-sent events
+// (GET /api/session/{id}/events): a phase event whenever the session moves
+// between idle, probe, download and upload, progress events with the bytes
+// and rate the server measured while transfers run, and an end event once
+// the session is gone
+func (s *Server) handleSessionEvents(w http.ResponseWriter, r *http.Request, session *testSession) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(sessionEventInterval)
+	defer ticker.Stop()
+
+	prev := session.snapshot()
+	lastPhase := ""
+	lastWrite := time.Now()
+	for {
+		cur := session.snapshot()
+		var err error
+		if cur.phase != lastPhase {
+			err = writeEvent(w, "phase", map[string]string{"phase": cur.phase})
+			lastPhase = cur.phase
+			lastWrite = cur.at
+		}
+		if err == nil && cur.phase != phaseIdle {
+			err = writeEvent(w, "progress", cur.progressSince(prev))
+			lastWrite = cur.at
+		}
+		if err == nil && cur.at.Sub(lastWrite) >= sessionKeepAlive {
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			lastWrite = cur.at
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+		prev = cur
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if _, ok := s.sessions.get(session.id); !ok {
+			writeEvent(w, "end", map[string]string{"session": session.id})
+			rc.Flush()
+			return
+		}
+	}
+}
+
+// writeEvent writes one server-sent event with data encoded as JSON
+func writeEvent(w http.ResponseWriter, name string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload)
+	return err
+}
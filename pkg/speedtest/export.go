@@ -0,0 +1,171 @@
+package speedtest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// csvHeader lists the columns written by the CSV export
+var csvHeader = []string{
+	"timestamp",
+	"client_ip",
+	"user_agent",
+	"session_id",
+	"server",
+	"download_mbps",
+	"upload_mbps",
+	"latency_ms",
+	"jitter_ms",
+	"rpm",
+	"server_download_mbps",
+	"server_upload_mbps",
+	"download_latency_ms",
+	"upload_latency_ms",
+	"bufferbloat_grade",
+	"country",
+	"city",
+	"latitude",
+	"longitude",
+	"asn",
+	"isp",
+	"id",
+	"segment",
+	"agent",
+	"latency_p50_ms",
+	"latency_p95_ms",
+	"latency_p99_ms",
+	"loss",
+	"quality_score",
+	"mos",
+}
+
+// csvRecord converts a result to a CSV row matching csvHeader
+func csvRecord(res testResult) []string {
+	formatFloat := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	var country, city, lat, lon string
+	if loc := res.Location; loc != nil {
+		country, city = loc.CountryCode, loc.City
+		lat, lon = formatFloat(loc.Latitude), formatFloat(loc.Longitude)
+	}
+	var downloadLatency, uploadLatency, grade string
+	if bb := res.Bufferbloat; bb != nil {
+		downloadLatency, uploadLatency, grade = formatFloat(bb.Download), formatFloat(bb.Upload), bb.Grade
+	}
+	// Idle round trips measured by the server
+	var p50, p95, p99 string
+	if ls := res.LatencyStats; ls != nil && ls.Idle != nil {
+		p50, p95, p99 = formatFloat(ls.Idle.P50), formatFloat(ls.Idle.P95), formatFloat(ls.Idle.P99)
+	}
+	var loss, quality, mos string
+	if res.Loss != nil {
+		loss = formatFloat(*res.Loss)
+	}
+	if res.Quality != nil {
+		quality = strconv.Itoa(res.Quality.Score)
+	}
+	if res.VoIP != nil {
+		mos = formatFloat(res.VoIP.MOS)
+	}
+	var asn, isp string
+	if res.ISP != nil {
+		asn, isp = strconv.FormatUint(uint64(res.ISP.ASN), 10), res.ISP.Name
+	}
+	return []string{
+		res.Timestamp.Format(time.RFC3339),
+		res.ClientIP,
+		res.UserAgent,
+		res.SessionID,
+		res.Server,
+		formatFloat(res.Download),
+		formatFloat(res.Upload),
+		formatFloat(res.Latency),
+		formatFloat(res.Jitter),
+		formatFloat(res.RPM),
+		formatFloat(res.ServerDownload),
+		formatFloat(res.ServerUpload),
+		downloadLatency,
+		uploadLatency,
+		grade,
+		country,
+		city,
+		lat,
+		lon,
+		asn,
+		isp,
+		res.ID,
+		res.Segment,
+		res.Agent,
+		p50,
+		p95,
+		p99,
+		loss,
+		quality,
+		mos,
+	}
+}
+
+// handleResultsExport streams the stored result history as CSV or JSON Lines.
+// The from, to and ip filters of /api/results are supported; pagination is not.
+func (s *Server) handleResultsExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, err := parseResultFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Limit, f.Offset, f.Ascending = 0, 0, true
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "jsonl" {
+		http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	all, _, err := s.results.query(f)
+	if err != nil {
+		s.log("results").Error("Reading results failed", "err", err)
+		http.Error(w, "Could not read results", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="speedtest-results.csv"`)
+
+		cw := csv.NewWriter(w)
+		cw.Write(csvHeader)
+		for _, res := range all {
+			if err := cw.Write(csvRecord(res)); err != nil {
+				s.log("results").Warn("Writing CSV export failed", "err", err)
+				return
+			}
+		}
+		cw.Flush()
+
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="speedtest-results.jsonl"`)
+
+		enc := json.NewEncoder(w)
+		for _, res := range all {
+			if err := enc.Encode(res); err != nil {
+				s.log("results").Warn("Writing JSONL export failed", "err", err)
+				return
+			}
+		}
+	}
+}
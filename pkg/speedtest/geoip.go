@@ -0,0 +1,120 @@
+package speedtest
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoLocation is the approximate location of a client IP
+type geoLocation struct {
+	Country        string  `json:"country,omitempty"`      // English country name
+	CountryCode    string  `json:"country_code,omitempty"` // ISO 3166-1 alpha-2
+	City           string  `json:"city,omitempty"`
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
+	AccuracyRadius uint16  `json:"accuracy_radius_km,omitempty"`
+}
+
+// ispInfo identifies the network a client IP belongs to
+type ispInfo struct {
+	ASN  uint   `json:"asn"`
+	Name string `json:"name"` // Organization registered for the AS
+}
+
+// geoIPReader looks up client locations and networks in MaxMind
+// GeoLite2/GeoIP2 City and ASN databases
+type geoIPReader struct {
+	city   *geoip2.Reader
+	asn    *geoip2.Reader
+	logger *slog.Logger // Receives failed lookups
+}
+
+// openGeoIP opens the configured databases. Empty paths disable the
+// corresponding lookups.
+func openGeoIP(gc GeoIPConfig, logger *slog.Logger) (*geoIPReader, error) {
+	g := &geoIPReader{logger: logger}
+	var err error
+	if gc.CityDB != "" {
+		if g.city, err = geoip2.Open(gc.CityDB); err != nil {
+			return nil, fmt.Errorf("opening GeoIP city database: %w", err)
+		}
+	}
+	if gc.ASNDB != "" {
+		if g.asn, err = geoip2.Open(gc.ASNDB); err != nil {
+			g.close()
+			return nil, fmt.Errorf("opening GeoIP ASN database: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// close closes the open databases
+func (g *geoIPReader) close() {
+	if g == nil {
+		return
+	}
+	if g.city != nil {
+		g.city.Close()
+	}
+	if g.asn != nil {
+		g.asn.Close()
+	}
+}
+
+// locate returns the location of ip, or nil when it is unknown
+func (g *geoIPReader) locate(ip string) *geoLocation {
+	if g == nil || g.city == nil {
+		return nil
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+
+	rec, err := g.city.City(addr)
+	if err != nil {
+		g.logger.Warn("GeoIP lookup failed", "ip", ip, "err", err)
+		return nil
+	}
+	// Private and unlisted addresses come back as empty records
+	if rec.Country.IsoCode == "" && rec.City.GeoNameID == 0 {
+		return nil
+	}
+
+	return &geoLocation{
+		Country:        rec.Country.Names["en"],
+		CountryCode:    rec.Country.IsoCode,
+		City:           rec.City.Names["en"],
+		Latitude:       rec.Location.Latitude,
+		Longitude:      rec.Location.Longitude,
+		AccuracyRadius: rec.Location.AccuracyRadius,
+	}
+}
+
+// isp returns the autonomous system of ip, or nil when it is unknown
+func (g *geoIPReader) isp(ip string) *ispInfo {
+	if g == nil || g.asn == nil {
+		return nil
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+
+	rec, err := g.asn.ASN(addr)
+	if err != nil {
+		g.logger.Warn("ASN lookup failed", "ip", ip, "err", err)
+		return nil
+	}
+	if rec.AutonomousSystemNumber == 0 {
+		return nil
+	}
+
+	return &ispInfo{
+		ASN:  rec.AutonomousSystemNumber,
+		Name: rec.AutonomousSystemOrganization,
+	}
+}
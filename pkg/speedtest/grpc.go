@@ -0,0 +1,395 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/infobits-io/infobits-speedtest/pkg/speedtestpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const grpcMaxChunk = 1 << 20 // Largest download chunk sent per message, well below gRPC's 4 MiB message limit
+
+// grpcService implements the gRPC API on top of the server's sessions,
+// admission control and result store
+type grpcService struct {
+	speedtestpb.UnimplementedSpeedtestServer
+	s *Server
+}
+
+// startGRPC listens for gRPC clients, over TLS when a certificate is
+// configured
+func (s *Server) startGRPC() error {
+	var opts []grpc.ServerOption
+	if s.cfg.TLS.Enabled() {
+		creds, err := credentials.NewServerTLSFromFile(s.cfg.TLS.Cert, s.cfg.TLS.Key)
+		if err != nil {
+			return fmt.Errorf("loading gRPC TLS certificate: %w", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	addr := net.JoinHostPort(s.cfg.BindHost(), strconv.Itoa(s.cfg.GRPC.Port))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening on gRPC port %d: %w", s.cfg.GRPC.Port, err)
+	}
+	s.grpcServer = grpc.NewServer(opts...)
+	speedtestpb.RegisterSpeedtestServer(s.grpcServer, &grpcService{s: s})
+	reflection.Register(s.grpcServer) // Lets tools like grpcurl discover the service
+	s.log("grpc").Info("Starting gRPC listener", "addr", ln.Addr().String(), "tls", s.cfg.TLS.Enabled())
+	go func() {
+		if err := s.grpcServer.Serve(ln); err != nil {
+			s.log("grpc").Error("gRPC listener stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// grpcClientIP returns the address of the gRPC peer
+func grpcClientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// admitGRPC admits a test like admitTest does for HTTP, answering with
+// ResourceExhausted when the server is busy or the client over its rate
+// limit. Admitted tests must call releaseTest.
+func (s *Server) admitGRPC(ip string) error {
+	if s.slots != nil {
+		if ok, _ := s.slots.acquire(ip); !ok {
+			testsQueued.Inc()
+			return status.Error(codes.ResourceExhausted, "Server busy")
+		}
+	}
+	if s.limiter != nil {
+		if ok, _ := s.limiter.allow(ip); !ok {
+			s.releaseTest()
+			rateLimited.Inc()
+			return status.Errorf(codes.ResourceExhausted, "Rate limit of %d tests per hour exceeded", s.cfg.RateLimit.TestsPerHour)
+		}
+	}
+	return nil
+}
+
+// grpcStream is one gRPC download or upload, counted toward its session
+// when it names one, or else admitted as a test of its own
+type grpcStream struct {
+	s         *Server
+	direction string
+	session   *testSession
+	stats     *transferStats
+	admitted  bool
+	start     time.Time
+	bytes     int64
+	ip        string
+}
+
+// beginGRPCStream looks up the stream's session or admits it, and records
+// its start
+func (s *Server) beginGRPCStream(ctx context.Context, direction, sessionID string) (*grpcStream, error) {
+	st := &grpcStream{s: s, direction: direction, ip: grpcClientIP(ctx)}
+	if sessionID != "" {
+		var ok bool
+		if st.session, ok = s.sessions.lookup(sessionID, st.ip); !ok {
+			return nil, status.Error(codes.NotFound, "Unknown session")
+		}
+		st.stats = &st.session.download
+		if direction == directionUpload {
+			st.stats = &st.session.upload
+		}
+		// A session that gave up its test slot after idling is admitted again
+		if !st.session.hasSlot() {
+			if err := s.admitGRPC(st.ip); err != nil {
+				return nil, err
+			}
+			s.sessions.reclaimSlot(st.session)
+		}
+		if err := st.session.beginStream(st.stats); err == errSessionUsedUp {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		} else if err != nil {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+	} else {
+		if err := s.grpcToken(ctx, st.ip); err != nil {
+			return nil, err
+		}
+		if err := s.admitGRPC(st.ip); err != nil {
+			return nil, err
+		}
+		st.admitted = true
+	}
+	st.start = time.Now()
+	s.transferStarted(direction)
+	return st, nil
+}
+
+// add accounts for n bytes moved
+func (st *grpcStream) add(n int) {
+	st.bytes += int64(n)
+	if st.session != nil {
+		st.session.addBytes(st.stats, n)
+	}
+	st.s.transferBytes(st.direction, n)
+}
+
+// finish records the end of the stream and frees its test slot
+func (st *grpcStream) finish(completed bool) {
+	if st.session != nil {
+		st.session.endStream(st.stats)
+	}
+	if st.admitted {
+		st.s.releaseTest()
+	}
+	st.s.transferFinished(st.s.log("test").With("client_ip", st.ip, "transport", "grpc"), st.direction, st.bytes, time.Since(st.start), completed)
+}
+
+// grpcDuration checks a requested test duration against max_duration
+func (s *Server) grpcDuration(seconds float64) (time.Duration, error) {
+	d := time.Duration(seconds * float64(time.Second))
+	if d < 0 {
+		return 0, status.Error(codes.InvalidArgument, "Invalid duration")
+	}
+	if d > time.Duration(s.cfg.MaxDuration)*time.Second {
+		return 0, status.Error(codes.InvalidArgument, "Duration exceeds limit")
+	}
+	return d, nil
+}
+
+func (g *grpcService) StartTest(ctx context.Context, req *speedtestpb.StartTestRequest) (*speedtestpb.StartTestResponse, error) {
+	s := g.s
+	streams := int(req.Streams)
+	if streams == 0 {
+		streams = 1
+	}
+	if streams < 0 || streams > maxStreamsPerSession {
+		return nil, status.Error(codes.InvalidArgument, "Invalid streams")
+	}
+
+	ip := grpcClientIP(ctx)
+	if err := s.grpcToken(ctx, ip); err != nil {
+		return nil, err
+	}
+	if err := s.admitGRPC(ip); err != nil {
+		return nil, err
+	}
+	session, err := s.sessions.create(streams, ip, true)
+	if err != nil {
+		s.releaseTest()
+		s.log("grpc").Error("Creating session failed", "err", err)
+		return nil, status.Error(codes.Internal, "Could not create session")
+	}
+	sessionsCreated.Inc()
+
+	nonce, _, err := s.resultNonces.issue(resultNonceSubject(ip, session.id))
+	if err != nil {
+		s.log("grpc").Error("Issuing result nonce failed", "err", err)
+	}
+	return &speedtestpb.StartTestResponse{SessionId: session.id, Streams: int32(streams), ResultNonce: nonce}, nil
+}
+
+func (g *grpcService) StreamDownload(req *speedtestpb.StreamDownloadRequest, stream speedtestpb.Speedtest_StreamDownloadServer) error {
+	s := g.s
+	duration, err := s.grpcDuration(req.DurationSeconds)
+	if err != nil {
+		return err
+	}
+	limit := s.cfg.MaxDownloadSize
+	if req.Size < 0 {
+		return status.Error(codes.InvalidArgument, "Invalid size")
+	}
+	if req.Size > 0 {
+		limit = min(req.Size, limit)
+	} else if duration == 0 {
+		duration = wsTransferDuration
+	}
+
+	ctx := stream.Context()
+	st, err := s.beginGRPCStream(ctx, directionDownload, req.SessionId)
+	if err != nil {
+		return err
+	}
+	completed := false
+	defer func() { st.finish(completed) }()
+
+	chunk := min(s.cfg.ChunkSize, grpcMaxChunk)
+	for (duration == 0 || time.Since(st.start) < duration) && st.bytes < limit {
+		size := int(min(int64(chunk), limit-st.bytes))
+		if err := s.waitBandwidth(ctx, directionDownload, size); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		err := stream.Send(&speedtestpb.DownloadChunk{
+			Data:      s.random.chunk(size),
+			Bytes:     st.bytes + int64(size),
+			ElapsedMs: float64(time.Since(st.start).Microseconds()) / 1000,
+		})
+		if err != nil {
+			return err
+		}
+		st.add(size)
+	}
+	completed = true
+	return nil
+}
+
+func (g *grpcService) StreamUpload(stream speedtestpb.Speedtest_StreamUploadServer) error {
+	s := g.s
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "Empty upload")
+	}
+	if err != nil {
+		return err
+	}
+	duration, err := s.grpcDuration(first.DurationSeconds)
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	st, err := s.beginGRPCStream(ctx, directionUpload, first.SessionId)
+	if err != nil {
+		return err
+	}
+	completed := false
+	defer func() { st.finish(completed) }()
+
+	msg := first
+	for {
+		n := len(msg.Data)
+		if err := s.waitBandwidth(ctx, directionUpload, n); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		st.add(n)
+		// Like /upload, a timed upload is bounded by time alone
+		if (duration == 0 && st.bytes >= s.cfg.MaxFileSize) || (duration > 0 && time.Since(st.start) >= duration) {
+			break
+		}
+		if msg, err = stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	completed = true
+
+	elapsed := time.Since(st.start)
+	summary := &speedtestpb.UploadSummary{Bytes: st.bytes, ElapsedMs: float64(elapsed.Microseconds()) / 1000}
+	if secs := elapsed.Seconds(); secs > 0 {
+		summary.Mbps = float64(st.bytes) * 8 / secs / 1e6
+	}
+	return stream.SendAndClose(summary)
+}
+
+// grpcAPIKey checks the x-api-key metadata like checkAPIKey checks the
+// header. Without configured keys every call is refused.
+func (s *Server) grpcAPIKey(ctx context.Context) error {
+	if len(s.cfg.APIKeys) == 0 {
+		return status.Error(codes.PermissionDenied, "API keys are not configured")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range md.Get("x-api-key") {
+		if s.validKey(key) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "Valid API key required")
+}
+
+// grpcToken redeems the test token in the x-speedtest-token metadata like
+// checkToken does for HTTP, answering with PermissionDenied when it is
+// missing or invalid. Always succeeds when tokens are not required.
+func (s *Server) grpcToken(ctx context.Context, ip string) error {
+	if s.tokens == nil {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get("x-speedtest-token")
+	if len(tokens) == 0 || tokens[0] == "" {
+		return status.Error(codes.PermissionDenied, "Test token required")
+	}
+	if err := s.tokens.redeem(tokens[0], ip); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+func (g *grpcService) GetResults(ctx context.Context, req *speedtestpb.GetResultsRequest) (*speedtestpb.GetResultsResponse, error) {
+	s := g.s
+	if err := s.grpcAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	f := resultFilter{IP: req.Ip, Limit: int(req.Limit), Offset: int(req.Offset), Ascending: req.Ascending}
+	if f.Limit == 0 {
+		f.Limit = defaultResultsLimit
+	}
+	if f.Limit < 0 || f.Limit > maxResultsLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", maxResultsLimit)
+	}
+	if f.Offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset cannot be negative")
+	}
+	if req.From != nil {
+		f.From = req.From.AsTime()
+	}
+	if req.To != nil {
+		f.To = req.To.AsTime()
+	}
+
+	page, total, err := s.results.query(f)
+	if err != nil {
+		s.log("results").Error("Reading results failed", "err", err)
+		return nil, status.Error(codes.Internal, "Could not read results")
+	}
+	resp := &speedtestpb.GetResultsResponse{Total: int32(total)}
+	for _, res := range page {
+		resp.Results = append(resp.Results, resultProto(res))
+	}
+	return resp, nil
+}
+
+// resultProto converts a stored result to its gRPC message
+func resultProto(res testResult) *speedtestpb.Result {
+	pb := &speedtestpb.Result{
+		Id:                 res.ID,
+		Timestamp:          timestamppb.New(res.Timestamp),
+		ClientIp:           res.ClientIP,
+		UserAgent:          res.UserAgent,
+		Server:             res.Server,
+		DownloadMbps:       res.Download,
+		UploadMbps:         res.Upload,
+		LatencyMs:          res.Latency,
+		JitterMs:           res.Jitter,
+		Rpm:                res.RPM,
+		ServerDownloadMbps: res.ServerDownload,
+		ServerUploadMbps:   res.ServerUpload,
+		Segment:            res.Segment,
+		Agent:              res.Agent,
+	}
+	if res.Location != nil {
+		pb.Country, pb.City = res.Location.CountryCode, res.Location.City
+	}
+	if res.ISP != nil {
+		pb.Asn, pb.Isp = uint32(res.ISP.ASN), res.ISP.Name
+	}
+	return pb
+}
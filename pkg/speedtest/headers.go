@@ -0,0 +1,95 @@
+package speedtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// setSecurityHeaders adds the security headers of the web UI's pages and
+// static files: HSTS over HTTPS, a Content-Security-Policy, framing rules
+// and the referrer policy
+func (s *Server) setSecurityHeaders(w http.ResponseWriter, r *http.Request) {
+	s.setFramedHeaders(w, r, s.cfg.Headers.AllowEmbed)
+}
+
+// setFramedHeaders adds the security headers for a page the origins in
+// ancestors may show in a frame; none may when it is empty
+func (s *Server) setFramedHeaders(w http.ResponseWriter, r *http.Request, ancestors []string) {
+	hc := s.cfg.Headers
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	if r.TLS != nil && hc.HSTSMaxAge > 0 {
+		h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", hc.HSTSMaxAge))
+	}
+	if hc.ReferrerPolicy != "" {
+		h.Set("Referrer-Policy", hc.ReferrerPolicy)
+	}
+	// X-Frame-Options cannot list origins, so with embedding allowed only
+	// the CSP's frame-ancestors applies
+	if len(ancestors) == 0 {
+		h.Set("X-Frame-Options", "DENY")
+	}
+	switch hc.CSP {
+	case "off":
+	case "":
+		h.Set("Content-Security-Policy", s.defaultCSP(ancestors))
+	default:
+		h.Set("Content-Security-Policy", hc.CSP)
+	}
+}
+
+// withSecurityHeaders adds the web UI's security headers to every response
+// of next
+func (s *Server) withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.setSecurityHeaders(w, r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// defaultCSP returns a policy allowing the web UI's own scripts, styles and
+// images plus the branding logo, connections to this server, its peers and
+// its dual-stack hosts, and framing by ancestors. Inline styles are allowed
+// since the pages toggle sections with style attributes.
+func (s *Server) defaultCSP(ancestors []string) string {
+	connect := []string{"'self'"}
+	urls := []string{s.cfg.DualStack.IPv4URL, s.cfg.DualStack.IPv6URL}
+	for _, peer := range s.cfg.Servers {
+		urls = append(urls, peer.URL)
+	}
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Host == "" {
+			continue
+		}
+		// Tests against a peer use its WebSocket channels too
+		ws := "ws"
+		if parsed.Scheme == "https" {
+			ws = "wss"
+		}
+		connect = append(connect, parsed.Scheme+"://"+parsed.Host, ws+"://"+parsed.Host)
+	}
+
+	img := "img-src 'self' data:"
+	if origin := s.cfg.Branding.logoOrigin(); origin != "" {
+		img += " " + origin
+	}
+
+	frame := "'none'"
+	if len(ancestors) > 0 {
+		frame = strings.Join(ancestors, " ")
+	}
+	return strings.Join([]string{
+		"default-src 'self'",
+		"script-src 'self'",
+		"style-src 'self' 'unsafe-inline'",
+		img,
+		"connect-src " + strings.Join(connect, " "),
+		"frame-ancestors " + frame,
+		"object-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+	}, "; ")
+}
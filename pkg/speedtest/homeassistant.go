@@ -0,0 +1,90 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"regexp"
+)
+
+// haUnsafeID matches characters Home Assistant does not allow in discovery
+// node and object IDs
+var haUnsafeID = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// haDevice groups the sensors under one device in Home Assistant
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// haSensorConfig is a Home Assistant MQTT discovery message for one sensor, see
+// https://www.home-assistant.io/integrations/sensor.mqtt/
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	UnitOfMeasurement string   `json:"unit_of_measurement"`
+	DeviceClass       string   `json:"device_class"`
+	StateClass        string   `json:"state_class"`
+	Icon              string   `json:"icon,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// haSensors lists the sensors announced to Home Assistant, read from the
+// result messages on the results topic
+var haSensors = []struct {
+	key, name, field, unit, deviceClass, icon string
+}{
+	{"download", "Download", "download", "Mbit/s", "data_rate", "mdi:download"},
+	{"upload", "Upload", "upload", "Mbit/s", "data_rate", "mdi:upload"},
+	{"ping", "Ping", "latency", "ms", "duration", "mdi:timer-outline"},
+}
+
+// discoveryMessages builds the retained discovery messages that make Home
+// Assistant create download, upload and ping sensors for the results topic
+func (p *mqttPublisher) discoveryMessages() ([]mqttMessage, error) {
+	node := haUnsafeID.ReplaceAllString(p.cfg.ClientID, "_")
+	device := haDevice{
+		Identifiers:  []string{node},
+		Name:         "Infobits Speed Test",
+		Manufacturer: "Infobits",
+		Model:        "infobits-speedtest",
+	}
+
+	var msgs []mqttMessage
+	for _, sensor := range haSensors {
+		payload, err := json.Marshal(haSensorConfig{
+			Name:              sensor.name,
+			UniqueID:          node + "_" + sensor.key,
+			StateTopic:        p.cfg.Topic,
+			ValueTemplate:     "{{ value_json." + sensor.field + " | round(2) }}",
+			UnitOfMeasurement: sensor.unit,
+			DeviceClass:       sensor.deviceClass,
+			StateClass:        "measurement",
+			Icon:              sensor.icon,
+			Device:            device,
+		})
+		if err != nil {
+			return nil, err
+		}
+		topic := p.cfg.DiscoveryPrefix + "/sensor/" + node + "/" + sensor.key + "/config"
+		msgs = append(msgs, mqttMessage{topic, payload, true})
+	}
+	return msgs, nil
+}
+
+// announceDiscovery publishes the Home Assistant discovery messages in the
+// background. They are retained, so Home Assistant finds them whenever it
+// (re)connects to the broker.
+func (p *mqttPublisher) announceDiscovery() {
+	if p == nil || !p.cfg.Discovery {
+		return
+	}
+	msgs, err := p.discoveryMessages()
+	if err != nil {
+		p.logger.Error("Encoding Home Assistant discovery messages failed", "err", err)
+		return
+	}
+	p.sendAsync(msgs)
+}
@@ -0,0 +1,141 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	localeDir       = "locales" // Directory of the web UI holding one <lang>.json per language
+	defaultLanguage = "en"      // Served when no preferred language is available, and fills gaps in others
+)
+
+// localeResponse is the body of /api/locale
+type localeResponse struct {
+	Lang      string            `json:"lang"`
+	Languages []localeLanguage  `json:"languages"` // Every language available, for a language picker
+	Messages  map[string]string `json:"messages"`
+}
+
+// localeLanguage names an available language in that language
+type localeLanguage struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+// handleLocale serves the web UI's messages in the language asked for with
+// ?lang=, or else the best match for the browser's Accept-Language. Messages
+// missing from a translation fall back to English.
+func (s *Server) handleLocale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	locales := s.loadLocales()
+	codes := make([]string, 0, len(locales))
+	for code := range locales {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	lang := pickLanguage(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language"), codes)
+	resp := localeResponse{Lang: lang, Messages: map[string]string{}}
+	for _, code := range []string{defaultLanguage, lang} {
+		for key, text := range locales[code] {
+			resp.Messages[key] = text
+		}
+	}
+	for _, code := range codes {
+		resp.Languages = append(resp.Languages, localeLanguage{Code: code, Name: locales[code]["language.name"]})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("Vary", "Accept-Language")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// loadLocales reads every locale file of the web UI, keyed by language code.
+// They are read on each request so edits under -static-dir show up at once.
+func (s *Server) loadLocales() map[string]map[string]string {
+	locales := map[string]map[string]string{}
+	files, _ := fs.Glob(s.webFS, localeDir+"/*.json")
+	for _, file := range files {
+		data, err := fs.ReadFile(s.webFS, file)
+		if err != nil {
+			continue
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			s.log("http").Warn("Skipping invalid locale file", "file", file, "err", err)
+			continue
+		}
+		locales[strings.ToLower(strings.TrimSuffix(path.Base(file), ".json"))] = messages
+	}
+	return locales
+}
+
+// pickLanguage returns the requested language when it is available, or else
+// the available language the Accept-Language header prefers most. Languages
+// match on their full tag first and then on the primary subtag, so de-AT
+// gets de.
+func pickLanguage(requested, acceptLanguage string, available []string) string {
+	match := func(tag string) string {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		base, _, _ := strings.Cut(tag, "-")
+		for _, candidate := range []string{tag, base} {
+			for _, code := range available {
+				if code == candidate {
+					return code
+				}
+			}
+		}
+		return ""
+	}
+
+	if lang := match(requested); lang != "" {
+		return lang
+	}
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		if lang := match(tag); lang != "" {
+			return lang
+		}
+	}
+	return defaultLanguage
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language header,
+// most preferred first, leaving out * and refused (q=0) tags
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag == "" || tag == "*" || q <= 0 {
+			continue
+		}
+		tags = append(tags, weighted{tag, q})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	out := make([]string, len(tags))
+	for i, t := range tags {
+		out[i] = t.tag
+	}
+	return out
+}
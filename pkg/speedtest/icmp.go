@@ -0,0 +1,111 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const icmpReplyTimeout = time.Second // Echo requests unanswered this long count as lost
+
+// errICMPUnavailable means the client may not send ICMP echo requests, which
+// usually takes root, CAP_NET_RAW or a matching net.ipv4.ping_group_range
+var errICMPUnavailable = errors.New("ICMP ping needs raw socket privileges")
+
+// measureICMPPings measures round trips of ICMP echo requests to the server
+// host. Unlike HTTP pings they leave out the TCP stack and server, showing
+// the network latency alone. Lost echoes are left out.
+func (c *Client) measureICMPPings(ctx context.Context) ([]float64, error) {
+	u, err := url.Parse(c.base)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address for %s", u.Hostname())
+	}
+	ip := addrs[0].IP
+
+	conn, dst, err := listenICMP(ip)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	echoType, replyType, proto := icmp.Type(ipv4.ICMPTypeEcho), icmp.Type(ipv4.ICMPTypeEchoReply), 1
+	if ip.To4() == nil {
+		echoType, replyType, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, 58
+	}
+
+	id := os.Getpid() & 0xffff
+	payload := []byte("infobits-speedtest")
+	reply := make([]byte, 1500)
+	var rtts []float64
+	for seq := 0; seq < clientPings; seq++ {
+		if ctx.Err() != nil {
+			return rtts, ctx.Err()
+		}
+
+		msg, _ := (&icmp.Message{
+			Type: echoType,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: payload},
+		}).Marshal(nil)
+		start := time.Now()
+		if _, err := conn.WriteTo(msg, dst); err != nil {
+			return rtts, err
+		}
+
+		// Skip replies to other processes' pings and late replies to our own
+		conn.SetReadDeadline(start.Add(icmpReplyTimeout))
+		for {
+			n, _, err := conn.ReadFrom(reply)
+			if err != nil {
+				break
+			}
+			m, err := icmp.ParseMessage(proto, reply[:n])
+			if err != nil || m.Type != replyType {
+				continue
+			}
+			// Unprivileged sockets get a kernel-chosen ID, so only the sequence number and payload are checked
+			if echo, ok := m.Body.(*icmp.Echo); ok && echo.Seq == seq && bytes.Equal(echo.Data, payload) {
+				rtts = append(rtts, float64(time.Since(start).Microseconds())/1000)
+				break
+			}
+		}
+		time.Sleep(clientPingDelay)
+	}
+
+	if len(rtts) == 0 {
+		return nil, fmt.Errorf("no ICMP echo replies from %s", ip)
+	}
+	return rtts, nil
+}
+
+// listenICMP opens a socket for pinging ip. Raw sockets need privileges;
+// Linux also allows unprivileged ICMP datagram sockets to permitted groups.
+func listenICMP(ip net.IP) (*icmp.PacketConn, net.Addr, error) {
+	rawNetwork, dgramNetwork, local := "ip4:icmp", "udp4", "0.0.0.0"
+	if ip.To4() == nil {
+		rawNetwork, dgramNetwork, local = "ip6:ipv6-icmp", "udp6", "::"
+	}
+
+	if conn, err := icmp.ListenPacket(rawNetwork, local); err == nil {
+		return conn, &net.IPAddr{IP: ip}, nil
+	}
+	if conn, err := icmp.ListenPacket(dgramNetwork, local); err == nil {
+		return conn, &net.UDPAddr{IP: ip}, nil
+	}
+	return nil, nil, errICMPUnavailable
+}
@@ -0,0 +1,157 @@
+package speedtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const influxTimeout = 10 * time.Second // Limit for writing one result
+
+// influxTagEscaper escapes tag keys and values in line protocol
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxWriter writes finished tests to an InfluxDB v2 bucket, so they can be
+// graphed in existing Influx and Grafana setups
+type influxWriter struct {
+	cfg      InfluxDBConfig
+	writeURL string
+	client   *http.Client
+	logger   *slog.Logger
+	wg       sync.WaitGroup // Writes in flight
+}
+
+// newInfluxWriter returns a writer for cfg, or nil when no URL is configured
+func newInfluxWriter(cfg InfluxDBConfig, logger *slog.Logger) *influxWriter {
+	if cfg.URL == "" {
+		return nil
+	}
+	q := url.Values{}
+	q.Set("org", cfg.Org)
+	q.Set("bucket", cfg.Bucket)
+	q.Set("precision", "ns")
+	return &influxWriter{
+		cfg:      cfg,
+		writeURL: strings.TrimSuffix(cfg.URL, "/") + "/api/v2/write?" + q.Encode(),
+		client:   &http.Client{Timeout: influxTimeout},
+		logger:   logger,
+	}
+}
+
+// influxField is one field of a point, left out unless set
+type influxField struct {
+	key   string
+	value float64
+	set   bool
+}
+
+// line formats a result as one point in InfluxDB line protocol. Where the
+// test ran from becomes tags; the measured values become fields.
+func (w *influxWriter) line(res testResult) string {
+	var b strings.Builder
+	b.WriteString(strings.NewReplacer(",", `\,`, " ", `\ `).Replace(w.cfg.Measurement))
+
+	tag := func(key, value string) {
+		if value != "" {
+			b.WriteString("," + key + "=" + influxTagEscaper.Replace(value))
+		}
+	}
+	// Tags must be sorted by key
+	tag("agent", res.Agent)
+	if res.ISP != nil {
+		tag("asn", strconv.FormatUint(uint64(res.ISP.ASN), 10))
+	}
+	if res.Location != nil {
+		tag("country", res.Location.CountryCode)
+	}
+	if res.ISP != nil {
+		tag("isp", res.ISP.Name)
+	}
+	tag("segment", res.Segment)
+	tag("server", res.Server)
+	if res.Mesh != nil {
+		tag("source", res.Mesh.Source)
+		tag("target", res.Mesh.Target)
+	}
+
+	fields := []influxField{
+		{"download", res.Download, true},
+		{"upload", res.Upload, true},
+		{"latency", res.Latency, true},
+		{"jitter", res.Jitter, true},
+		{"rpm", res.RPM, res.RPM > 0},
+		{"server_download", res.ServerDownload, res.ServerDownload > 0},
+		{"server_upload", res.ServerUpload, res.ServerUpload > 0},
+	}
+	if bb := res.Bufferbloat; bb != nil {
+		fields = append(fields,
+			influxField{"idle_latency", bb.Idle, true},
+			influxField{"download_latency", bb.Download, bb.Download > 0},
+			influxField{"upload_latency", bb.Upload, bb.Upload > 0},
+		)
+	}
+	sep := " "
+	for _, f := range fields {
+		if f.set {
+			b.WriteString(sep + f.key + "=" + strconv.FormatFloat(f.value, 'f', -1, 64))
+			sep = ","
+		}
+	}
+
+	fmt.Fprintf(&b, " %d", res.Timestamp.UnixNano())
+	return b.String()
+}
+
+// write sends a stored result to InfluxDB in the background
+func (w *influxWriter) write(res testResult) {
+	if w == nil {
+		return
+	}
+	body := w.line(res)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		if err := w.post(body); err != nil {
+			w.logger.Warn("Writing result to InfluxDB failed", "err", err)
+		}
+	}()
+}
+
+// post sends line protocol to the write API
+func (w *influxWriter) post(body string) error {
+	req, err := http.NewRequest("POST", w.writeURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.cfg.Token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		// InfluxDB explains rejected writes in a short JSON body
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// wait blocks until writes in flight have finished or timed out
+func (w *influxWriter) wait() {
+	if w != nil {
+		w.wg.Wait()
+	}
+}
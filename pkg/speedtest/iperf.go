@@ -0,0 +1,440 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The iperf3 control protocol, as spoken by iperf3's own server: every
+// connection starts with a cookie identifying the test, the control
+// connection then exchanges single state bytes and length-prefixed JSON,
+// and data streams are further connections carrying the same cookie.
+const (
+	iperfTestStart       = 1
+	iperfTestRunning     = 2
+	iperfTestEnd         = 4
+	iperfParamExchange   = 9
+	iperfCreateStreams   = 10
+	iperfClientTerminate = 12
+	iperfExchangeResults = 13
+	iperfDisplayResults  = 14
+	iperfDone            = 16
+	iperfAccessDenied    = -1
+	iperfServerError     = -2
+)
+
+// iperf3 error numbers the client knows how to describe
+const (
+	iperfErrDuration   = 5  // Test too long
+	iperfErrNumStreams = 6  // Too many parallel streams
+	iperfErrBlockSize  = 7  // Block size too large
+	iperfErrUnimp      = 13 // Not implemented
+)
+
+const (
+	iperfCookieSize     = 37               // 36 characters plus a NUL byte
+	iperfMaxJSONSize    = 1024 * 1024      // Largest params or results message accepted
+	iperfMaxStreams     = 128              // Same limit as iperf3 itself
+	iperfMaxBlockSize   = 1024 * 1024      // Same limit as iperf3 itself
+	iperfDefaultLen     = 128 * 1024       // iperf3's default TCP block size
+	iperfDefaultTime    = 10 * time.Second // iperf3's default test length
+	iperfMaxDuration    = 60 * time.Second // Longest test the server runs
+	iperfSetupTimeout   = 10 * time.Second // How long each setup step may take
+	iperfEndGracePeriod = 5 * time.Second  // How late the client may end the test
+)
+
+// iperfParams are the test parameters sent by the client. Only the ones the
+// server acts on are decoded.
+type iperfParams struct {
+	TCP           bool  `json:"tcp"`
+	UDP           bool  `json:"udp"`
+	SCTP          bool  `json:"sctp"`
+	Time          int   `json:"time"` // Seconds; 0 when the test is bounded by bytes or blocks
+	Bytes         int64 `json:"num"`
+	Blocks        int64 `json:"blockcount"`
+	Parallel      int   `json:"parallel"`
+	Len           int   `json:"len"`    // Block size
+	Window        int   `json:"window"` // Socket buffer size
+	Reverse       bool  `json:"reverse"`
+	Bidirectional bool  `json:"bidirectional"`
+}
+
+// iperfResults is the server's half of the results exchange
+type iperfResults struct {
+	CPUUtilTotal         float64             `json:"cpu_util_total"`
+	CPUUtilUser          float64             `json:"cpu_util_user"`
+	CPUUtilSystem        float64             `json:"cpu_util_system"`
+	SenderHasRetransmits int                 `json:"sender_has_retransmits"`
+	Streams              []iperfStreamResult `json:"streams"`
+}
+
+// iperfStreamResult is what the server measured on one data stream
+type iperfStreamResult struct {
+	ID          int     `json:"id"`
+	Bytes       int64   `json:"bytes"`
+	Retransmits int64   `json:"retransmits"` // -1 when unknown
+	Jitter      float64 `json:"jitter"`
+	Errors      int64   `json:"errors"`
+	Packets     int64   `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+// iperfTest is the test the iperf3 listener is currently running. Like
+// iperf3 itself, the listener runs one test at a time.
+type iperfTest struct {
+	cookie  string
+	streams chan net.Conn // Data connections carrying the test's cookie
+}
+
+// iperfState tracks the test the iperf3 listener is running
+type iperfState struct {
+	mu      sync.Mutex
+	current *iperfTest
+}
+
+// serveIPerf accepts iperf3 control and data connections until the
+// listener is closed
+func (s *Server) serveIPerf() {
+	for {
+		conn, err := s.iperfListener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.log("iperf").Error("iperf3 listener stopped", "err", err)
+			}
+			return
+		}
+		go s.handleIPerfConn(conn)
+	}
+}
+
+// handleIPerfConn reads the cookie of a new connection and either hands it
+// to the running test as a data stream or runs a new test over it
+func (s *Server) handleIPerfConn(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(iperfSetupTimeout))
+	cookie := make([]byte, iperfCookieSize)
+	if _, err := io.ReadFull(conn, cookie); err != nil {
+		conn.Close()
+		return
+	}
+
+	s.iperf.mu.Lock()
+	current := s.iperf.current
+	if current == nil {
+		current = &iperfTest{cookie: string(cookie), streams: make(chan net.Conn, iperfMaxStreams)}
+		s.iperf.current = current
+		s.iperf.mu.Unlock()
+
+		defer func() {
+			s.iperf.mu.Lock()
+			s.iperf.current = nil
+			s.iperf.mu.Unlock()
+
+			// Close streams that arrived too late to be used
+			for {
+				select {
+				case c := <-current.streams:
+					c.Close()
+				default:
+					return
+				}
+			}
+		}()
+		s.runIPerfTest(conn, current)
+		return
+	}
+	s.iperf.mu.Unlock()
+
+	if current.cookie == string(cookie) {
+		select {
+		case current.streams <- conn:
+		default:
+			conn.Close()
+		}
+		return
+	}
+
+	// The server is busy with another client's test
+	writeIPerfState(conn, iperfAccessDenied)
+	conn.Close()
+}
+
+// runIPerfTest runs one test over its control connection
+func (s *Server) runIPerfTest(ctrl net.Conn, t *iperfTest) {
+	defer ctrl.Close()
+	ip, _, _ := net.SplitHostPort(ctrl.RemoteAddr().String())
+	logger := s.log("iperf").With("client_ip", ip)
+
+	if !s.admitIPerf(ctrl, ip) {
+		return
+	}
+	defer s.releaseTest()
+
+	params, err := s.exchangeIPerfParams(ctrl)
+	if err != nil {
+		logger.Warn("iperf3 test refused", "err", err)
+		return
+	}
+
+	if err := writeIPerfState(ctrl, iperfCreateStreams); err != nil {
+		return
+	}
+	streams := make([]net.Conn, 0, params.Parallel)
+	defer func() {
+		for _, c := range streams {
+			c.Close()
+		}
+	}()
+	timeout := time.After(iperfSetupTimeout)
+	for len(streams) < params.Parallel {
+		select {
+		case c := <-t.streams:
+			c.SetDeadline(time.Time{})
+			if tc, ok := c.(*net.TCPConn); ok && params.Window > 0 {
+				tc.SetReadBuffer(params.Window)
+				tc.SetWriteBuffer(params.Window)
+			}
+			streams = append(streams, c)
+		case <-timeout:
+			logger.Warn("iperf3 test timed out waiting for data streams")
+			return
+		}
+	}
+
+	direction := directionUpload
+	if params.Reverse {
+		direction = directionDownload
+	}
+	if writeIPerfState(ctrl, iperfTestStart) != nil || writeIPerfState(ctrl, iperfTestRunning) != nil {
+		return
+	}
+
+	// Move data until the client ends the test on the control connection
+	start := time.Now()
+	s.transferStarted(direction)
+	counts := make([]atomic.Int64, len(streams))
+	var wg sync.WaitGroup
+	for i, c := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.transferIPerf(c, params, direction, &counts[i])
+		}()
+	}
+
+	limit := time.Duration(params.Time) * time.Second
+	if limit == 0 {
+		limit = iperfMaxDuration
+	}
+	ctrl.SetReadDeadline(start.Add(limit + iperfEndGracePeriod))
+	state, err := readIPerfState(ctrl)
+	elapsed := time.Since(start)
+
+	// Unblock the transfers and wait for them to stop
+	for _, c := range streams {
+		c.SetDeadline(time.Now())
+	}
+	wg.Wait()
+
+	var total int64
+	results := iperfResults{Streams: make([]iperfStreamResult, len(streams))}
+	for i, c := range streams {
+		res := iperfStreamResult{
+			ID:          iperfStreamID(i),
+			Bytes:       counts[i].Load(),
+			Retransmits: -1,
+			EndTime:     elapsed.Seconds(),
+		}
+		if direction == directionDownload {
+			if info, _ := readTCPInfo(c); info != nil {
+				res.Retransmits = info.TotalRetrans
+				results.SenderHasRetransmits = 1
+			}
+		}
+		results.Streams[i] = res
+		total += res.Bytes
+	}
+	completed := err == nil && state == iperfTestEnd
+	s.transferFinished(logger, direction, total, elapsed, completed)
+
+	if !completed {
+		if err == nil && state != iperfClientTerminate {
+			err = fmt.Errorf("unexpected state %d", state)
+		}
+		if err != nil {
+			logger.Warn("iperf3 test failed", "bytes", total, "duration", elapsed, "err", err)
+		}
+		return
+	}
+	logger.Info("iperf3 test finished",
+		"direction", direction,
+		"streams", len(streams),
+		"bytes", total,
+		"duration", elapsed,
+		"mbps", float64(total)*8/elapsed.Seconds()/1e6,
+	)
+
+	// Swap results, then let the client print them
+	ctrl.SetDeadline(time.Now().Add(iperfSetupTimeout))
+	if err := writeIPerfState(ctrl, iperfExchangeResults); err != nil {
+		return
+	}
+	var clientResults json.RawMessage
+	if err := readIPerfJSON(ctrl, &clientResults); err != nil {
+		return
+	}
+	if writeIPerfJSON(ctrl, results) != nil || writeIPerfState(ctrl, iperfDisplayResults) != nil {
+		return
+	}
+	readIPerfState(ctrl) // iperfDone
+}
+
+// admitIPerf applies the server's concurrency and rate limits to a new
+// iperf3 test, denying access when it may not start
+func (s *Server) admitIPerf(ctrl net.Conn, ip string) bool {
+	if s.slots != nil {
+		if ok, _ := s.slots.acquire(ip); !ok {
+			testsQueued.Inc()
+			writeIPerfState(ctrl, iperfAccessDenied)
+			return false
+		}
+	}
+	if s.limiter != nil {
+		if ok, _ := s.limiter.allow(ip); !ok {
+			s.releaseTest()
+			rateLimited.Inc()
+			writeIPerfState(ctrl, iperfAccessDenied)
+			return false
+		}
+	}
+	return true
+}
+
+// exchangeIPerfParams asks the client for its test parameters and checks
+// that the server can run the test, reporting an error to the client when not
+func (s *Server) exchangeIPerfParams(ctrl net.Conn) (iperfParams, error) {
+	var params iperfParams
+	if err := writeIPerfState(ctrl, iperfParamExchange); err != nil {
+		return params, err
+	}
+	if err := readIPerfJSON(ctrl, &params); err != nil {
+		return params, err
+	}
+
+	if params.Len <= 0 {
+		params.Len = iperfDefaultLen
+	}
+	if params.Parallel <= 0 {
+		params.Parallel = 1
+	}
+	if params.Time <= 0 && params.Bytes <= 0 && params.Blocks <= 0 {
+		params.Time = int(iperfDefaultTime / time.Second)
+	}
+
+	var code int32
+	var err error
+	switch {
+	case params.UDP || params.SCTP || params.Bidirectional:
+		code, err = iperfErrUnimp, errors.New("only TCP tests in one direction are supported")
+	case params.Parallel > iperfMaxStreams:
+		code, err = iperfErrNumStreams, fmt.Errorf("%d parallel streams requested", params.Parallel)
+	case params.Len > iperfMaxBlockSize:
+		code, err = iperfErrBlockSize, fmt.Errorf("block size of %d bytes requested", params.Len)
+	case time.Duration(params.Time)*time.Second > iperfMaxDuration:
+		code, err = iperfErrDuration, fmt.Errorf("%d second test requested", params.Time)
+	}
+	if err != nil && writeIPerfState(ctrl, iperfServerError) == nil {
+		// The error number is followed by an errno, which does not apply
+		msg := make([]byte, 8)
+		binary.BigEndian.PutUint32(msg, uint32(code))
+		ctrl.Write(msg)
+	}
+	return params, err
+}
+
+// transferIPerf sends or receives test data on one stream until its
+// deadline is set, counting the bytes moved
+func (s *Server) transferIPerf(c net.Conn, params iperfParams, direction string, count *atomic.Int64) {
+	if direction == directionDownload {
+		size := min(params.Len, s.cfg.ChunkSize)
+		for {
+			s.waitBandwidth(context.Background(), direction, size)
+			n, err := c.Write(s.random.chunk(size))
+			count.Add(int64(n))
+			s.transferBytes(direction, n)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	buffer := make([]byte, params.Len)
+	for {
+		n, err := c.Read(buffer)
+		count.Add(int64(n))
+		s.transferBytes(direction, n)
+		if err != nil {
+			return
+		}
+		s.waitBandwidth(context.Background(), direction, n)
+	}
+}
+
+// iperfStreamID numbers streams the way iperf3 does: 1, 3, 4, 5, ...
+func iperfStreamID(i int) int {
+	if i == 0 {
+		return 1
+	}
+	return i + 2
+}
+
+// writeIPerfState sends a control state byte
+func writeIPerfState(c net.Conn, state int8) error {
+	_, err := c.Write([]byte{byte(state)})
+	return err
+}
+
+// readIPerfState reads a control state byte
+func readIPerfState(c net.Conn) (int8, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return 0, err
+	}
+	return int8(b[0]), nil
+}
+
+// writeIPerfJSON sends v as JSON prefixed with its big-endian length
+func writeIPerfJSON(c net.Conn, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	_, err = c.Write(append(msg, data...))
+	return err
+}
+
+// readIPerfJSON reads a length-prefixed JSON message into v
+func readIPerfJSON(c net.Conn, v interface{}) error {
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > iperfMaxJSONSize {
+		return fmt.Errorf("%d byte message too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,74 @@
+package speedtest
+
+import "sort"
+
+// latencyHistogramBounds are the upper bounds of the latency histogram's
+// buckets in milliseconds. A last bucket counts everything slower.
+var latencyHistogramBounds = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+// latencyHistogram counts round trips per bucket: Counts[i] holds samples of
+// at most Bounds[i] and more than Bounds[i-1], and the last count those above
+// the last bound
+type latencyHistogram struct {
+	Bounds []float64 `json:"bounds_ms"`
+	Counts []int     `json:"counts"`
+}
+
+// latencyDistribution describes the round trips measured in one test phase
+type latencyDistribution struct {
+	Samples   int              `json:"samples"`
+	Min       float64          `json:"min_ms"`
+	P50       float64          `json:"p50_ms"`
+	P95       float64          `json:"p95_ms"`
+	P99       float64          `json:"p99_ms"`
+	Max       float64          `json:"max_ms"`
+	Histogram latencyHistogram `json:"histogram"`
+}
+
+// latencyReport holds the distribution of a session's server-measured round
+// trips per phase, for phases with samples
+type latencyReport struct {
+	Idle     *latencyDistribution `json:"idle,omitempty"`
+	Download *latencyDistribution `json:"download,omitempty"`
+	Upload   *latencyDistribution `json:"upload,omitempty"`
+}
+
+// report summarizes the session's latency samples, or returns nil before
+// the first one. Must be called with the session lock held.
+func (l *latencySamples) report() *latencyReport {
+	if len(l.idle) == 0 && len(l.download) == 0 && len(l.upload) == 0 {
+		return nil
+	}
+	return &latencyReport{
+		Idle:     distribution(l.idle),
+		Download: distribution(l.download),
+		Upload:   distribution(l.upload),
+	}
+}
+
+// distribution computes percentiles and a histogram of samples, or returns
+// nil when there are none
+func distribution(samples []float64) *latencyDistribution {
+	if len(samples) == 0 {
+		return nil
+	}
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+
+	d := &latencyDistribution{
+		Samples: len(sorted),
+		Min:     sorted[0],
+		P50:     percentile(sorted, 50),
+		P95:     percentile(sorted, 95),
+		P99:     percentile(sorted, 99),
+		Max:     sorted[len(sorted)-1],
+		Histogram: latencyHistogram{
+			Bounds: latencyHistogramBounds,
+			Counts: make([]int, len(latencyHistogramBounds)+1),
+		},
+	}
+	for _, v := range sorted {
+		d.Histogram.Counts[sort.SearchFloat64s(latencyHistogramBounds, v)]++
+	}
+	return d
+}
@@ -0,0 +1,114 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	libreSpeedChunkSize    = 1024 * 1024 // garbage.php sends ckSize chunks of this size
+	libreSpeedDefaultCount = 4
+	libreSpeedMaxCount     = 1024
+)
+
+// libreSpeedCORS sets the headers LibreSpeed's backend sends when a frontend
+// hosted elsewhere adds the cors parameter, for origins corsOrigin allows.
+// It returns false once it has answered a preflight request.
+func (s *Server) libreSpeedCORS(w http.ResponseWriter, r *http.Request) bool {
+	if !r.URL.Query().Has("cors") {
+		return true
+	}
+	h := w.Header()
+	if len(s.cfg.CORSOrigins) > 0 {
+		h.Add("Vary", "Origin")
+	}
+	allow := s.corsOrigin(r)
+	if allow == "" {
+		return true
+	}
+	h.Set("Access-Control-Allow-Origin", allow)
+	h.Set("Access-Control-Allow-Methods", "GET, POST")
+	h.Set("Access-Control-Allow-Headers", "Content-Encoding, Content-Type")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return false
+	}
+	return true
+}
+
+// handleLibreSpeedGarbage serves LibreSpeed's /garbage.php download endpoint.
+// It streams ckSize MiB of test data, capped like any other download.
+func (s *Server) handleLibreSpeedGarbage(w http.ResponseWriter, r *http.Request) {
+	if !s.libreSpeedCORS(w, r) {
+		return
+	}
+
+	// LibreSpeed falls back to the default rather than rejecting bad sizes
+	count := libreSpeedDefaultCount
+	if n, err := strconv.Atoi(r.URL.Query().Get("ckSize")); err == nil && n > 0 {
+		count = min(n, libreSpeedMaxCount)
+	}
+
+	r = r.Clone(r.Context())
+	q := r.URL.Query()
+	q.Set("size", strconv.Itoa(count*libreSpeedChunkSize))
+	r.URL.RawQuery = q.Encode()
+
+	w.Header().Set("Content-Description", "File Transfer")
+	w.Header().Set("Content-Disposition", "attachment; filename=random.dat")
+	w.Header().Set("Content-Transfer-Encoding", "binary")
+	s.requireToken(s.limitTests(s.handleTestFile))(w, r)
+}
+
+// handleLibreSpeedEmpty serves LibreSpeed's /empty.php, which clients ping
+// with GET requests and upload to with POST requests
+func (s *Server) handleLibreSpeedEmpty(w http.ResponseWriter, r *http.Request) {
+	if !s.libreSpeedCORS(w, r) {
+		return
+	}
+
+	w.Header().Set("Connection", "keep-alive")
+	if r.Method == "POST" {
+		w.Header().Set("Cache-Control", "no-store")
+		s.requireToken(s.limitTests(s.handleUpload))(w, r)
+		return
+	}
+	// LibreSpeed pings expect an empty response
+	if setTestHeaders(w, r) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// handleLibreSpeedIP serves LibreSpeed's /getIP.php. With the isp parameter
+// the client IP is followed by its network and country, when the GeoIP
+// databases know them.
+func (s *Server) handleLibreSpeedIP(w http.ResponseWriter, r *http.Request) {
+	if !s.libreSpeedCORS(w, r) {
+		return
+	}
+
+	ip := s.clientIP(r)
+	response := struct {
+		ProcessedString string      `json:"processedString"`
+		RawISPInfo      interface{} `json:"rawIspInfo"`
+	}{ProcessedString: ip, RawISPInfo: ""}
+
+	if r.URL.Query().Has("isp") {
+		raw := map[string]string{"ip": ip}
+		if isp := s.geoIP.isp(ip); isp != nil {
+			response.ProcessedString += " - " + isp.Name
+			raw["org"] = fmt.Sprintf("AS%d %s", isp.ASN, isp.Name)
+		}
+		if loc := s.geoIP.locate(ip); loc != nil && loc.CountryCode != "" {
+			response.ProcessedString += ", " + loc.CountryCode
+			raw["country"] = loc.CountryCode
+		}
+		response.RawISPInfo = raw
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,156 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LogModules are the parts of the server whose log level can be set on its
+// own with the log levels option
+var LogModules = []string{
+	"server",    // Startup and everything not listed below
+	"http",      // Request log
+	"test",      // Transfers, pings and sessions of individual tests
+	"results",   // Result store and exports
+	"scheduler", // Scheduled tests
+	"mesh",      // Tests between mesh instances
+	"monitor",   // Threshold alerts on scheduled and mesh tests
+	"geoip",
+	"webhook",
+	"mqtt",
+	"influxdb",
+	"report", // Results sent to a collector
+	"syslog", // Test events and access logs sent to syslog
+	"grpc",
+	"mdns",
+	"udp",
+	"iperf",
+	"ndt7",
+}
+
+// NewLogger creates the server logger from the logging options. The logger
+// lets every record through that some module's level allows; Server narrows
+// it down per module.
+func NewLogger(lc LogConfig) (*slog.Logger, error) {
+	var out io.Writer = os.Stdout
+	if lc.File != "" {
+		f, err := os.OpenFile(lc.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening log file: %w", err)
+		}
+		out = f
+	}
+
+	lowest := lc.level("")
+	for module := range lc.Levels {
+		lowest = min(lowest, lc.level(module))
+	}
+	opts := &slog.HandlerOptions{Level: lowest}
+	if lc.Format == "json" {
+		return slog.New(slog.NewJSONHandler(out, opts)), nil
+	}
+	if lc.Prefix != "" {
+		out = &prefixWriter{w: out, prefix: []byte(lc.Prefix)}
+	}
+	return slog.New(slog.NewTextHandler(out, opts)), nil
+}
+
+// ModuleLogger returns a logger for one of LogModules, tagged with the
+// module name and filtered at its configured level
+func (lc LogConfig) ModuleLogger(base *slog.Logger, module string) *slog.Logger {
+	h := base.With("module", module).Handler()
+	return slog.New(&levelHandler{Handler: h, level: lc.level(module)})
+}
+
+// level returns the level configured for module, falling back to the
+// global level. The levels were checked by Validate.
+func (lc LogConfig) level(module string) slog.Level {
+	text, ok := lc.Levels[module]
+	if !ok || module == "" {
+		text = lc.Level
+	}
+	var level slog.Level
+	level.UnmarshalText([]byte(text))
+	return level
+}
+
+// validate checks the format and levels
+func (lc LogConfig) validate() error {
+	if lc.Format != "text" && lc.Format != "json" {
+		return fmt.Errorf("log format must be text or json")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(lc.Level)); err != nil {
+		return fmt.Errorf("invalid log level %q", lc.Level)
+	}
+	for module, text := range lc.Levels {
+		known := false
+		for _, m := range LogModules {
+			known = known || m == module
+		}
+		if !known {
+			return fmt.Errorf("unknown log module %q, expected one of %s", module, strings.Join(LogModules, ", "))
+		}
+		if err := level.UnmarshalText([]byte(text)); err != nil {
+			return fmt.Errorf("invalid log level %q for %s", text, module)
+		}
+	}
+	return nil
+}
+
+// levelHandler drops records below a module's level before they reach the
+// shared handler
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.Handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// prefixWriter starts every line of text output with a prefix. Handlers
+// write each record in one call.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(append(append([]byte{}, p.prefix...), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// log returns the logger of one of LogModules
+func (s *Server) log(module string) *slog.Logger {
+	return s.loggers[module]
+}
+
+// testLogger returns the logger for lines about one test request, carrying
+// the client IP and, for streams of a test session, the session ID
+func (s *Server) testLogger(r *http.Request) *slog.Logger {
+	logger := s.log("test").With("client_ip", s.clientIP(r))
+	if sessionID := r.URL.Query().Get("session"); sessionID != "" {
+		logger = logger.With("session", sessionID)
+	}
+	return logger
+}
@@ -0,0 +1,317 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Multicast DNS service discovery (RFC 6762 and RFC 6763), IPv4 only
+const (
+	mdnsService      = "_speedtest._tcp.local."
+	mdnsServiceEnum  = "_services._dns-sd._udp.local." // Lists every service type on the LAN
+	mdnsTTL          = 120                             // Seconds receivers may cache records
+	mdnsMaxPacket    = 9000                            // Largest mDNS message accepted
+	mdnsAnnounceWait = time.Second                     // Pause between startup announcements
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsResponder advertises this server on the LAN as a _speedtest._tcp
+// service and answers queries for it
+type mdnsResponder struct {
+	conn     *net.UDPConn
+	instance dnsmessage.Name // e.g. "My Server._speedtest._tcp.local."
+	host     dnsmessage.Name // e.g. "myhost.local."
+	port     uint16
+	txt      []string
+}
+
+// startMDNS joins the mDNS multicast group and announces the server under
+// the configured instance name, or the hostname when none is set
+func (s *Server) startMDNS() (*mdnsResponder, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("reading hostname: %w", err)
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	name := s.cfg.MDNS.Name
+	if name == "" {
+		name = hostname
+	}
+
+	scheme := "http"
+	if s.cfg.TLS.Enabled() || s.cfg.ACME.Enabled() {
+		scheme = "https"
+	}
+
+	m := &mdnsResponder{
+		port: uint16(s.cfg.ServePort()),
+		txt:  []string{"scheme=" + scheme, "path=/"},
+	}
+	// Dots would split the instance name into several labels
+	if m.instance, err = dnsmessage.NewName(strings.ReplaceAll(name, ".", "-") + "." + mdnsService); err != nil {
+		return nil, fmt.Errorf("invalid mdns name %q: %w", name, err)
+	}
+	if m.host, err = dnsmessage.NewName(hostname + ".local."); err != nil {
+		return nil, fmt.Errorf("invalid hostname %q: %w", hostname, err)
+	}
+
+	if m.conn, err = net.ListenMulticastUDP("udp4", nil, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("joining mDNS group: %w", err)
+	}
+	go s.serveMDNS(m)
+	go func() {
+		// Announce twice, as RFC 6762 asks, so packet loss is less likely to hide us
+		for i := 0; i < 2; i++ {
+			m.send(m.records(true, mdnsTTL), nil, 0, nil)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(mdnsAnnounceWait):
+			}
+		}
+	}()
+	return m, nil
+}
+
+// close tells the LAN the service is going away and leaves the group
+func (m *mdnsResponder) close() {
+	m.send(m.records(true, 0), nil, 0, nil)
+	m.conn.Close()
+}
+
+// serveMDNS answers queries for the service, its instance and its host
+func (s *Server) serveMDNS(m *mdnsResponder) {
+	buf := make([]byte, mdnsMaxPacket)
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			s.log("mdns").Error("mDNS responder stopped", "err", err)
+			return
+		}
+
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil || header.Response {
+			continue
+		}
+		questions, err := p.AllQuestions()
+		if err != nil {
+			continue
+		}
+
+		var answers []dnsmessage.Resource
+		var answered []dnsmessage.Question
+		for _, q := range questions {
+			if rs := m.answer(q); len(rs) > 0 {
+				answers = append(answers, rs...)
+				answered = append(answered, q)
+			}
+		}
+		if len(answers) == 0 {
+			continue
+		}
+
+		// Queries from a port other than 5353 come from simple resolvers
+		// such as our own client, which expect a direct, classic DNS reply
+		if addr.Port != mdnsGroup.Port {
+			m.send(answers, addr, header.ID, answered)
+		} else {
+			m.send(answers, nil, 0, nil)
+		}
+	}
+}
+
+// answer returns the records answering one question
+func (m *mdnsResponder) answer(q dnsmessage.Question) []dnsmessage.Resource {
+	all := q.Type == dnsmessage.TypeALL
+	switch {
+	case strings.EqualFold(q.Name.String(), mdnsService) && (q.Type == dnsmessage.TypePTR || all):
+		return m.records(true, mdnsTTL)
+	case strings.EqualFold(q.Name.String(), mdnsServiceEnum) && (q.Type == dnsmessage.TypePTR || all):
+		return []dnsmessage.Resource{{
+			Header: m.header(dnsmessage.MustNewName(mdnsServiceEnum), dnsmessage.TypePTR, mdnsTTL),
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(mdnsService)},
+		}}
+	case strings.EqualFold(q.Name.String(), m.instance.String()):
+		if q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT || all {
+			return m.records(false, mdnsTTL)
+		}
+	case strings.EqualFold(q.Name.String(), m.host.String()):
+		if q.Type == dnsmessage.TypeA || all {
+			return m.addressRecords(mdnsTTL)
+		}
+	}
+	return nil
+}
+
+// records returns the instance's SRV, TXT and address records, preceded by
+// the service's PTR record when withPTR is set
+func (m *mdnsResponder) records(withPTR bool, ttl uint32) []dnsmessage.Resource {
+	var rs []dnsmessage.Resource
+	if withPTR {
+		rs = append(rs, dnsmessage.Resource{
+			Header: m.header(dnsmessage.MustNewName(mdnsService), dnsmessage.TypePTR, ttl),
+			Body:   &dnsmessage.PTRResource{PTR: m.instance},
+		})
+	}
+	rs = append(rs,
+		dnsmessage.Resource{
+			Header: m.header(m.instance, dnsmessage.TypeSRV, ttl),
+			Body:   &dnsmessage.SRVResource{Target: m.host, Port: m.port},
+		},
+		dnsmessage.Resource{
+			Header: m.header(m.instance, dnsmessage.TypeTXT, ttl),
+			Body:   &dnsmessage.TXTResource{TXT: m.txt},
+		},
+	)
+	return append(rs, m.addressRecords(ttl)...)
+}
+
+// addressRecords returns A records for the host's non-loopback IPv4 addresses
+func (m *mdnsResponder) addressRecords(ttl uint32) []dnsmessage.Resource {
+	addrs, _ := net.InterfaceAddrs()
+	var rs []dnsmessage.Resource
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		var a [4]byte
+		copy(a[:], ipNet.IP.To4())
+		rs = append(rs, dnsmessage.Resource{
+			Header: m.header(m.host, dnsmessage.TypeA, ttl),
+			Body:   &dnsmessage.AResource{A: a},
+		})
+	}
+	return rs
+}
+
+// header returns a resource header in the Internet class
+func (m *mdnsResponder) header(name dnsmessage.Name, typ dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+// send multicasts a response, or sends it to addr when that is set
+func (m *mdnsResponder) send(answers []dnsmessage.Resource, addr *net.UDPAddr, id uint16, questions []dnsmessage.Question) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: questions,
+		Answers:   answers,
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	if addr == nil {
+		addr = mdnsGroup
+	}
+	m.conn.WriteToUDP(packet, addr)
+}
+
+// DiscoveredServer is a speedtest server advertising itself on the LAN
+type DiscoveredServer struct {
+	Name string // Instance name, usually the server's hostname
+	URL  string // Base URL to test against
+}
+
+// Discover looks for speedtest servers on the local network through mDNS,
+// collecting answers until timeout passes. Servers are sorted by name.
+func Discover(ctx context.Context, timeout time.Duration) ([]DiscoveredServer, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(mdnsService),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(packet, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("sending mDNS query: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	// Answers may arrive split over several responses, so collect every
+	// record before putting servers together
+	instances := map[string]string{} // Lower-cased name to name as advertised
+	srvs := map[string]dnsmessage.SRVResource{}
+	txts := map[string][]string{}
+	addrs := map[string]net.IP{}
+	buf := make([]byte, mdnsMaxPacket)
+	for ctx.Err() == nil {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil || !msg.Header.Response {
+			continue
+		}
+		for _, r := range append(msg.Answers, msg.Additionals...) {
+			name := strings.ToLower(r.Header.Name.String())
+			switch body := r.Body.(type) {
+			case *dnsmessage.PTRResource:
+				if name == mdnsService && r.Header.TTL > 0 {
+					instances[strings.ToLower(body.PTR.String())] = body.PTR.String()
+				}
+			case *dnsmessage.SRVResource:
+				srvs[name] = *body
+			case *dnsmessage.TXTResource:
+				txts[name] = body.TXT
+			case *dnsmessage.AResource:
+				if _, ok := addrs[name]; !ok {
+					addrs[name] = net.IP(body.A[:])
+				}
+			}
+		}
+	}
+
+	var servers []DiscoveredServer
+	for instance, advertised := range instances {
+		srv, ok := srvs[instance]
+		if !ok {
+			continue
+		}
+		host := strings.TrimSuffix(srv.Target.String(), ".")
+		if ip, ok := addrs[strings.ToLower(srv.Target.String())]; ok {
+			host = ip.String()
+		}
+		scheme := "http"
+		for _, kv := range txts[instance] {
+			if v, ok := strings.CutPrefix(kv, "scheme="); ok && v == "https" {
+				scheme = v
+			}
+		}
+		servers = append(servers, DiscoveredServer{
+			Name: advertised[:len(advertised)-len("."+mdnsService)],
+			URL:  fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, fmt.Sprint(srv.Port))),
+		})
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers, ctx.Err()
+}
@@ -0,0 +1,184 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	meshUserAgent     = "speedtest-mesh" // Marks results recorded by mesh tests
+	meshSplay         = 30 * time.Second // Longest random wait before a round, so instances on one schedule don't all test at once
+	defaultMeshWindow = 24 * time.Hour   // Results /api/mesh summarizes when no from is given
+)
+
+// meshLink names the instance that ran a mesh test and the one it tested
+type meshLink struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// meshTarget is a server tested in each mesh round
+type meshTarget struct {
+	name string
+	url  string
+}
+
+// meshTargets returns the servers this instance tests: the hub on a spoke,
+// or else every peer in servers except this instance itself
+func (s *Server) meshTargets() []meshTarget {
+	mc := s.cfg.Mesh
+	if mc.Hub != "" {
+		name := mc.Hub
+		if parsed, err := url.Parse(mc.Hub); err == nil {
+			name = parsed.Host
+		}
+		// A hub listed in servers goes by its name there
+		for _, peer := range s.cfg.Servers {
+			if peer.URL == mc.Hub {
+				name = peer.Name
+			}
+		}
+		return []meshTarget{{name: name, url: mc.Hub}}
+	}
+
+	var targets []meshTarget
+	for _, peer := range s.cfg.Servers {
+		if peer.Name != mc.Name {
+			targets = append(targets, meshTarget{name: peer.Name, url: peer.URL})
+		}
+	}
+	return targets
+}
+
+// startMesh runs a mesh round on the configured cron schedule
+func (s *Server) startMesh() (*cron.Cron, error) {
+	mc := s.cfg.Mesh
+	c := cron.New(cron.WithChain(
+		// A slow round must not pile up behind the next one
+		cron.SkipIfStillRunning(cron.PrintfLogger(slog.NewLogLogger(s.log("mesh").Handler(), slog.LevelInfo))),
+	))
+	if _, err := c.AddFunc(mc.Cron, s.runMeshRound); err != nil {
+		return nil, fmt.Errorf("invalid mesh schedule %q: %w", mc.Cron, err)
+	}
+	c.Start()
+	return c, nil
+}
+
+// runMeshRound tests against each mesh target in turn, after a random wait
+// that spreads out the rounds of instances sharing a schedule. Tests are cut
+// short when the server shuts down.
+func (s *Server) runMeshRound() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Duration(rand.Int63n(int64(meshSplay)))):
+	}
+
+	mc := s.cfg.Mesh
+	for _, target := range s.meshTargets() {
+		if ctx.Err() != nil {
+			return
+		}
+		link := &meshLink{Source: mc.Name, Target: target.name}
+		res, err := s.runClientTest(ctx, s.log("mesh"), meshUserAgent, target.url, mc.Streams, mc.Duration, link)
+		if ctx.Err() == nil {
+			s.monitor.record(target.url, res, err)
+		}
+	}
+}
+
+// meshLinkStats summarizes the tests of one instance against another
+type meshLinkStats struct {
+	Source   string    `json:"source"`
+	Target   string    `json:"target"`
+	LastTest time.Time `json:"last_test"`
+	groupStats
+}
+
+// meshMatrix is the body of /api/mesh
+type meshMatrix struct {
+	Nodes []string        `json:"nodes"`
+	Links []meshLinkStats `json:"links"`
+}
+
+// handleMesh returns the matrix of mesh links found in the stored results:
+// every instance seen, and for each pair that tested, the number of tests
+// and their medians. It covers the last day unless from and to say
+// otherwise.
+func (s *Server) handleMesh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := parseResultFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Limit, f.Offset, f.Ascending = 0, 0, true
+	if r.URL.Query().Get("from") == "" {
+		f.From = time.Now().Add(-defaultMeshWindow)
+	}
+
+	results, _, err := s.results.query(f)
+	if err != nil {
+		s.log("results").Error("Reading results failed", "err", err)
+		http.Error(w, "Could not read results", http.StatusInternalServerError)
+		return
+	}
+
+	matrix := meshMatrix{Nodes: []string{}, Links: []meshLinkStats{}}
+	nodes := map[string]bool{}
+	var links []meshLink
+	byLink := map[meshLink][]testResult{}
+	for _, res := range results {
+		if res.Mesh == nil {
+			continue
+		}
+		link := *res.Mesh
+		if _, ok := byLink[link]; !ok {
+			links = append(links, link)
+		}
+		byLink[link] = append(byLink[link], res)
+		nodes[link.Source], nodes[link.Target] = true, true
+	}
+	for node := range nodes {
+		matrix.Nodes = append(matrix.Nodes, node)
+	}
+	sort.Strings(matrix.Nodes)
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Source < links[j].Source || (links[i].Source == links[j].Source && links[i].Target < links[j].Target)
+	})
+	for _, link := range links {
+		group := byLink[link]
+		matrix.Links = append(matrix.Links, meshLinkStats{
+			Source:     link.Source,
+			Target:     link.Target,
+			LastTest:   group[len(group)-1].Timestamp,
+			groupStats: summarizeGroup(group),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(matrix)
+}
@@ -0,0 +1,187 @@
+package speedtest
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Transfer directions used as metric labels
+const (
+	directionDownload = "download"
+	directionUpload   = "upload"
+)
+
+var (
+	testsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_tests_started_total",
+		Help: "Download and upload test transfers started.",
+	}, []string{"direction"})
+
+	testsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_tests_completed_total",
+		Help: "Download and upload test transfers that ran to completion.",
+	}, []string{"direction"})
+
+	sessionsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "speedtest_sessions_created_total",
+		Help: "Multi-stream test sessions created.",
+	})
+
+	rateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "speedtest_rate_limited_total",
+		Help: "Tests refused because the client exceeded its rate limit.",
+	})
+
+	testsQueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "speedtest_tests_queued_total",
+		Help: "Tests refused because all concurrent test slots were in use.",
+	})
+
+	bytesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "speedtest_download_bytes_total",
+		Help: "Bytes sent by /testfile.",
+	})
+
+	bytesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "speedtest_upload_bytes_total",
+		Help: "Bytes received by /upload.",
+	})
+
+	throughput = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "speedtest_throughput_mbps",
+		Help:    "Throughput of completed test transfers as measured by the server, in Mbps.",
+		Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000},
+	}, []string{"direction"})
+
+	activeTransfers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_active_transfers",
+		Help: "Test transfers currently in progress.",
+	}, []string{"direction"})
+
+	activeConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "speedtest_active_connections",
+		Help: "Open client connections.",
+	})
+
+	// Results of the client tests this server runs itself: scheduled, mesh
+	// and API-triggered tests, labelled with the server tested against
+	clientDownload = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_download_bps",
+		Help: "Download rate of the latest client test, in bits per second.",
+	}, []string{"server"})
+
+	clientUpload = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_upload_bps",
+		Help: "Upload rate of the latest client test, in bits per second.",
+	}, []string{"server"})
+
+	clientPing = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_ping_seconds",
+		Help: "Idle latency of the latest client test, in seconds.",
+	}, []string{"server"})
+
+	clientJitter = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_jitter_seconds",
+		Help: "Jitter of the latest client test, in seconds.",
+	}, []string{"server"})
+
+	clientTestTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_last_test_timestamp_seconds",
+		Help: "Unix time the latest successful client test finished.",
+	}, []string{"server"})
+
+	clientTests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_client_tests_total",
+		Help: "Client tests run by this server, by outcome.",
+	}, []string{"server", "outcome"})
+
+	clientDownloadHistory = newClientSummary("speedtest_download_bps_summary", "Download rates of client tests over the last day, in bits per second.")
+	clientUploadHistory   = newClientSummary("speedtest_upload_bps_summary", "Upload rates of client tests over the last day, in bits per second.")
+	clientPingHistory     = newClientSummary("speedtest_ping_seconds_summary", "Idle latency of client tests over the last day, in seconds.")
+)
+
+// newClientSummary registers a summary of client test results over a day,
+// the span periodic tests are usually compared across
+func newClientSummary(name, help string) *prometheus.SummaryVec {
+	return promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       name,
+		Help:       help,
+		Objectives: map[float64]float64{0.05: 0.01, 0.5: 0.05, 0.95: 0.01},
+		MaxAge:     24 * time.Hour,
+		AgeBuckets: 6,
+	}, []string{"server"})
+}
+
+// transferStarted records the start of a download or upload transfer
+func (s *Server) transferStarted(direction string) {
+	testsStarted.WithLabelValues(direction).Inc()
+	activeTransfers.WithLabelValues(direction).Inc()
+	s.stats.transferStarted(direction)
+}
+
+// transferBytes records data sent or received by a transfer
+func (s *Server) transferBytes(direction string, n int) {
+	if direction == directionDownload {
+		bytesServed.Add(float64(n))
+	} else {
+		bytesReceived.Add(float64(n))
+	}
+	s.stats.addBytes(direction, n)
+}
+
+// transferFinished records the end of a transfer and logs it at debug level.
+// Throughput is only observed for transfers that completed, so aborted tests
+// don't skew the distribution.
+func (s *Server) transferFinished(logger *slog.Logger, direction string, bytes int64, elapsed time.Duration, completed bool) {
+	logger.Debug("Transfer finished", "direction", direction, "bytes", bytes, "duration", elapsed, "completed", completed)
+	activeTransfers.WithLabelValues(direction).Dec()
+	s.stats.transferFinished(direction)
+	if !completed {
+		return
+	}
+
+	testsCompleted.WithLabelValues(direction).Inc()
+	if secs := elapsed.Seconds(); secs > 0 {
+		throughput.WithLabelValues(direction).Observe(float64(bytes) * 8 / secs / 1e6)
+	}
+}
+
+// clientTestFinished records the result of a client test against server
+func clientTestFinished(server string, res testResult) {
+	download, upload := res.Download*1e6, res.Upload*1e6
+	ping, jitter := res.Latency/1000, res.Jitter/1000
+
+	clientDownload.WithLabelValues(server).Set(download)
+	clientUpload.WithLabelValues(server).Set(upload)
+	clientPing.WithLabelValues(server).Set(ping)
+	clientJitter.WithLabelValues(server).Set(jitter)
+	clientTestTime.WithLabelValues(server).Set(float64(res.Timestamp.Unix()))
+	clientTests.WithLabelValues(server, "success").Inc()
+
+	clientDownloadHistory.WithLabelValues(server).Observe(download)
+	clientUploadHistory.WithLabelValues(server).Observe(upload)
+	clientPingHistory.WithLabelValues(server).Observe(ping)
+}
+
+// clientTestFailed records a client test against server that did not finish
+func clientTestFailed(server string) {
+	clientTests.WithLabelValues(server, "failure").Inc()
+}
+
+// ConnState keeps the active connection count up to date. Set it as the
+// ConnState hook of the http.Server serving Handler.
+func (s *Server) ConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		activeConnections.Inc()
+		s.stats.connections.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		activeConnections.Dec()
+		s.stats.connections.Add(-1)
+	}
+}
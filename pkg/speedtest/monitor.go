@@ -0,0 +1,261 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// monitorAlert is the JSON body sent to alert webhooks and MQTT when a
+// threshold alert fires or clears
+type monitorAlert struct {
+	Event     string  `json:"event"`  // "alert.triggered" or "alert.resolved"
+	Server    string  `json:"server"` // Server the tests ran against
+	Metric    string  `json:"metric"` // download, upload or latency
+	Value     float64 `json:"value"`  // Measured by the latest test; 0 when it failed
+	Threshold float64 `json:"threshold"`
+	// The test that changed the alert's state, or why it failed
+	Result *testResult `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// monitorThreshold is one configured limit on a result's metric
+type monitorThreshold struct {
+	metric string
+	limit  float64
+	below  bool // Breached by values below the limit rather than above
+	value  func(testResult) float64
+}
+
+// breached reports whether v is outside the threshold
+func (t monitorThreshold) breached(v float64) bool {
+	if t.below {
+		return v < t.limit
+	}
+	return v > t.limit
+}
+
+// recovered reports whether v is inside the threshold by at least margin
+// percent
+func (t monitorThreshold) recovered(v, margin float64) bool {
+	if t.below {
+		return v >= t.limit*(1+margin/100)
+	}
+	return v <= t.limit*(1-margin/100)
+}
+
+// alertState tracks one threshold for one tested server
+type alertState struct {
+	firing bool
+	streak int // Consecutive tests pointing the other way
+}
+
+// monitor checks the results of scheduled and mesh tests against thresholds.
+// An alert fires after fail_after breaching tests in a row and clears after
+// recover_after passing ones, so a single odd test changes nothing.
+type monitor struct {
+	cfg        MonitorConfig
+	thresholds []monitorThreshold
+	webhooks   *webhookNotifier // Nil when no alert webhooks are configured
+	mqtt       *mqttPublisher   // Nil unless alerts are published over MQTT
+	logger     *slog.Logger
+
+	mu     sync.Mutex
+	states map[string]*alertState // By server and metric
+
+	wg sync.WaitGroup // Emails in flight
+}
+
+// newMonitor returns a monitor for cfg, or nil when no threshold is set.
+// Webhooks time out like result webhooks, and MQTT alerts go out through
+// the result publisher's broker.
+func newMonitor(cfg MonitorConfig, webhookTimeout int, mqtt *mqttPublisher, logger *slog.Logger) *monitor {
+	if !cfg.enabled() {
+		return nil
+	}
+	m := &monitor{
+		cfg:      cfg,
+		webhooks: newWebhookNotifier(WebhookConfig{URLs: cfg.Webhooks, Timeout: webhookTimeout}, logger),
+		logger:   logger,
+		states:   make(map[string]*alertState),
+	}
+	if cfg.MQTTTopic != "" {
+		m.mqtt = mqtt
+	}
+	if cfg.MinDownloadMbps > 0 {
+		m.thresholds = append(m.thresholds, monitorThreshold{"download", cfg.MinDownloadMbps, true,
+			func(res testResult) float64 { return res.Download }})
+	}
+	if cfg.MinUploadMbps > 0 {
+		m.thresholds = append(m.thresholds, monitorThreshold{"upload", cfg.MinUploadMbps, true,
+			func(res testResult) float64 { return res.Upload }})
+	}
+	if cfg.MaxLatencyMs > 0 {
+		m.thresholds = append(m.thresholds, monitorThreshold{"latency", cfg.MaxLatencyMs, false,
+			func(res testResult) float64 { return res.Latency }})
+	}
+	return m
+}
+
+// record compares the result of a scheduled or mesh test against server
+// against the thresholds, and sends an alert for every one that fired or
+// cleared. A test that failed with err counts as breaching every threshold,
+// since a link that is down is as bad as it gets.
+func (m *monitor) record(server string, res testResult, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil && !errors.Is(err, errResultNotStored) {
+		m.update(server, nil, err)
+		return
+	}
+	m.update(server, &res, nil)
+}
+
+// update moves the alert states of server on with a result, or with the
+// error of a test that failed
+func (m *monitor) update(server string, res *testResult, testErr error) {
+	var alerts []monitorAlert
+	m.mu.Lock()
+	for _, t := range m.thresholds {
+		key := server + " " + t.metric
+		st, ok := m.states[key]
+		if !ok {
+			st = &alertState{}
+			m.states[key] = st
+		}
+
+		var v float64
+		if res != nil {
+			v = t.value(*res)
+		}
+		var moved bool
+		if st.firing {
+			moved = res != nil && t.recovered(v, m.cfg.Margin)
+		} else {
+			moved = res == nil || t.breached(v)
+		}
+		if !moved {
+			st.streak = 0
+			continue
+		}
+		st.streak++
+		if (!st.firing && st.streak < m.cfg.FailAfter) || (st.firing && st.streak < m.cfg.RecoverAfter) {
+			continue
+		}
+
+		st.firing, st.streak = !st.firing, 0
+		event := "alert.resolved"
+		if st.firing {
+			event = "alert.triggered"
+		}
+		alert := monitorAlert{
+			Event:     event,
+			Server:    server,
+			Metric:    t.metric,
+			Value:     v,
+			Threshold: t.limit,
+			Result:    res,
+		}
+		if testErr != nil {
+			alert.Error = testErr.Error()
+		}
+		alerts = append(alerts, alert)
+	}
+	m.mu.Unlock()
+
+	for _, alert := range alerts {
+		m.send(alert)
+	}
+}
+
+// send logs an alert and passes it on to webhooks, MQTT and email
+func (m *monitor) send(alert monitorAlert) {
+	log := m.logger.Info
+	if alert.Event == "alert.triggered" {
+		log = m.logger.Warn
+	}
+	log(alertSubject(alert), "server", alert.Server, "metric", alert.Metric, "value", alert.Value, "threshold", alert.Threshold)
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		m.logger.Error("Encoding alert failed", "err", err)
+		return
+	}
+	if m.webhooks != nil {
+		m.webhooks.deliver(body)
+	}
+	if m.mqtt != nil {
+		m.mqtt.publishTo(m.cfg.MQTTTopic, body)
+	}
+	if m.cfg.Email.SMTP != "" {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			if err := m.email(alert); err != nil {
+				m.logger.Warn("Sending alert email failed", "smtp", m.cfg.Email.SMTP, "err", err)
+			}
+		}()
+	}
+}
+
+// email mails an alert to the configured recipients
+func (m *monitor) email(alert monitorAlert) error {
+	e := m.cfg.Email
+	var auth smtp.Auth
+	if e.Username != "" {
+		host, _, _ := net.SplitHostPort(e.SMTP)
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [speedtest] %s\r\n", alertSubject(alert))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Server:    %s\r\n", alert.Server)
+	if res := alert.Result; res != nil {
+		fmt.Fprintf(&msg, "Tested:    %s\r\n", res.Timestamp.Format(time.RFC3339))
+		fmt.Fprintf(&msg, "Download:  %.2f Mbps\r\n", res.Download)
+		fmt.Fprintf(&msg, "Upload:    %.2f Mbps\r\n", res.Upload)
+		fmt.Fprintf(&msg, "Latency:   %.1f ms\r\n", res.Latency)
+		fmt.Fprintf(&msg, "Jitter:    %.1f ms\r\n", res.Jitter)
+		if res.ID != "" {
+			fmt.Fprintf(&msg, "Result:    %s\r\n", res.ID)
+		}
+	} else {
+		fmt.Fprintf(&msg, "Test failed: %s\r\n", alert.Error)
+	}
+	return smtp.SendMail(e.SMTP, auth, e.From, e.To, []byte(msg.String()))
+}
+
+// alertSubject describes an alert in one line
+func alertSubject(alert monitorAlert) string {
+	unit := "Mbps"
+	if alert.Metric == "latency" {
+		unit = "ms"
+	}
+	if alert.Error != "" {
+		return fmt.Sprintf("Alert: %s test failed (threshold %g %s)", alert.Metric, alert.Threshold, unit)
+	}
+	if alert.Event == "alert.resolved" {
+		return fmt.Sprintf("Resolved: %s back at %.1f %s (threshold %g %s)", alert.Metric, alert.Value, unit, alert.Threshold, unit)
+	}
+	return fmt.Sprintf("Alert: %s at %.1f %s (threshold %g %s)", alert.Metric, alert.Value, unit, alert.Threshold, unit)
+}
+
+// wait blocks until alert webhooks and emails in flight have been sent or
+// failed. MQTT alerts are waited for with the results published there.
+func (m *monitor) wait() {
+	if m != nil {
+		m.webhooks.wait()
+		m.wg.Wait()
+	}
+}
@@ -0,0 +1,260 @@
+package speedtest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The parts of MQTT 3.1.1 needed to publish a message, see
+// https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttDisconnect = 14
+
+	mqttProtocolLevel = 4                // MQTT 3.1.1
+	mqttKeepAlive     = 60               // Seconds; connections only live for one publish
+	mqttTimeout       = 10 * time.Second // Limit for connecting and publishing one result
+	mqttMaxPacketSize = 1 << 16          // Largest packet accepted from the broker
+)
+
+// mqttConnAckErrors describes the CONNACK return codes refusing a connection
+var mqttConnAckErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttPublisher publishes finished tests to an MQTT broker. Results are
+// rare, so each one is sent over a connection of its own.
+type mqttPublisher struct {
+	cfg    MQTTConfig
+	addr   string // host:port of the broker
+	useTLS bool
+	logger *slog.Logger
+
+	mu sync.Mutex     // Brokers drop older connections using the same client ID
+	wg sync.WaitGroup // Publishes in flight
+}
+
+// newMQTTPublisher returns a publisher for cfg, which has passed
+// Config.Validate, or nil when no broker is configured
+func newMQTTPublisher(cfg MQTTConfig, logger *slog.Logger) *mqttPublisher {
+	if cfg.Broker == "" {
+		return nil
+	}
+	u, _ := url.Parse(cfg.Broker)
+	p := &mqttPublisher{cfg: cfg, logger: logger}
+	p.useTLS = u.Scheme == "mqtts" || u.Scheme == "ssl" || u.Scheme == "tls"
+	port := u.Port()
+	if port == "" {
+		port = "1883"
+		if p.useTLS {
+			port = "8883"
+		}
+	}
+	p.addr = net.JoinHostPort(u.Hostname(), port)
+	return p
+}
+
+// mqttMessage is one message to publish
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// publish sends a stored result to the broker in the background
+func (p *mqttPublisher) publish(res testResult) {
+	if p == nil {
+		return
+	}
+	payload, err := json.Marshal(res)
+	if err != nil {
+		p.logger.Error("Encoding MQTT message failed", "err", err)
+		return
+	}
+	p.sendAsync([]mqttMessage{{p.cfg.Topic, payload, p.cfg.Retain}})
+}
+
+// publishTo sends a payload to topic in the background, regardless of the
+// retain setting for results
+func (p *mqttPublisher) publishTo(topic string, payload []byte) {
+	p.sendAsync([]mqttMessage{{topic, payload, false}})
+}
+
+// sendAsync sends messages to the broker in the background
+func (p *mqttPublisher) sendAsync(msgs []mqttMessage) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if err := p.send(msgs); err != nil {
+			p.logger.Warn("Publishing to MQTT broker failed", "broker", p.addr, "err", err)
+		}
+	}()
+}
+
+// send connects to the broker, publishes messages and disconnects
+func (p *mqttPublisher) send(msgs []mqttMessage) error {
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	var err error
+	if p.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", p.addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+	r := bufio.NewReader(conn)
+
+	if _, err := conn.Write(p.connectPacket()); err != nil {
+		return err
+	}
+	typ, body, err := readMQTTPacket(r)
+	if err != nil {
+		return fmt.Errorf("reading CONNACK: %w", err)
+	}
+	if typ != mqttConnAck || len(body) != 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", typ)
+	}
+	if code := body[1]; code != 0 {
+		if reason, ok := mqttConnAckErrors[code]; ok {
+			return fmt.Errorf("connection refused: %s", reason)
+		}
+		return fmt.Errorf("connection refused with code %d", code)
+	}
+
+	for i, msg := range msgs {
+		// QoS 1 messages carry an ID the broker acknowledges
+		packetID := uint16(i + 1)
+		if _, err := conn.Write(p.publishPacket(msg, packetID)); err != nil {
+			return err
+		}
+		if p.cfg.QoS == 1 {
+			typ, body, err := readMQTTPacket(r)
+			if err != nil {
+				return fmt.Errorf("reading PUBACK: %w", err)
+			}
+			if typ != mqttPubAck || len(body) != 2 || binary.BigEndian.Uint16(body) != packetID {
+				return fmt.Errorf("expected PUBACK, got packet type %d", typ)
+			}
+		}
+	}
+
+	_, err = conn.Write([]byte{mqttDisconnect << 4, 0})
+	return err
+}
+
+// connectPacket builds the CONNECT packet, starting a clean session
+func (p *mqttPublisher) connectPacket() []byte {
+	flags := byte(0x02) // Clean session
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, mqttProtocolLevel, 0)
+	body = binary.BigEndian.AppendUint16(body, mqttKeepAlive)
+	body = appendMQTTString(body, p.cfg.ClientID)
+	if p.cfg.Username != "" {
+		flags |= 0x80
+		body = appendMQTTString(body, p.cfg.Username)
+		if p.cfg.Password != "" {
+			flags |= 0x40
+			body = appendMQTTString(body, p.cfg.Password)
+		}
+	}
+	body[7] = flags // After the protocol name and level
+	return mqttPacket(mqttConnect<<4, body)
+}
+
+// publishPacket builds the PUBLISH packet for one message
+func (p *mqttPublisher) publishPacket(msg mqttMessage, packetID uint16) []byte {
+	header := byte(mqttPublish<<4) | byte(p.cfg.QoS)<<1
+	if msg.retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, msg.topic)
+	if p.cfg.QoS > 0 {
+		body = binary.BigEndian.AppendUint16(body, packetID)
+	}
+	return mqttPacket(header, append(body, msg.payload...))
+}
+
+// wait blocks until publishes in flight have finished or timed out
+func (p *mqttPublisher) wait() {
+	if p != nil {
+		p.wg.Wait()
+	}
+}
+
+// mqttPacket prefixes a packet body with its fixed header
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	// The remaining length is a base-128 varint
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// appendMQTTString appends a length-prefixed UTF-8 string
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTPacket reads one packet from the broker and returns its type and body
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	if n > mqttMaxPacketSize {
+		return 0, nil, fmt.Errorf("packet of %d bytes too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
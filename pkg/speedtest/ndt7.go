@@ -0,0 +1,356 @@
+package speedtest
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Parameters of M-Lab's ndt7 protocol, see
+// https://github.com/m-lab/ndt-server/blob/main/spec/ndt7-protocol.md
+const (
+	ndt7Subprotocol     = "net.measurementlab.ndt.v7"
+	ndt7Duration        = 10 * time.Second       // How long each ndt7 test runs
+	ndt7Timeout         = 15 * time.Second       // Hard limit for a whole ndt7 connection
+	ndt7MeasureInterval = 250 * time.Millisecond // How often measurements are sent to the client
+	ndt7MinMessageSize  = 1 << 13                // First download message size
+	ndt7MaxMessageSize  = 1 << 20                // Download messages grow up to this size
+	ndt7MaxReadSize     = 1 << 24                // Largest message clients may upload
+	ndt7ScalingFraction = 16                     // Messages grow while smaller than this fraction of the bytes sent
+)
+
+// ndt7Upgrader upgrades ndt7 connections. ndt7 clients are commonly served
+// from other origins, so any origin is accepted.
+var ndt7Upgrader = websocket.Upgrader{
+	ReadBufferSize:  1 << 16,
+	WriteBufferSize: 1 << 16,
+	Subprotocols:    []string{ndt7Subprotocol},
+	CheckOrigin:     func(*http.Request) bool { return true },
+}
+
+// ndt7Measurement is the JSON text message both sides send during an ndt7
+// test. Field names follow the ndt7 specification.
+type ndt7Measurement struct {
+	AppInfo        ndt7AppInfo
+	ConnectionInfo *ndt7ConnectionInfo `json:",omitempty"` // Only sent with the first measurement
+	Origin         string
+	Test           string
+	BBRInfo        *ndt7BBRInfo `json:",omitempty"` // Only when the connection uses BBR
+	TCPInfo        *ndt7TCPInfo `json:",omitempty"` // Only where the kernel reports TCP_INFO
+}
+
+// ndt7AppInfo is what the application layer has transferred so far
+type ndt7AppInfo struct {
+	ElapsedTime int64 // Microseconds since the test started
+	NumBytes    int64
+}
+
+// ndt7ConnectionInfo identifies the connection a test runs over
+type ndt7ConnectionInfo struct {
+	Client string
+	Server string
+	UUID   string
+}
+
+// ndt7BBRInfo is the kernel's BBR congestion control state
+type ndt7BBRInfo struct {
+	BW          int64 // Bottleneck bandwidth estimate in bytes per second
+	MinRTT      int64 // Microseconds
+	PacingGain  int64
+	CwndGain    int64
+	ElapsedTime int64
+}
+
+// ndt7TCPInfo is the kernel's view of the TCP connection. Times are in
+// microseconds.
+type ndt7TCPInfo struct {
+	State         int64
+	CAState       int64
+	Retransmits   int64
+	RTO           int64
+	ATO           int64
+	SndMSS        int64
+	RcvMSS        int64
+	Unacked       int64
+	Sacked        int64
+	Lost          int64
+	Retrans       int64
+	PMTU          int64
+	RTT           int64
+	RTTVar        int64
+	SndSsThresh   int64
+	SndCwnd       int64
+	AdvMSS        int64
+	Reordering    int64
+	RcvRTT        int64
+	RcvSpace      int64
+	TotalRetrans  int64
+	PacingRate    int64
+	MaxPacingRate int64
+	BytesAcked    int64
+	BytesReceived int64
+	SegsOut       int64
+	SegsIn        int64
+	NotsentBytes  int64
+	MinRTT        int64
+	DataSegsIn    int64
+	DataSegsOut   int64
+	DeliveryRate  int64
+	BusyTime      int64
+	RWndLimited   int64
+	SndBufLimited int64
+	Delivered     int64
+	DeliveredCE   int64
+	BytesSent     int64
+	BytesRetrans  int64
+	DSackDups     int64
+	ReordSeen     int64
+	RcvOooPack    int64
+	SndWnd        int64
+	ElapsedTime   int64
+}
+
+// ndt7Test is one ndt7 download or upload in progress
+type ndt7Test struct {
+	conn      *websocket.Conn
+	direction string // directionDownload or directionUpload
+	uuid      string
+	start     time.Time
+	bytes     atomic.Int64 // Application bytes sent or received
+	measured  bool         // Whether a measurement has been sent yet
+	logger    *slog.Logger // Carries the client IP
+}
+
+// measure sends the current measurement to the client. Only one goroutine
+// may call it at a time.
+func (t *ndt7Test) measure() error {
+	elapsed := time.Since(t.start).Microseconds()
+	m := ndt7Measurement{
+		AppInfo: ndt7AppInfo{ElapsedTime: elapsed, NumBytes: t.bytes.Load()},
+		Origin:  "server",
+		Test:    t.direction,
+	}
+	if !t.measured {
+		m.ConnectionInfo = &ndt7ConnectionInfo{
+			Client: t.conn.RemoteAddr().String(),
+			Server: t.conn.LocalAddr().String(),
+			UUID:   t.uuid,
+		}
+		t.measured = true
+	}
+	m.TCPInfo, m.BBRInfo = readTCPInfo(t.conn.NetConn())
+	if m.TCPInfo != nil {
+		m.TCPInfo.ElapsedTime = elapsed
+	}
+	if m.BBRInfo != nil {
+		m.BBRInfo.ElapsedTime = elapsed
+	}
+	return t.conn.WriteJSON(m)
+}
+
+// close ends the test with a normal WebSocket closure
+func (t *ndt7Test) close() {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	t.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	t.conn.Close()
+}
+
+// upgradeNDT7 turns an ndt7 request into a WebSocket connection. It writes an
+// error response and returns nil when the client did not ask for ndt7.
+func (s *Server) upgradeNDT7(w http.ResponseWriter, r *http.Request, direction string) *ndt7Test {
+	hasProtocol := false
+	for _, p := range websocket.Subprotocols(r) {
+		hasProtocol = hasProtocol || p == ndt7Subprotocol
+	}
+	if !hasProtocol {
+		http.Error(w, "Missing "+ndt7Subprotocol+" WebSocket subprotocol", http.StatusBadRequest)
+		return nil
+	}
+
+	logger := s.log("ndt7").With("client_ip", s.clientIP(r))
+	uuid, err := newSessionID()
+	if err != nil {
+		logger.Error("Creating ndt7 test ID failed", "err", err)
+		http.Error(w, "Could not start test", http.StatusInternalServerError)
+		return nil
+	}
+
+	conn, err := ndt7Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already wrote an error response
+		logger.Warn("ndt7 upgrade failed", "err", err)
+		return nil
+	}
+	// BBR gives ndt7 clients the bandwidth estimates they expect. Kernels
+	// without it keep their default congestion control.
+	enableBBR(conn.NetConn())
+
+	t := &ndt7Test{conn: conn, direction: direction, uuid: uuid, start: time.Now(), logger: logger.With("uuid", uuid)}
+	conn.SetReadDeadline(t.start.Add(ndt7Timeout))
+	conn.SetWriteDeadline(t.start.Add(ndt7Timeout))
+	return t
+}
+
+// handleNDT7Download runs an ndt7 download test: random binary messages,
+// growing in size, interleaved with measurements for ndt7Duration
+func (s *Server) handleNDT7Download(w http.ResponseWriter, r *http.Request) {
+	t := s.upgradeNDT7(w, r, directionDownload)
+	if t == nil {
+		return
+	}
+	defer t.close()
+
+	completed := false
+	s.transferStarted(directionDownload)
+	defer func() {
+		s.transferFinished(t.logger, directionDownload, t.bytes.Load(), time.Since(t.start), completed)
+	}()
+
+	// The client may send measurements of its own; reading them also
+	// notices when it goes away
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		for {
+			if _, _, err := t.conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(ndt7MeasureInterval)
+	defer ticker.Stop()
+
+	size := ndt7MinMessageSize
+	deadline := t.start.Add(ndt7Duration)
+	for time.Now().Before(deadline) {
+		var err error
+		select {
+		case <-clientGone:
+			return
+		case <-ticker.C:
+			err = t.measure()
+		default:
+			err = s.writeNDT7Message(t.conn, size)
+			if err == nil {
+				s.transferBytes(directionDownload, size)
+				sent := t.bytes.Add(int64(size))
+				if size < ndt7MaxMessageSize && int64(size) <= sent/ndt7ScalingFraction {
+					size *= 2
+				}
+			}
+		}
+		if err != nil {
+			t.logger.Info("ndt7 download failed", "bytes", t.bytes.Load(), "duration", time.Since(t.start), "err", err)
+			return
+		}
+	}
+	completed = true
+}
+
+// writeNDT7Message sends one binary message of size bytes of test data
+func (s *Server) writeNDT7Message(conn *websocket.Conn, size int) error {
+	mw, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	for written := 0; written < size; {
+		n := min(s.cfg.ChunkSize, size-written)
+		if err := s.waitBandwidth(context.Background(), directionDownload, n); err != nil {
+			mw.Close()
+			return err
+		}
+		if _, err := mw.Write(s.random.chunk(n)); err != nil {
+			mw.Close()
+			return err
+		}
+		written += n
+	}
+	return mw.Close()
+}
+
+// handleNDT7Upload runs an ndt7 upload test: the client sends binary
+// messages for ndt7Duration while the server reports what it received
+func (s *Server) handleNDT7Upload(w http.ResponseWriter, r *http.Request) {
+	t := s.upgradeNDT7(w, r, directionUpload)
+	if t == nil {
+		return
+	}
+	defer t.close()
+
+	t.conn.SetReadLimit(ndt7MaxReadSize)
+	deadline := t.start.Add(ndt7Duration)
+	t.conn.SetReadDeadline(deadline)
+
+	completed := false
+	s.transferStarted(directionUpload)
+	defer func() {
+		s.transferFinished(t.logger, directionUpload, t.bytes.Load(), time.Since(t.start), completed)
+	}()
+
+	// Report progress while the main loop reads
+	stop := make(chan struct{})
+	measured := make(chan struct{})
+	go func() {
+		defer close(measured)
+		ticker := time.NewTicker(ndt7MeasureInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := t.measure(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-measured
+	}()
+
+	bufPtr := s.buffers.getUpload()
+	defer s.buffers.putUpload(bufPtr)
+	buffer := *bufPtr
+
+	for {
+		_, mr, err := t.conn.NextReader()
+		if err == nil {
+			err = s.readNDT7Message(t, mr, buffer)
+		}
+		if err == nil {
+			continue
+		}
+
+		// The test ends when the deadline passes or the client closes the connection
+		if !time.Now().Before(deadline) || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			completed = true
+		} else {
+			t.logger.Warn("ndt7 upload failed", "bytes", t.bytes.Load(), "duration", time.Since(t.start), "err", err)
+		}
+		return
+	}
+}
+
+// readNDT7Message counts and discards one message from the client
+func (s *Server) readNDT7Message(t *ndt7Test, mr io.Reader, buffer []byte) error {
+	for {
+		n, err := mr.Read(buffer)
+		t.bytes.Add(int64(n))
+		s.transferBytes(directionUpload, n)
+		s.waitBandwidth(context.Background(), directionUpload, n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const openAPIVersion = "3.0.3"
+
+// openAPIDoc builds an OpenAPI document. Schemas are generated from the Go
+// types the handlers encode, so the document follows the code.
+type openAPIDoc struct {
+	paths   map[string]map[string]any
+	schemas map[string]any
+}
+
+// schema returns the schema of v's type. Named structs are added to the
+// components once and referenced from then on.
+func (d *openAPIDoc) schema(v any) map[string]any {
+	return d.schemaOf(reflect.TypeOf(v))
+}
+
+func (d *openAPIDoc) schemaOf(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": d.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": d.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.structSchema(t)
+		}
+		name := componentName(t.Name())
+		if _, ok := d.schemas[name]; !ok {
+			d.schemas[name] = nil // Stops recursion through self-referencing types
+			d.schemas[name] = d.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// structSchema describes a struct by its JSON fields. Fields without
+// omitempty are always sent, so they are listed as required.
+func (d *openAPIDoc) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = d.schemaOf(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// componentName turns a Go type name into a schema name, testResult into
+// TestResult
+func componentName(name string) string {
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// object describes a JSON object with the given properties, all required
+// but the optional ones
+func object(props map[string]any, optional ...string) map[string]any {
+	var required []string
+	for name := range props {
+		if !slices.Contains(optional, name) {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	return map[string]any{"type": "object", "properties": props, "required": required}
+}
+
+// add registers an operation
+func (d *openAPIDoc) add(method, path string, op map[string]any) {
+	if d.paths[path] == nil {
+		d.paths[path] = map[string]any{}
+	}
+	d.paths[path][strings.ToLower(method)] = op
+}
+
+// operation describes an endpoint. protected operations need an API key
+// once keys are configured.
+func operation(id, summary string, protected bool, params []map[string]any, responses map[string]any) map[string]any {
+	op := map[string]any{
+		"operationId": id,
+		"summary":     summary,
+		"responses":   responses,
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if protected {
+		op["security"] = []map[string][]string{{"apiKey": {}}, {"basicAuth": {}}}
+		responses["401"] = map[string]any{"description": "Missing or invalid API key"}
+		responses["403"] = map[string]any{"description": "No API keys are configured"}
+	}
+	return op
+}
+
+// param describes a query or path parameter
+func param(in, name string, schema map[string]any, description string) map[string]any {
+	p := map[string]any{"name": name, "in": in, "schema": schema, "description": description}
+	if in == "path" {
+		p["required"] = true
+	}
+	return p
+}
+
+// jsonResponse describes a JSON response body
+func jsonResponse(description string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+// reply describes a response without a documented body
+func reply(description string) map[string]any {
+	return map[string]any{"description": description}
+}
+
+var (
+	typeString  = map[string]any{"type": "string"}
+	typeInteger = map[string]any{"type": "integer"}
+	typeNumber  = map[string]any{"type": "number"}
+	typeTime    = map[string]any{"type": "string", "description": "RFC 3339 timestamp or Unix seconds"}
+)
+
+// openAPIDocument describes the measurement and result APIs this server
+// serves with its current configuration
+func (s *Server) openAPIDocument() map[string]any {
+	d := &openAPIDoc{paths: map[string]map[string]any{}, schemas: map[string]any{}}
+
+	session := param("query", "session", typeString, "Session the stream belongs to, see POST /api/v1/session")
+	buster := param("query", "t", typeString, "Cache buster, echoed in X-Cache-Buster")
+	duration := param("query", "duration", typeString, "Run for this long instead of a fixed size, in seconds or as a Go duration, up to max_duration")
+	throttle := param("query", "throttle", typeNumber, "Throttle the transfer to this many KB/s")
+	size := param("query", "size", typeInteger, "Bytes to transfer")
+	filters := []map[string]any{
+		param("query", "from", typeTime, "Only results from this time on"),
+		param("query", "to", typeTime, "Only results up to this time"),
+		param("query", "ip", typeString, "Only results from this client IP"),
+	}
+	page := append(append([]map[string]any{}, filters...),
+		param("query", "limit", typeInteger, "Page size, 1 to 1000 (default 100)"),
+		param("query", "offset", typeInteger, "Results to skip"),
+		param("query", "sort", map[string]any{"type": "string", "enum": []string{"desc", "asc"}}, "Newest (desc, default) or oldest first"),
+	)
+	testParams := func(params ...map[string]any) []map[string]any {
+		if s.cfg.Tokens.Required {
+			params = append(params, param("query", "token", typeString, "Test token from POST /api/v1/token"))
+		}
+		return params
+	}
+	busy := jsonResponse("Server busy or client over its rate limit", d.schema(admissionError{}))
+	badRequest := reply("Invalid parameters")
+	notFound := reply("Unknown session")
+	webSocket := reply("WebSocket upgrade")
+
+	// Measurement
+	d.add("GET", "/api/v1/ping", operation("ping", "Round trip for latency measurement", false,
+		[]map[string]any{buster},
+		map[string]any{"200": jsonResponse("Server receive and send times", d.schema(pingTimes{}))}))
+	d.add("GET", "/api/v1/testfile", operation("download", "Download random test data", false,
+		testParams(size, duration, session, param("query", "probe", typeString, "Count the stream as a speed probe"), throttle, buster,
+			param("header", "Range", typeString, "One byte range of the size bytes, such as bytes=0-1048575")),
+		map[string]any{
+			"200": map[string]any{"description": "Random data", "content": map[string]any{"application/octet-stream": map[string]any{}}},
+			"206": map[string]any{"description": "The requested byte range", "content": map[string]any{"application/octet-stream": map[string]any{}}},
+			"400": badRequest, "404": notFound, "416": reply("Range starts past the end"), "429": busy,
+		}))
+	d.add("HEAD", "/api/v1/testfile", operation("downloadSize", "Size of the test file, for planning byte ranges", false,
+		[]map[string]any{size}, map[string]any{"200": reply("Headers only")}))
+	d.add("POST", "/api/v1/upload", map[string]any{
+		"operationId": "upload",
+		"summary":     "Upload test data",
+		"parameters": testParams(param("query", "size", typeInteger, "Bytes the client intends to send"), duration, session,
+			param("query", "latency", typeInteger, "Extra delay before responding, in milliseconds"), throttle,
+			param("query", "checksum", map[string]any{"type": "string", "enum": []string{"sha256"}}, "Return a checksum of the bytes received")),
+		"requestBody": map[string]any{"content": map[string]any{"application/octet-stream": map[string]any{}}},
+		"responses": map[string]any{
+			"200": jsonResponse("Bytes received and the rate measured by the server", object(map[string]any{
+				"success":    map[string]any{"type": "boolean"},
+				"size":       typeInteger,
+				"duration":   typeNumber,
+				"mbps":       typeNumber,
+				"sha256":     typeString,
+				"throughput": d.schema(throughputSummary{}),
+				"trimmed":    d.schema(trimmedThroughput{}),
+				"session":    d.schema(transferSummary{}),
+			}, "mbps", "sha256", "trimmed", "session")),
+			"400": badRequest, "404": notFound, "413": reply("Upload size exceeds limit"), "429": busy,
+		},
+	})
+	d.add("GET", "/api/v1/ws/ping", operation("wsPing", "Latency measurement over a WebSocket", false,
+		[]map[string]any{session}, map[string]any{"101": webSocket}))
+	d.add("GET", "/api/v1/ws/download", operation("wsDownload", "Download test data over a WebSocket", false,
+		testParams(size, duration, session), map[string]any{"101": webSocket, "429": busy}))
+	d.add("GET", "/api/v1/ws/upload", operation("wsUpload", "Upload test data over a WebSocket", false,
+		testParams(size, duration, session), map[string]any{"101": webSocket, "429": busy}))
+	d.add("GET", "/ndt/v7/download", operation("ndt7Download", "ndt7 download test", false,
+		testParams(), map[string]any{"101": webSocket, "429": busy}))
+	d.add("GET", "/ndt/v7/upload", operation("ndt7Upload", "ndt7 upload test", false,
+		testParams(), map[string]any{"101": webSocket, "429": busy}))
+
+	// Sessions
+	id := param("path", "id", typeString, "Session ID")
+	d.add("POST", "/api/v1/session", operation("createSession", "Start a multi-stream test session", false,
+		testParams(param("query", "streams", typeInteger, "Parallel streams, 1 to 32 (default 1)")),
+		map[string]any{"201": jsonResponse("Session created", d.schema(sessionSummary{})), "400": badRequest, "429": busy}))
+	d.add("GET", "/api/v1/session/{id}", operation("getSession", "Server-side totals of a session", false,
+		[]map[string]any{id}, map[string]any{"200": jsonResponse("Session totals", d.schema(sessionSummary{})), "404": notFound}))
+	d.add("DELETE", "/api/v1/session/{id}", operation("deleteSession", "End a session", false,
+		[]map[string]any{id}, map[string]any{"204": reply("Session ended"), "404": notFound}))
+	d.add("GET", "/api/v1/session/{id}/server-result", operation("getServerResult", "Download result measured by the server", false,
+		[]map[string]any{id}, map[string]any{"200": jsonResponse("Server-side download result", d.schema(serverResult{})), "404": notFound}))
+	d.add("GET", "/api/v1/session/{id}/plan", operation("getTestPlan", "Test sizing advised after the speed probes", false,
+		[]map[string]any{id, param("query", "mbps", typeNumber, "Probe rate measured by the client")},
+		map[string]any{"200": jsonResponse("Test plan", d.schema(testPlan{})), "404": notFound, "409": reply("No probe has finished yet")}))
+	d.add("GET", "/api/v1/session/{id}/events", operation("sessionEvents", "Live progress of a session as server-sent events", false,
+		[]map[string]any{id}, map[string]any{
+			"200": map[string]any{"description": "phase, progress and end events", "content": map[string]any{"text/event-stream": map[string]any{}}},
+			"404": notFound,
+		}))
+
+	// Results
+	d.add("GET", "/api/v1/results", operation("listResults", "List stored results", true, page,
+		map[string]any{"200": jsonResponse("A page of results, newest first", object(map[string]any{
+			"total":   typeInteger,
+			"limit":   typeInteger,
+			"offset":  typeInteger,
+			"results": d.schema([]testResult{}),
+		})), "400": badRequest}))
+	d.add("POST", "/api/v1/results", map[string]any{
+		"operationId": "submitResult",
+		"summary":     "Store a result measured by the client",
+		"description": "Needs the session's result nonce unless an API key is sent. Only results sent with an API key may set timestamp, client_ip, user_agent, agent and server.",
+		"requestBody": map[string]any{"required": true, "content": map[string]any{"application/json": map[string]any{"schema": d.schema(submittedResult{})}}},
+		"responses": map[string]any{
+			"201": jsonResponse("Stored result", d.schema(testResult{})),
+			"400": reply("Invalid result"),
+			"403": reply("Missing or invalid nonce"),
+		},
+	})
+	d.add("GET", "/api/v1/results/{id}", operation("getResult", "Public view of a stored result", false,
+		[]map[string]any{param("path", "id", typeString, "Result ID")},
+		map[string]any{"200": jsonResponse("Result", d.schema(sharedResult{})), "404": reply("Result not found")}))
+	d.add("GET", "/api/v1/results/export", operation("exportResults", "Export stored results", true,
+		append(append([]map[string]any{}, filters...),
+			param("query", "format", map[string]any{"type": "string", "enum": []string{"csv", "jsonl"}}, "csv (default) or JSON Lines")),
+		map[string]any{
+			"200": map[string]any{"description": "All matching results, oldest first", "content": map[string]any{
+				"text/csv":             map[string]any{},
+				"application/x-ndjson": map[string]any{"schema": d.schema(testResult{})},
+			}},
+			"400": badRequest,
+		}))
+	d.add("GET", "/api/v1/history", operation("history", "The caller's own past results, oldest first", false,
+		[]map[string]any{param("query", "limit", typeInteger, "Most results to return")},
+		map[string]any{"200": jsonResponse("Results", object(map[string]any{"results": d.schema([]testResult{})})), "400": badRequest}))
+	d.add("GET", "/api/v1/stats", operation("aggregateStats", "Percentiles and breakdowns of stored results", true, filters,
+		map[string]any{"200": jsonResponse("Statistics", d.schema(aggregateStats{})), "400": badRequest}))
+	d.add("GET", "/api/v1/mesh", operation("meshMatrix", "Results between mesh instances", true, filters,
+		map[string]any{"200": jsonResponse("Nodes and links, over the last day unless from is given", d.schema(meshMatrix{})), "400": badRequest}))
+
+	// Clients and servers
+	d.add("GET", "/api/v1/clientinfo", operation("clientInfo", "What the server knows about the caller's connection", false, nil,
+		map[string]any{"200": jsonResponse("Client details", d.schema(clientInfo{}))}))
+	d.add("GET", "/api/v1/status", operation("serverStatus", "How many tests are running right now", false, nil,
+		map[string]any{"200": jsonResponse("Active tests and transfers", d.schema(serverStatus{}))}))
+	d.add("GET", "/api/v1/servers", operation("listServers", "This server and its configured peers", false, nil,
+		map[string]any{"200": jsonResponse("Servers", object(map[string]any{"servers": d.schema([]serverListEntry{})}))}))
+
+	if s.cfg.Tokens.Required {
+		d.add("POST", "/api/v1/token", operation("issueToken", "Issue a test token", false, nil,
+			map[string]any{"200": jsonResponse("Token", object(map[string]any{
+				"token":   typeString,
+				"expires": map[string]any{"type": "string", "format": "date-time"},
+			}))}))
+	}
+	if s.cfg.UDP.Enabled {
+		d.add("POST", "/api/v1/udp/start", operation("startUDPProbe", "Start a UDP packet-loss and jitter probe", false, nil,
+			map[string]any{"201": jsonResponse("Probe ID and the UDP port to send datagrams to", object(map[string]any{
+				"id":   typeString,
+				"port": typeInteger,
+			}))}))
+		d.add("POST", "/api/v1/udp/stop", operation("stopUDPProbe", "End a UDP probe", false,
+			[]map[string]any{param("query", "id", typeString, "Probe ID")},
+			map[string]any{"200": jsonResponse("Probe statistics", d.schema(udpProbeStats{})), "404": reply("Unknown probe")}))
+	}
+	if s.cfg.WebRTC.Enabled {
+		offer := operation("startWebRTCProbe", "Answer a WebRTC offer and start a data channel probe", false, nil,
+			map[string]any{
+				"201": jsonResponse("Probe ID and the SDP answer", d.schema(webrtcAnswer{})),
+				"400": reply("Invalid offer"),
+				"503": reply("Too many WebRTC probes"),
+			})
+		offer["requestBody"] = map[string]any{"required": true, "content": map[string]any{"application/json": map[string]any{"schema": d.schema(webrtcOffer{})}}}
+		d.add("POST", "/api/v1/webrtc/offer", offer)
+		d.add("POST", "/api/v1/webrtc/stop", operation("stopWebRTCProbe", "End a WebRTC probe", false,
+			[]map[string]any{param("query", "id", typeString, "Probe ID")},
+			map[string]any{"200": jsonResponse("Probe statistics", d.schema(udpProbeStats{})), "404": reply("Unknown probe")}))
+	}
+	if len(s.cfg.APIKeys) > 0 {
+		d.add("GET", "/admin/api/stats", operation("serverStats", "Live server statistics", true, nil,
+			map[string]any{"200": jsonResponse("Statistics", d.schema(serverStats{}))}))
+		d.add("POST", "/admin/api/prune", operation("pruneResults", "Delete old results", true,
+			[]map[string]any{
+				param("query", "older_than", typeString, "Delete results older than this, such as 30d (default results.retain)"),
+				param("query", "keep", typeInteger, "Keep at most this many results (default results.max_count)"),
+			},
+			map[string]any{"200": jsonResponse("Results deleted", object(map[string]any{"removed": typeInteger})), "400": badRequest}))
+		runTest := operation("runTest", "Run a client-mode test against another server and store its result", true, nil,
+			map[string]any{
+				"201": jsonResponse("Stored result", d.schema(testResult{})),
+				"400": badRequest,
+				"409": reply("A test is already running"),
+				"502": reply("Test failed"),
+			})
+		runTest["requestBody"] = map[string]any{"content": map[string]any{"application/json": map[string]any{"schema": d.schema(testRunRequest{})}}}
+		d.add("POST", "/api/v1/tests/run", runTest)
+	}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":       "Infobits Speedtest",
+			"description": "Speed test measurement and result APIs. Transfer sizes are in bytes, rates in Mbps and times in milliseconds unless noted.",
+			"version":     "1",
+		},
+		"paths": d.paths,
+		"components": map[string]any{
+			"schemas": d.schemas,
+			"securitySchemes": map[string]any{
+				"apiKey":    map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"basicAuth": map[string]any{"type": "http", "scheme": "basic"},
+			},
+		},
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document of the server's APIs
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.openAPIDocument())
+}
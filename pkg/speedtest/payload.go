@@ -0,0 +1,107 @@
+package speedtest
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"os"
+	"path/filepath"
+)
+
+// openPayloadFile maps the random data downloads are cut from from the file
+// at path, first generating it when it is missing or not size bytes long.
+// The data then sits in the page cache rather than the heap, and plain
+// HTTP/1.1 downloads can leave copying it to the kernel, see payloadSender.
+func openPayloadFile(path string, size int, logger *slog.Logger) (*randomBlock, error) {
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(size) {
+		logger.Info("Generating payload file", "file", path, "size", size)
+		if err := writePayloadFile(path, size); err != nil {
+			return nil, fmt.Errorf("generating payload file: %w", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening payload file: %w", err)
+	}
+	data, err := mapPayload(f, size)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("mapping payload file: %w", err)
+	}
+	return &randomBlock{data: data, size: size, file: f}, nil
+}
+
+// writePayloadFile writes size random bytes to path, replacing it only once
+// the new file is complete
+func writePayloadFile(path string, size int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	buf := make([]byte, 1024*1024)
+	for written := 0; written < size; written += len(buf) {
+		part := buf[:min(len(buf), size-written)]
+		if err := fillRandom(part); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := tmp.Write(part); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// close unmaps the payload file
+func (b *randomBlock) close() error {
+	if b == nil || b.file == nil {
+		return nil
+	}
+	unmapPayload(b.data)
+	return b.file.Close()
+}
+
+// payloadSender writes chunks of the payload file through its own file
+// handle. Copying from a file lets the HTTP server hand a plain TCP
+// connection's response to sendfile, so the data never passes through user
+// space.
+type payloadSender struct {
+	f    *os.File
+	size int
+}
+
+// sender opens a sender for one download, or returns nil when the block is
+// not backed by a file
+func (b *randomBlock) sender() *payloadSender {
+	if b.file == nil {
+		return nil
+	}
+	f, err := os.Open(b.file.Name())
+	if err != nil {
+		return nil
+	}
+	return &payloadSender{f: f, size: b.size}
+}
+
+// send writes n bytes, at most the file size, from a random offset
+func (p *payloadSender) send(w io.Writer, n int) (int, error) {
+	if _, err := p.f.Seek(int64(mathrand.IntN(p.size-n+1)), io.SeekStart); err != nil {
+		return 0, err
+	}
+	written, err := io.CopyN(w, p.f, int64(n))
+	return int(written), err
+}
+
+func (p *payloadSender) close() {
+	if p != nil {
+		p.f.Close()
+	}
+}
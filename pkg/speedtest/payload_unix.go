@@ -0,0 +1,18 @@
+//go:build !windows
+
+package speedtest
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapPayload maps the first size bytes of f read-only into memory
+func mapPayload(f *os.File, size int) ([]byte, error) {
+	return unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func unmapPayload(data []byte) {
+	unix.Munmap(data)
+}
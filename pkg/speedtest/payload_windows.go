@@ -0,0 +1,18 @@
+package speedtest
+
+import (
+	"io"
+	"os"
+)
+
+// mapPayload reads the first size bytes of f into memory on Windows, where
+// the server does not map files
+func mapPayload(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func unmapPayload(data []byte) {}
@@ -0,0 +1,68 @@
+package speedtest
+
+import "math"
+
+const (
+	planRequestTime = 2       // Seconds each planned request should take at the probed rate
+	planMinPayload  = 1 << 20 // Smallest planned payload
+	planMaxPayload  = 1 << 26 // Largest planned payload; browsers hold uploads in memory
+)
+
+// testPlan is the server's advice on how to size a test, based on the
+// warm-up probes of its session. A single fixed payload finishes too fast
+// on gigabit links to measure them and takes ages on slow ones.
+type testPlan struct {
+	ProbeBytes  int64   `json:"probe_bytes"`  // Bytes the probes downloaded
+	ProbeMbps   float64 `json:"probe_mbps"`   // Rate the plan is based on
+	MeasuredBy  string  `json:"measured_by"`  // "client" or "server"
+	Streams     int     `json:"streams"`      // Parallel streams per direction
+	PayloadSize int64   `json:"payload_size"` // Bytes per /testfile or /upload request
+}
+
+// plan sizes the rest of the test from the session's probes, or returns nil
+// while none has finished. clientMbps is the probe rate the client measured,
+// or 0 to use the server's measurement. The server only sees data leave its
+// socket buffers, so for probes of a few MB the client's figure is the more
+// accurate one. maxPayload is the most the server lets a request transfer.
+func (s *testSession) plan(clientMbps float64, maxPayload int64) *testPlan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	probe := s.probe.summarize()
+	if probe.Streams == 0 || probe.ActiveStreams > 0 || probe.Mbps <= 0 {
+		return nil
+	}
+	measuredBy := "server"
+	if clientMbps > 0 {
+		probe.Mbps, measuredBy = clientMbps, "client"
+	}
+
+	// More streams make up for the per-stream limits fast links run into
+	streams := 12
+	switch {
+	case probe.Mbps < 10:
+		streams = 2
+	case probe.Mbps < 50:
+		streams = 3
+	case probe.Mbps < 300:
+		streams = 4
+	case probe.Mbps < 1000:
+		streams = 6
+	case probe.Mbps < 2500:
+		streams = 8
+	}
+	streams = min(streams, s.streams)
+
+	// Each stream's share of the link for planRequestTime, in whole MiB
+	perStream := probe.Mbps * 1e6 / 8 / float64(streams) * planRequestTime
+	payload := int64(math.Ceil(perStream/planMinPayload)) * planMinPayload
+	payload = max(min(payload, planMaxPayload, maxPayload), planMinPayload)
+
+	return &testPlan{
+		ProbeBytes:  probe.Bytes,
+		ProbeMbps:   probe.Mbps,
+		MeasuredBy:  measuredBy,
+		Streams:     streams,
+		PayloadSize: payload,
+	}
+}
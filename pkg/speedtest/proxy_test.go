@@ -0,0 +1,83 @@
+package speedtest
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    []string // Networks as strings; nil expects an error
+	}{
+		{[]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1", "2001:db8::/32"},
+			[]string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128", "2001:db8::/32"}},
+		{[]string{"10.0.0.1/8"}, []string{"10.0.0.0/8"}},
+		{[]string{"proxy.example.com"}, nil},
+		{[]string{"10.0.0.0/33"}, nil},
+	}
+	for _, tt := range tests {
+		nets, err := parseTrustedProxies(tt.entries)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseTrustedProxies(%q) = %v, want an error", tt.entries, nets)
+			}
+			continue
+		}
+		if err != nil || len(nets) != len(tt.want) {
+			t.Errorf("parseTrustedProxies(%q) = %v, %v, want %q", tt.entries, nets, err, tt.want)
+			continue
+		}
+		for i, n := range nets {
+			if n.String() != tt.want[i] {
+				t.Errorf("parseTrustedProxies(%q)[%d] = %s, want %s", tt.entries, i, n, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	nets, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: nets}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string // X-Forwarded-For headers
+		realIP string
+		want   string
+	}{
+		{"direct", "198.51.100.7:4321", nil, "", "198.51.100.7"},
+		{"direct IPv6", "[2001:db8::7]:4321", nil, "", "2001:db8::7"},
+		{"untrusted peer ignores headers", "198.51.100.7:4321", []string{"203.0.113.9"}, "203.0.113.8", "198.51.100.7"},
+		{"trusted proxy", "10.0.0.2:4321", []string{"203.0.113.9"}, "", "203.0.113.9"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:4321", []string{"203.0.113.9"}, "", "203.0.113.9"},
+		{"chain of proxies", "10.0.0.2:4321", []string{"203.0.113.9, 10.0.0.3, 10.0.0.4"}, "", "203.0.113.9"},
+		{"spoofed entry left of the client", "10.0.0.2:4321", []string{"1.2.3.4, 203.0.113.9"}, "", "203.0.113.9"},
+		{"several headers", "10.0.0.2:4321", []string{"1.2.3.4", "203.0.113.9, 10.0.0.3"}, "", "203.0.113.9"},
+		{"malformed hop", "10.0.0.2:4321", []string{"203.0.113.9, garbage"}, "", "10.0.0.2"},
+		{"only proxies", "10.0.0.2:4321", []string{"10.0.0.3"}, "203.0.113.8", "203.0.113.8"},
+		{"real IP", "10.0.0.2:4321", nil, "203.0.113.8", "203.0.113.8"},
+		{"invalid real IP", "10.0.0.2:4321", nil, "garbage", "10.0.0.2"},
+		{"unix socket", "@", []string{"203.0.113.9"}, "", "203.0.113.9"},
+		{"unix socket without headers", "", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := s.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
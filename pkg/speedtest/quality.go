@@ -0,0 +1,164 @@
+package speedtest
+
+import "math"
+
+// qualityMetric is one measurement a connection is rated on, scored from 0
+// at Bad to 100 at Good. Throughput is compared on a log scale, since going
+// from 1 to 10 Mbps matters as much as going from 10 to 100.
+type qualityMetric struct {
+	Name      string
+	Bad, Good float64
+	Log       bool
+}
+
+// score rates v against the metric, or returns false when v is unknown
+func (m qualityMetric) score(v float64, ok bool) (float64, bool) {
+	if !ok {
+		return 0, false
+	}
+	bad, good := m.Bad, m.Good
+	if m.Log {
+		v, bad, good = math.Log(math.Max(v, 0.01)), math.Log(bad), math.Log(good)
+	}
+	return math.Max(0, math.Min(100, (v-bad)/(good-bad)*100)), true
+}
+
+// useCase names an activity and the metrics it needs to work well
+type useCase struct {
+	Name    string
+	Metrics []qualityMetric
+}
+
+// useCases are rated with every result. Thresholds follow the providers'
+// published requirements where there are any, e.g. 25 Mbps for 4K streaming.
+var useCases = []useCase{
+	{"browsing", []qualityMetric{
+		{"download", 1, 25, true},
+		{"upload", 0.5, 5, true},
+		{"latency", 500, 100, false},
+		{"loss", 5, 1, false},
+	}},
+	{"streaming_4k", []qualityMetric{
+		{"download", 10, 25, true},
+		{"latency", 1000, 200, false},
+		{"loss", 3, 0.5, false},
+	}},
+	{"video_calls", []qualityMetric{
+		{"download", 1, 6, true},
+		{"upload", 1, 6, true},
+		{"latency", 300, 100, false},
+		{"jitter", 50, 15, false},
+		{"loss", 3, 0.5, false},
+	}},
+	{"gaming", []qualityMetric{
+		{"download", 3, 25, true},
+		{"upload", 1, 5, true},
+		{"latency", 150, 30, false},
+		{"jitter", 30, 5, false},
+		{"loss", 2, 0.1, false},
+	}},
+}
+
+// overallMetrics and their weights make up the composite score
+var overallMetrics = []struct {
+	qualityMetric
+	Weight float64
+}{
+	{qualityMetric{"download", 1, 500, true}, 0.3},
+	{qualityMetric{"upload", 0.5, 100, true}, 0.2},
+	{qualityMetric{"latency", 300, 20, false}, 0.25},
+	{qualityMetric{"jitter", 50, 2, false}, 0.15},
+	{qualityMetric{"loss", 5, 0, false}, 0.1},
+}
+
+// qualityReport rates a result as a whole and for each use case
+type qualityReport struct {
+	Score    int              `json:"score"` // 0 to 100
+	UseCases []useCaseVerdict `json:"use_cases"`
+}
+
+// useCaseVerdict tells how well a connection suits one use case
+type useCaseVerdict struct {
+	UseCase string `json:"use_case"`
+	Verdict string `json:"verdict"` // great, good, fair or poor
+	Score   int    `json:"score"`
+	// Metric that held the score back, unless the verdict is great
+	LimitedBy string `json:"limited_by,omitempty"`
+}
+
+// rateQuality scores a result from its throughput, its latency under load,
+// jitter and packet loss. Metrics the result lacks are left out.
+func rateQuality(res *testResult) *qualityReport {
+	if res.Download <= 0 && res.Upload <= 0 {
+		return nil
+	}
+
+	values := map[string]float64{
+		"download": res.Download,
+		"upload":   res.Upload,
+		"latency":  loadedLatency(res),
+		"jitter":   res.Jitter,
+	}
+	if res.Loss != nil {
+		values["loss"] = *res.Loss
+	}
+	lookup := func(name string) (float64, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+
+	var sum, weights float64
+	for _, m := range overallMetrics {
+		if score, ok := m.score(lookup(m.Name)); ok {
+			sum += score * m.Weight
+			weights += m.Weight
+		}
+	}
+	report := &qualityReport{Score: int(math.Round(sum / weights))}
+
+	for _, uc := range useCases {
+		lowest, limitedBy := 100.0, ""
+		for _, m := range uc.Metrics {
+			if score, ok := m.score(lookup(m.Name)); ok && score < lowest {
+				lowest, limitedBy = score, m.Name
+			}
+		}
+		verdict := qualityVerdict(lowest)
+		if verdict == "great" {
+			limitedBy = ""
+		}
+		report.UseCases = append(report.UseCases, useCaseVerdict{
+			UseCase:   uc.Name,
+			Verdict:   verdict,
+			Score:     int(math.Round(lowest)),
+			LimitedBy: limitedBy,
+		})
+	}
+	return report
+}
+
+// loadedLatency returns the higher of the result's latencies while
+// downloading and uploading, or its plain latency without a bufferbloat
+// measurement
+func loadedLatency(res *testResult) float64 {
+	if bb := res.Bufferbloat; bb != nil {
+		if loaded := math.Max(bb.Download, bb.Upload); loaded > 0 {
+			return loaded
+		}
+	}
+	return res.Latency
+}
+
+// qualityVerdict words a score
+func qualityVerdict(score float64) string {
+	switch {
+	case score >= 80:
+		return "great"
+	case score >= 60:
+		return "good"
+	case score >= 40:
+		return "fair"
+	default:
+		return "poor"
+	}
+}
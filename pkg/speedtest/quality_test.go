@@ -0,0 +1,101 @@
+package speedtest
+
+import "testing"
+
+func TestRateQuality(t *testing.T) {
+	loss := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name  string
+		res   testResult
+		score int // -1 expects no report
+		// Verdict and limiting metric per use case
+		verdicts map[string][2]string
+	}{
+		{"no throughput", testResult{Latency: 20}, -1, nil},
+		{"excellent", testResult{Download: 1000, Upload: 200, Latency: 10, Jitter: 1, Loss: loss(0)}, 100, map[string][2]string{
+			"browsing":     {"great", ""},
+			"streaming_4k": {"great", ""},
+			"video_calls":  {"great", ""},
+			"gaming":       {"great", ""},
+		}},
+		{"unusable", testResult{Download: 0.5, Upload: 0.1, Latency: 2000, Jitter: 100, Loss: loss(10)}, 0, map[string][2]string{
+			"browsing":     {"poor", "download"},
+			"streaming_4k": {"poor", "download"},
+			"video_calls":  {"poor", "download"},
+			"gaming":       {"poor", "download"},
+		}},
+		{"slow upload", testResult{Download: 1000, Upload: 2, Latency: 10, Jitter: 1}, 84, map[string][2]string{
+			"browsing":     {"good", "upload"},
+			"streaming_4k": {"great", ""},
+			"video_calls":  {"poor", "upload"},
+			"gaming":       {"fair", "upload"},
+		}},
+		{"bufferbloat", testResult{
+			Download:    1000,
+			Upload:      200,
+			Latency:     10,
+			Jitter:      1,
+			Bufferbloat: &bufferbloatResult{Download: 400, Upload: 50},
+		}, 72, map[string][2]string{
+			"browsing":     {"poor", "latency"},
+			"streaming_4k": {"good", "latency"},
+			"video_calls":  {"poor", "latency"},
+			"gaming":       {"poor", "latency"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rateQuality(&tt.res)
+			if tt.score < 0 {
+				if got != nil {
+					t.Fatalf("rateQuality() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("rateQuality() = nil")
+			}
+			if got.Score != tt.score {
+				t.Errorf("score = %d, want %d", got.Score, tt.score)
+			}
+			if len(got.UseCases) != len(useCases) {
+				t.Fatalf("got %d use cases, want %d", len(got.UseCases), len(useCases))
+			}
+			for _, uc := range got.UseCases {
+				want := tt.verdicts[uc.UseCase]
+				if uc.Verdict != want[0] || uc.LimitedBy != want[1] {
+					t.Errorf("%s = %s limited by %q, want %s limited by %q",
+						uc.UseCase, uc.Verdict, uc.LimitedBy, want[0], want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestQualityMetricScore(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric qualityMetric
+		v      float64
+		want   float64
+	}{
+		{"at bad", qualityMetric{"latency", 300, 100, false}, 300, 0},
+		{"at good", qualityMetric{"latency", 300, 100, false}, 100, 100},
+		{"halfway", qualityMetric{"latency", 300, 100, false}, 200, 50},
+		{"past good", qualityMetric{"latency", 300, 100, false}, 10, 100},
+		{"past bad", qualityMetric{"latency", 300, 100, false}, 900, 0},
+		{"log scale", qualityMetric{"download", 1, 100, true}, 10, 50},
+		{"log scale zero", qualityMetric{"download", 1, 100, true}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.metric.score(tt.v, true)
+			if !ok || got < tt.want-1e-9 || got > tt.want+1e-9 {
+				t.Errorf("score(%v) = %v, %v, want %v, true", tt.v, got, ok, tt.want)
+			}
+		})
+	}
+	if _, ok := (qualityMetric{"loss", 5, 0, false}).score(1, false); ok {
+		t.Error("score() of an unknown value reported ok")
+	}
+}
@@ -0,0 +1,56 @@
+package speedtest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand/v2"
+	"os"
+)
+
+// randomBlockSize is how much random data downloads are cut from. It is far
+// larger than any compression window a middlebox might use, so the data stays
+// incompressible even though every download repeats it.
+const randomBlockSize = 16 * 1024 * 1024
+
+// randomBlock is random data generated once at startup and shared by all
+// downloads, so streaming test data costs no CPU for entropy. Every chunk of a
+// download is cut from a random offset, so each response is a different
+// permutation of the block and no two downloads send the same byte stream.
+// The block lives in memory, or is mapped from the payload file.
+type randomBlock struct {
+	data []byte // size bytes of random data
+	size int
+	file *os.File // The payload file data is mapped from; nil for a block in memory
+}
+
+// newRandomBlock generates size bytes of random data in memory
+func newRandomBlock(size int) (*randomBlock, error) {
+	data := make([]byte, size)
+	if err := fillRandom(data); err != nil {
+		return nil, err
+	}
+	return &randomBlock{data: data, size: size}, nil
+}
+
+// fillRandom fills data with random bytes from a ChaCha8 stream seeded from
+// crypto/rand, which is much faster than reading crypto/rand directly
+func fillRandom(data []byte) error {
+	var seed [32]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return fmt.Errorf("seeding random data: %w", err)
+	}
+	gen := mathrand.NewChaCha8(seed)
+	var word [8]byte
+	for i := 0; i < len(data); i += len(word) {
+		binary.LittleEndian.PutUint64(word[:], gen.Uint64())
+		copy(data[i:], word[:])
+	}
+	return nil
+}
+
+// chunk returns n bytes, at most the block size, from a random offset
+func (b *randomBlock) chunk(n int) []byte {
+	offset := mathrand.IntN(b.size - n + 1)
+	return b.data[offset : offset+n]
+}
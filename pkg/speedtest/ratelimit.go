@@ -0,0 +1,79 @@
+package speedtest
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdle is how long an idle client's bucket is kept. After an hour
+// a bucket sized for tests per hour is full again, so forgetting it is free.
+const rateLimitIdle = time.Hour
+
+// rateLimitedClient is the token bucket of one client IP
+type rateLimitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ipRateLimiter hands out tests to client IPs from per-IP token buckets
+type ipRateLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*rateLimitedClient
+}
+
+// newIPRateLimiter allows each IP perHour tests per hour, all of which may be
+// used at once
+func newIPRateLimiter(perHour int) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:   rate.Limit(float64(perHour) / time.Hour.Seconds()),
+		burst:   perHour,
+		clients: make(map[string]*rateLimitedClient),
+	}
+}
+
+// allow takes a token for ip. When none is left it returns false and how long
+// until the next one is available.
+func (l *ipRateLimiter) allow(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &rateLimitedClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = time.Now()
+
+	res := c.limiter.Reserve()
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// expireLoop periodically forgets clients that have not started a test in a while
+func (l *ipRateLimiter) expireLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		for ip, c := range l.clients {
+			if time.Since(c.lastSeen) > rateLimitIdle {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
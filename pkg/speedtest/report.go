@@ -0,0 +1,131 @@
+package speedtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reportUserAgent = "infobits-speedtest-agent"
+	reportTimeout   = 30 * time.Second
+)
+
+// reportRetries are the waits before retrying a report the collector did not
+// take, so short outages at either end lose no results
+var reportRetries = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute}
+
+// reportedResult is the body an agent posts to the collector's /api/results.
+// The collector only honours the timestamp, client, agent and server with
+// the agent's API key.
+type reportedResult struct {
+	Timestamp time.Time `json:"timestamp"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Agent     string    `json:"agent"`
+	Server    string    `json:"server,omitempty"`
+	Download  float64   `json:"download"`
+	Upload    float64   `json:"upload"`
+	Latency   float64   `json:"latency"`
+	Jitter    float64   `json:"jitter"`
+	RPM       float64   `json:"rpm,omitempty"`
+}
+
+// reporter forwards the results an agent stores to a central collector
+type reporter struct {
+	cfg    ReportConfig
+	client *http.Client
+	logger *slog.Logger
+	done   <-chan struct{} // Abandons retries on shutdown
+	wg     sync.WaitGroup  // Reports in flight
+}
+
+// newReporter returns a reporter for cfg, or nil when no collector is set
+func newReporter(cfg ReportConfig, logger *slog.Logger, done <-chan struct{}) *reporter {
+	if cfg.To == "" {
+		return nil
+	}
+	return &reporter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: reportTimeout},
+		logger: logger,
+		done:   done,
+	}
+}
+
+// report posts a stored result to the collector in the background
+func (rp *reporter) report(res testResult) {
+	if rp == nil {
+		return
+	}
+	body, err := json.Marshal(reportedResult{
+		Timestamp: res.Timestamp,
+		ClientIP:  res.ClientIP,
+		UserAgent: res.UserAgent,
+		Agent:     rp.cfg.Name,
+		Server:    res.Server,
+		Download:  res.Download,
+		Upload:    res.Upload,
+		Latency:   res.Latency,
+		Jitter:    res.Jitter,
+		RPM:       res.RPM,
+	})
+	if err != nil {
+		rp.logger.Error("Encoding report failed", "err", err)
+		return
+	}
+
+	rp.wg.Add(1)
+	go func() {
+		defer rp.wg.Done()
+		for attempt := 0; ; attempt++ {
+			err := rp.post(body)
+			if err == nil {
+				return
+			}
+			if attempt == len(reportRetries) {
+				rp.logger.Error("Reporting result failed, giving up", "id", res.ID, "err", err)
+				return
+			}
+			rp.logger.Warn("Reporting result failed, retrying", "id", res.ID, "err", err, "retry_in", reportRetries[attempt])
+			select {
+			case <-rp.done:
+				return
+			case <-time.After(reportRetries[attempt]):
+			}
+		}
+	}()
+}
+
+// post delivers one report
+func (rp *reporter) post(body []byte) error {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(rp.cfg.To, "/")+"/api/results", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", reportUserAgent)
+	req.Header.Set("X-API-Key", rp.cfg.APIKey)
+
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// wait blocks until reports in flight have been delivered or given up
+func (rp *reporter) wait() {
+	if rp != nil {
+		rp.wg.Wait()
+	}
+}
@@ -0,0 +1,76 @@
+package speedtest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// resultLog appends every finished test to a file, as JSON lines or CSV rows
+// with the columns of the CSV export
+type resultLog struct {
+	format string // jsonl or csv
+	out    *rotatingFile
+	logger *slog.Logger
+}
+
+// openResultLog opens the configured result log, or returns nil when none is
+// configured
+func openResultLog(cfg ResultLogConfig, logger *slog.Logger) (*resultLog, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	out := &rotatingFile{
+		name:       cfg.File,
+		maxSize:    int64(cfg.MaxSizeMB) * 1024 * 1024,
+		maxBackups: cfg.MaxBackups,
+		daily:      cfg.Daily,
+	}
+	if cfg.Format == "csv" {
+		out.header = csvLine(csvHeader)
+	}
+	if err := out.open(); err != nil {
+		return nil, fmt.Errorf("opening result log: %w", err)
+	}
+	return &resultLog{format: cfg.Format, out: out, logger: logger}, nil
+}
+
+// csvLine formats one CSV row
+func csvLine(record []string) []byte {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(record)
+	cw.Flush()
+	return buf.Bytes()
+}
+
+// write appends a stored result to the log
+func (l *resultLog) write(res testResult) {
+	if l == nil {
+		return
+	}
+	var line []byte
+	if l.format == "csv" {
+		line = csvLine(csvRecord(res))
+	} else {
+		var err error
+		if line, err = json.Marshal(res); err != nil {
+			l.logger.Error("Encoding result for the result log failed", "err", err)
+			return
+		}
+		line = append(line, '\n')
+	}
+	if _, err := l.out.Write(line); err != nil {
+		l.logger.Warn("Writing result log failed", "file", l.out.name, "err", err)
+	}
+}
+
+// close closes the log file
+func (l *resultLog) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.out.close()
+}
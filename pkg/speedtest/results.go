@@ -0,0 +1,664 @@
+package speedtest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResultsLimit = 100  // Results returned when no limit is given
+	maxResultsLimit     = 1000 // Upper bound on results returned per page
+	maxPlausibleMbps    = 100000
+	defaultHistoryLimit = 30  // Past tests charted by the web UI
+	maxHistoryLimit     = 100 // Upper bound on past tests returned by /api/history
+)
+
+// testResult is one completed speed test
+type testResult struct {
+	// Short public ID used in shareable /result/{id} links
+	ID        string    `json:"id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	SessionID string    `json:"session_id,omitempty"`
+	// Remote server tested by a scheduled test; empty for tests run against this server
+	Server string `json:"server,omitempty"`
+	// Agent that measured the result and reported it to this collector
+	Agent string `json:"agent,omitempty"`
+	// Instances on either end of a mesh test
+	Mesh *meshLink `json:"mesh,omitempty"`
+
+	// Approximate client location, when a GeoIP database is configured
+	Location *geoLocation `json:"location,omitempty"`
+	// Client network, when an ASN database is configured
+	ISP *ispInfo `json:"isp,omitempty"`
+	// Named segment of the client's network, when segments are configured
+	Segment string `json:"segment,omitempty"`
+
+	// Values measured by the browser
+	Download float64 `json:"download"` // Mbps
+	Upload   float64 `json:"upload"`   // Mbps
+	Latency  float64 `json:"latency"`  // Milliseconds
+	Jitter   float64 `json:"jitter"`   // Milliseconds
+	// Responsiveness under load in round trips per minute, when measured
+	RPM float64 `json:"rpm,omitempty"`
+
+	// Values measured by the server, when the test used a session
+	ServerDownload float64 `json:"server_download,omitempty"` // Mbps
+	ServerUpload   float64 `json:"server_upload,omitempty"`   // Mbps
+	// Latency under load, when the client kept a session's ping channel open
+	Bufferbloat *bufferbloatResult `json:"bufferbloat,omitempty"`
+	// Distribution of the round trips the server measured on that channel
+	LatencyStats *latencyReport `json:"latency_stats,omitempty"`
+	// Packet loss in percent, when the client measured it
+	Loss *float64 `json:"loss,omitempty"`
+	// Retransmits, round trips and congestion windows of the test's
+	// connections, as the server's kernel saw them
+	TCPInfo *tcpReport `json:"tcp_info,omitempty"`
+
+	// Composite score and per-use-case verdicts derived from the values above
+	Quality *qualityReport `json:"quality,omitempty"`
+	// Expected voice call quality, estimated with the E-model
+	VoIP *voipEstimate `json:"voip,omitempty"`
+}
+
+// resultFilter selects results from the store
+type resultFilter struct {
+	From, To  time.Time // Zero values leave the range open
+	IP        string
+	Limit     int
+	Offset    int
+	Ascending bool
+}
+
+// matches reports whether a result passes the filter
+func (f resultFilter) matches(res testResult) bool {
+	if !f.From.IsZero() && res.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && res.Timestamp.After(f.To) {
+		return false
+	}
+	if f.IP != "" && res.ClientIP != f.IP {
+		return false
+	}
+	return true
+}
+
+// resultStore keeps completed test results
+type resultStore interface {
+	// add stores a new result, assigning it an ID when it has none
+	add(res *testResult) error
+	// get returns the result with the given ID
+	get(id string) (testResult, bool, error)
+	// query returns one page of results matching the filter plus the total number of matches
+	query(f resultFilter) ([]testResult, int, error)
+	// prune deletes results older than before, unless it is zero, and all but
+	// the newest keep results, unless keep is 0. It returns how many it deleted.
+	prune(before time.Time, keep int) (int, error)
+	close() error
+}
+
+// openResultStore opens the SQL database named by the config's DSN, or else
+// the results file
+func openResultStore(cfg ResultsConfig) (resultStore, error) {
+	if cfg.DSN != "" {
+		store, err := openSQLResultStore(cfg.DSN)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	store, err := openFileResultStore(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// fileResultStore keeps completed test results in memory, optionally
+// appending them to a JSON Lines file so they survive restarts
+type fileResultStore struct {
+	mu      sync.RWMutex
+	results []testResult // Ordered oldest first
+	file    *os.File
+}
+
+// openFileResultStore loads previously stored results from path and appends
+// new ones to it. An empty path keeps results in memory only.
+func openFileResultStore(path string) (*fileResultStore, error) {
+	store := &fileResultStore{}
+	if path == "" {
+		return store, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening results file: %w", err)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var res testResult
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		store.results = append(store.results, res)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading results file: %w", err)
+	}
+
+	// Keep results ordered even if the file was edited by hand
+	sort.SliceStable(store.results, func(i, j int) bool {
+		return store.results[i].Timestamp.Before(store.results[j].Timestamp)
+	})
+
+	store.file = f
+	return store, nil
+}
+
+// close closes the results file, if any
+func (st *fileResultStore) close() error {
+	if st.file == nil {
+		return nil
+	}
+	return st.file.Close()
+}
+
+// newResultID returns a random, URL-safe result ID
+func newResultID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// assignResultID gives a result a new ID when it has none
+func assignResultID(res *testResult) error {
+	if res.ID != "" {
+		return nil
+	}
+	id, err := newResultID()
+	if err != nil {
+		return fmt.Errorf("creating result ID: %w", err)
+	}
+	res.ID = id
+	return nil
+}
+
+func (st *fileResultStore) add(res *testResult) error {
+	if err := assignResultID(res); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.file != nil {
+		line, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		if _, err := st.file.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("writing result: %w", err)
+		}
+	}
+
+	// Results normally arrive in order, but keyed submissions may backdate them
+	i := sort.Search(len(st.results), func(i int) bool {
+		return st.results[i].Timestamp.After(res.Timestamp)
+	})
+	st.results = append(st.results, testResult{})
+	copy(st.results[i+1:], st.results[i:])
+	st.results[i] = *res
+	return nil
+}
+
+func (st *fileResultStore) get(id string) (testResult, bool, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	// Shared links are usually for recent tests, so search newest first
+	for i := len(st.results) - 1; i >= 0; i-- {
+		if st.results[i].ID == id {
+			return st.results[i], true, nil
+		}
+	}
+	return testResult{}, false, nil
+}
+
+func (st *fileResultStore) query(f resultFilter) ([]testResult, int, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var matched []testResult
+	for _, res := range st.results {
+		if f.matches(res) {
+			matched = append(matched, res)
+		}
+	}
+
+	if !f.Ascending {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+
+	total := len(matched)
+	if f.Offset >= total {
+		return []testResult{}, total, nil
+	}
+	end := total
+	if f.Limit > 0 && f.Offset+f.Limit < end {
+		end = f.Offset + f.Limit
+	}
+	return matched[f.Offset:end], total, nil
+}
+
+func (st *fileResultStore) prune(before time.Time, keep int) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// Results are ordered oldest first, so pruning cuts off a prefix
+	start := 0
+	if !before.IsZero() {
+		start = sort.Search(len(st.results), func(i int) bool {
+			return !st.results[i].Timestamp.Before(before)
+		})
+	}
+	if keep > 0 && len(st.results)-start > keep {
+		start = len(st.results) - keep
+	}
+	if start == 0 {
+		return 0, nil
+	}
+
+	kept := append([]testResult{}, st.results[start:]...)
+	if st.file != nil {
+		if err := st.rewrite(kept); err != nil {
+			return 0, err
+		}
+	}
+	st.results = kept
+	return start, nil
+}
+
+// rewrite replaces the results file with the given results. The new file is
+// written next to the old one and renamed over it, so a crash leaves one of
+// them intact.
+func (st *fileResultStore) rewrite(results []testResult) error {
+	path := st.file.Name()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("rewriting results file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, res := range results {
+		if err := enc.Encode(res); err != nil {
+			tmp.Close()
+			return fmt.Errorf("rewriting results file: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("rewriting results file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("rewriting results file: %w", err)
+	}
+
+	// Windows cannot rename over a file that is still open
+	st.file.Close()
+	renameErr := os.Rename(tmp.Name(), path)
+	if st.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644); err != nil {
+		return fmt.Errorf("reopening results file: %w", err)
+	}
+	if renameErr != nil {
+		return fmt.Errorf("rewriting results file: %w", renameErr)
+	}
+	return nil
+}
+
+// parseResultFilter reads filtering and pagination options from the query string
+func parseResultFilter(r *http.Request) (resultFilter, error) {
+	q := r.URL.Query()
+	f := resultFilter{
+		IP:    q.Get("ip"),
+		Limit: defaultResultsLimit,
+	}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		if f.From, err = parseTime(v); err != nil {
+			return f, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if f.To, err = parseTime(v); err != nil {
+			return f, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > maxResultsLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxResultsLimit)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if f.Offset, err = strconv.Atoi(v); err != nil || f.Offset < 0 {
+			return f, fmt.Errorf("invalid offset")
+		}
+	}
+	switch q.Get("sort") {
+	case "", "desc":
+	case "asc":
+		f.Ascending = true
+	default:
+		return f, fmt.Errorf("sort must be asc or desc")
+	}
+
+	return f, nil
+}
+
+// parseTime accepts RFC 3339 timestamps or Unix seconds
+func parseTime(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// validMeasurement reports whether a submitted value is plausible
+func validMeasurement(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0) && v >= 0
+}
+
+// announceResult passes a newly stored result on to the result log, syslog,
+// webhooks, MQTT and InfluxDB
+func (s *Server) announceResult(res testResult) {
+	s.resultLog.write(res)
+	s.syslog.event(completedEvent(res))
+	s.webhooks.notify(res)
+	s.mqtt.publish(res)
+	s.influx.write(res)
+	s.reporter.report(res)
+}
+
+// submittedResult is the body of POST /api/results
+type submittedResult struct {
+	Download float64  `json:"download"`
+	Upload   float64  `json:"upload"`
+	Latency  float64  `json:"latency"`
+	Jitter   float64  `json:"jitter"`
+	RPM      float64  `json:"rpm,omitempty"`
+	Loss     *float64 `json:"loss,omitempty"` // Percent
+	Session  string   `json:"session,omitempty"`
+	Nonce    string   `json:"nonce,omitempty"` // Issued with the session, see checkResultNonce
+
+	// Only honoured with an API key, for results measured elsewhere
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Agent     string    `json:"agent,omitempty"`
+	Server    string    `json:"server,omitempty"`
+}
+
+// handleResults lists stored results (GET, API key required) and stores a
+// browser-computed result (POST, anonymous)
+func (s *Server) handleResults(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch r.Method {
+	case "GET":
+		if !s.checkAPIKey(w, r) {
+			return
+		}
+
+		f, err := parseResultFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page, total, err := s.results.query(f)
+		if err != nil {
+			s.log("results").Error("Reading results failed", "err", err)
+			http.Error(w, "Could not read results", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"total":   total,
+			"limit":   f.Limit,
+			"offset":  f.Offset,
+			"results": page,
+		})
+
+	case "POST":
+		var submitted submittedResult
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&submitted); err != nil {
+			http.Error(w, "Invalid result", http.StatusBadRequest)
+			return
+		}
+		for _, v := range []float64{submitted.Download, submitted.Upload, submitted.Latency, submitted.Jitter, submitted.RPM} {
+			if !validMeasurement(v) {
+				http.Error(w, "Invalid result", http.StatusBadRequest)
+				return
+			}
+		}
+		if submitted.Download > maxPlausibleMbps || submitted.Upload > maxPlausibleMbps {
+			http.Error(w, "Invalid result", http.StatusBadRequest)
+			return
+		}
+		if l := submitted.Loss; l != nil && (!validMeasurement(*l) || *l > 100) {
+			http.Error(w, "Invalid result", http.StatusBadRequest)
+			return
+		}
+
+		// Results vouched for by an API key need no nonce
+		trusted := len(s.cfg.APIKeys) > 0 && s.validAPIKey(r)
+		if !trusted && !s.checkResultNonce(w, r, submitted.Nonce, submitted.Session) {
+			return
+		}
+
+		res := testResult{
+			Timestamp: time.Now().UTC(),
+			ClientIP:  s.clientIP(r),
+			UserAgent: r.UserAgent(),
+			Download:  submitted.Download,
+			Upload:    submitted.Upload,
+			Latency:   submitted.Latency,
+			Jitter:    submitted.Jitter,
+			RPM:       submitted.RPM,
+			Loss:      submitted.Loss,
+		}
+		if trusted {
+			if !submitted.Timestamp.IsZero() {
+				res.Timestamp = submitted.Timestamp.UTC()
+			}
+			if submitted.ClientIP != "" {
+				if net.ParseIP(submitted.ClientIP) == nil {
+					http.Error(w, "Invalid client_ip", http.StatusBadRequest)
+					return
+				}
+				res.ClientIP = submitted.ClientIP
+			}
+			if submitted.UserAgent != "" {
+				res.UserAgent = submitted.UserAgent
+			}
+			res.Agent, res.Server = submitted.Agent, submitted.Server
+		}
+		res.Location = s.geoIP.locate(res.ClientIP)
+		res.ISP = s.geoIP.isp(res.ClientIP)
+		res.Segment = s.segments.match(res.ClientIP)
+
+		// Attach the server's own view of the test when it used a session of
+		// the submitting client
+		if session, ok := s.sessions.lookup(submitted.Session, s.clientIP(r)); ok {
+			sum := session.summary()
+			res.SessionID = sum.ID
+			res.ServerDownload = sum.Download.Mbps
+			res.ServerUpload = sum.Upload.Mbps
+			res.Bufferbloat = sum.Bufferbloat
+			res.LatencyStats = sum.LatencyStats
+			if sum.Download.TCP != nil || sum.Upload.TCP != nil {
+				res.TCPInfo = &tcpReport{Download: sum.Download.TCP, Upload: sum.Upload.TCP}
+			}
+		}
+		res.Quality = rateQuality(&res)
+		res.VoIP = estimateVoIP(&res)
+
+		if err := s.results.add(&res); err != nil {
+			s.log("results").Error("Storing result failed", "err", err)
+			http.Error(w, "Could not store result", http.StatusInternalServerError)
+			return
+		}
+		s.announceResult(res)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(res)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleHistory returns the calling client's own past results, oldest first,
+// for the history charts in the web UI
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	// Take the newest results, then flip them so charts read left to right
+	page, _, err := s.results.query(resultFilter{IP: s.clientIP(r), Limit: limit})
+	if err != nil {
+		s.log("results").Error("Reading results failed", "err", err)
+		http.Error(w, "Could not read results", http.StatusInternalServerError)
+		return
+	}
+	for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+		page[i], page[j] = page[j], page[i]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": page,
+	})
+}
+
+// sharedResult is the public view of a stored result. It leaves out the
+// client's IP address and user agent, since shared links may be passed on.
+type sharedResult struct {
+	ID             string             `json:"id"`
+	Timestamp      time.Time          `json:"timestamp"`
+	ISP            string             `json:"isp,omitempty"`
+	Country        string             `json:"country,omitempty"`
+	Download       float64            `json:"download"`
+	Upload         float64            `json:"upload"`
+	Latency        float64            `json:"latency"`
+	Jitter         float64            `json:"jitter"`
+	RPM            float64            `json:"rpm,omitempty"`
+	ServerDownload float64            `json:"server_download,omitempty"`
+	ServerUpload   float64            `json:"server_upload,omitempty"`
+	Bufferbloat    *bufferbloatResult `json:"bufferbloat,omitempty"`
+	Quality        *qualityReport     `json:"quality,omitempty"`
+	VoIP           *voipEstimate      `json:"voip,omitempty"`
+}
+
+// handleSharedResult returns a single result by ID, for shareable result pages
+func (s *Server) handleSharedResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, APIPrefix+"/results/")
+	res, ok, err := s.results.get(id)
+	if err != nil {
+		s.log("results").Error("Reading results failed", "err", err)
+		http.Error(w, "Could not read results", http.StatusInternalServerError)
+		return
+	}
+	if id == "" || !ok {
+		http.Error(w, "Result not found", http.StatusNotFound)
+		return
+	}
+
+	shared := sharedResult{
+		ID:             res.ID,
+		Timestamp:      res.Timestamp,
+		Download:       res.Download,
+		Upload:         res.Upload,
+		Latency:        res.Latency,
+		Jitter:         res.Jitter,
+		RPM:            res.RPM,
+		ServerDownload: res.ServerDownload,
+		ServerUpload:   res.ServerUpload,
+		Bufferbloat:    res.Bufferbloat,
+		Quality:        res.Quality,
+		VoIP:           res.VoIP,
+	}
+	if res.ISP != nil {
+		shared.ISP = res.ISP.Name
+	}
+	if res.Location != nil {
+		shared.Country = res.Location.Country
+	}
+
+	// Stored results never change
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(shared)
+}
+
+// handleResultPage serves the read-only page behind a shared result link,
+// or the result as an image when the ID ends in .svg or .png
+func (s *Server) handleResultPage(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/result/")
+	for _, format := range []string{"svg", "png"} {
+		if badgeID, ok := strings.CutSuffix(id, "."+format); ok {
+			s.handleResultBadge(w, r, badgeID, format)
+			return
+		}
+	}
+
+	if id == "" || s.webFS == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveBranded(w, r, "result.html")
+}
@@ -0,0 +1,133 @@
+package speedtest
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLDriver(t *testing.T) {
+	tests := []struct {
+		dsn            string
+		driver, source string // An empty driver expects an error
+	}{
+		{"postgres://st:secret@db:5432/speedtest?sslmode=disable", "postgres", "postgres://st:secret@db:5432/speedtest?sslmode=disable"},
+		{"postgresql://st@db/speedtest", "postgres", "postgresql://st@db/speedtest"},
+		{"mysql://st:secret@db:3306/speedtest", "mysql", "st:secret@tcp(db:3306)/speedtest?parseTime=true"},
+		{"mysql://st@db/speedtest?timeout=5s", "mysql", "st@tcp(db:3306)/speedtest?parseTime=true&timeout=5s"},
+		{"sqlite://db/speedtest", "", ""},
+		{"postgres:///speedtest", "", ""},
+		{"db:5432", "", ""},
+	}
+	for _, tt := range tests {
+		driver, source, err := sqlDriver(tt.dsn)
+		if tt.driver == "" {
+			if err == nil {
+				t.Errorf("sqlDriver(%q) = %q, %q, want an error", tt.dsn, driver, source)
+			}
+			continue
+		}
+		if err != nil || driver != tt.driver || source != tt.source {
+			t.Errorf("sqlDriver(%q) = %q, %q, %v, want %q, %q", tt.dsn, driver, source, err, tt.driver, tt.source)
+		}
+	}
+}
+
+func TestSQLBind(t *testing.T) {
+	query := "SELECT data FROM speedtest_results WHERE tested_at >= ? AND client_ip = ? LIMIT ? OFFSET ?"
+	tests := []struct {
+		driver, want string
+	}{
+		{"postgres", "SELECT data FROM speedtest_results WHERE tested_at >= $1 AND client_ip = $2 LIMIT $3 OFFSET $4"},
+		{"mysql", query},
+	}
+	for _, tt := range tests {
+		st := &sqlResultStore{driver: tt.driver}
+		if got := st.bind(query); got != tt.want {
+			t.Errorf("bind() for %s = %q, want %q", tt.driver, got, tt.want)
+		}
+	}
+}
+
+// TestSQLResultStore runs against the database in SPEEDTEST_TEST_DSN, which
+// must be a scratch database: the test empties its results table
+func TestSQLResultStore(t *testing.T) {
+	dsn := os.Getenv("SPEEDTEST_TEST_DSN")
+	if dsn == "" {
+		t.Skip("SPEEDTEST_TEST_DSN not set")
+	}
+	st, err := openSQLResultStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+	if _, err := st.db.Exec("DELETE FROM speedtest_results"); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		ip := "192.0.2.1"
+		if i%2 == 1 {
+			ip = "192.0.2.2"
+		}
+		res := testResult{
+			Timestamp: base.Add(time.Duration(i) * time.Hour),
+			ClientIP:  ip,
+			Download:  float64(100 + i),
+		}
+		if err := st.add(&res); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			got, ok, err := st.get(res.ID)
+			if err != nil || !ok || got.Download != 100 || !got.Timestamp.Equal(res.Timestamp) {
+				t.Fatalf("get(%s) = %+v, %v, %v", res.ID, got, ok, err)
+			}
+		}
+	}
+	if _, ok, err := st.get("missing"); ok || err != nil {
+		t.Errorf("get(missing) = %v, %v, want not found", ok, err)
+	}
+
+	downloads := func(page []testResult) string {
+		var s []string
+		for _, res := range page {
+			s = append(s, strconv.FormatFloat(res.Download, 'f', -1, 64))
+		}
+		return strings.Join(s, ",")
+	}
+	tests := []struct {
+		name   string
+		filter resultFilter
+		want   string
+		total  int
+	}{
+		{"all, newest first", resultFilter{}, "104,103,102,101,100", 5},
+		{"oldest first", resultFilter{Ascending: true}, "100,101,102,103,104", 5},
+		{"page", resultFilter{Limit: 2, Offset: 1}, "103,102", 5},
+		{"client", resultFilter{IP: "192.0.2.2"}, "103,101", 2},
+		{"time range", resultFilter{From: base.Add(time.Hour), To: base.Add(3 * time.Hour)}, "103,102,101", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, total, err := st.query(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := downloads(page); got != tt.want || total != tt.total {
+				t.Errorf("query() = %s of %d, want %s of %d", got, total, tt.want, tt.total)
+			}
+		})
+	}
+
+	// Keeping the newest three and nothing before the second hour leaves 104,103,102
+	if n, err := st.prune(base.Add(time.Hour+time.Minute), 3); err != nil || n != 2 {
+		t.Fatalf("prune() = %d, %v, want 2", n, err)
+	}
+	if page, _, err := st.query(resultFilter{}); err != nil || downloads(page) != "104,103,102" {
+		t.Errorf("after prune query() = %s, %v, want 104,103,102", downloads(page), err)
+	}
+}
@@ -0,0 +1,112 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pruneInterval = time.Hour // How often results beyond the retention policy are deleted
+
+// ParseRetention parses how long results are kept: a Go duration such as
+// 720h, or a whole number of days or weeks such as 90d or 12w. An empty
+// string keeps results forever.
+func ParseRetention(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	var d time.Duration
+	var err error
+	if n, ok := strings.CutSuffix(v, "d"); ok {
+		var days int
+		days, err = strconv.Atoi(n)
+		d = time.Duration(days) * 24 * time.Hour
+	} else if n, ok := strings.CutSuffix(v, "w"); ok {
+		var weeks int
+		weeks, err = strconv.Atoi(n)
+		d = time.Duration(weeks) * 7 * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(v)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention %q, expected e.g. 90d, 12w or 720h", v)
+	}
+	return d, nil
+}
+
+// retentionCutoff returns the time before which results are deleted, or the
+// zero time when they are kept regardless of age
+func retentionCutoff(retain time.Duration) time.Time {
+	if retain <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-retain)
+}
+
+// pruneLoop deletes results beyond the configured retention on startup and
+// then every pruneInterval
+func (s *Server) pruneLoop(done <-chan struct{}) {
+	retain, _ := ParseRetention(s.cfg.Results.Retain) // Checked by Validate
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := s.results.prune(retentionCutoff(retain), s.cfg.Results.MaxCount)
+		if err != nil {
+			s.log("results").Error("Pruning results failed", "err", err)
+		} else if removed > 0 {
+			s.log("results").Info("Pruned old results", "removed", removed)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleAdminPrune deletes results on demand. Without parameters it applies
+// the configured retention; older_than and keep override it for this purge.
+func (s *Server) handleAdminPrune(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	retention := s.cfg.Results.Retain
+	if v := q.Get("older_than"); v != "" {
+		retention = v
+	}
+	retain, err := ParseRetention(retention)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keep := s.cfg.Results.MaxCount
+	if v := q.Get("keep"); v != "" {
+		if keep, err = strconv.Atoi(v); err != nil || keep < 0 {
+			http.Error(w, "keep must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+	if retain <= 0 && keep == 0 {
+		http.Error(w, "No retention configured; pass older_than or keep", http.StatusBadRequest)
+		return
+	}
+
+	removed, err := s.results.prune(retentionCutoff(retain), keep)
+	if err != nil {
+		s.log("results").Error("Pruning results failed", "err", err)
+		http.Error(w, "Could not prune results", http.StatusInternalServerError)
+		return
+	}
+	s.log("results").Info("Pruned results on request", "removed", removed, "older_than", retention, "keep", keep)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+}
@@ -0,0 +1,154 @@
+package speedtest
+
+import (
+	"math"
+	"time"
+)
+
+// uploadSampleInterval is how often handleUpload samples its throughput
+const uploadSampleInterval = 200 * time.Millisecond
+
+// maxThroughputSamples bounds the samples kept for one transfer, about
+// 13 minutes at the default interval
+const maxThroughputSamples = 4096
+
+// throughputSampler turns a running byte count into throughput samples taken
+// at fixed intervals. It is fed from the transfer loop, so a sample that spans
+// a long read covers more than one interval and is computed over its real length.
+type throughputSampler struct {
+	interval  time.Duration
+	last      time.Time
+	lastBytes int64
+	samples   []float64 // Mbps
+}
+
+// newThroughputSampler starts sampling a transfer that begins at start
+func newThroughputSampler(interval time.Duration, start time.Time) *throughputSampler {
+	return &throughputSampler{interval: interval, last: start}
+}
+
+// observe records a sample once an interval has passed since the last one.
+// total is the number of bytes transferred so far.
+func (t *throughputSampler) observe(now time.Time, total int64) {
+	if now.Sub(t.last) >= t.interval {
+		t.sample(now, total)
+	}
+}
+
+// finish records the trailing partial interval, unless it is too short to
+// give a meaningful rate
+func (t *throughputSampler) finish(now time.Time, total int64) {
+	if now.Sub(t.last) >= t.interval/2 || len(t.samples) == 0 {
+		t.sample(now, total)
+	}
+}
+
+// sample appends the rate since the previous sample
+func (t *throughputSampler) sample(now time.Time, total int64) {
+	secs := now.Sub(t.last).Seconds()
+	if secs <= 0 || len(t.samples) >= maxThroughputSamples {
+		return
+	}
+	t.samples = append(t.samples, float64(total-t.lastBytes)*8/secs/1e6)
+	t.last, t.lastBytes = now, total
+}
+
+// throughputSummary is the JSON view of a transfer's throughput samples
+type throughputSummary struct {
+	IntervalMs int64     `json:"interval_ms"`
+	Samples    []float64 `json:"samples"` // Mbps, oldest first
+	Min        float64   `json:"min"`
+	Avg        float64   `json:"avg"`
+	Max        float64   `json:"max"`
+	StdDev     float64   `json:"stddev"`
+}
+
+// summary returns the samples with their statistics
+func (t *throughputSampler) summary() throughputSummary {
+	sum := throughputSummary{
+		IntervalMs: t.interval.Milliseconds(),
+		Samples:    t.samples,
+	}
+	if len(t.samples) == 0 {
+		sum.Samples = []float64{}
+		return sum
+	}
+
+	sum.Min, sum.Max = math.Inf(1), math.Inf(-1)
+	var total float64
+	for _, v := range t.samples {
+		sum.Min = math.Min(sum.Min, v)
+		sum.Max = math.Max(sum.Max, v)
+		total += v
+	}
+	sum.Avg = total / float64(len(t.samples))
+
+	var variance float64
+	for _, v := range t.samples {
+		variance += (v - sum.Avg) * (v - sum.Avg)
+	}
+	sum.StdDev = math.Sqrt(variance / float64(len(t.samples)))
+	return sum
+}
+
+// warmupWindow finds where a transfer's warm-up ends, so that TCP slow start
+// can be left out of its throughput. The warm-up lasts until both minDuration
+// has passed and minBytes have been transferred; zero skips a condition.
+type warmupWindow struct {
+	minDuration time.Duration
+	minBytes    int64
+	start       time.Time
+	ended       bool
+	endTime     time.Time // When the warm-up ended
+	endBytes    int64     // Bytes transferred during the warm-up
+}
+
+// newWarmupWindow starts watching for the end of the warm-up configured in
+// cfg, for a transfer that begins at start. It returns nil when no warm-up is
+// configured.
+func newWarmupWindow(cfg WarmupConfig, start time.Time) *warmupWindow {
+	if cfg.Seconds <= 0 && cfg.Bytes <= 0 {
+		return nil
+	}
+	return &warmupWindow{
+		minDuration: time.Duration(cfg.Seconds * float64(time.Second)),
+		minBytes:    cfg.Bytes,
+		start:       start,
+	}
+}
+
+// observe checks whether the warm-up is over. total is the number of bytes
+// transferred so far.
+func (w *warmupWindow) observe(now time.Time, total int64) {
+	if w.ended || now.Sub(w.start) < w.minDuration || total < w.minBytes {
+		return
+	}
+	w.ended, w.endTime, w.endBytes = true, now, total
+}
+
+// trimmedThroughput is the throughput of a transfer after its warm-up
+type trimmedThroughput struct {
+	WarmupMs    float64 `json:"warmup_ms"`    // Length of the warm-up left out
+	WarmupBytes int64   `json:"warmup_bytes"` // Bytes transferred during the warm-up
+	Bytes       int64   `json:"bytes"`
+	Duration    float64 `json:"duration"` // Seconds
+	Mbps        float64 `json:"mbps"`
+}
+
+// trimmed returns the throughput after the warm-up for a transfer that moved
+// total bytes by now, or nil when it ended before its warm-up did
+func (w *warmupWindow) trimmed(now time.Time, total int64) *trimmedThroughput {
+	if !w.ended {
+		return nil
+	}
+	t := &trimmedThroughput{
+		WarmupMs:    float64(w.endTime.Sub(w.start).Microseconds()) / 1000,
+		WarmupBytes: w.endBytes,
+		Bytes:       total - w.endBytes,
+		Duration:    now.Sub(w.endTime).Seconds(),
+	}
+	if t.Duration > 0 {
+		t.Mbps = float64(t.Bytes) * 8 / t.Duration / 1e6
+	}
+	return t
+}
@@ -0,0 +1,95 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// schedulerUserAgent marks results recorded by scheduled tests
+const schedulerUserAgent = "speedtest-scheduler"
+
+// errResultNotStored is returned with the result of a client test that ran
+// but could not be stored
+var errResultNotStored = errors.New("result could not be stored")
+
+// startScheduler runs client-mode tests against the configured server on the
+// cron schedule and stores their results in the local result store
+func (s *Server) startScheduler() (*cron.Cron, error) {
+	sc := s.cfg.Schedule
+	c := cron.New(cron.WithChain(
+		// A slow test must not pile up behind the next one
+		cron.SkipIfStillRunning(cron.PrintfLogger(slog.NewLogLogger(s.log("scheduler").Handler(), slog.LevelInfo))),
+	))
+	if _, err := c.AddFunc(sc.Cron, s.runScheduledTest); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", sc.Cron, err)
+	}
+	c.Start()
+	return c, nil
+}
+
+// runScheduledTest performs one test and records its result
+func (s *Server) runScheduledTest() {
+	sc := s.cfg.Schedule
+	res, err := s.runClientTest(context.Background(), s.log("scheduler"), schedulerUserAgent, sc.Server, sc.Streams, sc.Duration, nil)
+	s.monitor.record(sc.Server, res, err)
+}
+
+// runClientTest tests against server in client mode and records the result
+// under userAgent, marked as a mesh test when link is set. It returns the
+// stored result, or the error the test failed with.
+func (s *Server) runClientTest(ctx context.Context, logger *slog.Logger, userAgent, server string, streams, duration int, link *meshLink) (testResult, error) {
+	logger = logger.With("server", server)
+	client, err := NewClient(server, streams, time.Duration(duration)*time.Second)
+	if err != nil {
+		logger.Error("Scheduled test not run", "err", err)
+		clientTestFailed(server)
+		return testResult{}, err
+	}
+
+	logger.Info("Running scheduled test")
+	event := testEvent{Event: "test.started", UserAgent: userAgent, Server: server, Streams: streams}
+	s.syslog.event(event)
+	res, err := client.Run(ctx, nil)
+	if err != nil {
+		logger.Warn("Scheduled test failed", "err", err)
+		clientTestFailed(server)
+		event.Event, event.Error = "test.failed", err.Error()
+		s.syslog.event(event)
+		return testResult{}, err
+	}
+
+	stored := testResult{
+		Timestamp:      res.Timestamp,
+		UserAgent:      userAgent,
+		Server:         res.Server,
+		Mesh:           link,
+		Download:       res.Download,
+		Upload:         res.Upload,
+		Latency:        res.Latency,
+		Jitter:         res.Jitter,
+		RPM:            res.RPM,
+		ServerDownload: res.ServerDownload,
+		ServerUpload:   res.ServerUpload,
+	}
+	stored.Quality = rateQuality(&stored)
+	stored.VoIP = estimateVoIP(&stored)
+	clientTestFinished(server, stored)
+	if err := s.results.add(&stored); err != nil {
+		logger.Error("Storing scheduled test result failed", "err", err)
+		return stored, errResultNotStored
+	}
+	s.announceResult(stored)
+	logger.Info("Scheduled test finished",
+		"id", stored.ID,
+		"download_mbps", res.Download,
+		"upload_mbps", res.Upload,
+		"latency_ms", res.Latency,
+		"jitter_ms", res.Jitter,
+	)
+	return stored, nil
+}
@@ -0,0 +1,50 @@
+package speedtest
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// segmentPrefix is one network of a named segment
+type segmentPrefix struct {
+	name   string
+	prefix netip.Prefix
+}
+
+// segmentMatcher finds the named segment a client IP belongs to. Prefixes
+// are ordered most specific first, so a VLAN inside an office's range gets
+// the VLAN's name.
+type segmentMatcher []segmentPrefix
+
+// newSegmentMatcher parses the networks of the configured segments
+func newSegmentMatcher(segments []Segment) (segmentMatcher, error) {
+	var m segmentMatcher
+	for _, seg := range segments {
+		for _, cidr := range seg.CIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q of segment %s: %w", cidr, seg.Name, err)
+			}
+			m = append(m, segmentPrefix{name: seg.Name, prefix: prefix.Masked()})
+		}
+	}
+	sort.SliceStable(m, func(i, j int) bool { return m[i].prefix.Bits() > m[j].prefix.Bits() })
+	return m, nil
+}
+
+// match returns the name of the segment ip belongs to, or "" when it is in
+// none of them
+func (m segmentMatcher) match(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, seg := range m {
+		if seg.prefix.Contains(addr) {
+			return seg.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,427 @@
+// Package speedtest implements the speed test server: the download, upload
+// and latency endpoints, test sessions, admission control and result storage.
+// The speedtest command serves it on its own; other Go services can mount
+// Server.Handler to embed the same endpoints.
+package speedtest
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robfig/cron/v3"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// Server serves speed tests according to its Config. Create it with New and
+// call Start before serving requests from Handler.
+type Server struct {
+	cfg     Config
+	loggers map[string]*slog.Logger // One per LogModules entry, see log
+	webFS   fs.FS
+
+	sessions       *sessionRegistry
+	udpProbes      *udpProbeRegistry
+	results        resultStore
+	geoIP          *geoIPReader
+	trustedProxies []*net.IPNet
+	segments       segmentMatcher
+	limiter        *ipRateLimiter      // Tests started per client IP; nil disables rate limiting
+	slots          *concurrencyLimiter // Tests transferring at once; nil leaves concurrency unlimited
+	tokens         *tokenIssuer        // Nil when tokens are not required
+	resultNonces   *tokenIssuer        // Signs the nonces results are submitted with
+	bandwidth      *bandwidthCap       // Server-wide traffic cap; nil when uncapped
+	webhooks       *webhookNotifier    // Nil when no webhooks are configured
+	mqtt           *mqttPublisher      // Nil when no MQTT broker is configured
+	monitor        *monitor            // Nil when no monitor thresholds are set
+	influx         *influxWriter       // Nil when no InfluxDB is configured
+	reporter       *reporter           // Nil unless results are reported to a collector
+	access         *accessLog          // Nil when no access log is configured
+	resultLog      *resultLog          // Nil when no result log is configured
+	syslog         *syslogWriter       // Nil when no syslog server is configured
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider // Nil when tracing is off
+	stats          *statsCollector
+	buffers        *bufferPools
+	random         *randomBlock // Test data for downloads
+	scheduler      *cron.Cron
+	meshCron       *cron.Cron
+	udpConn        *net.UDPConn
+	webrtc         *webrtcListener // Nil unless WebRTC probes are served
+	stun           *stunResponder  // Nil unless STUN requests are answered
+	iperfListener  net.Listener    // Nil unless iperf3 clients are served
+	grpcServer     *grpc.Server    // Nil unless the gRPC API is served
+	mdns           *mdnsResponder  // Nil unless the server is advertised on the LAN
+	iperf          iperfState
+	remoteTest     sync.Mutex   // Held while a test requested through the API runs
+	middleware     []Middleware // Wrapped around every endpoint, see Use
+
+	done chan struct{} // Closed by Close to stop background work
+}
+
+// New creates a server for cfg, which should have passed Config.Validate
+func New(cfg Config) *Server {
+	s := &Server{
+		cfg:       cfg,
+		webFS:     cfg.WebFS,
+		udpProbes: &udpProbeRegistry{probes: make(map[string]*udpProbe)},
+		stats:     &statsCollector{started: time.Now()},
+		buffers:   newBufferPools(cfg.UploadBufferSize),
+		tracer:    noopTracer,
+		done:      make(chan struct{}),
+	}
+	base := cfg.Logger
+	if base == nil {
+		// Logging to stdout, NewLogger cannot fail
+		lc := cfg.Log
+		lc.File = ""
+		base, _ = NewLogger(lc)
+	}
+	s.loggers = make(map[string]*slog.Logger, len(LogModules))
+	for _, module := range LogModules {
+		s.loggers[module] = cfg.Log.ModuleLogger(base, module)
+	}
+	if cfg.MaxConcurrent > 0 {
+		s.slots = newConcurrencyLimiter(cfg.MaxConcurrent)
+	}
+	if cfg.RateLimit.TestsPerHour > 0 {
+		s.limiter = newIPRateLimiter(cfg.RateLimit.TestsPerHour)
+	}
+	s.bandwidth = newBandwidthCap(cfg.Bandwidth, max(cfg.ChunkSize, cfg.UploadBufferSize))
+	s.webhooks = newWebhookNotifier(cfg.Webhooks, s.log("webhook"))
+	s.mqtt = newMQTTPublisher(cfg.MQTT, s.log("mqtt"))
+	s.monitor = newMonitor(cfg.Monitor, cfg.Webhooks.Timeout, s.mqtt, s.log("monitor"))
+	s.influx = newInfluxWriter(cfg.InfluxDB, s.log("influxdb"))
+	if s.cfg.Report.Name == "" {
+		s.cfg.Report.Name, _ = os.Hostname()
+	}
+	s.reporter = newReporter(s.cfg.Report, s.log("report"), s.done)
+	s.sessions = newSessionRegistry(s.slots, time.Duration(cfg.MaxDuration)*time.Second+sessionPhaseSlack)
+	return s
+}
+
+// Start opens the result store, GeoIP databases, access log and result log,
+// connects to syslog, starts the trace exporter, UDP probe and iperf3 listeners, mDNS
+// advertisement and scheduled tests when configured, announces the result
+// sensors to Home Assistant when MQTT discovery is enabled, and starts the
+// background work that expires sessions and samples statistics
+func (s *Server) Start() error {
+	var err error
+	if s.trustedProxies, err = parseTrustedProxies(s.cfg.TrustedProxies); err != nil {
+		return err
+	}
+	if s.segments, err = newSegmentMatcher(s.cfg.Segments); err != nil {
+		return err
+	}
+	if s.results, err = openResultStore(s.cfg.Results); err != nil {
+		return fmt.Errorf("opening result store: %w", err)
+	}
+	if s.geoIP, err = openGeoIP(s.cfg.GeoIP, s.log("geoip")); err != nil {
+		return err
+	}
+	if s.syslog, err = openSyslog(s.cfg.Syslog, s.log("syslog")); err != nil {
+		return err
+	}
+	accessSyslog := s.syslog
+	if !s.cfg.Syslog.AccessLog {
+		accessSyslog = nil
+	}
+	if s.access, err = openAccessLog(s.cfg.AccessLog, accessSyslog); err != nil {
+		return err
+	}
+	if s.resultLog, err = openResultLog(s.cfg.ResultLog, s.log("results")); err != nil {
+		return err
+	}
+	if s.cfg.Tracing.Endpoint != "" {
+		if s.tracerProvider, err = startTracing(s.cfg.Tracing); err != nil {
+			return err
+		}
+		s.tracer = s.tracerProvider.Tracer(tracerName)
+	}
+	if s.cfg.PayloadFile != "" {
+		s.random, err = openPayloadFile(s.cfg.PayloadFile, s.cfg.PayloadSizeMB*1024*1024, s.log("server"))
+	} else {
+		s.random, err = newRandomBlock(randomBlockSize)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Nonces issued with each session vouch for results submitted later
+	if s.resultNonces, err = newTokenIssuer("", sessionTTL); err != nil {
+		return fmt.Errorf("setting up result nonces: %w", err)
+	}
+	go s.resultNonces.expireLoop(s.done)
+
+	// Keep the result history within the retention policy
+	if s.cfg.Results.Retain != "" || s.cfg.Results.MaxCount > 0 {
+		go s.pruneLoop(s.done)
+	}
+
+	// Signed one-time tokens keep third parties from hot-linking test files
+	if s.cfg.Tokens.Required {
+		if s.tokens, err = newTokenIssuer(s.cfg.Tokens.Secret, time.Duration(s.cfg.Tokens.TTL)*time.Second); err != nil {
+			return fmt.Errorf("setting up test tokens: %w", err)
+		}
+		go s.tokens.expireLoop(s.done)
+	}
+
+	// Optional UDP packet-loss and jitter probes
+	if s.cfg.UDP.Enabled {
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s.cfg.BindHost(), strconv.Itoa(s.cfg.UDP.Port)))
+		if err != nil {
+			return fmt.Errorf("resolving UDP probe address: %w", err)
+		}
+		if s.udpConn, err = net.ListenUDP("udp", addr); err != nil {
+			return fmt.Errorf("listening on UDP port %d: %w", s.cfg.UDP.Port, err)
+		}
+		s.log("udp").Info("Starting UDP probe listener", "addr", s.udpConn.LocalAddr().String())
+		go s.serveUDP()
+	}
+
+	// Optional WebRTC data channel probes, sharing the UDP probes' registry
+	if s.cfg.WebRTC.Enabled {
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s.cfg.BindHost(), strconv.Itoa(s.cfg.WebRTC.Port)))
+		if err != nil {
+			return fmt.Errorf("resolving WebRTC address: %w", err)
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return fmt.Errorf("listening on WebRTC port %d: %w", s.cfg.WebRTC.Port, err)
+		}
+		if s.webrtc, err = newWebRTCListener(conn, s.log("udp")); err != nil {
+			conn.Close()
+			return err
+		}
+		s.log("udp").Info("Starting WebRTC probe listener", "addr", conn.LocalAddr().String())
+		go s.webrtc.serve()
+		go s.webrtc.expireLoop(s.done)
+	}
+	if s.cfg.UDP.Enabled || s.cfg.WebRTC.Enabled {
+		go s.udpProbes.expireLoop(s.done)
+	}
+
+	// Optional STUN responder, so clients can find out their NAT type
+	if s.cfg.STUN.Enabled {
+		var conns [2]*net.UDPConn
+		for i := range conns {
+			port := s.cfg.STUN.Port + i
+			addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s.cfg.BindHost(), strconv.Itoa(port)))
+			if err == nil {
+				conns[i], err = net.ListenUDP("udp", addr)
+			}
+			if err != nil {
+				if i > 0 {
+					conns[0].Close()
+				}
+				return fmt.Errorf("listening on STUN port %d: %w", port, err)
+			}
+		}
+		s.log("udp").Info("Starting STUN responder", "addr", conns[0].LocalAddr().String(), "alternate", conns[1].LocalAddr().String())
+		s.stun = newSTUNResponder(conns, s.log("udp"))
+		go s.stun.expireLoop(s.done)
+	}
+
+	// Optional listener for classic iperf3 clients
+	if s.cfg.IPerf3.Enabled {
+		addr := net.JoinHostPort(s.cfg.BindHost(), strconv.Itoa(s.cfg.IPerf3.Port))
+		if s.iperfListener, err = net.Listen("tcp", addr); err != nil {
+			return fmt.Errorf("listening on iperf3 port %d: %w", s.cfg.IPerf3.Port, err)
+		}
+		s.log("iperf").Info("Starting iperf3 listener", "addr", s.iperfListener.Addr().String())
+		go s.serveIPerf()
+	}
+
+	// Optional gRPC API
+	if s.cfg.GRPC.Enabled {
+		if err := s.startGRPC(); err != nil {
+			return err
+		}
+	}
+
+	// Advertise the server to clients on the local network
+	if s.cfg.MDNS.Enabled {
+		if s.mdns, err = s.startMDNS(); err != nil {
+			return err
+		}
+		s.log("mdns").Info("Advertising over mDNS", "service", mdnsService)
+	}
+
+	// Periodic tests against another server
+	if s.cfg.Schedule.Cron != "" {
+		if s.scheduler, err = s.startScheduler(); err != nil {
+			return err
+		}
+		s.log("scheduler").Info("Testing on schedule", "server", s.cfg.Schedule.Server, "cron", s.cfg.Schedule.Cron)
+	}
+
+	// Tests between the instances of a mesh
+	if s.cfg.Mesh.Cron != "" {
+		if s.cfg.Mesh.Name == "" {
+			s.cfg.Mesh.Name, _ = os.Hostname()
+		}
+		if s.meshCron, err = s.startMesh(); err != nil {
+			return err
+		}
+		s.log("mesh").Info("Testing mesh on schedule", "name", s.cfg.Mesh.Name, "targets", len(s.meshTargets()), "cron", s.cfg.Mesh.Cron)
+	}
+
+	// Let Home Assistant pick up the result sensors
+	s.mqtt.announceDiscovery()
+
+	// Forget abandoned test sessions
+	go s.sessions.expireLoop(s.done)
+	go s.stats.sampleLoop(s.done)
+	if s.limiter != nil {
+		go s.limiter.expireLoop(s.done)
+	}
+	return nil
+}
+
+// Close stops background work and scheduled tests, waits for results and
+// alerts still being sent to webhooks, MQTT, InfluxDB, the collector and
+// email, withdraws the mDNS advertisement, flushes pending traces and closes
+// the UDP, WebRTC, STUN, iperf3 and gRPC listeners, result store, GeoIP
+// databases, access log and result log, sending what is still queued for
+// syslog, and unmaps the payload file
+func (s *Server) Close() error {
+	close(s.done)
+	if s.scheduler != nil {
+		<-s.scheduler.Stop().Done()
+	}
+	if s.meshCron != nil {
+		<-s.meshCron.Stop().Done()
+	}
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	s.webrtc.close()
+	s.stun.close()
+	if s.iperfListener != nil {
+		s.iperfListener.Close()
+	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if s.mdns != nil {
+		s.mdns.close()
+	}
+	s.webhooks.wait()
+	s.monitor.wait()
+	s.mqtt.wait()
+	s.influx.wait()
+	s.reporter.wait()
+	s.geoIP.close()
+	s.access.close()
+	s.resultLog.close()
+	s.syslog.close()
+	s.random.close()
+	s.stopTracing()
+	if s.results != nil {
+		return s.results.close()
+	}
+	return nil
+}
+
+// Handler returns the HTTP handler serving all speed test endpoints, plus the
+// web UI when Config.WebFS is set, wrapped in the middleware added with Use
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// api registers an endpoint of the versioned API under APIPrefix, and at
+	// its unversioned path for clients written before the API was versioned
+	api := func(path string, handler http.HandlerFunc) {
+		mux.HandleFunc(versionedPath(path), handler)
+		mux.Handle(path, legacyAPI(mux))
+	}
+
+	api("/ping", s.allowCrossOrigin(s.handlePing))
+	api("/testfile", s.allowCrossOrigin(s.requireToken(s.limitTests(s.handleTestFile))))
+	api("/upload", s.allowCrossOrigin(s.requireToken(s.limitTests(s.handleUpload))))
+	api("/ws/ping", s.handleWSPing)
+	api("/ws/download", s.requireToken(s.limitTests(s.handleWSDownload)))
+	api("/ws/upload", s.requireToken(s.limitTests(s.handleWSUpload)))
+	api("/api/session", s.allowCrossOrigin(s.handleSession))
+	api("/api/session/", s.allowCrossOrigin(s.handleSession))
+	api("/api/servers", s.handleServers)
+	api("/api/results", s.allowCrossOrigin(s.handleResults))
+	api("/api/results/", s.handleSharedResult)
+	api("/api/results/export", s.requireAPIKey(s.handleResultsExport))
+	api("/api/stats", s.requireAPIKey(s.handleAggregateStats))
+	api("/api/mesh", s.requireAPIKey(s.handleMesh))
+	api("/api/history", s.allowCrossOrigin(s.handleHistory))
+	mux.HandleFunc("/result/", s.handleResultPage)
+	api("/api/clientinfo", s.allowCrossOrigin(s.handleClientInfo))
+	api("/api/status", s.allowCrossOrigin(s.handleStatus))
+	api("/api/openapi.json", s.allowCrossOrigin(s.handleOpenAPI))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// LibreSpeed's backend endpoints, so its frontends and CLI work unmodified
+	mux.HandleFunc("/garbage.php", s.handleLibreSpeedGarbage)
+	mux.HandleFunc("/empty.php", s.handleLibreSpeedEmpty)
+	mux.HandleFunc("/getIP.php", s.handleLibreSpeedIP)
+
+	// M-Lab's ndt7 protocol, for standard ndt7 clients
+	mux.HandleFunc("/ndt/v7/download", s.requireToken(s.limitTests(s.handleNDT7Download)))
+	mux.HandleFunc("/ndt/v7/upload", s.requireToken(s.limitTests(s.handleNDT7Upload)))
+
+	if s.cfg.Tokens.Required {
+		api("/api/token", s.allowCrossOrigin(s.handleToken))
+	}
+	if s.cfg.UDP.Enabled {
+		api("/api/udp/start", s.handleUDPStart)
+		api("/api/udp/stop", s.handleUDPStop)
+	}
+	if s.cfg.WebRTC.Enabled {
+		api("/api/webrtc/offer", s.handleWebRTCOffer)
+		api("/api/webrtc/stop", s.handleUDPStop)
+	}
+
+	// The admin dashboard shows client IPs and remote tests make the server
+	// generate traffic, so both are only served behind API keys
+	if len(s.cfg.APIKeys) > 0 {
+		mux.HandleFunc("/admin/api/stats", s.requireAPIKey(s.handleAdminStats))
+		mux.HandleFunc("/admin/api/prune", s.requireAPIKey(s.handleAdminPrune))
+		api("/api/tests/run", s.requireAPIKey(s.handleTestRun))
+		if s.webFS != nil {
+			mux.HandleFunc("/admin", s.requireAPIKey(s.handleAdmin))
+		}
+	}
+
+	if s.webFS != nil {
+		mux.HandleFunc("/", s.serveHome)
+		mux.HandleFunc("/embed", s.handleEmbed)
+		mux.HandleFunc("/speedtest-widget.js", s.handleWidgetScript)
+		api("/api/locale", s.handleLocale)
+		mux.Handle("/static/", s.withSecurityHeaders(http.StripPrefix("/static/", http.FileServerFS(s.webFS))))
+	}
+
+	var h http.Handler = s.chain(mux)
+	if s.tracerProvider != nil {
+		h = s.traceRequests(mux, h)
+	}
+	// The access log sees requests as they arrive, before any middleware
+	if s.access != nil {
+		h = s.logAccess(h)
+	}
+	return h
+}
+
+// serveHome serves the home page
+func (s *Server) serveHome(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.serveBranded(w, r, "index.html")
+}
@@ -0,0 +1,147 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	selectionPings   = 3               // Pings per candidate when selecting a server, after a warm-up
+	selectionTimeout = 5 * time.Second // Candidates slower to answer are left out
+)
+
+// serverListEntry is one server the web UI can run its test against
+type serverListEntry struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"` // Empty for the server answering the request
+	Location string `json:"location,omitempty"`
+	Local    bool   `json:"local,omitempty"`
+}
+
+// handleServers lists this server and its configured peers, so the web UI
+// can let users pick one or select the one with the lowest latency
+func (s *Server) handleServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	servers := []serverListEntry{{Name: r.Host, Local: true}}
+	for _, peer := range s.cfg.Servers {
+		servers = append(servers, serverListEntry{
+			Name:     peer.Name,
+			URL:      peer.URL,
+			Location: peer.Location,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"servers": servers,
+	})
+}
+
+// ServerLatency is a candidate server and its median HTTP ping time
+type ServerLatency struct {
+	URL     string  `json:"url"`
+	Latency float64 `json:"latency"` // Milliseconds
+}
+
+// ListServers returns the URLs of the servers listed by the server at base,
+// itself included, for picking one with SelectServer
+func ListServers(ctx context.Context, base string) ([]string, error) {
+	base = strings.TrimSuffix(base, "/")
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/api/servers", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing servers: %s", resp.Status)
+	}
+
+	var list struct {
+		Servers []serverListEntry `json:"servers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("listing servers: %w", err)
+	}
+	var urls []string
+	for _, server := range list.Servers {
+		if server.Local {
+			urls = append(urls, base)
+		} else {
+			urls = append(urls, strings.TrimSuffix(server.URL, "/"))
+		}
+	}
+	return urls, nil
+}
+
+// SelectServer pings every candidate at once and returns the one with the
+// lowest median round trip. Unreachable candidates are skipped; an error is
+// returned only when none answers.
+func SelectServer(ctx context.Context, urls []string) (ServerLatency, error) {
+	ctx, cancel := context.WithTimeout(ctx, selectionTimeout)
+	defer cancel()
+
+	latencies := make([]float64, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			latencies[i] = pingServer(ctx, u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	best := ServerLatency{Latency: -1}
+	for i, latency := range latencies {
+		if latency >= 0 && (best.Latency < 0 || latency < best.Latency) {
+			best = ServerLatency{URL: urls[i], Latency: latency}
+		}
+	}
+	if best.Latency < 0 {
+		return best, errors.New("no server answered")
+	}
+	return best, nil
+}
+
+// pingServer returns the median /ping round trip to the server at base in
+// milliseconds, or -1 when it cannot be reached
+func pingServer(ctx context.Context, base string) float64 {
+	base = strings.TrimSuffix(base, "/")
+	var rtts []float64
+	// The first request also pays for connection setup
+	for i := -1; i < selectionPings; i++ {
+		buster := newCacheBuster()
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/ping?t=%s", base, buster), nil)
+		if err != nil {
+			return -1
+		}
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return -1
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || checkFresh(resp, buster) != nil {
+			return -1
+		}
+		if i >= 0 {
+			rtts = append(rtts, float64(time.Since(start).Microseconds())/1000)
+		}
+	}
+	return median(rtts)
+}
@@ -0,0 +1,503 @@
+package speedtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionTTL           = 10 * time.Minute // Sessions are forgotten after this much inactivity
+	sessionMaxAge        = 15 * time.Minute // Sessions end this long after they were created, however busy
+	sessionSlotIdle      = time.Minute      // Idle sessions give up their test slot after this long
+	maxStreamsPerSession = 32               // Upper bound on parallel streams a client may request
+	sessionPhaseSlack    = 30 * time.Second // How much longer than max_duration a direction of a session may start streams
+)
+
+var (
+	errStreamsRunning = errors.New("All streams of the session are running")
+	errSessionUsedUp  = errors.New("Session has run as long as a test may; create a new one")
+)
+
+// transferStats aggregates all streams of one direction within a session
+type transferStats struct {
+	bytes   int64
+	streams int                   // Streams started so far
+	active  int                   // Streams currently transferring
+	start   time.Time             // When the first stream started
+	end     time.Time             // When the most recent stream finished
+	tcp     map[string]*tcpWindow // Kernel statistics of the connections streams ran on, by client address
+}
+
+// testSession ties together the parallel streams that make up one speed test
+type testSession struct {
+	id      string
+	streams int           // Parallel streams the client intends to use
+	ip      string        // Client the session was created for; only it may use the session
+	phase   time.Duration // How long after its first stream each direction may start more
+	created time.Time
+
+	mu        sync.Mutex
+	lastSeen  time.Time
+	holdsSlot bool // Whether the session occupies one of the server's test slots
+	download  transferStats
+	upload    transferStats
+	probe     transferStats  // Warm-up downloads, kept out of the download totals
+	latency   latencySamples // Measured over the WebSocket ping channel
+}
+
+// sessionRegistry keeps track of all live test sessions
+type sessionRegistry struct {
+	slots *concurrencyLimiter // Where sessions give back their test slots; nil when unlimited
+	phase time.Duration       // Longest a direction of a session may start streams for
+
+	mu       sync.Mutex
+	sessions map[string]*testSession
+}
+
+// newSessionRegistry creates an empty registry returning test slots to slots,
+// whose sessions may transfer in each direction for phase
+func newSessionRegistry(slots *concurrencyLimiter, phase time.Duration) *sessionRegistry {
+	return &sessionRegistry{
+		slots:    slots,
+		phase:    phase,
+		sessions: make(map[string]*testSession),
+	}
+}
+
+// create registers a new session of ip for the given number of streams.
+// holdsSlot tells whether the session was admitted with a test slot it must
+// give back.
+func (reg *sessionRegistry) create(streams int, ip string, holdsSlot bool) (*testSession, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s := &testSession{
+		id:        id,
+		streams:   streams,
+		ip:        ip,
+		phase:     reg.phase,
+		created:   now,
+		lastSeen:  now,
+		holdsSlot: holdsSlot,
+	}
+
+	reg.mu.Lock()
+	reg.sessions[id] = s
+	reg.mu.Unlock()
+
+	return s, nil
+}
+
+// get looks up a session by ID
+func (reg *sessionRegistry) get(id string) (*testSession, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	s, ok := reg.sessions[id]
+	return s, ok
+}
+
+// lookup returns the session with id for a stream from ip. Sessions are
+// bound to the client that created them, having redeemed its test token and
+// taken its rate limit, and end sessionMaxAge after they were created.
+func (reg *sessionRegistry) lookup(id, ip string) (*testSession, bool) {
+	s, ok := reg.get(id)
+	if !ok || s.ip != ip || time.Since(s.created) > sessionMaxAge {
+		return nil, false
+	}
+	return s, true
+}
+
+// list returns the summaries of all live sessions, newest first
+func (reg *sessionRegistry) list() []sessionSummary {
+	reg.mu.Lock()
+	all := make([]*testSession, 0, len(reg.sessions))
+	for _, s := range reg.sessions {
+		all = append(all, s)
+	}
+	reg.mu.Unlock()
+
+	summaries := make([]sessionSummary, len(all))
+	for i, s := range all {
+		summaries[i] = s.summary()
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Created.After(summaries[j].Created)
+	})
+	return summaries
+}
+
+// active counts the sessions testing right now: those moving data or idle
+// for no longer than sessionSlotIdle, between phases of their test
+func (reg *sessionRegistry) active() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	n := 0
+	for _, s := range reg.sessions {
+		if s.idleSince() <= sessionSlotIdle {
+			n++
+		}
+	}
+	return n
+}
+
+// remove ends a session, giving back its test slot
+func (reg *sessionRegistry) remove(id string) bool {
+	reg.mu.Lock()
+	s, ok := reg.sessions[id]
+	delete(reg.sessions, id)
+	reg.mu.Unlock()
+
+	if ok {
+		reg.releaseSlot(s)
+	}
+	return ok
+}
+
+// expireLoop periodically drops sessions that have been idle longer than
+// sessionTTL or live longer than sessionMaxAge, and frees the test slots of
+// sessions idle for sessionSlotIdle
+func (reg *sessionRegistry) expireLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(sessionSlotIdle / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		reg.mu.Lock()
+		for id, s := range reg.sessions {
+			idle := s.idleSince()
+			if idle > sessionTTL || time.Since(s.created) > sessionMaxAge {
+				delete(reg.sessions, id)
+				reg.releaseSlot(s)
+			} else if idle > sessionSlotIdle {
+				reg.releaseSlot(s)
+			}
+		}
+		reg.mu.Unlock()
+	}
+}
+
+// newSessionID returns a random, URL-safe session identifier
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// idleSince reports how long ago the session last saw traffic
+func (s *testSession) idleSince() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.download.active > 0 || s.upload.active > 0 || s.probe.active > 0 {
+		return 0
+	}
+	return time.Since(s.lastSeen)
+}
+
+// releaseSlot gives back the test slot of s, if it still holds one
+func (reg *sessionRegistry) releaseSlot(s *testSession) {
+	s.mu.Lock()
+	held := s.holdsSlot
+	s.holdsSlot = false
+	s.mu.Unlock()
+
+	if held && reg.slots != nil {
+		reg.slots.release()
+	}
+}
+
+// reclaimSlot hands s the test slot just admitted for it after it gave up
+// its own, giving the slot back when s got one meanwhile or has ended
+func (reg *sessionRegistry) reclaimSlot(s *testSession) {
+	reg.mu.Lock()
+	_, live := reg.sessions[s.id]
+	s.mu.Lock()
+	take := live && !s.holdsSlot
+	if take {
+		s.holdsSlot = true
+	}
+	s.mu.Unlock()
+	reg.mu.Unlock()
+
+	if !take && reg.slots != nil {
+		reg.slots.release()
+	}
+}
+
+// hasSlot reports whether s still holds the test slot it was admitted with
+func (s *testSession) hasSlot() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.holdsSlot
+}
+
+// beginStream records the start of a transfer stream. It refuses the stream
+// when as many as the session was created for are already running in t, or
+// the first stream in t started longer than the session's phase ago, so a
+// session can't take more of the server than it was admitted for. Clients
+// start a stream per chunk, so fast links start many of them in a phase.
+func (s *testSession) beginStream(t *transferStats) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.active >= s.streams {
+		return errStreamsRunning
+	}
+	now := time.Now()
+	if t.streams > 0 && now.Sub(t.start) > s.phase {
+		return errSessionUsedUp
+	}
+	if t.streams == 0 {
+		t.start = now
+	}
+	t.streams++
+	t.active++
+	s.lastSeen = now
+	return nil
+}
+
+// addBytes accounts for data moved by one of the session's streams
+func (s *testSession) addBytes(t *transferStats, n int) {
+	s.mu.Lock()
+	t.bytes += int64(n)
+	s.mu.Unlock()
+}
+
+// endStream records the end of a transfer stream
+func (s *testSession) endStream(t *transferStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	t.active--
+	t.end = now
+	s.lastSeen = now
+}
+
+// transferSummary is the JSON view of one direction of a session
+type transferSummary struct {
+	Bytes         int64   `json:"bytes"`
+	Streams       int     `json:"streams"`
+	ActiveStreams int     `json:"active_streams"`
+	Duration      float64 `json:"duration"` // Seconds from first stream start to last stream end
+	Mbps          float64 `json:"mbps"`     // Combined throughput of all streams
+	// What the kernel reported about the streams' connections, on Linux
+	TCP *tcpSummary `json:"tcp,omitempty"`
+}
+
+// summarize converts the stats to their JSON view. Must be called with the session lock held.
+func (t *transferStats) summarize() transferSummary {
+	sum := transferSummary{
+		Bytes:         t.bytes,
+		Streams:       t.streams,
+		ActiveStreams: t.active,
+		TCP:           t.summarizeTCP(),
+	}
+	if t.streams == 0 {
+		return sum
+	}
+
+	end := t.end
+	if t.active > 0 {
+		end = time.Now()
+	}
+	sum.Duration = end.Sub(t.start).Seconds()
+	if sum.Duration > 0 {
+		sum.Mbps = float64(t.bytes) * 8 / sum.Duration / 1e6
+	}
+	return sum
+}
+
+// sessionSummary is the JSON view of a whole session
+type sessionSummary struct {
+	ID       string          `json:"id"`
+	Streams  int             `json:"streams"`
+	Created  time.Time       `json:"created"`
+	Download transferSummary `json:"download"`
+	Upload   transferSummary `json:"upload"`
+	// Idle and loaded latency, once the server measured both
+	Bufferbloat *bufferbloatResult `json:"bufferbloat,omitempty"`
+	// Percentiles and histogram of the round trips the server measured
+	LatencyStats *latencyReport `json:"latency_stats,omitempty"`
+	// One-time nonce for submitting the session's result, only sent when
+	// the session is created
+	ResultNonce string `json:"result_nonce,omitempty"`
+}
+
+// summary returns the aggregated, server-measured view of the session
+func (s *testSession) summary() sessionSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sessionSummary{
+		ID:           s.id,
+		Streams:      s.streams,
+		Created:      s.created,
+		Download:     s.download.summarize(),
+		Upload:       s.upload.summarize(),
+		Bufferbloat:  s.latency.bufferbloat(),
+		LatencyStats: s.latency.report(),
+	}
+}
+
+// uploadSummary returns the aggregated view of all upload streams
+func (s *testSession) uploadSummary() transferSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upload.summarize()
+}
+
+// serverResult is what the server measured while sending a session's
+// downloads, for clients to cross-check their own measurement against
+type serverResult struct {
+	Session  string  `json:"session"`
+	Bytes    int64   `json:"bytes"`      // Bytes written by all download streams
+	Elapsed  float64 `json:"elapsed_ms"` // From first stream start to last stream end
+	Mbps     float64 `json:"mbps"`
+	Streams  int     `json:"streams"`
+	Complete bool    `json:"complete"` // False while download streams are still running
+}
+
+// downloadResult returns the server-measured result of the session's downloads
+func (s *testSession) downloadResult() serverResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := s.download.summarize()
+	return serverResult{
+		Session:  s.id,
+		Bytes:    sum.Bytes,
+		Elapsed:  sum.Duration * 1000,
+		Mbps:     sum.Mbps,
+		Streams:  sum.Streams,
+		Complete: sum.ActiveStreams == 0,
+	}
+}
+
+// handleSession creates sessions (POST /api/session?streams=N), reports
+// their aggregated server-side throughput (GET /api/session/{id}), the
+// server's download result (GET /api/session/{id}/server-result), the test
+// sizing advised after the probes (GET /api/session/{id}/plan) and live
+// progress (GET /api/session/{id}/events), and ends them (DELETE /api/session/{id})
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix+"/session"), "/")
+	id, view, _ := strings.Cut(path, "/")
+	if view != "" && view != "server-result" && view != "plan" && view != "events" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if id == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		streams := 1
+		if streamsStr := r.URL.Query().Get("streams"); streamsStr != "" {
+			parsedStreams, err := strconv.Atoi(streamsStr)
+			if err != nil || parsedStreams <= 0 || parsedStreams > maxStreamsPerSession {
+				http.Error(w, "Invalid streams", http.StatusBadRequest)
+				return
+			}
+			streams = parsedStreams
+		}
+
+		if !s.checkToken(w, r) || !s.admitTest(w, r) {
+			return
+		}
+
+		session, err := s.sessions.create(streams, s.clientIP(r), true)
+		if err != nil {
+			s.releaseTest()
+			s.testLogger(r).Error("Creating session failed", "err", err)
+			http.Error(w, "Could not create session", http.StatusInternalServerError)
+			return
+		}
+		sessionsCreated.Inc()
+		s.testLogger(r).Debug("Session created", "session", session.id, "streams", streams)
+		s.syslog.event(testEvent{
+			Event:     "test.started",
+			Session:   session.id,
+			ClientIP:  s.clientIP(r),
+			UserAgent: r.UserAgent(),
+			Streams:   streams,
+		})
+
+		sum := session.summary()
+		if sum.ResultNonce, _, err = s.resultNonces.issue(resultNonceSubject(s.clientIP(r), session.id)); err != nil {
+			s.testLogger(r).Error("Issuing result nonce failed", "err", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sum)
+		return
+	}
+
+	if r.Method != "GET" && (r.Method != "DELETE" || view != "") {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Only the client that created a session may see or end it
+	session, ok := s.sessions.lookup(id, s.clientIP(r))
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		s.sessions.remove(session.id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if view == "events" {
+		s.handleSessionEvents(w, r, session)
+		return
+	}
+
+	if view == "plan" {
+		var clientMbps float64
+		if v := r.URL.Query().Get("mbps"); v != "" {
+			var err error
+			if clientMbps, err = strconv.ParseFloat(v, 64); err != nil || !validMeasurement(clientMbps) || clientMbps == 0 {
+				http.Error(w, "Invalid mbps", http.StatusBadRequest)
+				return
+			}
+		}
+		plan := session.plan(clientMbps, min(s.cfg.MaxDownloadSize, s.cfg.MaxFileSize))
+		if plan == nil {
+			http.Error(w, "No probe has finished yet", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if view == "server-result" {
+		json.NewEncoder(w).Encode(session.downloadResult())
+		return
+	}
+	json.NewEncoder(w).Encode(session.summary())
+}
@@ -0,0 +1,128 @@
+package speedtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestSessionFullLengthTest runs a test the way clients do on a fast link: a
+// stream per chunk, thousands of them, for each direction's whole phase
+func TestSessionFullLengthTest(t *testing.T) {
+	const streams, chunks = 4, 5000
+
+	reg := newSessionRegistry(nil, time.Minute)
+	session, err := reg.create(streams, "192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []*transferStats{&session.probe, &session.download, &session.upload} {
+		for i := 0; i < chunks; i++ {
+			if err := session.beginStream(dir); err != nil {
+				t.Fatalf("stream %d: beginStream() error = %v", i, err)
+			}
+			session.endStream(dir)
+		}
+		// The phase runs to its end, where the last chunks are still started
+		dir.start = time.Now().Add(-time.Minute + time.Second)
+		if err := session.beginStream(dir); err != nil {
+			t.Fatalf("beginStream() at the end of the phase error = %v", err)
+		}
+		session.endStream(dir)
+	}
+}
+
+func TestSessionBeginStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		active  int           // Streams running in the direction
+		started time.Duration // How long ago its first stream started, if any
+		want    error
+	}{
+		{"first stream", 0, 0, nil},
+		{"below the stream count", 3, 10 * time.Second, nil},
+		{"all streams running", 4, 10 * time.Second, errStreamsRunning},
+		{"within the phase", 0, 59 * time.Second, nil},
+		{"phase over", 0, 61 * time.Second, errSessionUsedUp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newSessionRegistry(nil, time.Minute)
+			session, err := reg.create(4, "192.0.2.1", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.started > 0 {
+				session.download.streams = 1
+				session.download.start = time.Now().Add(-tt.started)
+			}
+			session.download.active = tt.active
+			if err := session.beginStream(&session.download); err != tt.want {
+				t.Errorf("beginStream() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionLookup(t *testing.T) {
+	reg := newSessionRegistry(nil, time.Minute)
+	session, err := reg.create(1, "192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := reg.create(1, "192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.created = time.Now().Add(-sessionMaxAge - time.Second)
+
+	tests := []struct {
+		name string
+		id   string
+		ip   string
+		want bool
+	}{
+		{"creator", session.id, "192.0.2.1", true},
+		{"other client", session.id, "192.0.2.2", false},
+		{"unknown", "0123", "192.0.2.1", false},
+		{"too old", old.id, "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := reg.lookup(tt.id, tt.ip); ok != tt.want {
+				t.Errorf("lookup() ok = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleSessionOwner(t *testing.T) {
+	tests := []struct {
+		method string
+		ip     string
+		want   int
+	}{
+		{"GET", "192.0.2.2", http.StatusNotFound},
+		{"DELETE", "192.0.2.2", http.StatusNotFound},
+		{"GET", "192.0.2.1", http.StatusOK},
+		{"DELETE", "192.0.2.1", http.StatusNoContent},
+	}
+	s := &Server{sessions: newSessionRegistry(nil, time.Minute)}
+	session, err := s.sessions.create(1, "192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, APIPrefix+"/session/"+session.id, nil)
+		r.RemoteAddr = tt.ip + ":1234"
+		w := httptest.NewRecorder()
+		s.handleSession(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s from %s = %d, want %d", tt.method, tt.ip, w.Code, tt.want)
+		}
+	}
+	if _, ok := s.sessions.get(session.id); ok {
+		t.Error("session still exists after its creator ended it")
+	}
+}
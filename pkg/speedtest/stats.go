@@ -0,0 +1,246 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statsSampleInterval = 5 * time.Second // How often throughput is sampled
+	statsSamples        = 60              // Samples kept, 5 minutes at the default interval
+	adminRecentResults  = 10              // Results shown on the admin dashboard
+)
+
+// throughputSample is the server-wide throughput over one sample interval
+type throughputSample struct {
+	Time     time.Time `json:"time"`
+	Download float64   `json:"download"` // Mbps sent by /testfile
+	Upload   float64   `json:"upload"`   // Mbps received by /upload
+}
+
+// statsCollector keeps live server statistics for the admin dashboard. The
+// Prometheus metrics cover the same ground for external monitoring; this
+// collector exists so the server can report them on its own.
+type statsCollector struct {
+	started         time.Time
+	connections     atomic.Int64
+	activeDownloads atomic.Int64
+	activeUploads   atomic.Int64
+	bytesSent       atomic.Int64
+	bytesReceived   atomic.Int64
+
+	mu      sync.Mutex
+	samples []throughputSample // Oldest first
+}
+
+// transferStarted counts a transfer in progress
+func (c *statsCollector) transferStarted(direction string) {
+	if direction == directionDownload {
+		c.activeDownloads.Add(1)
+	} else {
+		c.activeUploads.Add(1)
+	}
+}
+
+// transferFinished counts a transfer as no longer in progress
+func (c *statsCollector) transferFinished(direction string) {
+	if direction == directionDownload {
+		c.activeDownloads.Add(-1)
+	} else {
+		c.activeUploads.Add(-1)
+	}
+}
+
+// addBytes counts bytes moved by a transfer
+func (c *statsCollector) addBytes(direction string, n int) {
+	if direction == directionDownload {
+		c.bytesSent.Add(int64(n))
+	} else {
+		c.bytesReceived.Add(int64(n))
+	}
+}
+
+// sampleLoop records the server-wide throughput every statsSampleInterval
+func (c *statsCollector) sampleLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(statsSampleInterval)
+	defer ticker.Stop()
+
+	lastSent, lastReceived := c.bytesSent.Load(), c.bytesReceived.Load()
+	lastTime := time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-done:
+			return
+		case now = <-ticker.C:
+		}
+
+		sent, received := c.bytesSent.Load(), c.bytesReceived.Load()
+		secs := now.Sub(lastTime).Seconds()
+
+		c.mu.Lock()
+		c.samples = append(c.samples, throughputSample{
+			Time:     now.UTC(),
+			Download: float64(sent-lastSent) * 8 / secs / 1e6,
+			Upload:   float64(received-lastReceived) * 8 / secs / 1e6,
+		})
+		if len(c.samples) > statsSamples {
+			c.samples = c.samples[len(c.samples)-statsSamples:]
+		}
+		c.mu.Unlock()
+
+		lastSent, lastReceived, lastTime = sent, received, now
+	}
+}
+
+// serverLoad describes how busy the machine running the server is
+type serverLoad struct {
+	LoadAverage []float64 `json:"load_average,omitempty"` // 1, 5 and 15 minutes; Linux only
+	CPUs        int       `json:"cpus"`
+	Goroutines  int       `json:"goroutines"`
+	MemoryBytes uint64    `json:"memory_bytes"` // Obtained from the OS by the Go runtime
+}
+
+// slotUsage is the state of the concurrent test limit
+type slotUsage struct {
+	Active int `json:"active"`
+	Queued int `json:"queued"`
+	Max    int `json:"max"`
+}
+
+// serverStats is the JSON view served to the admin dashboard
+type serverStats struct {
+	Started         time.Time          `json:"started"`
+	Uptime          float64            `json:"uptime"` // Seconds
+	Connections     int64              `json:"connections"`
+	ActiveTests     int                `json:"active_tests"` // Sessions testing right now
+	ActiveDownloads int64              `json:"active_downloads"`
+	ActiveUploads   int64              `json:"active_uploads"`
+	BytesSent       int64              `json:"bytes_sent"`
+	BytesReceived   int64              `json:"bytes_received"`
+	Throughput      []throughputSample `json:"throughput"`
+	Sessions        []sessionSummary   `json:"sessions"`
+	Slots           *slotUsage         `json:"slots,omitempty"`
+	Load            serverLoad         `json:"load"`
+	RecentResults   []testResult       `json:"recent_results"`
+}
+
+// statsSnapshot gathers the current statistics
+func (s *Server) statsSnapshot() serverStats {
+	c := s.stats
+	st := serverStats{
+		Started:         c.started.UTC(),
+		Uptime:          time.Since(c.started).Seconds(),
+		Connections:     c.connections.Load(),
+		ActiveTests:     s.sessions.active(),
+		ActiveDownloads: c.activeDownloads.Load(),
+		ActiveUploads:   c.activeUploads.Load(),
+		BytesSent:       c.bytesSent.Load(),
+		BytesReceived:   c.bytesReceived.Load(),
+		Sessions:        s.sessions.list(),
+		Load:            currentLoad(),
+	}
+
+	c.mu.Lock()
+	st.Throughput = append([]throughputSample{}, c.samples...)
+	c.mu.Unlock()
+
+	if s.slots != nil {
+		active, queued := s.slots.usage()
+		st.Slots = &slotUsage{Active: active, Queued: queued, Max: s.slots.max}
+	}
+
+	var err error
+	if st.RecentResults, _, err = s.results.query(resultFilter{Limit: adminRecentResults}); err != nil {
+		s.log("results").Warn("Reading recent results failed", "err", err)
+	}
+	return st
+}
+
+// serverStatus is the public view of how busy the server is, so testers can
+// tell when others may be sharing its bandwidth
+type serverStatus struct {
+	ActiveTests     int        `json:"active_tests"`     // Sessions testing right now, the caller's included
+	ActiveTransfers int64      `json:"active_transfers"` // Download and upload streams in progress
+	Slots           *slotUsage `json:"slots,omitempty"`  // When concurrent tests are limited
+}
+
+// handleStatus reports how many tests are running (GET /api/status)
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	st := serverStatus{
+		ActiveTests:     s.sessions.active(),
+		ActiveTransfers: s.stats.activeDownloads.Load() + s.stats.activeUploads.Load(),
+	}
+	if s.slots != nil {
+		active, queued := s.slots.usage()
+		st.Slots = &slotUsage{Active: active, Queued: queued, Max: s.slots.max}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(st)
+}
+
+// currentLoad reports the load of the machine and the server process
+func currentLoad() serverLoad {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return serverLoad{
+		LoadAverage: readLoadAverage(),
+		CPUs:        runtime.NumCPU(),
+		Goroutines:  runtime.NumGoroutine(),
+		MemoryBytes: mem.Sys,
+	}
+}
+
+// readLoadAverage returns the system load averages from /proc/loadavg, or
+// nil where that file doesn't exist
+func readLoadAverage() []float64 {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return nil
+	}
+	loads := make([]float64, 3)
+	for i := range loads {
+		if loads[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return nil
+		}
+	}
+	return loads
+}
+
+// handleAdmin serves the admin dashboard page
+func (s *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	s.setSecurityHeaders(w, r)
+	http.ServeFileFS(w, r, s.webFS, "admin.html")
+}
+
+// handleAdminStats returns the live statistics shown on the dashboard
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(s.statsSnapshot())
+}
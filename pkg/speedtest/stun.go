@@ -0,0 +1,307 @@
+package speedtest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The STUN responder tells clients the public endpoint their binding
+// requests came from, on two ports. A NAT that maps one local socket to the
+// same public port for both is a cone NAT, which lets games and calls
+// connect peers directly; one that picks a new port per destination is
+// symmetric and forces them through relays. Observations are kept by client
+// IP for /api/clientinfo to report.
+const (
+	natWindow     = 30 * time.Second // How long observations count towards a client's NAT type
+	natMaxClients = 10000            // Client IPs observed at a time; more are answered but not recorded
+)
+
+// STUN message types, attributes and constants (RFC 5389)
+const (
+	stunHeaderSize       = 20
+	stunMagicCookie      = 0x2112A442
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunUsername         = 0x0006
+	stunMessageIntegrity = 0x0008
+	stunXORMappedAddress = 0x0020
+	stunFingerprint      = 0x8028
+	stunFingerprintXOR   = 0x5354554e
+	stunIntegritySize    = 4 + sha1.Size
+	stunFingerprintSize  = 4 + 4
+)
+
+// stunRequest is what the server needs from a STUN message
+type stunRequest struct {
+	msgType     uint16
+	transaction []byte
+	username    string
+	integrity   int // Offset of the MESSAGE-INTEGRITY attribute, -1 without one
+}
+
+// parseSTUN reads the header and attributes of a STUN message
+func parseSTUN(msg []byte) (stunRequest, bool) {
+	req := stunRequest{integrity: -1}
+	if len(msg) < stunHeaderSize || binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie ||
+		int(binary.BigEndian.Uint16(msg[2:]))+stunHeaderSize != len(msg) {
+		return req, false
+	}
+	req.msgType = binary.BigEndian.Uint16(msg)
+	req.transaction = msg[8:stunHeaderSize]
+
+	for off := stunHeaderSize; off+4 <= len(msg); {
+		attr, size := binary.BigEndian.Uint16(msg[off:]), int(binary.BigEndian.Uint16(msg[off+2:]))
+		if off+4+size > len(msg) {
+			return req, false
+		}
+		switch attr {
+		case stunUsername:
+			req.username = string(msg[off+4 : off+4+size])
+		case stunMessageIntegrity:
+			if size != sha1.Size {
+				return req, false
+			}
+			req.integrity = off
+		}
+		if attr == stunMessageIntegrity {
+			// Only FINGERPRINT may follow, and it needs no checking
+			break
+		}
+		off += 4 + (size+3)&^3
+	}
+	return req, true
+}
+
+// verify checks the message's MESSAGE-INTEGRITY against pwd
+func (req stunRequest) verify(msg []byte, pwd string) bool {
+	signed := bytes.Clone(msg[:req.integrity])
+	// The length covers the message up to and including MESSAGE-INTEGRITY
+	binary.BigEndian.PutUint16(signed[2:], uint16(req.integrity+stunIntegritySize-stunHeaderSize))
+	mac := hmac.New(sha1.New, []byte(pwd))
+	mac.Write(signed)
+	return hmac.Equal(mac.Sum(nil), msg[req.integrity+4:req.integrity+stunIntegritySize])
+}
+
+// stunBindingResponse answers a binding request from addr, signed with pwd
+// unless it is empty
+func stunBindingResponse(transaction []byte, addr *net.UDPAddr, pwd string) []byte {
+	msg := make([]byte, stunHeaderSize, 96)
+	binary.BigEndian.PutUint16(msg, stunBindingSuccess)
+	binary.BigEndian.PutUint32(msg[4:], stunMagicCookie)
+	copy(msg[8:], transaction)
+
+	// XOR-MAPPED-ADDRESS tells the browser the address it was seen at
+	ip := addr.IP.To4()
+	family := byte(1)
+	if ip == nil {
+		ip, family = addr.IP.To16(), 2
+	}
+	mask := make([]byte, 16)
+	binary.BigEndian.PutUint32(mask, stunMagicCookie)
+	copy(mask[4:], transaction)
+	value := []byte{0, family, 0, 0}
+	binary.BigEndian.PutUint16(value[2:], uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	for i, b := range ip {
+		value = append(value, b^mask[i])
+	}
+	msg = appendSTUNAttribute(msg, stunXORMappedAddress, value)
+
+	if pwd != "" {
+		mac := hmac.New(sha1.New, []byte(pwd))
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)+stunIntegritySize-stunHeaderSize))
+		mac.Write(msg)
+		msg = appendSTUNAttribute(msg, stunMessageIntegrity, mac.Sum(nil))
+	}
+
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)+stunFingerprintSize-stunHeaderSize))
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(msg)^stunFingerprintXOR)
+	return appendSTUNAttribute(msg, stunFingerprint, crc)
+}
+
+// appendSTUNAttribute appends a padded attribute to msg and updates its length
+func appendSTUNAttribute(msg []byte, attr uint16, value []byte) []byte {
+	msg = binary.BigEndian.AppendUint16(msg, attr)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(value)))
+	msg = append(msg, value...)
+	for len(msg)%4 != 0 {
+		msg = append(msg, 0)
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)-stunHeaderSize))
+	return msg
+}
+
+// natInfo is what /api/clientinfo reports about the client's NAT
+type natInfo struct {
+	Ports  []int    `json:"ports"`            // STUN ports to send binding requests to
+	Type   string   `json:"type,omitempty"`   // cone or symmetric, once requests reached both ports
+	Mapped []string `json:"mapped,omitempty"` // Public endpoints the requests came from
+}
+
+// natObservation is when a client's requests reached each STUN port, by the
+// public source port they came from
+type natObservation struct {
+	ports    [2]map[int]time.Time
+	lastSeen time.Time
+}
+
+// stunResponder answers STUN binding requests on two consecutive ports and
+// remembers the endpoints they came from
+type stunResponder struct {
+	conns  [2]*net.UDPConn
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	clients map[string]*natObservation // By client IP
+}
+
+// newSTUNResponder answers binding requests on both conns
+func newSTUNResponder(conns [2]*net.UDPConn, logger *slog.Logger) *stunResponder {
+	r := &stunResponder{
+		conns:   conns,
+		logger:  logger,
+		clients: make(map[string]*natObservation),
+	}
+	for i := range conns {
+		go r.serve(i)
+	}
+	return r
+}
+
+// serve answers the binding requests that reach one of the ports
+func (r *stunResponder) serve(i int) {
+	conn := r.conns[i]
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			r.logger.Error("STUN responder stopped", "err", err)
+			return
+		}
+		req, ok := parseSTUN(buf[:n])
+		if !ok || req.msgType != stunBindingRequest {
+			continue
+		}
+
+		r.record(i, addr)
+		if _, err := conn.WriteToUDP(stunBindingResponse(req.transaction, addr, ""), addr); err != nil {
+			r.logger.Warn("Answering STUN request failed", "err", err)
+		}
+	}
+}
+
+// record notes that a request from addr reached port i
+func (r *stunResponder) record(i int, addr *net.UDPAddr) {
+	now := time.Now()
+	ip := addr.IP.String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	obs, ok := r.clients[ip]
+	if !ok {
+		if len(r.clients) >= natMaxClients {
+			return
+		}
+		obs = &natObservation{ports: [2]map[int]time.Time{{}, {}}}
+		r.clients[ip] = obs
+	}
+	obs.ports[i][addr.Port] = now
+	obs.lastSeen = now
+}
+
+// lookup returns what recent requests from ip tell about its NAT
+func (r *stunResponder) lookup(ip string) *natInfo {
+	if r == nil {
+		return nil
+	}
+	info := &natInfo{}
+	for _, conn := range r.conns {
+		info.Ports = append(info.Ports, conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	obs, ok := r.clients[ip]
+	if !ok {
+		return info
+	}
+
+	// Browsers may send from a socket per network interface, so the NAT is
+	// a cone when any source port reached both STUN ports
+	var recent [2][]int
+	for i, ports := range obs.ports {
+		for port, seen := range ports {
+			if time.Since(seen) <= natWindow {
+				recent[i] = append(recent[i], port)
+			}
+		}
+	}
+	ports := append(slices.Clone(recent[0]), recent[1]...)
+	slices.Sort(ports)
+	for _, port := range slices.Compact(ports) {
+		info.Mapped = append(info.Mapped, net.JoinHostPort(ip, strconv.Itoa(port)))
+	}
+	if len(recent[0]) > 0 && len(recent[1]) > 0 {
+		info.Type = "symmetric"
+		for _, port := range recent[0] {
+			if slices.Contains(recent[1], port) {
+				info.Type = "cone"
+				break
+			}
+		}
+	}
+	return info
+}
+
+// expireLoop forgets clients and source ports that sent no requests for a
+// while
+func (r *stunResponder) expireLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(natWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		for ip, obs := range r.clients {
+			if time.Since(obs.lastSeen) > natWindow {
+				delete(r.clients, ip)
+				continue
+			}
+			for _, ports := range obs.ports {
+				for port, seen := range ports {
+					if time.Since(seen) > natWindow {
+						delete(ports, port)
+					}
+				}
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// close stops answering requests
+func (r *stunResponder) close() {
+	if r != nil {
+		for _, conn := range r.conns {
+			conn.Close()
+		}
+	}
+}
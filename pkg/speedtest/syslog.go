@@ -0,0 +1,263 @@
+package speedtest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	syslogTimeout    = 5 * time.Second // Limit for connecting and for sending one message
+	syslogQueueSize  = 1024            // Messages waiting to be sent before new ones are dropped
+	syslogTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// Syslog severities used for the messages sent
+const (
+	syslogWarning = 4
+	syslogInfo    = 6
+)
+
+// syslogFacilities maps facility names to their RFC 5424 codes
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// testEvent is the JSON message of a test event sent to syslog
+type testEvent struct {
+	Event     string `json:"event"` // test.started, test.completed or test.failed
+	Session   string `json:"session,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Server    string `json:"server,omitempty"` // Tested by a client test this server ran
+	Streams   int    `json:"streams,omitempty"`
+	// The stored result of a completed test, or why a test failed
+	Result *testEventResult `json:"result,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// testEventResult is the outcome of a completed test
+type testEventResult struct {
+	ID       string  `json:"id"`
+	Download float64 `json:"download"`
+	Upload   float64 `json:"upload"`
+	Latency  float64 `json:"latency"`
+	Jitter   float64 `json:"jitter"`
+}
+
+// completedEvent describes a stored result as a test.completed event
+func completedEvent(res testResult) testEvent {
+	return testEvent{
+		Event:     "test.completed",
+		Session:   res.SessionID,
+		ClientIP:  res.ClientIP,
+		UserAgent: res.UserAgent,
+		Server:    res.Server,
+		Result: &testEventResult{
+			ID:       res.ID,
+			Download: res.Download,
+			Upload:   res.Upload,
+			Latency:  res.Latency,
+			Jitter:   res.Jitter,
+		},
+	}
+}
+
+// syslogWriter sends RFC 5424 messages to a syslog server over UDP, TCP or
+// TLS. Messages are queued and sent in the background, so a slow or
+// unreachable server never holds up a test; when the queue is full, new
+// messages are dropped.
+type syslogWriter struct {
+	network  string // udp or tcp
+	addr     string
+	tls      *tls.Config // Nil for plain connections
+	facility int
+	appName  string
+	hostname string
+	logger   *slog.Logger
+
+	queue   chan []byte
+	stop    chan struct{}
+	done    chan struct{}
+	dropped atomic.Int64 // Messages dropped since the last one was sent
+
+	conn net.Conn // Only used by run
+	down bool     // The last attempt to send failed
+}
+
+// openSyslog returns a writer for cfg, or nil when no address is configured
+func openSyslog(cfg SyslogConfig, logger *slog.Logger) (*syslogWriter, error) {
+	if cfg.Address == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q: %w", cfg.Address, err)
+	}
+	w := &syslogWriter{
+		network:  u.Scheme,
+		addr:     u.Host,
+		facility: syslogFacilities[cfg.Facility],
+		appName:  cfg.AppName,
+		hostname: "-",
+		logger:   logger,
+		queue:    make(chan []byte, syslogQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if u.Scheme == "tls" {
+		w.network = "tcp"
+		w.tls = &tls.Config{ServerName: u.Hostname()}
+		if cfg.CAFile != "" {
+			pem, err := os.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading syslog CA file: %w", err)
+			}
+			w.tls.RootCAs = x509.NewCertPool()
+			if !w.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in syslog CA file %s", cfg.CAFile)
+			}
+		}
+	}
+	// HOSTNAME may not contain spaces or anything but printable ASCII
+	if host, err := os.Hostname(); err == nil && host != "" && !strings.ContainsFunc(host, func(r rune) bool { return r <= ' ' || r > '~' }) {
+		w.hostname = host
+	}
+	go w.run()
+	return w, nil
+}
+
+// event sends a test event, at warning severity for failed tests
+func (w *syslogWriter) event(ev testEvent) {
+	if w == nil {
+		return
+	}
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		w.logger.Error("Encoding test event failed", "err", err)
+		return
+	}
+	severity := syslogInfo
+	if ev.Event == "test.failed" {
+		severity = syslogWarning
+	}
+	w.send(severity, ev.Event, string(msg))
+}
+
+// send queues a message with the given severity and MSGID
+func (w *syslogWriter) send(severity int, msgID, msg string) {
+	if w == nil {
+		return
+	}
+	line := fmt.Appendf(nil, "<%d>1 %s %s %s %d %s - %s",
+		w.facility*8+severity, time.Now().Format(syslogTimeLayout),
+		w.hostname, w.appName, os.Getpid(), msgID, msg)
+	select {
+	case w.queue <- line:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// run sends queued messages until close is called, then sends what is left
+// unless the server is unreachable
+func (w *syslogWriter) run() {
+	defer close(w.done)
+	for {
+		select {
+		case msg := <-w.queue:
+			w.write(msg)
+		case <-w.stop:
+			for !w.down && len(w.queue) > 0 {
+				w.write(<-w.queue)
+			}
+			w.closeConn()
+			return
+		}
+	}
+}
+
+// write sends one message, connecting first if needed and reconnecting once
+// when a kept-open connection turns out to be broken. Messages that cannot
+// be sent are dropped.
+func (w *syslogWriter) write(msg []byte) {
+	// Over TCP and TLS, messages are framed by their length (RFC 6587)
+	if w.network == "tcp" {
+		msg = append(fmt.Appendf(nil, "%d ", len(msg)), msg...)
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		fresh := w.conn == nil
+		if fresh {
+			if err = w.dial(); err != nil {
+				break
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err = w.conn.Write(msg); err == nil {
+			break
+		}
+		w.closeConn()
+		if fresh {
+			break
+		}
+	}
+
+	if err != nil {
+		if !w.down {
+			w.logger.Warn("Sending to syslog failed; dropping messages until it recovers", "addr", w.addr, "err", err)
+			w.down = true
+		}
+		w.dropped.Add(1)
+		return
+	}
+	if w.down {
+		w.logger.Info("Sending to syslog recovered", "addr", w.addr)
+		w.down = false
+	}
+	if n := w.dropped.Swap(0); n > 0 {
+		w.logger.Warn("Syslog messages dropped", "count", n)
+	}
+}
+
+func (w *syslogWriter) dial() error {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	var conn net.Conn
+	var err error
+	if w.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, w.network, w.addr, w.tls)
+	} else {
+		conn, err = dialer.Dial(w.network, w.addr)
+	}
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+func (w *syslogWriter) closeConn() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// close sends the messages still queued and closes the connection
+func (w *syslogWriter) close() {
+	if w != nil {
+		close(w.stop)
+		<-w.done
+	}
+}
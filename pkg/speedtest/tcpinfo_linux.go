@@ -0,0 +1,108 @@
+package speedtest
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketOf returns the TCP socket underneath c, unwrapping TLS
+func socketOf(c net.Conn) syscall.RawConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// enableBBR switches c to BBR congestion control, when the kernel has it
+func enableBBR(c net.Conn) {
+	if raw := socketOf(c); raw != nil {
+		raw.Control(func(fd uintptr) {
+			unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, "bbr")
+		})
+	}
+}
+
+// readTCPInfo returns the kernel's TCP_INFO for c, plus its BBR state when
+// c uses BBR. Either is nil when unavailable.
+func readTCPInfo(c net.Conn) (*ndt7TCPInfo, *ndt7BBRInfo) {
+	raw := socketOf(c)
+	if raw == nil {
+		return nil, nil
+	}
+
+	var tcpInfo *ndt7TCPInfo
+	var bbrInfo *ndt7BBRInfo
+	raw.Control(func(fd uintptr) {
+		if ti, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO); err == nil {
+			tcpInfo = &ndt7TCPInfo{
+				State:         int64(ti.State),
+				CAState:       int64(ti.Ca_state),
+				Retransmits:   int64(ti.Retransmits),
+				RTO:           int64(ti.Rto),
+				ATO:           int64(ti.Ato),
+				SndMSS:        int64(ti.Snd_mss),
+				RcvMSS:        int64(ti.Rcv_mss),
+				Unacked:       int64(ti.Unacked),
+				Sacked:        int64(ti.Sacked),
+				Lost:          int64(ti.Lost),
+				Retrans:       int64(ti.Retrans),
+				PMTU:          int64(ti.Pmtu),
+				RTT:           int64(ti.Rtt),
+				RTTVar:        int64(ti.Rttvar),
+				SndSsThresh:   int64(ti.Snd_ssthresh),
+				SndCwnd:       int64(ti.Snd_cwnd),
+				AdvMSS:        int64(ti.Advmss),
+				Reordering:    int64(ti.Reordering),
+				RcvRTT:        int64(ti.Rcv_rtt),
+				RcvSpace:      int64(ti.Rcv_space),
+				TotalRetrans:  int64(ti.Total_retrans),
+				PacingRate:    int64(ti.Pacing_rate),
+				MaxPacingRate: int64(ti.Max_pacing_rate),
+				BytesAcked:    int64(ti.Bytes_acked),
+				BytesReceived: int64(ti.Bytes_received),
+				SegsOut:       int64(ti.Segs_out),
+				SegsIn:        int64(ti.Segs_in),
+				NotsentBytes:  int64(ti.Notsent_bytes),
+				MinRTT:        int64(ti.Min_rtt),
+				DataSegsIn:    int64(ti.Data_segs_in),
+				DataSegsOut:   int64(ti.Data_segs_out),
+				DeliveryRate:  int64(ti.Delivery_rate),
+				BusyTime:      int64(ti.Busy_time),
+				RWndLimited:   int64(ti.Rwnd_limited),
+				SndBufLimited: int64(ti.Sndbuf_limited),
+				Delivered:     int64(ti.Delivered),
+				DeliveredCE:   int64(ti.Delivered_ce),
+				BytesSent:     int64(ti.Bytes_sent),
+				BytesRetrans:  int64(ti.Bytes_retrans),
+				DSackDups:     int64(ti.Dsack_dups),
+				ReordSeen:     int64(ti.Reord_seen),
+				RcvOooPack:    int64(ti.Rcv_ooopack),
+				SndWnd:        int64(ti.Snd_wnd),
+			}
+		}
+
+		if cc, err := unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION); err != nil || cc != "bbr" {
+			return
+		}
+		if bi, err := unix.GetsockoptTCPCCBBRInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_CC_INFO); err == nil {
+			bbrInfo = &ndt7BBRInfo{
+				BW:         int64(bi.Bw_hi)<<32 | int64(bi.Bw_lo),
+				MinRTT:     int64(bi.Min_rtt),
+				PacingGain: int64(bi.Pacing_gain),
+				CwndGain:   int64(bi.Cwnd_gain),
+			}
+		}
+	})
+	return tcpInfo, bbrInfo
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package speedtest
+
+import "net"
+
+// enableBBR does nothing where BBR cannot be selected per socket
+func enableBBR(c net.Conn) {}
+
+// readTCPInfo reports nothing on platforms without Linux's TCP_INFO
+func readTCPInfo(c net.Conn) (*ndt7TCPInfo, *ndt7BBRInfo) {
+	return nil, nil
+}
@@ -0,0 +1,130 @@
+package speedtest
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// connContextKey carries a request's connection, see ConnContext
+type connContextKey struct{}
+
+// ConnContext makes the connection behind each request available, so the
+// server can read the kernel's TCP statistics for test transfers. Set it as
+// the ConnContext hook of the http.Server serving Handler.
+func (s *Server) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// requestConn returns the connection r arrived on, or nil when the server
+// was not set up with ConnContext or r came over HTTP/3
+func requestConn(r *http.Request) net.Conn {
+	c, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	return c
+}
+
+// tcpWindow holds a connection's TCP statistics when the first of a
+// session's streams in one direction started on it and when the latest one
+// ended. Browsers multiplex streams over one HTTP/2 connection or reuse
+// connections, so statistics are taken per connection, not per stream.
+type tcpWindow struct {
+	first, last *ndt7TCPInfo
+}
+
+// tcpSummary is what the kernel reported about a session's connections in
+// one direction. Retransmits only happen on the sending side, so they
+// describe downloads; uploads show in out-of-order segments instead.
+type tcpSummary struct {
+	Connections       int     `json:"connections"`
+	Retransmits       int64   `json:"retransmits"`        // Segments the server sent again
+	RetransmitPercent float64 `json:"retransmit_percent"` // Of the segments the server sent
+	OutOfOrder        int64   `json:"out_of_order"`       // Segments the server received out of order
+	RTT               float64 `json:"rtt"`                // Smoothed round trip in ms, averaged over connections
+	RTTVar            float64 `json:"rtt_var"`            // Round trip variation in ms, averaged the same way
+	MinRTT            float64 `json:"min_rtt"`            // Lowest round trip in ms
+	Cwnd              int64   `json:"cwnd"`               // Largest congestion window in bytes
+}
+
+// tcpReport is the TCP view of both directions of a test
+type tcpReport struct {
+	Download *tcpSummary `json:"download,omitempty"`
+	Upload   *tcpSummary `json:"upload,omitempty"`
+}
+
+// tcpKey identifies c among a session's connections. Keying by address
+// rather than by c keeps closed connections from being held for as long as
+// the session lives.
+func tcpKey(c net.Conn) string {
+	return c.RemoteAddr().String()
+}
+
+// beginTCP takes the statistics of c when a stream in t is the first on it
+func (s *testSession) beginTCP(t *transferStats, c net.Conn) {
+	if c == nil {
+		return
+	}
+	key := tcpKey(c)
+	s.mu.Lock()
+	_, known := t.tcp[key]
+	s.mu.Unlock()
+	if known {
+		return
+	}
+
+	info, _ := readTCPInfo(c)
+	if info == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.tcp == nil {
+		t.tcp = make(map[string]*tcpWindow)
+	}
+	if _, known := t.tcp[key]; !known {
+		t.tcp[key] = &tcpWindow{first: info, last: info}
+	}
+}
+
+// endTCP takes the statistics of c when a stream in t on it ended
+func (s *testSession) endTCP(t *transferStats, c net.Conn) {
+	if c == nil {
+		return
+	}
+	info, _ := readTCPInfo(c)
+	if info == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w, ok := t.tcp[tcpKey(c)]; ok {
+		w.last = info
+	}
+}
+
+// summarizeTCP combines the statistics of all connections, or returns nil
+// when there are none. Must be called with the session lock held.
+func (t *transferStats) summarizeTCP() *tcpSummary {
+	if len(t.tcp) == 0 {
+		return nil
+	}
+
+	sum := &tcpSummary{Connections: len(t.tcp)}
+	var segsOut int64
+	for _, w := range t.tcp {
+		sum.Retransmits += w.last.TotalRetrans - w.first.TotalRetrans
+		segsOut += w.last.SegsOut - w.first.SegsOut
+		sum.OutOfOrder += w.last.RcvOooPack - w.first.RcvOooPack
+		sum.RTT += float64(w.last.RTT) / 1000
+		sum.RTTVar += float64(w.last.RTTVar) / 1000
+		if minRTT := float64(w.last.MinRTT) / 1000; minRTT > 0 && (sum.MinRTT == 0 || minRTT < sum.MinRTT) {
+			sum.MinRTT = minRTT
+		}
+		sum.Cwnd = max(sum.Cwnd, w.last.SndCwnd*w.last.SndMSS)
+	}
+	sum.RTT /= float64(len(t.tcp))
+	sum.RTTVar /= float64(len(t.tcp))
+	if segsOut > 0 {
+		sum.RetransmitPercent = float64(sum.Retransmits) / float64(segsOut) * 100
+	}
+	return sum
+}
@@ -0,0 +1,73 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// remoteUserAgent marks results of tests run through /api/tests/run
+const remoteUserAgent = "speedtest-api"
+
+// testRunRequest is the body of POST /api/tests/run
+type testRunRequest struct {
+	Server   string `json:"server,omitempty"`   // URL to test against; defaults to schedule.server
+	Streams  int    `json:"streams,omitempty"`  // Parallel streams per direction; defaults to schedule.streams
+	Duration int    `json:"duration,omitempty"` // Seconds per phase; defaults to schedule.duration
+}
+
+// handleTestRun runs a client-mode test against another server on request,
+// for monitoring systems that trigger their own measurements, and returns
+// the stored result. One such test runs at a time.
+func (s *Server) handleTestRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := testRunRequest{
+		Server:   s.cfg.Schedule.Server,
+		Streams:  s.cfg.Schedule.Streams,
+		Duration: s.cfg.Schedule.Duration,
+	}
+	// An empty body runs the scheduled test's settings
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Server == "" {
+		http.Error(w, "server must be set", http.StatusBadRequest)
+		return
+	}
+	if req.Duration > s.cfg.MaxDuration {
+		http.Error(w, fmt.Sprintf("duration must be at most %d seconds", s.cfg.MaxDuration), http.StatusBadRequest)
+		return
+	}
+	if _, err := NewClient(req.Server, req.Streams, time.Duration(req.Duration)*time.Second); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.remoteTest.TryLock() {
+		http.Error(w, "A test is already running", http.StatusConflict)
+		return
+	}
+	defer s.remoteTest.Unlock()
+
+	res, err := s.runClientTest(r.Context(), s.log("scheduler"), remoteUserAgent, req.Server, req.Streams, req.Duration, nil)
+	switch {
+	case errors.Is(err, errResultNotStored):
+		http.Error(w, "Could not store result", http.StatusInternalServerError)
+		return
+	case err != nil:
+		http.Error(w, "Test failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,58 @@
+package speedtest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// throttleRate returns the throttle for a transfer in KB/s: the request's
+// throttle parameter when it is a positive number, otherwise the configured
+// default. Fractions allow rates below 1 KB/s.
+func (s *Server) throttleRate(r *http.Request) float64 {
+	if v := r.URL.Query().Get("throttle"); v != "" {
+		if kbps, err := strconv.ParseFloat(v, 64); err == nil && kbps > 0 {
+			return kbps
+		}
+	}
+	return s.cfg.ThrottleKBps
+}
+
+// newThrottle returns a token bucket that passes kbps KB/s, or nil when
+// kbps is zero. The bucket holds throttle_burst_kb, and never less than one
+// write or read, so a transfer can go ahead by at most that much.
+func (s *Server) newThrottle(kbps float64, chunk int) *rate.Limiter {
+	if kbps <= 0 {
+		return nil
+	}
+	burst := max(s.cfg.ThrottleBurstKB*1024, chunk)
+	return rate.NewLimiter(rate.Limit(kbps*1024), burst)
+}
+
+// throttledReader limits how fast a reader can be drained. Reads must not be
+// larger than the limiter's burst.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+	waited  func(start time.Time, n int) // Called after each wait, if set
+}
+
+func (t *throttledReader) Read(p []byte) (n int, err error) {
+	n, err = t.r.Read(p)
+	if n > 0 {
+		// Wait for the bytes just read, so the next read comes no sooner than the rate allows
+		start := time.Now()
+		if waitErr := t.limiter.WaitN(t.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+		if t.waited != nil {
+			t.waited(start, n)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,207 @@
+package speedtest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tokenNonceSize = 16
+
+var errInvalidToken = errors.New("invalid test token")
+
+// tokenIssuer hands out short-lived, single-use tokens that clients must
+// present to start a test. Tokens are signed with HMAC-SHA256 and bound to
+// the client IP they were issued to, so they cannot be passed on to others.
+type tokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+
+	mu   sync.Mutex
+	used map[string]time.Time // Redeemed nonces and when their token expires
+}
+
+// newTokenIssuer creates an issuer signing with secret. An empty secret picks
+// a random one, which invalidates outstanding tokens on restart.
+func newTokenIssuer(secret string, ttl time.Duration) (*tokenIssuer, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generating token secret: %w", err)
+		}
+	}
+	return &tokenIssuer{
+		secret: key,
+		ttl:    ttl,
+		used:   make(map[string]time.Time),
+	}, nil
+}
+
+// sign computes the signature of a token payload for ip
+func (t *tokenIssuer) sign(payload []byte, ip string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write(payload)
+	mac.Write([]byte(ip))
+	return mac.Sum(nil)
+}
+
+// issue creates a token for ip. Its payload is the expiry time followed by a
+// random nonce; the signature follows after a dot.
+func (t *tokenIssuer) issue(ip string) (string, time.Time, error) {
+	expires := time.Now().Add(t.ttl)
+
+	payload := make([]byte, 8+tokenNonceSize)
+	binary.BigEndian.PutUint64(payload, uint64(expires.Unix()))
+	if _, err := rand.Read(payload[8:]); err != nil {
+		return "", time.Time{}, err
+	}
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(t.sign(payload, ip)), expires, nil
+}
+
+// redeem checks that token was issued to ip, has not expired and has not
+// been used before, and marks it used
+func (t *tokenIssuer) redeem(token, ip string) error {
+	encPayload, encSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return errInvalidToken
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(encPayload)
+	if err != nil || len(payload) != 8+tokenNonceSize {
+		return errInvalidToken
+	}
+	sig, err := enc.DecodeString(encSig)
+	if err != nil || !hmac.Equal(sig, t.sign(payload, ip)) {
+		return errInvalidToken
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	if time.Now().After(expires) {
+		return errors.New("test token expired")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	nonce := string(payload[8:])
+	if _, used := t.used[nonce]; used {
+		return errors.New("test token already used")
+	}
+	t.used[nonce] = expires
+	return nil
+}
+
+// expireLoop periodically forgets redeemed tokens that have expired anyway
+func (t *tokenIssuer) expireLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-done:
+			return
+		case now = <-ticker.C:
+		}
+
+		t.mu.Lock()
+		for nonce, expires := range t.used {
+			if now.After(expires) {
+				delete(t.used, nonce)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// checkToken redeems the token sent with the request, writing a 403 response
+// when it is missing or invalid. Always succeeds when tokens are not required.
+func (s *Server) checkToken(w http.ResponseWriter, r *http.Request) bool {
+	if s.tokens == nil {
+		return true
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.Header.Get("X-Speedtest-Token")
+	}
+	if token == "" {
+		http.Error(w, "Test token required", http.StatusForbidden)
+		return false
+	}
+	if err := s.tokens.redeem(token, s.clientIP(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireToken demands a token for /testfile and /upload requests made
+// outside a session. Sessions redeem a token when they are created, and only
+// the client that created one may use it.
+func (s *Server) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.requestSession(r); !ok && !s.checkToken(w, r) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// resultNonceSubject is what a result nonce is bound to: the client IP and
+// the session whose result it may submit
+func resultNonceSubject(ip, sessionID string) string {
+	return ip + " " + sessionID
+}
+
+// checkResultNonce redeems the nonce submitted with a result for sessionID,
+// writing a 403 response when it is invalid, or missing while nonces are
+// required. Nonces are issued with each session and can be redeemed once,
+// so results can neither be made up without running a test nor replayed.
+func (s *Server) checkResultNonce(w http.ResponseWriter, r *http.Request, nonce, sessionID string) bool {
+	if nonce == "" {
+		if s.cfg.Results.RequireNonce {
+			http.Error(w, "Result nonce required", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if err := s.resultNonces.redeem(nonce, resultNonceSubject(s.clientIP(r), sessionID)); err != nil {
+		http.Error(w, "Invalid result nonce", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleToken issues a test token to the calling client
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, expires, err := s.tokens.issue(s.clientIP(r))
+	if err != nil {
+		s.log("test").Error("Issuing test token failed", "err", err)
+		http.Error(w, "Could not issue token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":   token,
+		"expires": expires.UTC(),
+	})
+}
@@ -0,0 +1,73 @@
+package speedtest
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenRedeem(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		token   func(tok string) string // Alters the issued token
+		ip      string                  // Client redeeming the token
+		reuse   bool                    // Redeem the token once before
+		wantErr string
+	}{
+		{"valid", time.Minute, nil, "192.0.2.1", false, ""},
+		{"other client", time.Minute, nil, "192.0.2.2", false, "invalid test token"},
+		{"used twice", time.Minute, nil, "192.0.2.1", true, "test token already used"},
+		{"expired", -time.Minute, nil, "192.0.2.1", false, "test token expired"},
+		{"no signature", time.Minute, func(tok string) string {
+			payload, _, _ := strings.Cut(tok, ".")
+			return payload
+		}, "192.0.2.1", false, "invalid test token"},
+		{"forged signature", time.Minute, func(tok string) string {
+			payload, _, _ := strings.Cut(tok, ".")
+			return payload + ".AAAA"
+		}, "192.0.2.1", false, "invalid test token"},
+		{"garbage", time.Minute, func(string) string { return "not.a-token" }, "192.0.2.1", false, "invalid test token"},
+		{"empty", time.Minute, func(string) string { return "" }, "192.0.2.1", false, "invalid test token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, err := newTokenIssuer("secret", tt.ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tok, _, err := issuer.issue("192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != nil {
+				tok = tt.token(tok)
+			}
+			if tt.reuse {
+				if err := issuer.redeem(tok, tt.ip); err != nil {
+					t.Fatalf("first redeem: %v", err)
+				}
+			}
+
+			err = issuer.redeem(tok, tt.ip)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("redeem() error = %v, want none", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("redeem() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenSecret(t *testing.T) {
+	a, _ := newTokenIssuer("one", time.Minute)
+	b, _ := newTokenIssuer("two", time.Minute)
+	tok, _, err := a.issue("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.redeem(tok, "192.0.2.1"); err != errInvalidToken {
+		t.Errorf("redeem() with another secret error = %v, want %v", err, errInvalidToken)
+	}
+}
@@ -0,0 +1,149 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName           = "github.com/infobits-io/infobits-speedtest/pkg/speedtest"
+	traceMinWait         = time.Millisecond // Shorter throttling waits get no span of their own
+	traceMaxWaitSpans    = 50               // Wait spans per transfer; later waits only add to its totals
+	traceShutdownTimeout = 5 * time.Second  // How long Close waits for spans to be exported
+)
+
+// propagator reads the trace context callers send along with a request, so
+// a test can be traced from the client through to the server
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// noopTracer is used while tracing is not configured
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// startTracing sets up the OTLP exporter. Spans are batched and sent over
+// HTTP in the background.
+func startTracing(cfg TracingConfig) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("setting up OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("setting up trace resource: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	), nil
+}
+
+// stopTracing exports the spans still queued and stops the exporter
+func (s *Server) stopTracing() {
+	if s.tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+	if err := s.tracerProvider.Shutdown(ctx); err != nil {
+		s.log("server").Warn("Exporting remaining spans failed", "err", err)
+	}
+}
+
+// traceRequests wraps next in a span per request, named after the mux
+// pattern the request matches rather than its path, which may hold IDs
+func (s *Server) traceRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := s.tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(s.clientIP(r)),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// waitStats add up the throttling waits of one transfer. A transfer runs in
+// one goroutine, so they need no locking.
+type waitStats struct {
+	count int
+	total time.Duration
+	spans int
+}
+
+type waitStatsKey struct{}
+
+// startTransferSpan starts the span of a download or upload, with totals of
+// its throttling waits carried in the returned context
+func (s *Server) startTransferSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := s.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return context.WithValue(ctx, waitStatsKey{}, &waitStats{}), span
+}
+
+// endTransferSpan records how a download or upload went and ends its span
+func endTransferSpan(ctx context.Context, span trace.Span, bytes int64, elapsed time.Duration, completed bool) {
+	span.SetAttributes(
+		attribute.Int64("bytes", bytes),
+		attribute.Bool("completed", completed),
+	)
+	if secs := elapsed.Seconds(); secs > 0 {
+		span.SetAttributes(attribute.Float64("mbps", float64(bytes)*8/secs/1e6))
+	}
+	if stats, ok := ctx.Value(waitStatsKey{}).(*waitStats); ok && stats.count > 0 {
+		span.SetAttributes(
+			attribute.Int("throttle.waits", stats.count),
+			attribute.Float64("throttle.wait_ms", float64(stats.total.Microseconds())/1000),
+		)
+	}
+	span.End()
+}
+
+// traceWait records a throttling wait that began at start and has just
+// ended as a child span of ctx. The span is made after the fact, so waits
+// that did not block cost nothing. Within a transfer, waits past the first
+// traceMaxWaitSpans only count towards its totals.
+func (s *Server) traceWait(ctx context.Context, name string, start time.Time, bytes int) {
+	end := time.Now()
+	if end.Sub(start) < traceMinWait || !trace.SpanFromContext(ctx).IsRecording() {
+		return
+	}
+	if stats, ok := ctx.Value(waitStatsKey{}).(*waitStats); ok {
+		stats.count++
+		stats.total += end.Sub(start)
+		if stats.spans >= traceMaxWaitSpans {
+			return
+		}
+		stats.spans++
+	}
+	_, span := s.tracer.Start(ctx, name,
+		trace.WithTimestamp(start),
+		trace.WithAttributes(attribute.Int("bytes", bytes)),
+	)
+	span.End(trace.WithTimestamp(end))
+}
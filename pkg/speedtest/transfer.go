@@ -0,0 +1,558 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// maxCacheBusterLength bounds the cache buster clients may send
+const maxCacheBusterLength = 64
+
+// setTestHeaders keeps caches and compressing proxies away from a test
+// response and echoes the request's cache buster (the t parameter) in
+// X-Cache-Buster, so clients can tell the response really came from the
+// server. It writes a 400 response and returns false for a malformed buster.
+func setTestHeaders(w http.ResponseWriter, r *http.Request) bool {
+	buster := r.URL.Query().Get("t")
+	if len(buster) > maxCacheBusterLength || strings.IndexFunc(buster, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.')
+	}) >= 0 {
+		http.Error(w, "Invalid cache buster", http.StatusBadRequest)
+		return false
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-store, no-cache, no-transform, must-revalidate, max-age=0")
+	h.Set("Pragma", "no-cache")
+	h.Set("Expires", "0")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if buster != "" {
+		h.Set("X-Cache-Buster", buster)
+	}
+	return true
+}
+
+// pingTimes are the server's clock readings for a /ping request in Unix
+// nanoseconds. Together with its own send and receive times a client can
+// estimate the offset between the clocks and the delay in each direction,
+// as NTP does.
+type pingTimes struct {
+	Receive int64 `json:"receive_time"`
+	Send    int64 `json:"send_time"`
+}
+
+// handlePing responds to ping requests to measure latency, with the times
+// the server received and answered the request
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	if !setTestHeaders(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	body, _ := json.Marshal(pingTimes{Receive: received.UnixNano(), Send: time.Now().UnixNano()})
+	w.Write(body)
+}
+
+// handleTestFile generates and streams random data for the download test
+func (s *Server) handleTestFile(w http.ResponseWriter, r *http.Request) {
+	// Use the configured download size unless the client asks for another one
+	size := int(s.cfg.DownloadSize)
+
+	if sizeStr := r.URL.Query().Get("size"); sizeStr != "" {
+		parsedSize, err := strconv.Atoi(sizeStr)
+		if err != nil || parsedSize <= 0 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+
+		// Never stream more than the server-side cap
+		size = int(math.Min(float64(parsedSize), float64(s.cfg.MaxDownloadSize)))
+	}
+
+	// In duration mode the download runs for a fixed time instead, still
+	// capped at the largest download size unless the client asks for less
+	duration, err := s.testDuration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if duration > 0 && r.URL.Query().Get("size") == "" {
+		size = int(s.cfg.MaxDownloadSize)
+	}
+
+	// Segmented downloaders fetch the test file in byte ranges. It has no
+	// validators, so a conditional If-Range never matches and gets it whole.
+	// A range has no meaning while the length is open in duration mode.
+	total, partial := size, false
+	if duration == 0 && r.Header.Get("If-Range") == "" {
+		start, length, ok, err := parseRange(r.Header.Get("Range"), total)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+			http.Error(w, "Range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if ok {
+			size, partial = length, true
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, total))
+		}
+	}
+
+	// Throttle for testing purposes if requested
+	throttleKBps := s.throttleRate(r)
+	if throttleKBps != s.cfg.ThrottleKBps {
+		s.testLogger(r).Info("Throttling download", "kbps", throttleKBps)
+	}
+
+	// Streams belonging to a multi-stream test are aggregated per session
+	var session *testSession
+	var stats *transferStats
+	if r.URL.Query().Get("session") != "" {
+		var ok bool
+		if session, ok = s.requestSession(r); !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+		// Speed probes run before the test proper. They stay out of the
+		// session's totals, measured apart to plan the rest of the test.
+		stats = &session.download
+		if r.URL.Query().Get("probe") != "" {
+			stats = &session.probe
+		}
+		if r.Method != "HEAD" {
+			if err := session.beginStream(stats); err != nil {
+				refuseStream(w, session, err)
+				return
+			}
+			defer session.endStream(stats)
+		}
+	}
+
+	// Set appropriate headers. The data is incompressible, and saying it is
+	// sent as is keeps middleboxes from trying to compress it anyway.
+	if !setTestHeaders(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if duration == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	w.Header().Set("Content-Encoding", "identity")
+	if partial {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	// A HEAD request only asks for the size, for planning ranges
+	if r.Method == "HEAD" {
+		return
+	}
+
+	chunkSize := s.cfg.ChunkSize
+	throttle := s.newThrottle(throttleKBps, chunkSize)
+
+	// Responses of known length over plain HTTP/1.1 can be copied from the
+	// payload file by the kernel; anything else is written from memory
+	var sender *payloadSender
+	if duration == 0 && r.TLS == nil && r.ProtoMajor == 1 {
+		sender = s.random.sender()
+		defer sender.close()
+	}
+
+	// Stream random data
+	bytesRemaining := size
+	chunks := 0
+	startTime := time.Now()
+
+	if session != nil {
+		session.beginTCP(stats, requestConn(r))
+		defer session.endTCP(stats, requestConn(r))
+	}
+
+	ctx, span := s.startTransferSpan(r.Context(), "download stream",
+		attribute.Int("size", size),
+		attribute.String("session", r.URL.Query().Get("session")),
+		attribute.Float64("throttle_kbps", throttleKBps),
+	)
+	s.transferStarted(directionDownload)
+	completed := false
+	defer func() {
+		sent, elapsed := int64(size-bytesRemaining), time.Since(startTime)
+		endTransferSpan(ctx, span, sent, elapsed, completed)
+		s.transferFinished(s.testLogger(r), directionDownload, sent, elapsed, completed)
+	}()
+
+	for bytesRemaining > 0 && (duration == 0 || time.Since(startTime) < duration) {
+		currentChunkSize := int(math.Min(float64(chunkSize), float64(bytesRemaining)))
+
+		// Apply throttling if requested, waiting until the bucket holds the chunk
+		if throttle != nil {
+			waitStart := time.Now()
+			if err := throttle.WaitN(ctx, currentChunkSize); err != nil {
+				return
+			}
+			s.traceWait(ctx, "throttle wait", waitStart, currentChunkSize)
+		}
+
+		// Stay within the server's bandwidth cap
+		if err := s.waitBandwidth(ctx, directionDownload, currentChunkSize); err != nil {
+			return
+		}
+
+		// Write the chunk to the response
+		var n int
+		var err error
+		if sender != nil {
+			n, err = sender.send(w, currentChunkSize)
+		} else {
+			n, err = w.Write(s.random.chunk(currentChunkSize))
+		}
+		s.transferBytes(directionDownload, n)
+		if session != nil {
+			session.addBytes(stats, n)
+		}
+		if err != nil {
+			// Client probably disconnected, that's OK
+			s.testLogger(r).Info("Writing download failed", "bytes", size-bytesRemaining+n, "duration", time.Since(startTime), "err", err)
+			return
+		}
+
+		bytesRemaining -= currentChunkSize
+		chunks++
+
+		// Flush to ensure data is sent immediately. Flushing less often saves
+		// syscalls on fast links; without flushing the server buffers as it likes.
+		if s.cfg.FlushEvery > 0 && chunks%s.cfg.FlushEvery == 0 {
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+	completed = true
+}
+
+// testDuration parses the duration parameter, which makes /testfile and
+// /upload run for a fixed time rather than a fixed byte count. Go durations
+// such as "10s" and plain seconds are accepted. Without the parameter it
+// returns 0.
+func (s *Server) testDuration(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("duration")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if secs, convErr := strconv.ParseFloat(v, 64); convErr == nil {
+		d, err = time.Duration(secs*float64(time.Second)), nil
+	}
+	if err != nil || d <= 0 {
+		return 0, errors.New("Invalid duration")
+	}
+	if d > time.Duration(s.cfg.MaxDuration)*time.Second {
+		return 0, errors.New("Duration exceeds limit")
+	}
+	return d, nil
+}
+
+// parseRange reads a Range header for a body of size bytes, returning the
+// first byte and length of the range. ok is false when the whole body should
+// be sent instead: without a header, for units other than bytes, for
+// malformed headers and for several ranges, which the server does not split
+// into a multipart body. err is set when the range starts past the end.
+func parseRange(header string, size int) (start, length int, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		// A suffix range: the last n bytes
+		n, convErr := strconv.Atoi(last)
+		if convErr != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+
+	start, convErr := strconv.Atoi(first)
+	if convErr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, convErr = strconv.Atoi(last); convErr != nil || end < start {
+			return 0, 0, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end - start + 1, true, nil
+}
+
+// errRangeNotSatisfiable means a Range header asked for bytes past the end
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// uploadSink takes the body of an upload as io.CopyBuffer hands it over and
+// throws it away, doing the bookkeeping for every write. Copying this way
+// reads straight into the pooled buffer without a loop of our own.
+type uploadSink struct {
+	s        *Server
+	ctx      context.Context
+	session  *testSession // Nil outside a multi-stream test
+	checksum hash.Hash    // Nil unless the client asked for one
+	sampler  *throughputSampler
+	warmup   *warmupWindow // Nil without a warm-up
+	deadline time.Time     // Zero unless the upload runs for a duration
+	n        int64         // Bytes received so far
+}
+
+func (u *uploadSink) Write(p []byte) (int, error) {
+	n := len(p)
+	u.n += int64(n)
+	if u.checksum != nil {
+		u.checksum.Write(p)
+	}
+	u.s.transferBytes(directionUpload, n)
+	err := u.s.waitBandwidth(u.ctx, directionUpload, n)
+	if u.session != nil {
+		u.session.addBytes(&u.session.upload, n)
+	}
+	now := time.Now()
+	u.sampler.observe(now, u.n)
+	if u.warmup != nil {
+		u.warmup.observe(now, u.n)
+	}
+	if err == nil && !u.deadline.IsZero() && !now.Before(u.deadline) {
+		// Stop copying; the handler treats this as the end of the upload
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// handleUpload processes upload requests for the upload speed test
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// In duration mode the server stops reading once the time is up
+	duration, err := s.testDuration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Clients may announce how much they intend to send, up to the server
+	// limit. Duration-mode uploads that don't are bounded by time alone, so
+	// a fast link isn't cut off at max_file_size before the time is up.
+	limit := s.cfg.MaxFileSize
+	if sizeStr := r.URL.Query().Get("size"); sizeStr != "" {
+		parsedSize, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || parsedSize <= 0 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+		if parsedSize > s.cfg.MaxFileSize {
+			http.Error(w, "Upload size exceeds limit", http.StatusRequestEntityTooLarge)
+			return
+		}
+		limit = parsedSize
+	} else if duration > 0 {
+		limit = 0
+	}
+
+	// Bodies may be streamed chunked, without a Content-Length, in which case
+	// the limit applies as they are read. One announced as too large is
+	// turned away up front.
+	if limit > 0 {
+		if r.ContentLength > limit {
+			http.Error(w, "Upload size exceeds limit", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	// Uploads belonging to a multi-stream test are aggregated per session
+	var session *testSession
+	if r.URL.Query().Get("session") != "" {
+		var ok bool
+		if session, ok = s.requestSession(r); !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+	}
+
+	// Clients checking that their data arrived intact ask for its checksum
+	var checksum hash.Hash
+	switch r.URL.Query().Get("checksum") {
+	case "":
+	case "sha256":
+		checksum = sha256.New()
+	default:
+		http.Error(w, "checksum must be sha256", http.StatusBadRequest)
+		return
+	}
+
+	// Check if we need to simulate latency for more accurate testing
+	simulateLatencyStr := r.URL.Query().Get("latency")
+	var simulateLatencyMs int = 0
+
+	if simulateLatencyStr != "" {
+		parsedLatency, err := strconv.Atoi(simulateLatencyStr)
+		if err == nil && parsedLatency > 0 {
+			simulateLatencyMs = parsedLatency
+		}
+	}
+
+	// The stream ends once the body is read, so the response can report on
+	// the session; if reading fails, returning ends it
+	endStream := func() {}
+	if session != nil {
+		if err := session.beginStream(&session.upload); err != nil {
+			refuseStream(w, session, err)
+			return
+		}
+		conn := requestConn(r)
+		session.beginTCP(&session.upload, conn)
+		var once sync.Once
+		endStream = func() {
+			once.Do(func() {
+				session.endTCP(&session.upload, conn)
+				session.endStream(&session.upload)
+			})
+		}
+		defer endStream()
+	}
+
+	// Start timing the upload
+	startTime := time.Now()
+	deadline := startTime.Add(duration)
+	if duration > 0 {
+		// Don't stay blocked in a read past the deadline; where the connection
+		// can't do this the time is checked after each read instead
+		http.NewResponseController(w).SetReadDeadline(deadline)
+	}
+
+	ctx, span := s.startTransferSpan(r.Context(), "upload read loop",
+		attribute.Int64("limit", limit), // 0 when only the duration limits it
+		attribute.String("session", r.URL.Query().Get("session")),
+	)
+
+	// Create a rate-limited reader if throttling is requested
+	var reader io.Reader = r.Body
+	if throttle := s.newThrottle(s.throttleRate(r), s.cfg.UploadBufferSize); throttle != nil {
+		reader = &throttledReader{ctx: ctx, r: r.Body, limiter: throttle, waited: func(start time.Time, n int) {
+			s.traceWait(ctx, "throttle wait", start, n)
+		}}
+	}
+
+	// Read the uploaded data through the pooled buffer, counting every byte
+	// received as it's discarded
+	bufPtr := s.buffers.getUpload()
+	defer s.buffers.putUpload(bufPtr)
+
+	// Sample the rate as the data arrives, so clients can plot it
+	sink := &uploadSink{
+		s:        s,
+		ctx:      ctx,
+		session:  session,
+		checksum: checksum,
+		sampler:  newThroughputSampler(uploadSampleInterval, startTime),
+		warmup:   newWarmupWindow(s.cfg.Warmup, startTime),
+	}
+	if duration > 0 {
+		sink.deadline = deadline
+	}
+
+	s.transferStarted(directionUpload)
+	completed := false
+	defer func() {
+		elapsed := time.Since(startTime)
+		endTransferSpan(ctx, span, sink.n, elapsed, completed)
+		s.transferFinished(s.testLogger(r), directionUpload, sink.n, elapsed, completed)
+	}()
+
+	_, err = io.CopyBuffer(sink, reader, *bufPtr)
+	if duration > 0 && !time.Now().Before(deadline) {
+		// The time is up; whatever the client still sends is ignored
+		err = nil
+	}
+	byteCount := sink.n
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "Upload size exceeds limit", http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.testLogger(r).Warn("Reading upload failed", "bytes", byteCount, "duration", time.Since(startTime), "err", err)
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	endStream()
+	endTime := time.Now()
+	sink.sampler.finish(endTime, byteCount)
+	completed = true
+
+	// Simulate additional latency if requested
+	if simulateLatencyMs > 0 {
+		time.Sleep(time.Duration(simulateLatencyMs) * time.Millisecond)
+	}
+
+	// Calculate upload duration
+	elapsed := time.Since(startTime).Seconds()
+
+	// Send response with upload information
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{
+		"success":    true,
+		"size":       byteCount,
+		"duration":   elapsed,
+		"throughput": sink.sampler.summary(),
+	}
+	if elapsed > 0 {
+		response["mbps"] = float64(byteCount) * 8 / elapsed / 1e6
+	}
+
+	// The checksum covers every byte read, so it also reveals a truncated upload
+	if checksum != nil {
+		response["sha256"] = hex.EncodeToString(checksum.Sum(nil))
+	}
+
+	// With a warm-up configured, also report the rate without it
+	if sink.warmup != nil {
+		response["trimmed"] = sink.warmup.trimmed(endTime, byteCount)
+	}
+
+	// Include the combined rate of all upload streams in the session
+	if session != nil {
+		response["session"] = session.uploadSummary()
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
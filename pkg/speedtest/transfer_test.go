@@ -0,0 +1,47 @@
+package speedtest
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        string
+		size          int
+		start, length int
+		ok            bool
+		err           error
+	}{
+		{"first bytes", "bytes=0-99", 1000, 0, 100, true, nil},
+		{"middle", "bytes=100-199", 1000, 100, 100, true, nil},
+		{"open end", "bytes=900-", 1000, 900, 100, true, nil},
+		{"end past size", "bytes=900-5000", 1000, 900, 100, true, nil},
+		{"single byte", "bytes=999-999", 1000, 999, 1, true, nil},
+		{"suffix", "bytes=-100", 1000, 900, 100, true, nil},
+		{"suffix past size", "bytes=-5000", 1000, 0, 1000, true, nil},
+		{"spaces", "bytes= 0-9 ", 1000, 0, 10, true, nil},
+		{"start past size", "bytes=1000-", 1000, 0, 0, false, errRangeNotSatisfiable},
+		{"empty suffix", "bytes=-0", 1000, 0, 0, false, errRangeNotSatisfiable},
+		{"other unit", "items=0-99", 1000, 0, 0, false, nil},
+		{"multiple ranges", "bytes=0-9,20-29", 1000, 0, 0, false, nil},
+		{"no dash", "bytes=100", 1000, 0, 0, false, nil},
+		{"end before start", "bytes=200-100", 1000, 0, 0, false, nil},
+		{"negative start", "bytes=-1-5", 1000, 0, 0, false, nil},
+		{"not a number", "bytes=a-b", 1000, 0, 0, false, nil},
+		{"empty", "", 1000, 0, 0, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, length, ok, err := parseRange(tt.header, tt.size)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("parseRange(%q) error = %v, want %v", tt.header, err, tt.err)
+			}
+			if ok != tt.ok || start != tt.start || length != tt.length {
+				t.Errorf("parseRange(%q) = %d, %d, %v, want %d, %d, %v",
+					tt.header, start, length, ok, tt.start, tt.length, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package speedtest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// UDP probe datagrams are laid out as:
+//
+//	[16]byte probe token | uint32 sequence number | int64 client send time (ns)
+//
+// followed by optional padding. All integers are big-endian. The server echoes
+// every valid datagram back unchanged so the client can measure RTT and
+// downstream loss, and keeps its own upstream loss and jitter statistics.
+const (
+	udpTokenSize     = 16
+	udpHeaderSize    = udpTokenSize + 4 + 8
+	udpMaxPacketSize = 1500
+	udpMaxPackets    = 100000 // Stop tracking sequence numbers beyond this many packets
+)
+
+// udpProbe collects receive statistics for one UDP probe session
+type udpProbe struct {
+	id      string
+	created time.Time
+
+	mu          sync.Mutex
+	lastSeen    time.Time
+	received    int
+	duplicates  int
+	reordered   int
+	maxSeq      int64
+	seen        map[uint32]struct{}
+	lastTransit float64 // Previous one-way transit in ms, for RFC 3550 jitter
+	jitter      float64 // Interarrival jitter in ms
+}
+
+// udpProbeStats is the JSON view of a probe's statistics
+type udpProbeStats struct {
+	ID          string  `json:"id"`
+	Received    int     `json:"received"`
+	Expected    int64   `json:"expected"`
+	Lost        int64   `json:"lost"`
+	LossPercent float64 `json:"loss_percent"`
+	Duplicates  int     `json:"duplicates"`
+	Reordered   int     `json:"reordered"`
+	Jitter      float64 `json:"jitter"` // Milliseconds, RFC 3550 interarrival jitter
+}
+
+// udpProbeRegistry tracks active UDP probe sessions by token
+type udpProbeRegistry struct {
+	mu     sync.Mutex
+	probes map[string]*udpProbe
+}
+
+// start registers a new probe session
+func (reg *udpProbeRegistry) start() (*udpProbe, error) {
+	token := make([]byte, udpTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	p := &udpProbe{
+		id:       hex.EncodeToString(token),
+		created:  now,
+		lastSeen: now,
+		maxSeq:   -1,
+		seen:     make(map[uint32]struct{}),
+	}
+
+	reg.mu.Lock()
+	reg.probes[p.id] = p
+	reg.mu.Unlock()
+
+	return p, nil
+}
+
+// get looks up a probe by ID
+func (reg *udpProbeRegistry) get(id string) (*udpProbe, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	p, ok := reg.probes[id]
+	return p, ok
+}
+
+// stop removes a probe and returns it
+func (reg *udpProbeRegistry) stop(id string) (*udpProbe, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	p, ok := reg.probes[id]
+	delete(reg.probes, id)
+	return p, ok
+}
+
+// expireLoop drops probes that were never stopped
+func (reg *udpProbeRegistry) expireLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		reg.mu.Lock()
+		for id, p := range reg.probes {
+			p.mu.Lock()
+			idle := time.Since(p.lastSeen)
+			p.mu.Unlock()
+			if idle > sessionTTL {
+				delete(reg.probes, id)
+			}
+		}
+		reg.mu.Unlock()
+	}
+}
+
+// record accounts for one received datagram
+func (p *udpProbe) record(seq uint32, clientSendNs int64, arrival time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastSeen = arrival
+
+	if _, dup := p.seen[seq]; dup {
+		p.duplicates++
+		return
+	}
+	if len(p.seen) < udpMaxPackets {
+		p.seen[seq] = struct{}{}
+	}
+
+	p.received++
+	if int64(seq) < p.maxSeq {
+		p.reordered++
+	} else {
+		p.maxSeq = int64(seq)
+	}
+
+	// RFC 3550 interarrival jitter. Clock offset between client and server
+	// cancels out because only differences of transit times are used.
+	transit := float64(arrival.UnixNano()-clientSendNs) / 1e6
+	if p.received > 1 {
+		d := math.Abs(transit - p.lastTransit)
+		p.jitter += (d - p.jitter) / 16
+	}
+	p.lastTransit = transit
+}
+
+// stats returns the probe's current statistics
+func (p *udpProbe) stats() udpProbeStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := udpProbeStats{
+		ID:         p.id,
+		Received:   p.received,
+		Expected:   p.maxSeq + 1,
+		Duplicates: p.duplicates,
+		Reordered:  p.reordered,
+		Jitter:     p.jitter,
+	}
+	if st.Expected > int64(st.Received) {
+		st.Lost = st.Expected - int64(st.Received)
+	}
+	if st.Expected > 0 {
+		st.LossPercent = float64(st.Lost) / float64(st.Expected) * 100
+	}
+	return st
+}
+
+// serveUDP echoes probe datagrams arriving on the UDP listener until it is closed
+func (s *Server) serveUDP() {
+	conn := s.udpConn
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			s.log("udp").Error("UDP probe listener stopped", "err", err)
+			return
+		}
+		arrival := time.Now()
+
+		// Ignore anything that isn't a well-formed probe for a known session
+		if n < udpHeaderSize {
+			continue
+		}
+		p, ok := s.udpProbes.get(hex.EncodeToString(buf[:udpTokenSize]))
+		if !ok {
+			continue
+		}
+
+		seq := binary.BigEndian.Uint32(buf[udpTokenSize:])
+		sent := int64(binary.BigEndian.Uint64(buf[udpTokenSize+4:]))
+		p.record(seq, sent, arrival)
+
+		if _, err := conn.WriteToUDP(buf[:n], addr); err != nil {
+			s.log("udp").Warn("Echoing UDP datagram failed", "err", err)
+		}
+	}
+}
+
+// handleUDPStart creates a UDP probe session and tells the client where to send datagrams
+func (s *Server) handleUDPStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, err := s.udpProbes.start()
+	if err != nil {
+		s.log("udp").Error("Starting UDP probe failed", "err", err)
+		http.Error(w, "Could not start UDP probe", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":   p.id,
+		"port": s.cfg.UDP.Port,
+	})
+}
+
+// handleUDPStop ends a UDP probe session and returns its statistics
+func (s *Server) handleUDPStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := s.udpProbes.stop(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "Unknown probe", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(p.stats())
+}
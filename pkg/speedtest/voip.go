@@ -0,0 +1,61 @@
+package speedtest
+
+import "math"
+
+// E-model parameters for a G.711 call with packet loss concealment, after
+// ITU-T G.107 and G.113
+const (
+	voipBaseR        = 93.2 // Transmission rating of a perfect G.711 connection
+	voipCodecDelay   = 20   // Milliseconds of packetization and codec delay
+	voipLossRobust   = 25.1 // Bpl, how well the codec hides random packet loss
+	voipJitterBuffer = 2    // Jitter buffer size as a multiple of the jitter
+)
+
+// voipEstimate predicts how a voice call over the tested link would sound
+type voipEstimate struct {
+	R   float64 `json:"r_factor"` // 0 to 100
+	MOS float64 `json:"mos"`      // Mean opinion score, 1 to 4.5
+}
+
+// estimateVoIP applies the E-model to a result's latency under load, jitter
+// and packet loss, or returns nil without a latency. Loss the client did not
+// measure counts as none.
+func estimateVoIP(res *testResult) *voipEstimate {
+	latency := loadedLatency(res)
+	if latency <= 0 {
+		return nil
+	}
+
+	// One-way mouth-to-ear delay: half the round trip, the jitter buffer and
+	// the codec
+	d := latency/2 + voipJitterBuffer*res.Jitter + voipCodecDelay
+	delayImpairment := 0.024 * d
+	if d > 177.3 {
+		delayImpairment += 0.11 * (d - 177.3)
+	}
+
+	var loss float64
+	if res.Loss != nil {
+		loss = *res.Loss
+	}
+	lossImpairment := 95 * loss / (loss + voipLossRobust)
+
+	r := math.Max(0, math.Min(100, voipBaseR-delayImpairment-lossImpairment))
+	return &voipEstimate{
+		R:   r,
+		MOS: rToMOS(r),
+	}
+}
+
+// rToMOS converts a transmission rating to a mean opinion score (G.107
+// annex B)
+func rToMOS(r float64) float64 {
+	switch {
+	case r <= 0:
+		return 1
+	case r >= 100:
+		return 4.5
+	default:
+		return 1 + 0.035*r + r*(r-60)*(100-r)*7e-6
+	}
+}
@@ -0,0 +1,62 @@
+package speedtest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimateVoIP(t *testing.T) {
+	loss := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name   string
+		res    testResult
+		r, mos float64 // Zero expects no estimate
+	}{
+		{"no latency", testResult{Download: 100}, 0, 0},
+		{"clean link", testResult{Latency: 40}, 92.24, 4.3899},
+		{"jitter and loss", testResult{Latency: 100, Jitter: 10, Loss: loss(1)}, 87.4002, 4.2702},
+		{"long delay", testResult{Latency: 600, Jitter: 20}, 64.463, 3.3278},
+		{"latency under load", testResult{
+			Latency:     10,
+			Jitter:      20,
+			Bufferbloat: &bufferbloatResult{Download: 600, Upload: 200},
+		}, 64.463, 3.3278},
+		{"unusable", testResult{Latency: 2000, Loss: loss(50)}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := estimateVoIP(&tt.res)
+			if tt.r == 0 && tt.mos == 0 {
+				if got != nil {
+					t.Fatalf("estimateVoIP() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("estimateVoIP() = nil")
+			}
+			if math.Abs(got.R-tt.r) > 1e-3 || math.Abs(got.MOS-tt.mos) > 1e-3 {
+				t.Errorf("estimateVoIP() = R %.4f, MOS %.4f, want R %.4f, MOS %.4f", got.R, got.MOS, tt.r, tt.mos)
+			}
+		})
+	}
+}
+
+func TestRToMOS(t *testing.T) {
+	tests := []struct {
+		r, mos float64
+	}{
+		{-10, 1},
+		{0, 1},
+		{50, 2.575},
+		{60, 3.1},
+		{80, 4.024},
+		{100, 4.5},
+		{120, 4.5},
+	}
+	for _, tt := range tests {
+		if got := rToMOS(tt.r); math.Abs(got-tt.mos) > 1e-9 {
+			t.Errorf("rToMOS(%v) = %v, want %v", tt.r, got, tt.mos)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package speedtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const webhookUserAgent = "infobits-speedtest-webhook"
+
+// webhookEvent is the JSON body posted to webhook URLs
+type webhookEvent struct {
+	Event  string     `json:"event"` // Always "test.completed"
+	Result testResult `json:"result"`
+	// Thresholds the result crossed: "download", "upload" and/or "latency"
+	Crossed []string `json:"crossed,omitempty"`
+}
+
+// webhookNotifier posts finished tests to the configured webhook URLs
+type webhookNotifier struct {
+	cfg    WebhookConfig
+	client *http.Client
+	logger *slog.Logger
+	wg     sync.WaitGroup // Deliveries in flight
+}
+
+// newWebhookNotifier returns a notifier for cfg, or nil when no URLs are set
+func newWebhookNotifier(cfg WebhookConfig, logger *slog.Logger) *webhookNotifier {
+	if len(cfg.URLs) == 0 {
+		return nil
+	}
+	return &webhookNotifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		logger: logger,
+	}
+}
+
+// crossed returns the thresholds a result crossed
+func (n *webhookNotifier) crossed(res testResult) []string {
+	var crossed []string
+	if n.cfg.MinDownloadMbps > 0 && res.Download < n.cfg.MinDownloadMbps {
+		crossed = append(crossed, "download")
+	}
+	if n.cfg.MinUploadMbps > 0 && res.Upload < n.cfg.MinUploadMbps {
+		crossed = append(crossed, "upload")
+	}
+	if n.cfg.MaxLatencyMs > 0 && res.Latency > n.cfg.MaxLatencyMs {
+		crossed = append(crossed, "latency")
+	}
+	return crossed
+}
+
+// notify posts a stored result to every webhook URL in the background. With
+// thresholds configured, only results crossing one of them are sent.
+func (n *webhookNotifier) notify(res testResult) {
+	if n == nil {
+		return
+	}
+	event := webhookEvent{Event: "test.completed", Result: res, Crossed: n.crossed(res)}
+	if n.cfg.hasThresholds() && len(event.Crossed) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		n.logger.Error("Encoding webhook event failed", "err", err)
+		return
+	}
+	n.deliver(body)
+}
+
+// deliver posts an event body to every webhook URL in the background
+func (n *webhookNotifier) deliver(body []byte) {
+	for _, url := range n.cfg.URLs {
+		n.wg.Add(1)
+		go func(url string) {
+			defer n.wg.Done()
+			if err := n.post(url, body); err != nil {
+				n.logger.Warn("Webhook failed", "url", url, "err", err)
+			}
+		}(url)
+	}
+}
+
+// post delivers one event body
+func (n *webhookNotifier) post(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", webhookUserAgent)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// wait blocks until deliveries in flight have finished or timed out
+func (n *webhookNotifier) wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
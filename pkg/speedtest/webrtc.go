@@ -0,0 +1,550 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/crypto/selfsign"
+	"github.com/pion/logging"
+	"github.com/pion/sctp"
+	"github.com/pion/transport/v3/deadline"
+)
+
+// The WebRTC probe lets browsers send the UDP probe's datagrams over an
+// unordered data channel without retransmissions, so they see the loss and
+// jitter that TCP hides. The server is an ICE-lite peer: its answer offers a
+// single host candidate on the WebRTC port, the browser runs the
+// connectivity checks, and DTLS, SCTP and the data channels follow on the
+// same port. Messages on a channel use the UDP probe's layout and are echoed
+// back unchanged.
+const (
+	webrtcHandshakeTimeout = 10 * time.Second // Limit for the DTLS handshake
+	webrtcPeerIdle         = 30 * time.Second // Peers are dropped after this long without packets
+	webrtcMaxPeers         = 256              // Peer connections set up at a time
+	webrtcQueueSize        = 128              // DTLS datagrams waiting to be read per peer
+	webrtcMaxOfferSize     = 64 * 1024
+	webrtcCredentialBytes  = 12 // Random bytes in our ICE ufrag; the password gets twice as many
+)
+
+// webrtcOffer is the body of POST /api/webrtc/offer
+type webrtcOffer struct {
+	SDP string `json:"sdp"` // The browser's offer with one data channel
+}
+
+// webrtcAnswer is the reply to an offer
+type webrtcAnswer struct {
+	ID  string `json:"id"`  // Probe ID to put in datagrams and stop the probe with
+	SDP string `json:"sdp"` // The server's answer
+}
+
+// webrtcListener terminates the peer connections of WebRTC probes on one
+// UDP port
+type webrtcListener struct {
+	conn        *net.UDPConn
+	cert        tls.Certificate
+	fingerprint string // SHA-256 of cert, as written in SDP
+	pion        logging.LoggerFactory
+	logger      *slog.Logger
+
+	mu      sync.Mutex
+	byUfrag map[string]*webrtcPeer // By our ICE ufrag, from the offer on
+	byAddr  map[string]*webrtcPeer // By browser address, once it passed a check
+}
+
+// newWebRTCListener serves WebRTC probes on conn with a fresh self-signed
+// certificate; browsers verify it by the fingerprint in the answer
+func newWebRTCListener(conn *net.UDPConn, logger *slog.Logger) (*webrtcListener, error) {
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		return nil, fmt.Errorf("generating WebRTC certificate: %w", err)
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	pairs := make([]string, 0, len(sum))
+	for i := 0; i < len(hexSum); i += 2 {
+		pairs = append(pairs, hexSum[i:i+2])
+	}
+	return &webrtcListener{
+		conn:        conn,
+		cert:        cert,
+		fingerprint: strings.Join(pairs, ":"),
+		pion:        &logging.DefaultLoggerFactory{Writer: io.Discard, DefaultLogLevel: logging.LogLevelDisabled},
+		logger:      logger,
+		byUfrag:     make(map[string]*webrtcPeer),
+		byAddr:      make(map[string]*webrtcPeer),
+	}, nil
+}
+
+// serve reads datagrams until the listener is closed, answering ICE
+// connectivity checks and passing DTLS on to the peer they belong to
+func (l *webrtcListener) serve() {
+	buf := make([]byte, 8192)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			l.logger.Error("WebRTC listener stopped", "err", err)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+
+		// STUN and DTLS share the port, told apart by their first byte (RFC 7983)
+		switch b := buf[0]; {
+		case b < 4:
+			l.handleSTUN(buf[:n], addr)
+		case b >= 20 && b <= 63:
+			l.mu.Lock()
+			p, ok := l.byAddr[addr.String()]
+			l.mu.Unlock()
+			if ok {
+				p.deliver(bytes.Clone(buf[:n]), addr)
+			}
+		}
+	}
+}
+
+// handleSTUN answers a browser's connectivity check for a known peer
+func (l *webrtcListener) handleSTUN(msg []byte, addr *net.UDPAddr) {
+	req, ok := parseSTUN(msg)
+	if !ok || req.msgType != stunBindingRequest || req.integrity < 0 {
+		return
+	}
+	// USERNAME is our ufrag and the browser's, separated by a colon
+	local, _, _ := strings.Cut(req.username, ":")
+	l.mu.Lock()
+	p, ok := l.byUfrag[local]
+	l.mu.Unlock()
+	if !ok || !req.verify(msg, p.pwd) {
+		return
+	}
+
+	l.mu.Lock()
+	_, known := l.byAddr[addr.String()]
+	l.byAddr[addr.String()] = p
+	l.mu.Unlock()
+	if !known {
+		p.bind(addr)
+	}
+	p.touch()
+
+	if _, err := l.conn.WriteToUDP(stunBindingResponse(req.transaction, addr, p.pwd), addr); err != nil {
+		l.logger.Warn("Answering ICE check failed", "err", err)
+	}
+}
+
+// close closes the socket and every peer connection
+func (l *webrtcListener) close() {
+	if l == nil {
+		return
+	}
+	l.conn.Close()
+	l.mu.Lock()
+	peers := make([]*webrtcPeer, 0, len(l.byUfrag))
+	for _, p := range l.byUfrag {
+		peers = append(peers, p)
+	}
+	l.mu.Unlock()
+	for _, p := range peers {
+		p.Close()
+	}
+}
+
+// add registers a peer set up from an offer
+func (l *webrtcListener) add(p *webrtcPeer) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.byUfrag) >= webrtcMaxPeers {
+		return false
+	}
+	l.byUfrag[p.ufrag] = p
+	return true
+}
+
+// remove forgets a closed peer
+func (l *webrtcListener) remove(p *webrtcPeer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.byUfrag, p.ufrag)
+	for addr, peer := range l.byAddr {
+		if peer == p {
+			delete(l.byAddr, addr)
+		}
+	}
+}
+
+// expireLoop closes peers that went quiet without closing their connection
+func (l *webrtcListener) expireLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(webrtcPeerIdle / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		var idle []*webrtcPeer
+		for _, p := range l.byUfrag {
+			if p.idleSince() > webrtcPeerIdle {
+				idle = append(idle, p)
+			}
+		}
+		l.mu.Unlock()
+		for _, p := range idle {
+			p.Close()
+		}
+	}
+}
+
+// answer returns the SDP answering a browser's offer, with the peer's ICE
+// credentials and a host candidate at ip on the listener's port
+func (l *webrtcListener) answer(o parsedOffer, p *webrtcPeer, ip net.IP) string {
+	family := "IP4"
+	if ip.To4() == nil {
+		family = "IP6"
+	}
+	port := l.conn.LocalAddr().(*net.UDPAddr).Port
+	lines := []string{
+		"v=0",
+		"o=- " + strconv.FormatInt(time.Now().UnixNano(), 10) + " 2 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"a=ice-lite",
+		"a=group:BUNDLE " + o.mid,
+		"m=application " + strconv.Itoa(port) + " UDP/DTLS/SCTP webrtc-datachannel",
+		"c=IN " + family + " " + ip.String(),
+		"a=mid:" + o.mid,
+		"a=ice-ufrag:" + p.ufrag,
+		"a=ice-pwd:" + p.pwd,
+		"a=fingerprint:sha-256 " + l.fingerprint,
+		"a=setup:passive",
+		"a=sctp-port:5000",
+		"a=max-message-size:65536",
+		fmt.Sprintf("a=candidate:1 1 udp 2130706431 %s %d typ host", ip, port),
+		"a=end-of-candidates",
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// parsedOffer is what the server needs from a browser's offer
+type parsedOffer struct {
+	mid         string // Of the data channel's media section
+	fingerprint []byte // SHA-256 of the browser's DTLS certificate
+}
+
+// parseOffer picks the data channel section and certificate fingerprint out
+// of an SDP offer
+func parseOffer(sdp string) (parsedOffer, error) {
+	var o parsedOffer
+	inApplication := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			inApplication = strings.HasPrefix(line, "m=application ") && strings.Contains(line, "webrtc-datachannel")
+		case strings.HasPrefix(line, "a=mid:") && inApplication && o.mid == "":
+			o.mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=fingerprint:sha-256 ") && o.fingerprint == nil:
+			fp, err := hex.DecodeString(strings.ReplaceAll(strings.TrimPrefix(line, "a=fingerprint:sha-256 "), ":", ""))
+			if err != nil || len(fp) != sha256.Size {
+				return o, errors.New("invalid fingerprint")
+			}
+			o.fingerprint = fp
+		}
+	}
+	if o.mid == "" {
+		return o, errors.New("offer has no data channel")
+	}
+	if o.fingerprint == nil {
+		return o, errors.New("offer has no sha-256 fingerprint")
+	}
+	return o, nil
+}
+
+// webrtcPeer is one browser's peer connection, from its offer until it
+// closes or goes quiet. It is the packet connection DTLS runs over.
+type webrtcPeer struct {
+	l           *webrtcListener
+	ufrag, pwd  string // Our ICE credentials for this peer
+	fingerprint []byte // Expected of the browser's certificate
+	probe       *udpProbe
+	token       []byte // Probe token that datagrams start with
+
+	packets   chan []byte // DTLS datagrams from the browser
+	deadline  *deadline.Deadline
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	addr     *net.UDPAddr // Where the browser sends from; nil until its first check
+	lastSeen time.Time
+}
+
+// newWebRTCPeer sets up a peer for an offer, measuring into probe
+func newWebRTCPeer(l *webrtcListener, o parsedOffer, probe *udpProbe) (*webrtcPeer, error) {
+	cred := make([]byte, webrtcCredentialBytes*3)
+	if _, err := rand.Read(cred); err != nil {
+		return nil, err
+	}
+	token, _ := hex.DecodeString(probe.id)
+	return &webrtcPeer{
+		l:           l,
+		ufrag:       hex.EncodeToString(cred[:webrtcCredentialBytes]),
+		pwd:         hex.EncodeToString(cred[webrtcCredentialBytes:]),
+		fingerprint: o.fingerprint,
+		probe:       probe,
+		token:       token,
+		packets:     make(chan []byte, webrtcQueueSize),
+		deadline:    deadline.New(),
+		closed:      make(chan struct{}),
+		lastSeen:    time.Now(),
+	}, nil
+}
+
+// bind notes an address the browser passed a check from. The first one
+// starts the DTLS server.
+func (p *webrtcPeer) bind(addr *net.UDPAddr) {
+	p.mu.Lock()
+	first := p.addr == nil
+	if first {
+		p.addr = addr
+	}
+	p.mu.Unlock()
+	if first {
+		go p.run()
+	}
+}
+
+// deliver queues a DTLS datagram from addr, which then becomes the address
+// replies go to, as the browser may switch candidate pairs
+func (p *webrtcPeer) deliver(pkt []byte, addr *net.UDPAddr) {
+	p.mu.Lock()
+	p.addr = addr
+	p.lastSeen = time.Now()
+	p.mu.Unlock()
+	select {
+	case p.packets <- pkt:
+	default:
+		// Dropped like a full socket buffer would; DTLS and SCTP recover
+	}
+}
+
+func (p *webrtcPeer) touch() {
+	p.mu.Lock()
+	p.lastSeen = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *webrtcPeer) idleSince() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Since(p.lastSeen)
+}
+
+func (p *webrtcPeer) remote() *net.UDPAddr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addr
+}
+
+// run sets up DTLS and SCTP with the browser and echoes every data channel
+// it opens, until the connection ends
+func (p *webrtcPeer) run() {
+	defer p.Close()
+	logger := p.l.logger.With("probe", p.probe.id)
+
+	conn, err := dtls.Server(p, p.remote(), &dtls.Config{
+		Certificates:         []tls.Certificate{p.l.cert},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		ClientAuth:           dtls.RequireAnyClientCert,
+		// The certificate is self-signed; the offer vouches for it
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(sum[:], p.fingerprint) != 1 {
+				return errors.New("certificate does not match the offer's fingerprint")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		logger.Warn("Setting up DTLS failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), webrtcHandshakeTimeout)
+	err = conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		logger.Debug("DTLS handshake failed", "err", err)
+		return
+	}
+
+	assoc, err := sctp.Server(sctp.Config{NetConn: conn, LoggerFactory: p.l.pion})
+	if err != nil {
+		logger.Debug("SCTP association failed", "err", err)
+		return
+	}
+	defer assoc.Close()
+	logger.Debug("WebRTC peer connected", "addr", p.remote().String())
+
+	for {
+		dc, err := datachannel.Accept(assoc, &datachannel.Config{LoggerFactory: p.l.pion})
+		if err != nil {
+			return
+		}
+		go p.echo(dc)
+	}
+}
+
+// echo records and returns every probe datagram sent on a data channel
+func (p *webrtcPeer) echo(dc *datachannel.DataChannel) {
+	defer dc.Close()
+	buf := make([]byte, 65536)
+	for {
+		n, isString, err := dc.ReadDataChannel(buf)
+		if err != nil {
+			return
+		}
+		arrival := time.Now()
+		if isString || n < udpHeaderSize || n > udpMaxPacketSize || !bytes.Equal(buf[:udpTokenSize], p.token) {
+			continue
+		}
+
+		seq := binary.BigEndian.Uint32(buf[udpTokenSize:])
+		sent := int64(binary.BigEndian.Uint64(buf[udpTokenSize+4:]))
+		p.probe.record(seq, sent, arrival)
+		if _, err := dc.WriteDataChannel(buf[:n], false); err != nil {
+			return
+		}
+	}
+}
+
+// ReadFrom returns the next DTLS datagram from the browser
+func (p *webrtcPeer) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-p.packets:
+		return copy(b, pkt), p.remote(), nil
+	case <-p.deadline.Done():
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo sends a DTLS datagram to wherever the browser last sent from
+func (p *webrtcPeer) WriteTo(b []byte, _ net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return p.l.conn.WriteToUDP(b, p.remote())
+}
+
+// Close ends the peer connection and forgets the peer
+func (p *webrtcPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.l.remove(p)
+	})
+	return nil
+}
+
+func (p *webrtcPeer) LocalAddr() net.Addr { return p.l.conn.LocalAddr() }
+
+func (p *webrtcPeer) SetDeadline(t time.Time) error { return p.SetReadDeadline(t) }
+
+func (p *webrtcPeer) SetReadDeadline(t time.Time) error {
+	p.deadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing; writes to the UDP socket don't block
+func (p *webrtcPeer) SetWriteDeadline(time.Time) error { return nil }
+
+// handleWebRTCOffer answers a browser's WebRTC offer and starts a probe
+// measured over the data channels it opens (POST /api/webrtc/offer). The
+// probe is stopped like a UDP probe.
+func (s *Server) handleWebRTCOffer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var offer webrtcOffer
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, webrtcMaxOfferSize)).Decode(&offer); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	parsed, err := parseOffer(offer.SDP)
+	if err != nil {
+		http.Error(w, "Invalid offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Offer the address the browser reached this server on, unless told otherwise
+	ip := net.ParseIP(s.cfg.WebRTC.PublicIP)
+	if ip == nil {
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+			ip = addr.IP
+		}
+	}
+	if ip == nil || ip.IsUnspecified() {
+		http.Error(w, "Server address unknown; set webrtc.public_ip", http.StatusInternalServerError)
+		return
+	}
+
+	probe, err := s.udpProbes.start()
+	if err != nil {
+		s.log("udp").Error("Starting WebRTC probe failed", "err", err)
+		http.Error(w, "Could not start probe", http.StatusInternalServerError)
+		return
+	}
+	peer, err := newWebRTCPeer(s.webrtc, parsed, probe)
+	if err != nil {
+		s.udpProbes.stop(probe.id)
+		s.log("udp").Error("Starting WebRTC probe failed", "err", err)
+		http.Error(w, "Could not start probe", http.StatusInternalServerError)
+		return
+	}
+	if !s.webrtc.add(peer) {
+		s.udpProbes.stop(probe.id)
+		http.Error(w, "Too many WebRTC probes", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(webrtcAnswer{ID: probe.id, SDP: s.webrtc.answer(parsed, peer, ip)})
+}
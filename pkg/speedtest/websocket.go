@@ -0,0 +1,91 @@
+package speedtest
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsIdleTimeout  = 30 * time.Second // Close WebSocket connections idle for this long
+	wsMaxFrameSize = 512              // Ping frames are tiny, reject anything larger
+)
+
+// upgrader upgrades HTTP connections to WebSockets. The default origin check
+// only accepts same-origin browser connections, see wsUpgrader.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsUpgrader returns a copy of u that also accepts browsers on other origins
+// when cross_origin is enabled, so portals can test against this server. With
+// cors_origins set, only those origins are accepted besides our own.
+func (s *Server) wsUpgrader(u websocket.Upgrader) *websocket.Upgrader {
+	switch {
+	case len(s.cfg.CORSOrigins) > 0:
+		u.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || s.corsOrigin(r) != "" {
+				return true
+			}
+			parsed, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(parsed.Host, r.Host)
+		}
+	case s.cfg.CrossOrigin:
+		u.CheckOrigin = func(*http.Request) bool { return true }
+	}
+	return &u
+}
+
+// pingFrame is echoed back to the client on the WebSocket ping channel
+type pingFrame struct {
+	Seq        int64   `json:"seq"`
+	ClientTime float64 `json:"client_time"`
+	ServerTime int64   `json:"server_time"` // Unix time in nanoseconds
+}
+
+// handleWSPing echoes timestamped frames so the client can measure per-packet
+// RTT. Clients passing ?session=<id> keep the channel open for the whole
+// test, and the server measures latency under load over it.
+func (s *Server) handleWSPing(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.wsUpgrader(upgrader).Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already wrote an error response
+		s.testLogger(r).Warn("WebSocket upgrade failed", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadLimit(wsMaxFrameSize)
+
+	// Within a session the server also pings the client, to measure latency under load
+	if session, ok := s.requestSession(r); ok {
+		stop := make(chan struct{})
+		defer close(stop)
+		s.pingSession(conn, session, stop)
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+
+		var frame pingFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				s.testLogger(r).Warn("Reading WebSocket ping failed", "err", err)
+			}
+			return
+		}
+
+		frame.ServerTime = time.Now().UnixNano()
+
+		conn.SetWriteDeadline(time.Now().Add(wsIdleTimeout))
+		if err := conn.WriteJSON(frame); err != nil {
+			s.testLogger(r).Warn("Writing WebSocket pong failed", "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package speedtest
+
+import "net/http"
+
+// handleEmbed serves the compact test page that speedtest-widget.js shows
+// in a frame on other sites. Any site may frame it, unless
+// headers.allow_embed lists the ones that may.
+func (s *Server) handleEmbed(w http.ResponseWriter, r *http.Request) {
+	ancestors := s.cfg.Headers.AllowEmbed
+	if len(ancestors) == 0 {
+		ancestors = []string{"*"}
+	}
+	s.serveBrandedFramed(w, r, "embed.html", ancestors)
+}
+
+// handleWidgetScript serves the script other sites include to embed the
+// widget. It lives at a short, stable path so embed snippets keep working
+// across releases.
+func (s *Server) handleWidgetScript(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFileFS(w, r, s.webFS, "js/speedtest-widget.js")
+}
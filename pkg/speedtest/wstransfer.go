@@ -0,0 +1,305 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsTransferDuration = 10 * time.Second       // Length of transfers that ask for neither a duration nor a size
+	wsProgressInterval = 250 * time.Millisecond // How often progress messages are sent
+	wsMaxUploadFrame   = 1 << 24                // Largest binary message clients may upload
+)
+
+// transferUpgrader upgrades /ws/download and /ws/upload connections. Like the
+// ping channel it only accepts same-origin browser connections, unless
+// cross_origin is enabled.
+var transferUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1 << 16,
+	WriteBufferSize: 1 << 16,
+}
+
+// wsTransferMessage is a JSON text message on the WebSocket transfer
+// endpoints. The server sends progress while data flows and a result at the
+// end; clients may send stop to end a transfer early.
+type wsTransferMessage struct {
+	Type      string  `json:"type"` // progress, result or stop
+	Bytes     int64   `json:"bytes"`
+	ElapsedMs float64 `json:"elapsed_ms"`
+	Mbps      float64 `json:"mbps"`
+}
+
+// wsTransfer is one WebSocket download or upload in progress
+type wsTransfer struct {
+	conn      *websocket.Conn
+	direction string
+	session   *testSession   // Nil outside a session
+	stats     *transferStats // The session's stats for direction
+	duration  time.Duration  // How long the transfer runs; 0 to stop at limit only
+	limit     int64          // Most bytes the transfer moves
+	start     time.Time
+	tcpConn   net.Conn // The connection under conn, for TCP statistics
+	bytes     atomic.Int64
+	logger    *slog.Logger // Carries the client IP and session
+}
+
+// message reports the transfer's progress so far
+func (t *wsTransfer) message(kind string) wsTransferMessage {
+	elapsed := time.Since(t.start)
+	m := wsTransferMessage{Type: kind, Bytes: t.bytes.Load(), ElapsedMs: float64(elapsed.Microseconds()) / 1000}
+	if secs := elapsed.Seconds(); secs > 0 {
+		m.Mbps = float64(m.Bytes) * 8 / secs / 1e6
+	}
+	return m
+}
+
+// timeUp reports whether the transfer has run for its duration
+func (t *wsTransfer) timeUp() bool {
+	return t.duration > 0 && time.Since(t.start) >= t.duration
+}
+
+// add accounts for n bytes moved
+func (t *wsTransfer) add(n int) {
+	t.bytes.Add(int64(n))
+	if t.session != nil {
+		t.session.addBytes(t.stats, n)
+	}
+}
+
+// startWSTransfer validates a transfer request, accepting the duration, size
+// and session parameters of /testfile and /upload, and upgrades it. It
+// writes an error response and returns nil when the request is invalid.
+func (s *Server) startWSTransfer(w http.ResponseWriter, r *http.Request, direction string) *wsTransfer {
+	t := &wsTransfer{direction: direction, limit: s.cfg.MaxDownloadSize, logger: s.testLogger(r)}
+	if direction == directionUpload {
+		t.limit = s.cfg.MaxFileSize
+	}
+
+	var err error
+	if t.duration, err = s.testDuration(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if sizeStr := r.URL.Query().Get("size"); sizeStr != "" {
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || size <= 0 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return nil
+		}
+		t.limit = min(size, t.limit)
+	} else {
+		if t.duration == 0 {
+			t.duration = wsTransferDuration
+		}
+		// Like /upload, a timed upload is bounded by time alone
+		if direction == directionUpload {
+			t.limit = math.MaxInt64
+		}
+	}
+
+	if r.URL.Query().Get("session") != "" {
+		var ok bool
+		if t.session, ok = s.requestSession(r); !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return nil
+		}
+		t.stats = &t.session.download
+		if direction == directionUpload {
+			t.stats = &t.session.upload
+		}
+		if err := t.session.beginStream(t.stats); err != nil {
+			refuseStream(w, t.session, err)
+			return nil
+		}
+	}
+
+	if t.conn, err = s.wsUpgrader(transferUpgrader).Upgrade(w, r, nil); err != nil {
+		// Upgrade already wrote an error response
+		t.logger.Warn("WebSocket transfer upgrade failed", "direction", direction, "err", err)
+		if t.session != nil {
+			t.session.endStream(t.stats)
+		}
+		return nil
+	}
+	t.start = time.Now()
+	if t.session != nil {
+		t.tcpConn = requestConn(r)
+		t.session.beginTCP(t.stats, t.tcpConn)
+	}
+	s.transferStarted(direction)
+	return t
+}
+
+// finishWSTransfer sends the result, closes the connection and records the
+// end of the transfer
+func (s *Server) finishWSTransfer(t *wsTransfer, completed bool) {
+	if completed {
+		t.conn.SetWriteDeadline(time.Now().Add(wsIdleTimeout))
+		t.conn.WriteJSON(t.message("result"))
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		t.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	}
+	if t.session != nil {
+		// The statistics can only be read while the socket is open
+		t.session.endTCP(t.stats, t.tcpConn)
+	}
+	t.conn.Close()
+
+	if t.session != nil {
+		t.session.endStream(t.stats)
+	}
+	s.transferFinished(t.logger, t.direction, t.bytes.Load(), time.Since(t.start), completed)
+}
+
+// handleWSDownload streams test data as binary WebSocket messages of
+// chunk_size bytes, for a duration or up to a size, with progress messages
+// in between. A stop message from the client ends it early.
+func (s *Server) handleWSDownload(w http.ResponseWriter, r *http.Request) {
+	t := s.startWSTransfer(w, r, directionDownload)
+	if t == nil {
+		return
+	}
+	completed := false
+	defer func() { s.finishWSTransfer(t, completed) }()
+
+	// Watch for the client's stop message or for it going away
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			var m wsTransferMessage
+			if err := t.conn.ReadJSON(&m); err != nil || m.Type == "stop" {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsProgressInterval)
+	defer ticker.Stop()
+
+	for !t.timeUp() && t.bytes.Load() < t.limit {
+		size := int(min(int64(s.cfg.ChunkSize), t.limit-t.bytes.Load()))
+		var err error
+		select {
+		case <-stopped:
+			completed = true
+			return
+		case <-ticker.C:
+			t.conn.SetWriteDeadline(time.Now().Add(wsIdleTimeout))
+			err = t.conn.WriteJSON(t.message("progress"))
+		default:
+			if err = s.waitBandwidth(r.Context(), directionDownload, size); err != nil {
+				break
+			}
+			t.conn.SetWriteDeadline(time.Now().Add(wsIdleTimeout))
+			err = t.conn.WriteMessage(websocket.BinaryMessage, s.random.chunk(size))
+			if err == nil {
+				t.add(size)
+				s.transferBytes(directionDownload, size)
+			}
+		}
+		if err != nil {
+			t.logger.Info("WebSocket download failed", "bytes", t.bytes.Load(), "duration", time.Since(t.start), "err", err)
+			return
+		}
+	}
+	completed = true
+}
+
+// handleWSUpload receives binary WebSocket messages for a duration or up to
+// a size, sending progress messages while it does. A stop message from the
+// client ends it early.
+func (s *Server) handleWSUpload(w http.ResponseWriter, r *http.Request) {
+	t := s.startWSTransfer(w, r, directionUpload)
+	if t == nil {
+		return
+	}
+	completed := false
+	defer func() { s.finishWSTransfer(t, completed) }()
+
+	t.conn.SetReadLimit(wsMaxUploadFrame)
+	if t.duration > 0 {
+		t.conn.SetReadDeadline(t.start.Add(t.duration))
+	}
+
+	// Report progress while the main loop reads; it is the only writer until
+	// the result is sent
+	stop := make(chan struct{})
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		ticker := time.NewTicker(wsProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.conn.SetWriteDeadline(time.Now().Add(wsIdleTimeout))
+				if err := t.conn.WriteJSON(t.message("progress")); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-reported
+	}()
+
+	bufPtr := s.buffers.getUpload()
+	defer s.buffers.putUpload(bufPtr)
+	buffer := *bufPtr
+
+	for t.bytes.Load() < t.limit {
+		kind, mr, err := t.conn.NextReader()
+		if err == nil && kind == websocket.TextMessage {
+			var m wsTransferMessage
+			if jsonErr := json.NewDecoder(mr).Decode(&m); jsonErr == nil && m.Type == "stop" {
+				break
+			}
+			continue
+		}
+		if err == nil {
+			err = s.readWSUpload(r, t, mr, buffer)
+		}
+		if err != nil {
+			// Running out of time ends the transfer like a stop message
+			if t.timeUp() {
+				break
+			}
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				t.logger.Warn("WebSocket upload failed", "bytes", t.bytes.Load(), "duration", time.Since(t.start), "err", err)
+			}
+			return
+		}
+	}
+	completed = true
+}
+
+// readWSUpload counts and discards one binary message from the client
+func (s *Server) readWSUpload(r *http.Request, t *wsTransfer, mr io.Reader, buffer []byte) error {
+	for {
+		n, err := mr.Read(buffer)
+		t.add(n)
+		s.transferBytes(directionUpload, n)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = s.waitBandwidth(r.Context(), directionUpload, n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
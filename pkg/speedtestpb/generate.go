@@ -0,0 +1,6 @@
+// Package speedtestpb holds the gRPC service of the speed test server,
+// generated from speedtest.proto. Clients in other languages can generate
+// their stubs from the same file.
+package speedtestpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative speedtest.proto
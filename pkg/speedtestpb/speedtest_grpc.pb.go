@@ -0,0 +1,254 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: speedtest.proto
+
+package speedtestpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Speedtest_StartTest_FullMethodName      = "/infobits.speedtest.v1.Speedtest/StartTest"
+	Speedtest_StreamDownload_FullMethodName = "/infobits.speedtest.v1.Speedtest/StreamDownload"
+	Speedtest_StreamUpload_FullMethodName   = "/infobits.speedtest.v1.Speedtest/StreamUpload"
+	Speedtest_GetResults_FullMethodName     = "/infobits.speedtest.v1.Speedtest/GetResults"
+)
+
+// SpeedtestClient is the client API for Speedtest service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Speedtest gives programs typed, streaming access to the speed test engine.
+// It mirrors the HTTP API: sessions tie parallel streams together, downloads
+// and uploads move test data, and stored results can be listed.
+type SpeedtestClient interface {
+	// StartTest opens a test session, like POST /api/v1/session. Streams that
+	// name the session count toward its server-side totals.
+	StartTest(ctx context.Context, in *StartTestRequest, opts ...grpc.CallOption) (*StartTestResponse, error)
+	// StreamDownload sends random test data for a duration or up to a size.
+	StreamDownload(ctx context.Context, in *StreamDownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadChunk], error)
+	// StreamUpload counts the data the client sends until it closes the
+	// stream, the duration runs out or the size limit is reached.
+	StreamUpload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadChunk, UploadSummary], error)
+	// GetResults lists stored results, like GET /api/v1/results. It needs an API
+	// key in the x-api-key metadata when keys are configured.
+	GetResults(ctx context.Context, in *GetResultsRequest, opts ...grpc.CallOption) (*GetResultsResponse, error)
+}
+
+type speedtestClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSpeedtestClient(cc grpc.ClientConnInterface) SpeedtestClient {
+	return &speedtestClient{cc}
+}
+
+func (c *speedtestClient) StartTest(ctx context.Context, in *StartTestRequest, opts ...grpc.CallOption) (*StartTestResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StartTestResponse)
+	err := c.cc.Invoke(ctx, Speedtest_StartTest_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *speedtestClient) StreamDownload(ctx context.Context, in *StreamDownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Speedtest_ServiceDesc.Streams[0], Speedtest_StreamDownload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamDownloadRequest, DownloadChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Speedtest_StreamDownloadClient = grpc.ServerStreamingClient[DownloadChunk]
+
+func (c *speedtestClient) StreamUpload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadChunk, UploadSummary], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Speedtest_ServiceDesc.Streams[1], Speedtest_StreamUpload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadChunk, UploadSummary]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Speedtest_StreamUploadClient = grpc.ClientStreamingClient[UploadChunk, UploadSummary]
+
+func (c *speedtestClient) GetResults(ctx context.Context, in *GetResultsRequest, opts ...grpc.CallOption) (*GetResultsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetResultsResponse)
+	err := c.cc.Invoke(ctx, Speedtest_GetResults_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SpeedtestServer is the server API for Speedtest service.
+// All implementations must embed UnimplementedSpeedtestServer
+// for forward compatibility.
+//
+// Speedtest gives programs typed, streaming access to the speed test engine.
+// It mirrors the HTTP API: sessions tie parallel streams together, downloads
+// and uploads move test data, and stored results can be listed.
+type SpeedtestServer interface {
+	// StartTest opens a test session, like POST /api/v1/session. Streams that
+	// name the session count toward its server-side totals.
+	StartTest(context.Context, *StartTestRequest) (*StartTestResponse, error)
+	// StreamDownload sends random test data for a duration or up to a size.
+	StreamDownload(*StreamDownloadRequest, grpc.ServerStreamingServer[DownloadChunk]) error
+	// StreamUpload counts the data the client sends until it closes the
+	// stream, the duration runs out or the size limit is reached.
+	StreamUpload(grpc.ClientStreamingServer[UploadChunk, UploadSummary]) error
+	// GetResults lists stored results, like GET /api/v1/results. It needs an API
+	// key in the x-api-key metadata when keys are configured.
+	GetResults(context.Context, *GetResultsRequest) (*GetResultsResponse, error)
+	mustEmbedUnimplementedSpeedtestServer()
+}
+
+// UnimplementedSpeedtestServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSpeedtestServer struct{}
+
+func (UnimplementedSpeedtestServer) StartTest(context.Context, *StartTestRequest) (*StartTestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartTest not implemented")
+}
+func (UnimplementedSpeedtestServer) StreamDownload(*StreamDownloadRequest, grpc.ServerStreamingServer[DownloadChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamDownload not implemented")
+}
+func (UnimplementedSpeedtestServer) StreamUpload(grpc.ClientStreamingServer[UploadChunk, UploadSummary]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamUpload not implemented")
+}
+func (UnimplementedSpeedtestServer) GetResults(context.Context, *GetResultsRequest) (*GetResultsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetResults not implemented")
+}
+func (UnimplementedSpeedtestServer) mustEmbedUnimplementedSpeedtestServer() {}
+func (UnimplementedSpeedtestServer) testEmbeddedByValue()                   {}
+
+// UnsafeSpeedtestServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SpeedtestServer will
+// result in compilation errors.
+type UnsafeSpeedtestServer interface {
+	mustEmbedUnimplementedSpeedtestServer()
+}
+
+func RegisterSpeedtestServer(s grpc.ServiceRegistrar, srv SpeedtestServer) {
+	// If the following call pancis, it indicates UnimplementedSpeedtestServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Speedtest_ServiceDesc, srv)
+}
+
+func _Speedtest_StartTest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartTestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpeedtestServer).StartTest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Speedtest_StartTest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpeedtestServer).StartTest(ctx, req.(*StartTestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Speedtest_StreamDownload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamDownloadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SpeedtestServer).StreamDownload(m, &grpc.GenericServerStream[StreamDownloadRequest, DownloadChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Speedtest_StreamDownloadServer = grpc.ServerStreamingServer[DownloadChunk]
+
+func _Speedtest_StreamUpload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SpeedtestServer).StreamUpload(&grpc.GenericServerStream[UploadChunk, UploadSummary]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Speedtest_StreamUploadServer = grpc.ClientStreamingServer[UploadChunk, UploadSummary]
+
+func _Speedtest_GetResults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetResultsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpeedtestServer).GetResults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Speedtest_GetResults_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpeedtestServer).GetResults(ctx, req.(*GetResultsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Speedtest_ServiceDesc is the grpc.ServiceDesc for Speedtest service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Speedtest_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "infobits.speedtest.v1.Speedtest",
+	HandlerType: (*SpeedtestServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "StartTest",
+			Handler:    _Speedtest_StartTest_Handler,
+		},
+		{
+			MethodName: "GetResults",
+			Handler:    _Speedtest_GetResults_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamDownload",
+			Handler:       _Speedtest_StreamDownload_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamUpload",
+			Handler:       _Speedtest_StreamUpload_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "speedtest.proto",
+}
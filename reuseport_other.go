@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort is only supported on Linux, where the kernel spreads connections
+// across the listeners sharing an address
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("reuse_port is only supported on Linux")
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// runService is only supported on Windows; elsewhere use systemd or Docker
+func runService(args []string) error {
+	return errors.New("running as a service is only supported on Windows")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/infobits-io/infobits-speedtest/pkg/speedtest"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceName         = "infobits-speedtest"
+	serviceDisplayName  = "Infobits Speedtest"
+	serviceRestartDelay = 5 * time.Second // Wait before the service manager restarts a crashed server
+)
+
+// servicePathFlags are the server flags naming files or directories
+var servicePathFlags = map[string]bool{
+	"config":       true,
+	"static-dir":   true,
+	"tls-cert":     true,
+	"tls-key":      true,
+	"payload-file": true,
+	"access-log":   true,
+	"result-log":   true,
+}
+
+// runService implements the service subcommand: install and uninstall
+// register the server with the Windows service manager, which starts it
+// through run
+func runService(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: speedtest service install|uninstall|run [server flags]")
+	}
+	switch args[0] {
+	case "install":
+		return installService(args[1:])
+	case "uninstall":
+		return uninstallService()
+	case "run":
+		// Services start in the system directory. Relative paths in the
+		// config file, such as results.path or the ACME cache, are meant
+		// relative to it instead.
+		dir, err := serviceDir(args[1:])
+		if err != nil {
+			return err
+		}
+		if err := os.Chdir(dir); err != nil {
+			return fmt.Errorf("changing to %s: %w", dir, err)
+		}
+		return svc.Run(serviceName, serverService{args: args[1:]})
+	}
+	return fmt.Errorf("unknown service command %q, expected install, uninstall or run", args[0])
+}
+
+// installService registers the service to start with Windows, passing args
+// on to the server. Services run in the system directory, so paths given to
+// the server are made absolute.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locating executable: %w", err)
+	}
+	if err := absPathArgs(args); err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "Network speed test server",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run"}, args...)...)
+	if err != nil {
+		return fmt.Errorf("creating service: %w", err)
+	}
+	defer s.Close()
+	// Restart the server whenever it exits with an error; reset the failure
+	// count after a day
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: serviceRestartDelay}}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		return fmt.Errorf("setting recovery actions: %w", err)
+	}
+	fmt.Printf("Installed service %s, start it with: sc start %s\n", serviceName, serviceName)
+	return nil
+}
+
+// absPathArgs makes the values of servicePathFlags in args absolute, given
+// as "-flag value" or "-flag=value", with one or two dashes
+func absPathArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, value, inline := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+		if !servicePathFlags[name] {
+			continue
+		}
+		if !inline {
+			if i+1 == len(args) {
+				break
+			}
+			i++
+			value = args[i]
+		}
+		if value == "" {
+			continue
+		}
+		abs, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		if inline {
+			args[i] = "-" + name + "=" + abs
+		} else {
+			args[i] = abs
+		}
+	}
+	return nil
+}
+
+// serviceDir returns the directory the service runs in: that of the config
+// file named by the -config flag in args or by the environment, or else the
+// executable's
+func serviceDir(args []string) (string, error) {
+	config := os.Getenv(speedtest.EnvPrefix + "CONFIG")
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, value, inline := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+		if name != "config" {
+			continue
+		}
+		if !inline && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		config = value
+	}
+	if config != "" {
+		abs, err := filepath.Abs(config)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Dir(abs), nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("locating executable: %w", err)
+	}
+	return filepath.Dir(exe), nil
+}
+
+// uninstallService removes the service. Windows deletes a running service
+// once it has been stopped.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("deleting service: %w", err)
+	}
+	fmt.Printf("Removed service %s\n", serviceName)
+	return nil
+}
+
+// serverService runs the server under the Windows service manager
+type serverService struct {
+	args []string // Server flags
+}
+
+// Execute starts the server and reports it running until the service
+// manager asks it to stop, then shuts the server down so queued webhook,
+// MQTT and syslog deliveries go out. The server exits the process on fatal
+// errors, which the service manager treats as a failure.
+func (s serverService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		runServer(s.args, stop)
+		close(stopped)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32((2 * shutdownTimeout).Milliseconds())}
+			close(stop)
+			<-stopped
+			return false, 0
+		}
+	}
+	return false, 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestAbsPathArgs(t *testing.T) {
+	abs := func(path string) string {
+		p, err := filepath.Abs(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	tests := []struct {
+		name       string
+		args, want []string
+	}{
+		{"separate value", []string{"-config", "speedtest.yaml"}, []string{"-config", abs("speedtest.yaml")}},
+		{"two dashes", []string{"--tls-cert", `certs\cert.pem`}, []string{"--tls-cert", abs(`certs\cert.pem`)}},
+		{"inline value", []string{"-access-log=logs\\access.log"}, []string{"-access-log=" + abs(`logs\access.log`)}},
+		{"inline with two dashes", []string{"--result-log=results.log"}, []string{"-result-log=" + abs("results.log")}},
+		{"already absolute", []string{"-payload-file", `C:\data\payload.bin`}, []string{"-payload-file", `C:\data\payload.bin`}},
+		{"other flags kept", []string{"-port", "8080", "-static-dir", "web", "-api-keys=a,b"}, []string{"-port", "8080", "-static-dir", abs("web"), "-api-keys=a,b"}},
+		{"empty value", []string{"-config="}, []string{"-config="}},
+		{"missing value", []string{"-tls-key"}, []string{"-tls-key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := slices.Clone(tt.args)
+			if err := absPathArgs(args); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(args, tt.want) {
+				t.Errorf("absPathArgs(%q) = %q, want %q", tt.args, args, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceDir(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want string
+	}{
+		{"config flag", []string{"-port", "80", "-config", `C:\speedtest\speedtest.yaml`}, "", `C:\speedtest`},
+		{"inline config flag", []string{"--config=C:\\speedtest\\speedtest.yaml"}, "", `C:\speedtest`},
+		{"flag over environment", []string{"-config", `C:\speedtest\speedtest.yaml`}, `D:\other\speedtest.yaml`, `C:\speedtest`},
+		{"environment", nil, `D:\other\speedtest.yaml`, `D:\other`},
+		{"no config", []string{"-port", "80"}, "", filepath.Dir(exe)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SPEEDTEST_CONFIG", tt.env)
+			got, err := serviceDir(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("serviceDir(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// The web UI is compiled into the binary so a single file is enough to deploy
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+// newWebFS returns the embedded web UI, or the given directory when overridden
+func newWebFS(dir string) (fs.FS, error) {
+	if dir == "" {
+		return fs.Sub(embeddedStatic, "static")
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return os.DirFS(dir), nil
+}
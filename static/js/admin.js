@@ -0,0 +1,130 @@
+// Admin dashboard: polls the server statistics and renders them
+const REFRESH_INTERVAL = 2000; // Milliseconds between refreshes
+
+// Fetch the statistics and update the page
+async function refresh() {
+	try {
+		const response = await fetch("/admin/api/stats");
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		render(await response.json());
+	} catch (error) {
+		console.warn("Could not load server stats:", error);
+	}
+}
+
+// Render one snapshot of the statistics
+function render(stats) {
+	const latest = stats.throughput[stats.throughput.length - 1];
+
+	setText("stat-connections", stats.connections);
+	setText(
+		"stat-transfers",
+		`${stats.active_downloads} ↓ / ${stats.active_uploads} ↑`
+	);
+	setText("stat-download", latest ? formatMbps(latest.download) : "-");
+	setText("stat-upload", latest ? formatMbps(latest.upload) : "-");
+	setText("stat-sent", formatBytes(stats.bytes_sent));
+	setText("stat-received", formatBytes(stats.bytes_received));
+	setText(
+		"stat-load",
+		stats.load.load_average
+			? stats.load.load_average.map((l) => l.toFixed(2)).join(" ")
+			: `${stats.load.goroutines} goroutines`
+	);
+	setText("stat-memory", formatBytes(stats.load.memory_bytes));
+
+	let summary = `Up ${formatDuration(stats.uptime)} on ${stats.load.cpus} CPUs · ${stats.active_tests} tests running`;
+	if (stats.slots) {
+		summary += ` · ${stats.slots.active}/${stats.slots.max} test slots in use, ${stats.slots.queued} queued`;
+	}
+	setText("stat-summary", summary);
+
+	renderRows(
+		"sessions-body",
+		stats.sessions.map((s) => [
+			s.id.slice(0, 8),
+			new Date(s.created).toLocaleTimeString(),
+			formatMbps(s.download.mbps),
+			formatMbps(s.upload.mbps),
+			s.download.active_streams + s.upload.active_streams,
+		]),
+		"No active sessions"
+	);
+
+	renderRows(
+		"results-body",
+		stats.recent_results.map((r) => [
+			new Date(r.timestamp).toLocaleString(),
+			r.isp ? `${r.client_ip} (${r.isp.name})` : r.client_ip,
+			formatMbps(r.download),
+			formatMbps(r.upload),
+			`${r.latency.toFixed(1)} ms`,
+			`${r.jitter.toFixed(1)} ms`,
+		]),
+		"No results yet"
+	);
+}
+
+// Replace the rows of a table body, showing a placeholder when empty
+function renderRows(id, rows, emptyText) {
+	const body = document.getElementById(id);
+	body.replaceChildren();
+
+	if (rows.length === 0) {
+		const tr = body.insertRow();
+		const td = tr.insertCell();
+		td.colSpan = body.parentElement.tHead.rows[0].cells.length;
+		td.className = "admin-empty";
+		td.textContent = emptyText;
+		return;
+	}
+
+	for (const row of rows) {
+		const tr = body.insertRow();
+		for (const value of row) {
+			tr.insertCell().textContent = value;
+		}
+	}
+}
+
+// Set the text of an element by ID
+function setText(id, text) {
+	document.getElementById(id).textContent = text;
+}
+
+// Format a rate in Mbps
+function formatMbps(mbps) {
+	if (mbps >= 1000) {
+		return `${(mbps / 1000).toFixed(2)} Gbps`;
+	}
+	return `${mbps.toFixed(2)} Mbps`;
+}
+
+// Format a byte count with binary units
+function formatBytes(bytes) {
+	const units = ["B", "KB", "MB", "GB", "TB"];
+	let i = 0;
+	while (bytes >= 1024 && i < units.length - 1) {
+		bytes /= 1024;
+		i++;
+	}
+	return `${bytes.toFixed(i === 0 ? 0 : 1)} ${units[i]}`;
+}
+
+// Format a duration in seconds as days, hours and minutes
+function formatDuration(seconds) {
+	const days = Math.floor(seconds / 86400);
+	const hours = Math.floor((seconds % 86400) / 3600);
+	const minutes = Math.floor((seconds % 3600) / 60);
+	if (days > 0) return `${days}d ${hours}h`;
+	if (hours > 0) return `${hours}h ${minutes}m`;
+	return `${minutes}m`;
+}
+
+// Start polling when the page loads
+document.addEventListener("DOMContentLoaded", () => {
+	refresh();
+	setInterval(refresh, REFRESH_INTERVAL);
+});
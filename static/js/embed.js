@@ -0,0 +1,284 @@
+// Compact speed test shown in a frame by speedtest-widget.js. Progress and
+// results are posted to the embedding page as messages tagged with
+// MESSAGE_SOURCE, and the page can start a test by posting {type: "start"}.
+const MESSAGE_SOURCE = "infobits-speedtest";
+const WIDGET_STREAMS = 4; // Parallel streams per direction
+const WIDGET_PHASE_MS = 5000; // Duration of the download and upload phases
+const WIDGET_PINGS = 10; // Round trips for latency, after one to warm up
+const UPLOAD_START_SIZE = 256 * 1024; // First body per upload request
+const UPLOAD_BODY_SIZE = 32 * 1024 * 1024; // Largest body per upload request
+const UPDATE_INTERVAL_MS = 250; // How often live rates are shown and posted
+
+let running = false;
+
+// Post a message to the page embedding the widget
+function notify(type, data = {}) {
+	if (window.parent === window) return;
+	window.parent.postMessage({ source: MESSAGE_SOURCE, type, ...data }, "*");
+}
+
+// Run one test: latency, download and upload, then store the result
+async function runTest() {
+	if (running) return;
+	running = true;
+
+	const button = document.getElementById("start-button");
+	button.disabled = true;
+	button.classList.add("disabled");
+	button.textContent = t("button.running");
+	["download-result", "upload-result", "latency-result"].forEach((id) =>
+		setText(id, "-")
+	);
+	notify("start");
+
+	let session = null;
+	try {
+		session = await createSession();
+		const params = session
+			? `&session=${encodeURIComponent(session.id)}`
+			: "";
+
+		setStatus(t("status.latency"));
+		notify("progress", { phase: "latency" });
+		const { latency, jitter } = await measureLatency();
+		setText("latency-result", formatLatency(latency));
+
+		setStatus(t("widget.download"));
+		const download = await measureDownload(params, (mbps) => {
+			setText("download-result", formatSpeed(mbps));
+			notify("progress", { phase: "download", mbps });
+		});
+		setText("download-result", formatSpeed(download));
+
+		setStatus(t("widget.upload"));
+		const upload = await measureUpload(params, (mbps) => {
+			setText("upload-result", formatSpeed(mbps));
+			notify("progress", { phase: "upload", mbps });
+		});
+		setText("upload-result", formatSpeed(upload));
+
+		const result = { download, upload, latency, jitter };
+		const stored = await submitResult(result, session);
+		if (stored && stored.id) {
+			result.id = stored.id;
+			result.url = `${location.origin}/result/${stored.id}`;
+			document.getElementById("details-link").href = result.url;
+		}
+		setStatus(t("status.complete"));
+		notify("result", { result });
+	} catch (error) {
+		console.error("Speed test failed:", error);
+		setStatus(t("error.failed", { error: error.message }));
+		notify("error", { error: error.message });
+	} finally {
+		if (session) {
+			fetch(`/api/v1/session/${encodeURIComponent(session.id)}`, {
+				method: "DELETE",
+			}).catch(() => {});
+		}
+		running = false;
+		button.disabled = false;
+		button.classList.remove("disabled");
+		button.textContent = t("widget.again");
+	}
+}
+
+// Create a test session, fetching a test token first when the server
+// requires one. Returns null when the server offers no sessions.
+async function createSession() {
+	let token = null;
+	const tokenResponse = await fetch("/api/v1/token", { method: "POST" });
+	if (tokenResponse.ok) {
+		token = (await tokenResponse.json()).token;
+	}
+
+	const tokenParam = token ? `&token=${encodeURIComponent(token)}` : "";
+	const response = await fetch(
+		`/api/v1/session?streams=${WIDGET_STREAMS}${tokenParam}`,
+		{ method: "POST" }
+	);
+	if (response.status === 429) {
+		const refusal = await response.json();
+		throw new Error(refusal.error);
+	}
+	if (!response.ok) {
+		console.warn(`Could not create test session: HTTP error ${response.status}`);
+		return null;
+	}
+	return response.json();
+}
+
+// Median round trip and jitter of back-to-back pings, in milliseconds
+async function measureLatency() {
+	const rtts = [];
+	for (let i = 0; i <= WIDGET_PINGS; i++) {
+		const start = performance.now();
+		const response = await fetch(`/api/v1/ping?t=${Math.random()}`, {
+			cache: "no-store",
+		});
+		await response.arrayBuffer();
+		// The first round trip may include setting up the connection
+		if (i > 0) rtts.push(performance.now() - start);
+	}
+
+	let jitter = 0;
+	for (let i = 1; i < rtts.length; i++) {
+		jitter += Math.abs(rtts[i] - rtts[i - 1]);
+	}
+	jitter /= rtts.length - 1;
+
+	const sorted = [...rtts].sort((a, b) => a - b);
+	const mid = Math.floor(sorted.length / 2);
+	const latency =
+		sorted.length % 2 ? sorted[mid] : (sorted[mid - 1] + sorted[mid]) / 2;
+	return { latency, jitter };
+}
+
+// Download over parallel streams for the phase duration and return the rate
+// in Mbps. onProgress is called with the rate so far.
+async function measureDownload(params, onProgress) {
+	const start = performance.now();
+	let bytes = 0;
+	let lastUpdate = start;
+
+	const stream = async () => {
+		const response = await fetch(
+			`/api/v1/testfile?duration=${WIDGET_PHASE_MS}ms&t=${Math.random()}${params}`,
+			{ cache: "no-store" }
+		);
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		const reader = response.body.getReader();
+		for (;;) {
+			const { done, value } = await reader.read();
+			if (done) return;
+			bytes += value.length;
+
+			const now = performance.now();
+			if (now - lastUpdate >= UPDATE_INTERVAL_MS) {
+				lastUpdate = now;
+				onProgress(mbps(bytes, now - start));
+			}
+		}
+	};
+
+	await Promise.all(Array.from({ length: WIDGET_STREAMS }, stream));
+	return mbps(bytes, performance.now() - start);
+}
+
+// Upload over parallel streams for the phase duration and return the rate
+// in Mbps as counted by the server. Each stream starts with small requests
+// and doubles their size while they finish quickly, so slow links do not
+// overrun the phase. onProgress is called after each request.
+async function measureUpload(params, onProgress) {
+	const data = new Blob([randomData(UPLOAD_BODY_SIZE)]);
+	const start = performance.now();
+	const deadline = start + WIDGET_PHASE_MS;
+	let bytes = 0;
+
+	const stream = async () => {
+		let size = UPLOAD_START_SIZE;
+		while (performance.now() < deadline) {
+			const sent = performance.now();
+			const response = await fetch(
+				`/api/v1/upload?size=${size}&t=${Math.random()}${params}`,
+				{ method: "POST", body: data.slice(0, size) }
+			);
+			if (!response.ok) {
+				throw new Error(`HTTP error ${response.status}`);
+			}
+			bytes += (await response.json()).size;
+			onProgress(mbps(bytes, performance.now() - start));
+			if (performance.now() - sent < UPDATE_INTERVAL_MS * 2) {
+				size = Math.min(size * 2, UPLOAD_BODY_SIZE);
+			}
+		}
+	};
+
+	await Promise.all(Array.from({ length: WIDGET_STREAMS }, stream));
+	return mbps(bytes, performance.now() - start);
+}
+
+// Store the result, attaching the server's view of the session. Returns the
+// stored result, or null when it could not be stored.
+async function submitResult(result, session) {
+	try {
+		const response = await fetch("/api/v1/results", {
+			method: "POST",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({
+				...result,
+				session: session ? session.id : undefined,
+				nonce: session ? session.result_nonce : undefined,
+			}),
+		});
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		return await response.json();
+	} catch (error) {
+		console.warn("Could not store test result:", error);
+		return null;
+	}
+}
+
+// Random bytes that compression along the way cannot shrink
+function randomData(size) {
+	const data = new Uint8Array(size);
+	// getRandomValues fills at most 64 KiB at a time
+	const block = new Uint8Array(65536);
+	crypto.getRandomValues(block);
+	for (let offset = 0; offset < size; offset += block.length) {
+		data.set(block.subarray(0, Math.min(block.length, size - offset)), offset);
+		block[0]++;
+	}
+	return data;
+}
+
+// Rate in Mbps of bytes transferred in ms milliseconds
+function mbps(bytes, ms) {
+	return ms > 0 ? (bytes * 8) / (ms * 1000) : 0;
+}
+
+// Format a rate in Mbps
+function formatSpeed(speed) {
+	if (speed >= 1000) {
+		return `${(speed / 1000).toFixed(2)} Gbps`;
+	}
+	return `${speed.toFixed(2)} Mbps`;
+}
+
+// Format a latency in milliseconds
+function formatLatency(ms) {
+	return `${ms.toFixed(1)} ms`;
+}
+
+// Set the text of an element by ID
+function setText(id, text) {
+	document.getElementById(id).textContent = text;
+}
+
+// Show what the test is doing
+function setStatus(text) {
+	setText("widget-status", text);
+}
+
+// Start a test when the embedding page asks for one
+window.addEventListener("message", (event) => {
+	if (event.source !== window.parent) return;
+	const message = event.data;
+	if (message && message.source === MESSAGE_SOURCE && message.type === "start") {
+		runTest();
+	}
+});
+
+document.addEventListener("DOMContentLoaded", async () => {
+	await loadLocale();
+	document.getElementById("start-button").onclick = runTest;
+	setStatus(t("info.start"));
+	notify("ready", { height: document.documentElement.scrollHeight });
+	if (new URLSearchParams(location.search).has("autostart")) {
+		runTest();
+	}
+});
@@ -0,0 +1,61 @@
+// Translations of the web UI, served by /api/v1/locale in the language picked
+// from the browser's preferences or a ?lang= parameter
+let messages = {};
+
+// Load the messages and translate the elements marked with data-i18n. The
+// pages stay in English when the translations cannot be loaded.
+async function loadLocale() {
+	const lang = new URLSearchParams(location.search).get("lang");
+	try {
+		const response = await fetch(
+			`/api/v1/locale${lang ? `?lang=${encodeURIComponent(lang)}` : ""}`
+		);
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		const locale = await response.json();
+		messages = locale.messages;
+		document.documentElement.lang = locale.lang;
+		translatePage();
+		showLanguagePicker(locale);
+	} catch (error) {
+		console.warn("Could not load translations:", error);
+	}
+}
+
+// Message for key with {name} placeholders filled in from params. Falls back
+// to fallback, or the key itself, when the message is missing.
+function t(key, params = {}, fallback = key) {
+	const text = messages[key] ?? fallback;
+	return text.replace(/\{(\w+)\}/g, (match, name) =>
+		name in params ? params[name] : match
+	);
+}
+
+// Replace the text of every element marked with data-i18n
+function translatePage() {
+	document.querySelectorAll("[data-i18n]").forEach((el) => {
+		el.textContent = t(el.dataset.i18n, {}, el.textContent);
+	});
+}
+
+// Let the user switch languages when there is more than one. The choice is
+// kept in the page URL, so shared links open in the same language.
+function showLanguagePicker(locale) {
+	const select = document.getElementById("language-select");
+	if (!select || locale.languages.length < 2) return;
+
+	for (const language of locale.languages) {
+		const option = document.createElement("option");
+		option.value = language.code;
+		option.textContent = language.name || language.code;
+		option.selected = language.code === locale.lang;
+		select.appendChild(option);
+	}
+	select.onchange = () => {
+		const url = new URL(location.href);
+		url.searchParams.set("lang", select.value);
+		location.href = url.toString();
+	};
+	document.getElementById("language-picker").style.display = "block";
+}
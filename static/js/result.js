@@ -0,0 +1,124 @@
+// Shared result page: shows one stored result, read-only
+const MAX_SPEED_CLASS = 10000; // Upper bound for speed classification (10 Gbps)
+
+// Fetch the result named in the page URL and render it
+async function loadResult() {
+	const id = decodeURIComponent(location.pathname.split("/").pop());
+	try {
+		const response = await fetch(`/api/v1/results/${encodeURIComponent(id)}`);
+		if (response.status === 404) {
+			setText("shared-summary", t("result.missing"));
+			return;
+		}
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		render(await response.json());
+	} catch (error) {
+		console.warn("Could not load result:", error);
+		setText("shared-summary", t("result.load_failed"));
+	}
+}
+
+// Render a shared result
+function render(result) {
+	const time = new Date(result.timestamp).toLocaleString(
+		document.documentElement.lang
+	);
+	let summary = result.isp
+		? t("result.tested_isp", { time, isp: result.isp })
+		: t("result.tested", { time });
+	if (result.country) {
+		summary += `, ${result.country}`;
+	}
+	setText("shared-summary", summary);
+
+	setValue(
+		"download-result",
+		formatSpeed(result.download),
+		speedClass(result.download)
+	);
+	setValue(
+		"upload-result",
+		formatSpeed(result.upload),
+		speedClass(result.upload)
+	);
+	setValue(
+		"latency-result",
+		formatLatency(result.latency),
+		latencyClass(result.latency)
+	);
+	setValue(
+		"jitter-result",
+		formatLatency(result.jitter),
+		latencyClass(result.jitter)
+	);
+
+	if (result.server_download) {
+		setText("server-download-result", formatSpeed(result.server_download));
+	}
+	if (result.server_upload) {
+		setText("server-upload-result", formatSpeed(result.server_upload));
+	}
+	if (result.bufferbloat) {
+		const idle = formatLatency(result.bufferbloat.idle_ms);
+		setText(
+			"bufferbloat-grade",
+			t("result.grade_idle", { grade: result.bufferbloat.grade, idle })
+		);
+	}
+	if (result.rpm > 0) {
+		setText("responsiveness-result", `${Math.round(result.rpm)} RPM`);
+	}
+	if (result.quality) {
+		setText("quality-score", `${result.quality.score} / 100`);
+	}
+}
+
+// Set the text of an element by ID
+function setText(id, text) {
+	document.getElementById(id).textContent = text;
+}
+
+// Set the text and rating class of a result value
+function setValue(id, text, rating) {
+	const el = document.getElementById(id);
+	el.textContent = text;
+	el.className = `result-value ${rating}`;
+}
+
+// Format a rate in Mbps
+function formatSpeed(speed) {
+	if (speed >= 1000) {
+		return `${(speed / 1000).toFixed(2)} Gbps`;
+	}
+	return `${speed.toFixed(2)} Mbps`;
+}
+
+// Format a latency in milliseconds
+function formatLatency(ms) {
+	return `${ms.toFixed(1)} ms`;
+}
+
+// Rate a speed the way the test page does
+function speedClass(speed) {
+	if (speed >= MAX_SPEED_CLASS * 0.7) return "excellent";
+	if (speed >= MAX_SPEED_CLASS * 0.3) return "good";
+	if (speed >= MAX_SPEED_CLASS * 0.1) return "average";
+	if (speed >= MAX_SPEED_CLASS * 0.05) return "belowAverage";
+	return "poor";
+}
+
+// Rate a latency the way the test page does
+function latencyClass(ms) {
+	if (ms < 5) return "excellent";
+	if (ms < 20) return "good";
+	if (ms < 50) return "average";
+	if (ms < 100) return "belowAverage";
+	return "poor";
+}
+
+document.addEventListener("DOMContentLoaded", async () => {
+	await loadLocale();
+	loadResult();
+});
@@ -0,0 +1,91 @@
+// Embeddable speed test widget. Include this script from the speed test
+// server on any page and mark where the widget goes:
+//
+//	<div data-speedtest-widget></div>
+//	<script src="https://speedtest.example.com/speedtest-widget.js"></script>
+//
+// Each marked element gets a frame running a compact test against the server
+// the script came from. The element fires speedtest:ready, speedtest:start,
+// speedtest:progress, speedtest:result and speedtest:error events with the
+// frame's message in event.detail, and SpeedtestWidget.mount returns a
+// handle for starting tests and listening from code.
+(function () {
+	const MESSAGE_SOURCE = "infobits-speedtest";
+	const DEFAULT_HEIGHT = 260; // Frame height until the page reports its own
+
+	// The widget runs against the server the script was loaded from
+	const script = document.currentScript;
+	const origin = new URL(script ? script.src : location.href).origin;
+
+	// Show the widget in element. Options: lang picks the language,
+	// autostart runs a test once the frame has loaded, and onReady, onStart,
+	// onProgress, onResult and onError are called with the frame's messages.
+	function mount(element, options = {}) {
+		if (element.speedtestWidget) return element.speedtestWidget;
+
+		const params = new URLSearchParams();
+		if (options.lang) params.set("lang", options.lang);
+		if (options.autostart) params.set("autostart", "");
+
+		const frame = document.createElement("iframe");
+		frame.src = `${origin}/embed${params.size ? `?${params}` : ""}`;
+		frame.title = "Speed test";
+		frame.style.width = "100%";
+		frame.style.height = `${DEFAULT_HEIGHT}px`;
+		frame.style.border = "0";
+		element.appendChild(frame);
+
+		const callbacks = {
+			ready: options.onReady,
+			start: options.onStart,
+			progress: options.onProgress,
+			result: options.onResult,
+			error: options.onError,
+		};
+		window.addEventListener("message", (event) => {
+			if (event.origin !== origin || event.source !== frame.contentWindow) {
+				return;
+			}
+			const message = event.data;
+			if (!message || message.source !== MESSAGE_SOURCE) return;
+
+			if (message.type === "ready" && message.height) {
+				frame.style.height = `${message.height}px`;
+			}
+			if (callbacks[message.type]) callbacks[message.type](message);
+			element.dispatchEvent(
+				new CustomEvent(`speedtest:${message.type}`, { detail: message })
+			);
+		});
+
+		element.speedtestWidget = {
+			frame,
+			// Start a test, as if the button in the widget was pressed
+			start() {
+				frame.contentWindow.postMessage(
+					{ source: MESSAGE_SOURCE, type: "start" },
+					origin
+				);
+			},
+		};
+		return element.speedtestWidget;
+	}
+
+	// Mount a widget in every marked element, taking options from its
+	// data-lang and data-autostart attributes
+	function mountAll() {
+		document.querySelectorAll("[data-speedtest-widget]").forEach((element) =>
+			mount(element, {
+				lang: element.dataset.lang,
+				autostart: "autostart" in element.dataset,
+			})
+		);
+	}
+
+	window.SpeedtestWidget = { mount };
+	if (document.readyState === "loading") {
+		document.addEventListener("DOMContentLoaded", mountAll);
+	} else {
+		mountAll();
+	}
+})();
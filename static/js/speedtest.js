@@ -6,12 +6,23 @@ const MEASUREMENT_INTERVAL = 100; // Milliseconds between measurements
 const MAX_SPEED_CLASS = 10000; // Upper bound for speed classification (10 Gbps)
 const CRYPTO_BLOCK_SIZE = 65536; // Maximum bytes for crypto.getRandomValues() (browser security limit)
 const WARMUP_DURATION = 5; // Seconds for warmup phase
-
-// Fixed sizes as specified
-const DOWNLOAD_FILE_SIZE = 32 * 1024 * 1024; // Fixed 32 MB download size
-const UPLOAD_FILE_SIZE = 32 * 1024 * 1024; // Fixed 32 MB upload size (changed from 500 bytes)
+const HISTORY_LIMIT = 30; // Past tests shown in the history charts
+const FAMILY_PING_TESTS = 10; // Pings sent over the alternate address family
+const FAMILY_DOWNLOAD_SIZE = 16 * 1024 * 1024; // Download over the alternate address family
+const SERVER_PING_TESTS = 3; // Pings sent to each listed server to pick the closest
+const STATUS_INTERVAL = 15000; // Milliseconds between checks for other testers
+const LOSS_PACKETS = 200; // Datagrams sent over the WebRTC data channel
+const LOSS_INTERVAL = 10; // Milliseconds between them
+const LOSS_WAIT = 1000; // Milliseconds to wait for the last echoes
+const LOSS_OPEN_TIMEOUT = 5000; // Milliseconds for the data channel to open
+const NAT_GATHER_TIMEOUT = 3000; // Milliseconds to wait for STUN answers
+
+// Payload sizes, until the server's test plan sizes them to the probed speed
+let downloadFileSize = 32 * 1024 * 1024; // Bytes per download request
+let uploadFileSize = 32 * 1024 * 1024; // Bytes per upload request
 
 // Initial concurrency settings (can still adjust based on connection)
+const MAX_CONCURRENCY = 12; // Most parallel streams any connection type uses
 let downloadConcurrency = 4; // Initial concurrent downloads
 let uploadConcurrency = 4; // Initial concurrent uploads
 let downloadBufferSize = 1 * 1024 * 1024; // 1MB download buffer size
@@ -37,11 +48,21 @@ const statusLabel = document.getElementById("status-label");
 const progressBarFill = document.getElementById("progress-bar-fill");
 const currentSpeed = document.getElementById("current-speed");
 const infoText = document.getElementById("info-text");
+const clientInfo = document.getElementById("client-info");
+const activeUsers = document.getElementById("active-users");
 const resultContainer = document.getElementById("result-container");
 const downloadResult = document.getElementById("download-result");
 const uploadResult = document.getElementById("upload-result");
 const latencyResult = document.getElementById("latency-result");
 const jitterResult = document.getElementById("jitter-result");
+const historyContainer = document.getElementById("history-container");
+const familyContainer = document.getElementById("family-container");
+const bufferbloatContainer = document.getElementById("bufferbloat-container");
+const qualityContainer = document.getElementById("quality-container");
+const historySpeedChart = document.getElementById("history-speed-chart");
+const historyLatencyChart = document.getElementById("history-latency-chart");
+const serverPicker = document.getElementById("server-picker");
+const serverSelect = document.getElementById("server-select");
 
 // State variables
 let isRunning = false;
@@ -51,6 +72,7 @@ let testResult = {
 	uploadSpeed: 0,
 	latency: 0,
 	jitter: 0,
+	rpm: 0,
 };
 let connectionType = "unknown"; // Will be set by probing
 let totalDownloaded = 0; // Track total bytes downloaded
@@ -62,10 +84,27 @@ let testStartTime = 0; // When the test started
 let testEndTime = 0; // When the test should end
 let lastDisplaySpeed = 0; // Last displayed speed
 let speedCalculationMethod = "percentile"; // Method to calculate final speed
+let sessionId = null; // Server-side session aggregating parallel streams
+let resultNonce = null; // One-time nonce the session's result is submitted with
+let pingChannel = null; // WebSocket the server pings throughout the test
+let sessionEvents = null; // EventSource with the server's view of the test's progress
+let serverGaugeSpeed = 0; // Smoothed rate from the server's progress events, 0 until one arrives
+let lastProgress = 0; // Progress bar position in percent
+let historyResults = []; // Past results of this client, oldest first
+let clientDetails = null; // What the server knows about this client's connection
+let serverBase = ""; // Server the test runs against, empty for this one
+let serverLabel = ""; // How the result names that server, empty without peers
 
 // Initialize the app
-function init() {
+async function init() {
+	await loadLocale();
 	startButton.addEventListener("click", startTest);
+	window.addEventListener("resize", drawHistory);
+	loadHistory();
+	loadClientInfo();
+	loadServers();
+	loadStatus();
+	setInterval(loadStatus, STATUS_INTERVAL);
 	console.log("Infobits Speed Test initialized");
 }
 
@@ -80,19 +119,33 @@ async function startTest() {
 
 	// Hide previous results
 	resultContainer.style.display = "none";
+	familyContainer.style.display = "none";
+	bufferbloatContainer.style.display = "none";
+	qualityContainer.style.display = "none";
+	document.getElementById("share-container").style.display = "none";
 
 	updateUI();
 
 	try {
+		serverBase = await chooseServer();
+
+		// Register a session so the server can aggregate our parallel streams.
+		// It is created up front so the probe below counts as part of this test.
+		sessionId = await createSession(MAX_CONCURRENCY);
+		openSessionEvents();
+
 		// Step 0: Probe connection speed to optimize test parameters
 		updateStatus(TestStatus.PROBING);
 		const probeSpeed = await probeConnectionSpeed(updateProgress);
 		adjustTestParameters(probeSpeed);
+		await applyTestPlan(probeSpeed);
 
 		// Small pause between tests
 		await new Promise((resolve) => setTimeout(resolve, 500));
 
-		// Step 1: Measure latency
+		// Step 1: Measure latency. From here on the server also measures it,
+		// to compare idle latency with latency while the link is loaded.
+		openPingChannel();
 		updateStatus(TestStatus.IDLE);
 		const latencyData = await measureLatency();
 		testResult.latency = latencyData.latency;
@@ -101,9 +154,11 @@ async function startTest() {
 		// Small pause between tests
 		await new Promise((resolve) => setTimeout(resolve, 500));
 
-		// Step 2: Measure download speed
+		// Step 2: Measure download speed, and responsiveness while it saturates the link
 		updateStatus(TestStatus.DOWNLOAD);
+		const responsiveness = startResponsivenessProbes();
 		testResult.downloadSpeed = await measureDownloadSpeed(updateProgress);
+		testResult.rpm = await responsiveness.stop();
 
 		// Small pause between tests
 		await new Promise((resolve) => setTimeout(resolve, 500));
@@ -112,19 +167,831 @@ async function startTest() {
 		updateStatus(TestStatus.UPLOAD);
 		testResult.uploadSpeed = await measureUploadSpeed(updateProgress);
 
+		// Step 4: Measure packet loss over an unreliable data channel, which
+		// TCP would hide behind retransmissions
+		testResult.loss = await measurePacketLoss();
+
 		// Complete
 		updateStatus(TestStatus.COMPLETE);
 		showResults();
+		closePingChannel();
+		const stored = await submitResult();
+		showBufferbloat(stored && stored.bufferbloat, stored && stored.latency_stats);
+		showQuality(stored && stored.quality, stored && stored.voip);
+		showShareLink(stored && stored.id);
+		await loadHistory();
+		await compareAddressFamilies();
 	} catch (error) {
 		console.error("Speed test failed:", error);
-		alert("Speed test failed. Please try again.");
+		alert(t("error.failed", { error: error.message }));
 	} finally {
+		closePingChannel();
+		closeSessionEvents();
+		await endSession();
 		isRunning = false;
+		sessionId = null;
+		resultNonce = null;
 		resetTestData();
 		updateUI();
+		loadStatus();
 	}
 }
 
+// Create a server-side test session for the given number of parallel streams.
+// Waits in line while the server is busy with other tests.
+async function createSession(streams) {
+	for (;;) {
+		let response;
+		try {
+			const token = await fetchToken(serverBase);
+			response = await fetch(
+				`${serverBase}/api/v1/session?streams=${streams}${tokenParam(token)}`,
+				{ method: "POST" }
+			);
+		} catch (error) {
+			// The test still works without a session, just without server-side aggregation
+			console.warn("Could not create test session:", error);
+			return null;
+		}
+
+		if (response.status === 429) {
+			const refusal = await response.json();
+			if (!refusal.queue_position) {
+				// Rate limited: waiting in line won't help
+				throw new Error(refusal.error);
+			}
+			statusLabel.textContent = t("status.queued", {
+				position: refusal.queue_position,
+			});
+			await new Promise((resolve) =>
+				setTimeout(resolve, refusal.retry_after * 1000)
+			);
+			continue;
+		}
+
+		if (!response.ok) {
+			console.warn(`Could not create test session: HTTP error ${response.status}`);
+			return null;
+		}
+		const session = await response.json();
+		console.log(`Created test session ${session.id}`);
+		resultNonce = session.result_nonce || null;
+		return session.id;
+	}
+}
+
+// Fetch a one-time test token from the server at base ("" for this one).
+// Returns null when the server does not require tokens.
+async function fetchToken(base) {
+	const response = await fetch(`${base}/api/v1/token`, { method: "POST" });
+	if (response.status === 404) return null;
+	if (!response.ok) {
+		throw new Error(`HTTP error ${response.status}`);
+	}
+	const data = await response.json();
+	return data.token;
+}
+
+// WebSocket URL of path on the server the test runs against
+function wsURL(path) {
+	return (serverBase || window.location.origin).replace(/^http/, "ws") + path;
+}
+
+// Query string parameter carrying a test token, if there is one
+function tokenParam(token) {
+	return token ? `&token=${encodeURIComponent(token)}` : "";
+}
+
+// Keep a WebSocket open for the server to ping during the test. The browser
+// answers the pings by itself.
+function openPingChannel() {
+	if (!sessionId || !("WebSocket" in window)) return;
+
+	pingChannel = new WebSocket(wsURL(`/api/v1/ws/ping?session=${sessionId}`));
+	pingChannel.onerror = () => {
+		console.warn("Latency under load will not be measured");
+	};
+}
+
+// Close the channel opened by openPingChannel
+function closePingChannel() {
+	if (pingChannel) {
+		pingChannel.close();
+		pingChannel = null;
+	}
+}
+
+// Follow the session's progress events, so the gauge shows the rate the
+// server measures rather than what the browser's XHR progress suggests
+function openSessionEvents() {
+	if (!sessionId || !("EventSource" in window)) return;
+
+	sessionEvents = new EventSource(
+		`${serverBase}/api/v1/session/${sessionId}/events`
+	);
+	sessionEvents.addEventListener("phase", () => {
+		serverGaugeSpeed = 0;
+	});
+	sessionEvents.addEventListener("progress", (event) => {
+		const data = JSON.parse(event.data);
+		if (data.phase !== testStatus) return;
+
+		// The server reports decimal Mbps, the UI binary ones
+		const direction = data.phase === "download" ? data.download : data.upload;
+		const speed = (direction.mbps * 1e6) / (1024 * 1024);
+		serverGaugeSpeed = serverGaugeSpeed
+			? serverGaugeSpeed * 0.7 + speed * 0.3
+			: speed;
+		updateProgress({
+			progress: lastProgress,
+			currentSpeed: serverGaugeSpeed,
+			fromServer: true,
+		});
+	});
+	sessionEvents.onerror = () => {
+		// The browser's own measurements drive the gauge again
+		serverGaugeSpeed = 0;
+	};
+}
+
+// Close the stream opened by openSessionEvents
+function closeSessionEvents() {
+	if (sessionEvents) {
+		sessionEvents.close();
+		sessionEvents = null;
+	}
+	serverGaugeSpeed = 0;
+}
+
+// End the current session so the server can give its slot to the next test
+async function endSession() {
+	if (!sessionId) return;
+
+	try {
+		await fetch(`${serverBase}/api/v1/session/${sessionId}`, {
+			method: "DELETE",
+		});
+	} catch (error) {
+		// The server frees the slot on its own once the session goes idle
+		console.warn("Could not end test session:", error);
+	}
+}
+
+// Fetch the server's aggregated view of the current session
+async function fetchSessionSummary() {
+	if (!sessionId) return null;
+
+	try {
+		const response = await fetch(`${serverBase}/api/v1/session/${sessionId}`);
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		return await response.json();
+	} catch (error) {
+		console.warn("Could not fetch session summary:", error);
+		return null;
+	}
+}
+
+// Fetch what the server measured while sending this session's downloads
+async function fetchServerResult() {
+	if (!sessionId) return null;
+
+	try {
+		const response = await fetch(
+			`${serverBase}/api/v1/session/${sessionId}/server-result`
+		);
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		return await response.json();
+	} catch (error) {
+		console.warn("Could not fetch server result:", error);
+		return null;
+	}
+}
+
+// Format a payload size for status labels, e.g. "32 MB"
+function formatMB(bytes) {
+	return `${Math.round(bytes / 1024 / 1024)} MB`;
+}
+
+// Size the test as the server advises for the probed speed. Without a plan
+// the parameters from adjustTestParameters stay in place.
+async function applyTestPlan(probeSpeed) {
+	if (!sessionId) return;
+
+	try {
+		const response = await fetch(
+			`${serverBase}/api/v1/session/${sessionId}/plan?mbps=${probeSpeed}`
+		);
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		const plan = await response.json();
+		downloadConcurrency = plan.streams;
+		uploadConcurrency = plan.streams;
+		downloadFileSize = plan.payload_size;
+		uploadFileSize = plan.payload_size;
+		console.log(
+			`Test plan: ${plan.streams} streams, ${
+				plan.payload_size / 1024 / 1024
+			}MB per request`
+		);
+	} catch (error) {
+		console.warn("Could not fetch test plan:", error);
+	}
+}
+
+// Store the finished test on the server and return the stored result
+async function submitResult() {
+	try {
+		const response = await fetch(`${serverBase}/api/v1/results`, {
+			method: "POST",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({
+				download: testResult.downloadSpeed,
+				upload: testResult.uploadSpeed,
+				latency: testResult.latency,
+				jitter: testResult.jitter,
+				rpm: testResult.rpm,
+				loss: testResult.loss,
+				session: sessionId,
+				nonce: resultNonce,
+			}),
+		});
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		return await response.json();
+	} catch (error) {
+		console.warn("Could not store test result:", error);
+		return null;
+	}
+}
+
+// Send probe datagrams over an unordered WebRTC data channel without
+// retransmissions and return the percentage that did not come back, or
+// undefined when the browser or server offers no WebRTC probe
+async function measurePacketLoss() {
+	if (!window.RTCPeerConnection) return undefined;
+
+	statusLabel.textContent = t("status.loss");
+	const pc = new RTCPeerConnection();
+	try {
+		const channel = pc.createDataChannel("probe", {
+			ordered: false,
+			maxRetransmits: 0,
+		});
+		channel.binaryType = "arraybuffer";
+		await pc.setLocalDescription(await pc.createOffer());
+
+		// The server needs none of our candidates; it answers our checks
+		const response = await fetch(`${serverBase}/api/v1/webrtc/offer`, {
+			method: "POST",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({ sdp: pc.localDescription.sdp }),
+		});
+		if (response.status === 404) return undefined;
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		const probe = await response.json();
+		await pc.setRemoteDescription({ type: "answer", sdp: probe.sdp });
+		await new Promise((resolve, reject) => {
+			channel.onopen = resolve;
+			setTimeout(
+				() => reject(new Error("Data channel did not open")),
+				LOSS_OPEN_TIMEOUT
+			);
+		});
+
+		// Datagrams use the UDP probe's layout: token, sequence number and
+		// send time in nanoseconds, echoed back unchanged
+		const token = Uint8Array.from(probe.id.match(/../g), (h) =>
+			parseInt(h, 16)
+		);
+		const echoed = new Set();
+		channel.onmessage = (event) => {
+			if (event.data.byteLength < 28) return;
+			const seq = new DataView(event.data).getUint32(16);
+			if (seq < LOSS_PACKETS) echoed.add(seq);
+		};
+		for (let seq = 0; seq < LOSS_PACKETS; seq++) {
+			const packet = new Uint8Array(64);
+			const view = new DataView(packet.buffer);
+			packet.set(token);
+			view.setUint32(16, seq);
+			view.setBigInt64(
+				20,
+				BigInt(Math.round((performance.timeOrigin + performance.now()) * 1e6))
+			);
+			channel.send(packet);
+			await new Promise((resolve) => setTimeout(resolve, LOSS_INTERVAL));
+		}
+		await new Promise((resolve) => setTimeout(resolve, LOSS_WAIT));
+
+		// The server's statistics tell loss on the way up from loss on the way down
+		const stop = await fetch(
+			`${serverBase}/api/v1/webrtc/stop?id=${encodeURIComponent(probe.id)}`,
+			{ method: "POST" }
+		);
+		if (stop.ok) {
+			console.log("WebRTC probe, as seen by the server:", await stop.json());
+		}
+		const lost = LOSS_PACKETS - echoed.size;
+		console.log(`WebRTC probe: ${lost} of ${LOSS_PACKETS} datagrams lost`);
+		return (lost / LOSS_PACKETS) * 100;
+	} catch (error) {
+		// Firewalls often block the WebRTC port; the test stands without it
+		console.warn("Could not measure packet loss:", error);
+		return undefined;
+	} finally {
+		pc.close();
+	}
+}
+
+// Show a link to the stored result that can be passed on, e.g. to an ISP
+function showShareLink(id) {
+	if (!id) return;
+
+	const container = document.getElementById("share-container");
+	const input = document.getElementById("share-url");
+	const button = document.getElementById("share-copy");
+	input.value = `${serverBase || location.origin}/result/${id}`;
+	button.textContent = t("share.copy");
+	button.onclick = async () => {
+		try {
+			await navigator.clipboard.writeText(input.value);
+			button.textContent = t("share.copied");
+		} catch (error) {
+			input.select();
+		}
+	};
+	container.style.display = "flex";
+}
+
+// Offer the servers this one lists, when it lists any besides itself
+async function loadServers() {
+	try {
+		const response = await fetch("/api/v1/servers");
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		const data = await response.json();
+		if (data.servers.length < 2) return;
+
+		for (const server of data.servers) {
+			const option = document.createElement("option");
+			option.value = server.local ? "" : server.url.replace(/\/$/, "");
+			option.textContent = server.location
+				? `${server.name} (${server.location})`
+				: server.name;
+			serverSelect.appendChild(option);
+		}
+		serverPicker.style.display = "block";
+	} catch (error) {
+		console.warn("Could not load server list:", error);
+	}
+}
+
+// Base URL of the server picked for the test. In automatic mode all listed
+// servers are pinged at once and the one with the lowest latency wins.
+async function chooseServer() {
+	serverLabel = "";
+	if (serverPicker.style.display === "none") return "";
+	if (serverSelect.value !== "auto") {
+		serverLabel = serverSelect.selectedOptions[0].textContent;
+		return serverSelect.value;
+	}
+
+	statusLabel.textContent = t("status.finding_server");
+	const options = [...serverSelect.options].filter((o) => o.value !== "auto");
+	const latencies = await Promise.all(
+		options.map((option) => measureServerLatency(option.value))
+	);
+	let best = 0;
+	for (let i = 1; i < options.length; i++) {
+		if (latencies[i] < latencies[best]) best = i;
+	}
+	// With no server answering, fall back to this one and let the test fail
+	if (latencies[best] === Infinity) return "";
+
+	const latency = formatLatency(latencies[best]);
+	serverLabel = t("server.closest", {
+		server: options[best].textContent,
+		latency,
+	});
+	console.log(`Testing against ${serverLabel}`);
+	return options[best].value;
+}
+
+// Median HTTP ping time to the server at base, or Infinity if unreachable
+async function measureServerLatency(base) {
+	const samples = [];
+	for (let i = 0; i <= SERVER_PING_TESTS; i++) {
+		try {
+			const buster = cacheBuster(`server-${i}`);
+			const startTime = performance.now();
+			const response = await fetch(`${base}/api/v1/ping?t=${buster}`);
+			const endTime = performance.now();
+			const fresh = servedFresh(response.headers.get("X-Cache-Buster"), buster);
+			// The first request also pays for DNS and the connection setup
+			if (response.ok && fresh && i > 0) {
+				samples.push(endTime - startTime);
+			}
+		} catch (error) {
+			console.warn(`Could not reach ${base || "this server"}:`, error);
+			return Infinity;
+		}
+	}
+	samples.sort((a, b) => a - b);
+	return samples.length ? samples[Math.floor(samples.length / 2)] : Infinity;
+}
+
+// Show the client's IP address and ISP under the title
+async function loadClientInfo() {
+	try {
+		const response = await fetch("/api/v1/clientinfo");
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		const info = await response.json();
+		clientDetails = info;
+
+		let text = info.ip;
+		if (info.isp) {
+			text += ` · ${info.isp.name} (AS${info.isp.asn})`;
+		}
+		clientInfo.textContent = text;
+
+		if (info.nat && !info.nat.type) {
+			await detectNAT(info.nat.ports);
+		}
+	} catch (error) {
+		console.warn("Could not load client info:", error);
+	}
+}
+
+// Let the browser ask the server's STUN ports for its public endpoint, then
+// show the NAT type the server concluded from the requests
+async function detectNAT(ports) {
+	if (!window.RTCPeerConnection) return;
+
+	const pc = new RTCPeerConnection({
+		iceServers: [
+			{ urls: ports.map((port) => `stun:${location.hostname}:${port}`) },
+		],
+	});
+	try {
+		pc.createDataChannel("nat");
+		const gathered = new Promise((resolve) => {
+			pc.onicegatheringstatechange = () => {
+				if (pc.iceGatheringState === "complete") resolve();
+			};
+			setTimeout(resolve, NAT_GATHER_TIMEOUT);
+		});
+		await pc.setLocalDescription(await pc.createOffer());
+		await gathered;
+	} finally {
+		pc.close();
+	}
+
+	const response = await fetch("/api/v1/clientinfo");
+	if (!response.ok) {
+		throw new Error(`HTTP error ${response.status}`);
+	}
+	const nat = (await response.json()).nat;
+	if (nat && nat.type) {
+		clientInfo.textContent += ` · ${t(`nat.${nat.type}`)}`;
+		clientInfo.title = t(`nat.${nat.type}.hint`);
+	}
+}
+
+// Show how many others are testing against the same server, since they
+// share its bandwidth with this test
+async function loadStatus() {
+	try {
+		const response = await fetch(`${serverBase}/api/v1/status`, {
+			cache: "no-store",
+		});
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		const status = await response.json();
+
+		// Our own session counts while a test runs
+		const others = Math.max(0, status.active_tests - (sessionId ? 1 : 0));
+		if (others === 0) {
+			activeUsers.textContent = t("activity.none");
+		} else if (others === 1) {
+			activeUsers.textContent = t("activity.one");
+		} else {
+			activeUsers.textContent = t("activity.many", { count: others });
+		}
+		activeUsers.classList.toggle("busy", others > 0);
+	} catch (error) {
+		console.warn("Could not load server status:", error);
+	}
+}
+
+// Describe an RPM score the way Apple's networkQuality does
+function responsivenessRating(rpm) {
+	if (rpm >= 1000) return "high";
+	if (rpm >= 300) return "medium";
+	return "low";
+}
+
+// Show idle and loaded latency as measured by the server with its grade and
+// the spread of idle round trips, and the responsiveness measured while
+// downloading
+function showBufferbloat(bufferbloat, latencyStats) {
+	if (!bufferbloat && !(testResult.rpm > 0)) return;
+
+	const show = (id, text) => {
+		document.getElementById(id).textContent = text;
+	};
+	const loaded = (ms, delta) =>
+		ms ? `${formatLatency(ms)} (+${formatLatency(delta || 0)})` : "-";
+
+	if (bufferbloat) {
+		show("bufferbloat-grade", bufferbloat.grade);
+		show("bufferbloat-idle", formatLatency(bufferbloat.idle_ms));
+		show(
+			"bufferbloat-download",
+			loaded(bufferbloat.download_ms, bufferbloat.download_delta_ms)
+		);
+		show(
+			"bufferbloat-upload",
+			loaded(bufferbloat.upload_ms, bufferbloat.upload_delta_ms)
+		);
+	} else {
+		["grade", "idle", "download", "upload"].forEach((row) =>
+			show(`bufferbloat-${row}`, "-")
+		);
+	}
+	const idle = latencyStats && latencyStats.idle;
+	show(
+		"bufferbloat-percentiles",
+		idle ? `${formatLatency(idle.p95_ms)} / ${formatLatency(idle.p99_ms)}` : "-"
+	);
+
+	const rpm = Math.round(testResult.rpm);
+	show(
+		"responsiveness-result",
+		rpm > 0
+			? `${rpm} RPM (${t(`responsiveness.${responsivenessRating(rpm)}`)})`
+			: "-"
+	);
+	bufferbloatContainer.style.display = "block";
+}
+
+// Show the server's overall quality score for the result and its verdict on
+// each use case, with the metric that held a use case back, and the expected
+// quality of voice calls
+function showQuality(quality, voip) {
+	if (!quality) return;
+
+	document.getElementById("quality-score").textContent = `${quality.score} / 100`;
+	quality.use_cases.forEach((uc) => {
+		const el = document.getElementById(`quality-${uc.use_case}`);
+		if (!el) return;
+		let text = t(`quality.${uc.verdict}`);
+		if (uc.limited_by) {
+			const metric = t(`metric.${uc.limited_by}`);
+			text += ` (${t("quality.limitedBy", { metric })})`;
+		}
+		el.textContent = text;
+	});
+	document.getElementById("quality-mos").textContent = voip
+		? `${voip.mos.toFixed(2)} (R ${Math.round(voip.r_factor)})`
+		: "-";
+	qualityContainer.style.display = "block";
+}
+
+// Repeat a short test over the other address family and show both side by side
+async function compareAddressFamilies() {
+	// The alternate host belongs to this server, not to a picked peer
+	const alternate = clientDetails && clientDetails.alternate;
+	if (!alternate || serverBase) return;
+
+	const base = alternate.url.replace(/\/$/, "");
+	try {
+		// Make sure the alternate host really is reached over the other family
+		const response = await fetch(`${base}/api/v1/clientinfo`);
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		const info = await response.json();
+		if (info.family !== alternate.family) {
+			console.warn(
+				`${base} was reached over ${info.family}, not ${alternate.family}`
+			);
+			return;
+		}
+
+		statusLabel.textContent = t("status.family", {
+			family: familyName(alternate.family),
+		});
+		const latency = await measureAlternateLatency(base);
+		const download = await measureAlternateDownload(base);
+
+		document.getElementById("family-current-label").textContent = familyName(
+			clientDetails.family
+		);
+		document.getElementById("family-alternate-label").textContent =
+			familyName(alternate.family);
+		document.getElementById("family-current-download").textContent =
+			formatSpeed(testResult.downloadSpeed);
+		document.getElementById("family-alternate-download").textContent =
+			formatSpeed(download);
+		document.getElementById("family-current-latency").textContent =
+			formatLatency(testResult.latency);
+		document.getElementById("family-alternate-latency").textContent =
+			formatLatency(latency);
+		familyContainer.style.display = "block";
+	} catch (error) {
+		// The alternate family is often simply unavailable on the client's network
+		console.warn(`Could not test over ${alternate.family}:`, error);
+	}
+}
+
+// Median HTTP ping time to another host of this server
+async function measureAlternateLatency(base) {
+	const samples = [];
+	for (let i = 0; i <= FAMILY_PING_TESTS; i++) {
+		const buster = cacheBuster(i);
+		const startTime = performance.now();
+		const response = await fetch(`${base}/api/v1/ping?t=${buster}`);
+		const endTime = performance.now();
+		const fresh = servedFresh(response.headers.get("X-Cache-Buster"), buster);
+		// The first request also pays for DNS and the connection setup
+		if (response.ok && fresh && i > 0) {
+			samples.push(endTime - startTime);
+		}
+	}
+	samples.sort((a, b) => a - b);
+	return samples[Math.floor(samples.length / 2)] || 0;
+}
+
+// Single-stream download speed from another host of this server, in Mbps
+async function measureAlternateDownload(base) {
+	const token = await fetchToken(base);
+	const buster = cacheBuster("family");
+	const startTime = performance.now();
+	const response = await fetch(
+		`${base}/api/v1/testfile?size=${FAMILY_DOWNLOAD_SIZE}&t=${buster}${tokenParam(token)}`
+	);
+	if (!response.ok) {
+		throw new Error(`HTTP error ${response.status}`);
+	}
+	if (!servedFresh(response.headers.get("X-Cache-Buster"), buster)) {
+		throw new Error("Download was served from a cache");
+	}
+
+	const reader = response.body.getReader();
+	let received = 0;
+	for (;;) {
+		const { done, value } = await reader.read();
+		if (done) break;
+		received += value.length;
+	}
+
+	const seconds = (performance.now() - startTime) / 1000;
+	return (received * 8) / seconds / 1000000;
+}
+
+// Human-readable name of an address family
+function familyName(family) {
+	return family === "ipv6" ? "IPv6" : "IPv4";
+}
+
+// Load this client's past results and chart them
+async function loadHistory() {
+	try {
+		const response = await fetch(
+			`${serverBase}/api/v1/history?limit=${HISTORY_LIMIT}`
+		);
+		if (!response.ok) {
+			throw new Error(`HTTP error ${response.status}`);
+		}
+		const data = await response.json();
+		historyResults = data.results || [];
+	} catch (error) {
+		console.warn("Could not load test history:", error);
+		historyResults = [];
+	}
+	drawHistory();
+}
+
+// Draw the history charts, hiding them until there is something to show
+function drawHistory() {
+	if (historyResults.length === 0) {
+		historyContainer.style.display = "none";
+		return;
+	}
+	historyContainer.style.display = "block";
+
+	drawLineChart(historySpeedChart, [
+		{ color: "#2563eb", values: historyResults.map((r) => r.download) },
+		{ color: "#10b981", values: historyResults.map((r) => r.upload) },
+	]);
+	drawLineChart(historyLatencyChart, [
+		{ color: "#f59e0b", values: historyResults.map((r) => r.latency) },
+		{ color: "#8b5cf6", values: historyResults.map((r) => r.jitter) },
+	]);
+}
+
+// Draw one or more series as line charts sharing a y axis starting at zero
+function drawLineChart(canvas, series) {
+	// Match the canvas resolution to its displayed size for crisp lines
+	const ratio = window.devicePixelRatio || 1;
+	const width = canvas.clientWidth;
+	const height = canvas.clientHeight;
+	canvas.width = width * ratio;
+	canvas.height = height * ratio;
+
+	const ctx = canvas.getContext("2d");
+	ctx.scale(ratio, ratio);
+	ctx.clearRect(0, 0, width, height);
+
+	const padding = { top: 10, right: 10, bottom: 20, left: 48 };
+	const plotWidth = width - padding.left - padding.right;
+	const plotHeight = height - padding.top - padding.bottom;
+	const count = Math.max(...series.map((s) => s.values.length));
+	const maxValue = Math.max(1, ...series.flatMap((s) => s.values)) * 1.1;
+
+	const x = (i) =>
+		padding.left + (count > 1 ? (i / (count - 1)) * plotWidth : plotWidth / 2);
+	const y = (v) => padding.top + plotHeight - (v / maxValue) * plotHeight;
+
+	// Horizontal grid lines with labels
+	ctx.font = "11px sans-serif";
+	ctx.fillStyle = "#6b7280";
+	ctx.strokeStyle = "#e5e7eb";
+	ctx.lineWidth = 1;
+	ctx.textAlign = "right";
+	ctx.textBaseline = "middle";
+	for (let i = 0; i <= 4; i++) {
+		const value = (maxValue / 4) * i;
+		ctx.beginPath();
+		ctx.moveTo(padding.left, y(value));
+		ctx.lineTo(width - padding.right, y(value));
+		ctx.stroke();
+		ctx.fillText(value.toFixed(value >= 10 ? 0 : 1), padding.left - 6, y(value));
+	}
+
+	// Dates of the oldest and newest test under the x axis
+	ctx.textBaseline = "top";
+	ctx.textAlign = "left";
+	ctx.fillText(
+		new Date(historyResults[0].timestamp).toLocaleDateString(),
+		padding.left,
+		height - padding.bottom + 6
+	);
+	ctx.textAlign = "right";
+	ctx.fillText(
+		new Date(historyResults[historyResults.length - 1].timestamp).toLocaleDateString(),
+		width - padding.right,
+		height - padding.bottom + 6
+	);
+
+	// Data series
+	ctx.lineWidth = 2;
+	for (const s of series) {
+		ctx.strokeStyle = s.color;
+		ctx.fillStyle = s.color;
+		ctx.beginPath();
+		s.values.forEach((v, i) => {
+			if (i === 0) ctx.moveTo(x(i), y(v));
+			else ctx.lineTo(x(i), y(v));
+		});
+		ctx.stroke();
+
+		s.values.forEach((v, i) => {
+			ctx.beginPath();
+			ctx.arc(x(i), y(v), 3, 0, 2 * Math.PI);
+			ctx.fill();
+		});
+	}
+}
+
+// Query string parameter tying a request to the current session
+function sessionParam() {
+	return sessionId ? `&session=${sessionId}` : "";
+}
+
+// Unique value for the t parameter of a test request, echoed back by the server
+function cacheBuster(label) {
+	return `${Date.now()}-${label}-${Math.random().toString(36).slice(2, 10)}`;
+}
+
+// Whether a test response came from the server itself rather than from a
+// cache on the way, which would not echo the request's cache buster
+function servedFresh(echoed, buster) {
+	return echoed === buster;
+}
+
 // Reset all test data
 function resetTestData() {
 	totalDownloaded = 0;
@@ -216,14 +1083,18 @@ async function probeConnectionSpeed(onProgress) {
 			const xhr = new XMLHttpRequest();
 			activeXhrs.push(xhr);
 
-			const url = `/testfile?size=${size}&t=${Date.now()}-probe`;
+			const buster = cacheBuster("probe");
+			const url = `${serverBase}/api/v1/testfile?size=${size}&t=${buster}&probe=1${sessionParam()}`;
 			const startTime = performance.now();
 
 			xhr.open("GET", url, true);
 			xhr.responseType = "arraybuffer";
 
 			xhr.onload = function () {
-				if (xhr.status >= 200 && xhr.status < 300) {
+				const ok = xhr.status >= 200 && xhr.status < 300;
+				if (ok && !servedFresh(xhr.getResponseHeader("X-Cache-Buster"), buster)) {
+					reject(new Error("Probe was served from a cache"));
+				} else if (ok) {
 					const endTime = performance.now();
 					const duration = (endTime - startTime) / 1000; // seconds
 					const bytesReceived = xhr.response.byteLength;
@@ -309,76 +1180,34 @@ function adjustTestParameters(speedMbps) {
 
 	console.log(
 		`Adjusted test parameters: downloadSize=${
-			DOWNLOAD_FILE_SIZE / 1024 / 1024
+			downloadFileSize / 1024 / 1024
 		}MB, uploadSize=${
-			UPLOAD_FILE_SIZE / 1024 / 1024
+			uploadFileSize / 1024 / 1024
 		}MB, concurrency=${downloadConcurrency}/${uploadConcurrency}, method=${speedCalculationMethod}`
 	);
 }
 
 // Measure latency
 async function measureLatency() {
-	const pingResults = [];
-	const jitterValues = [];
-
 	// Reset progress and show status
 	updateProgress({ progress: 0, currentSpeed: 0 });
 	console.log("Starting latency test");
 
-	// Do initial warm-up pings
-	const warmupCount = 3;
-	for (let i = 0; i < warmupCount; i++) {
-		try {
-			await fetch(`/ping?t=${Date.now()}-warmup-${i}`, { method: "GET" });
-		} catch (e) {
-			console.warn("Warm-up ping failed, continuing with test");
-		}
+	// Prefer the WebSocket channel, which avoids per-request HTTP overhead
+	let pingResults = [];
+	try {
+		pingResults = await measureWebSocketPings();
+	} catch (error) {
+		console.warn("WebSocket ping unavailable, falling back to HTTP:", error);
+	}
+	if (pingResults.length < 5) {
+		pingResults = await measureHttpPings();
 	}
 
-	// Actual ping tests
-	let lastPing = null;
-
-	for (let i = 0; i < PING_TESTS; i++) {
-		try {
-			const startTime = performance.now();
-			const response = await fetch(`/ping?t=${Date.now()}-${i}`, {
-				method: "GET",
-			});
-			const endTime = performance.now();
-
-			if (response.ok) {
-				const latencyValue = endTime - startTime;
-				pingResults.push(latencyValue);
-
-				// Calculate jitter (variation between consecutive pings)
-				if (lastPing !== null) {
-					const jitter = Math.abs(latencyValue - lastPing);
-					jitterValues.push(jitter);
-				}
-
-				lastPing = latencyValue;
-				console.log(
-					`Ping ${i + 1}/${PING_TESTS}: ${latencyValue.toFixed(2)}ms`
-				);
-			}
-		} catch (error) {
-			console.error("Ping test failed:", error);
-		}
-
-		// Update progress
-		updateProgress({
-			progress: ((i + 1) / PING_TESTS) * 100,
-			currentSpeed: 0,
-		});
-
-		// Delay between pings
-		const pingDelay =
-			connectionType === "slow"
-				? 300
-				: connectionType === "moderate"
-				? 200
-				: 100;
-		await new Promise((resolve) => setTimeout(resolve, pingDelay));
+	// Calculate jitter (variation between consecutive pings)
+	const jitterValues = [];
+	for (let i = 1; i < pingResults.length; i++) {
+		jitterValues.push(Math.abs(pingResults[i] - pingResults[i - 1]));
 	}
 
 	// Calculate latency and jitter with statistical methods
@@ -437,15 +1266,209 @@ async function measureLatency() {
 		jitter = Math.max(jitter, 0.1);
 	}
 
+	// Per-packet RTT variance, useful for diagnosing unstable links
+	const meanRtt =
+		pingResults.reduce((sum, ping) => sum + ping, 0) /
+		Math.max(1, pingResults.length);
+	const rttVariance =
+		pingResults.reduce((sum, ping) => sum + (ping - meanRtt) ** 2, 0) /
+		Math.max(1, pingResults.length);
+
 	console.log(
 		`Latency test results - Average: ${latency.toFixed(
 			2
-		)}ms, Jitter: ${jitter.toFixed(2)}ms`
+		)}ms, Jitter: ${jitter.toFixed(2)}ms, RTT variance: ${rttVariance.toFixed(
+			2
+		)}ms²`
 	);
 	return { latency, jitter };
 }
 
-// Optimized download speed test with fixed file size (32 MB)
+// Delay between pings depending on connection type
+function pingDelay() {
+	return connectionType === "slow"
+		? 300
+		: connectionType === "moderate"
+		? 200
+		: 100;
+}
+
+// Measure round-trip times over the WebSocket ping channel
+function measureWebSocketPings() {
+	return new Promise((resolve, reject) => {
+		if (!("WebSocket" in window)) {
+			reject(new Error("WebSockets not supported"));
+			return;
+		}
+
+		const socket = new WebSocket(wsURL("/api/v1/ws/ping"));
+		const warmupCount = 3;
+		const total = warmupCount + PING_TESTS;
+		const pingResults = [];
+		const sentAt = new Map();
+		let seq = 0;
+
+		const timeout = setTimeout(() => {
+			socket.close();
+			reject(new Error("WebSocket ping timed out"));
+		}, 30000);
+
+		function sendPing() {
+			const clientTime = performance.now();
+			sentAt.set(seq, clientTime);
+			socket.send(JSON.stringify({ seq, client_time: clientTime }));
+			seq++;
+		}
+
+		socket.onopen = sendPing;
+
+		socket.onmessage = (event) => {
+			const receivedAt = performance.now();
+			const frame = JSON.parse(event.data);
+			const rtt = receivedAt - sentAt.get(frame.seq);
+
+			// Skip warm-up frames
+			if (frame.seq >= warmupCount) {
+				pingResults.push(rtt);
+				console.log(
+					`WebSocket ping ${pingResults.length}/${PING_TESTS}: ${rtt.toFixed(2)}ms`
+				);
+				updateProgress({
+					progress: (pingResults.length / PING_TESTS) * 100,
+					currentSpeed: 0,
+				});
+			}
+
+			if (seq >= total) {
+				clearTimeout(timeout);
+				socket.close();
+				resolve(pingResults);
+				return;
+			}
+			setTimeout(sendPing, pingDelay());
+		};
+
+		socket.onerror = () => {
+			clearTimeout(timeout);
+			reject(new Error("WebSocket error"));
+		};
+	});
+}
+
+// Measure round-trip times with HTTP requests to /api/v1/ping
+async function measureHttpPings() {
+	const pingResults = [];
+
+	// Do initial warm-up pings
+	const warmupCount = 3;
+	for (let i = 0; i < warmupCount; i++) {
+		try {
+			await fetch(`${serverBase}/api/v1/ping?t=${cacheBuster(`warmup-${i}`)}`, {
+				method: "GET",
+			});
+		} catch (e) {
+			console.warn("Warm-up ping failed, continuing with test");
+		}
+	}
+
+	// Actual ping tests
+	for (let i = 0; i < PING_TESTS; i++) {
+		try {
+			const buster = cacheBuster(i);
+			const startTime = performance.now();
+			const response = await fetch(`${serverBase}/api/v1/ping?t=${buster}`, {
+				method: "GET",
+			});
+			const endTime = performance.now();
+
+			if (
+				response.ok &&
+				!servedFresh(response.headers.get("X-Cache-Buster"), buster)
+			) {
+				console.warn(`Ping ${i + 1} was served from a cache, ignoring it`);
+			} else if (response.ok) {
+				const latencyValue = endTime - startTime;
+				pingResults.push(latencyValue);
+				console.log(
+					`Ping ${i + 1}/${PING_TESTS}: ${latencyValue.toFixed(2)}ms`
+				);
+			}
+		} catch (error) {
+			console.error("Ping test failed:", error);
+		}
+
+		// Update progress
+		updateProgress({
+			progress: ((i + 1) / PING_TESTS) * 100,
+			currentSpeed: 0,
+		});
+
+		// Delay between pings
+		await new Promise((resolve) => setTimeout(resolve, pingDelay()));
+	}
+
+	return pingResults;
+}
+
+// Send back-to-back HTTP requests to /api/v1/ping while a transfer loads the
+// connection. stop() ends them and resolves to the responsiveness in round
+// trips per minute (RPM), or 0 without enough samples.
+function startResponsivenessProbes() {
+	const rtts = [];
+	let stopped = false;
+
+	const probing = (async () => {
+		// Let the transfer ramp up first
+		await new Promise((resolve) =>
+			setTimeout(resolve, WARMUP_DURATION * 1000)
+		);
+
+		for (let i = 0; !stopped; i++) {
+			try {
+				const buster = cacheBuster(`rpm-${i}`);
+				const startTime = performance.now();
+				const response = await fetch(`${serverBase}/api/v1/ping?t=${buster}`);
+				const rtt = performance.now() - startTime;
+				if (
+					!stopped &&
+					response.ok &&
+					servedFresh(response.headers.get("X-Cache-Buster"), buster)
+				) {
+					rtts.push(rtt);
+				}
+			} catch (error) {
+				console.warn("Responsiveness probe failed:", error);
+				await new Promise((resolve) => setTimeout(resolve, 100));
+			}
+		}
+	})();
+
+	return {
+		async stop() {
+			stopped = true;
+			await probing;
+			const rpm = responsivenessRPM(rtts);
+			console.log(
+				`Responsiveness: ${Math.round(rpm)} RPM from ${rtts.length} round trips`
+			);
+			return rpm;
+		},
+	};
+}
+
+// Turn round-trip times in milliseconds into round trips per minute, from the
+// mean after trimming the slowest and fastest 5%
+function responsivenessRPM(rtts) {
+	if (rtts.length < 5) return 0;
+
+	const sorted = [...rtts].sort((a, b) => a - b);
+	const cut = Math.floor(sorted.length * 0.05);
+	const trimmed = sorted.slice(cut, sorted.length - cut);
+	const mean = trimmed.reduce((sum, rtt) => sum + rtt, 0) / trimmed.length;
+	return 60000 / mean;
+}
+
+// Optimized download speed test, requesting downloadFileSize per stream
 async function measureDownloadSpeed(onProgress) {
 	const isLocal =
 		window.location.hostname === "localhost" ||
@@ -461,7 +1484,9 @@ async function measureDownloadSpeed(onProgress) {
 	}
 
 	console.log(
-		`Starting download test with concurrency: ${downloadConcurrency}, file size: 32MB`
+		`Starting download test with concurrency: ${downloadConcurrency}, file size: ${
+			downloadFileSize / 1024 / 1024
+		}MB`
 	);
 
 	// Reset state
@@ -585,6 +1610,22 @@ async function measureDownloadSpeed(onProgress) {
 			`Total downloaded: ${(totalDownloaded / (1024 * 1024)).toFixed(2)} MB`
 		);
 
+		// Cross-check against what the server saw leaving across all streams
+		const serverResult = await fetchServerResult();
+		if (serverResult) {
+			console.log(
+				`Server-measured download: ${serverResult.mbps.toFixed(2)} Mbps, ${(serverResult.bytes / (1024 * 1024)).toFixed(2)} MB over ${serverResult.streams} streams in ${(serverResult.elapsed_ms / 1000).toFixed(1)} s`
+			);
+			if (
+				serverResult.mbps > 0 &&
+				Math.abs(finalSpeed - serverResult.mbps) / serverResult.mbps > 0.25
+			) {
+				console.warn(
+					"Browser and server download measurements differ by more than 25%"
+				);
+			}
+		}
+
 		// Final progress update
 		onProgress({ progress: 100, currentSpeed: finalSpeed });
 
@@ -598,8 +1639,9 @@ async function measureDownloadSpeed(onProgress) {
 	// Function to start a single download stream
 	async function startDownloadStream(streamId) {
 		return new Promise((resolve, reject) => {
-			// Create unique URL to avoid caching - always use fixed size of 32 MB
-			const url = `/testfile?size=${DOWNLOAD_FILE_SIZE}&stream=${streamId}&t=${Date.now()}`;
+			// Create unique URL to avoid caching
+			const buster = cacheBuster(`stream-${streamId}`);
+			const url = `${serverBase}/api/v1/testfile?size=${downloadFileSize}&stream=${streamId}${sessionParam()}&t=${buster}`;
 
 			const xhr = new XMLHttpRequest();
 			activeXhrs.push(xhr);
@@ -662,7 +1704,24 @@ async function measureDownloadSpeed(onProgress) {
 				reject(new Error("Network error"));
 			};
 
+			// Drop streams answered by a cache before they count any bytes
+			xhr.onreadystatechange = function () {
+				if (
+					xhr.readyState === XMLHttpRequest.HEADERS_RECEIVED &&
+					xhr.status === 200 &&
+					!servedFresh(xhr.getResponseHeader("X-Cache-Buster"), buster)
+				) {
+					hasError = true;
+					xhr.abort();
+				}
+			};
+
 			xhr.onabort = function () {
+				if (hasError) {
+					console.warn(`Download stream ${streamId} was served from a cache`);
+					reject(new Error("Download was served from a cache"));
+					return;
+				}
 				console.log(`Download stream ${streamId} aborted`);
 				resolve();
 			};
@@ -692,7 +1751,7 @@ async function measureDownloadSpeed(onProgress) {
 	}
 }
 
-// Optimized upload speed test with fixed file size (32 MB)
+// Optimized upload speed test, posting uploadFileSize per stream
 async function measureUploadSpeed(onProgress) {
 	const isLocal =
 		window.location.hostname === "localhost" ||
@@ -708,7 +1767,9 @@ async function measureUploadSpeed(onProgress) {
 	}
 
 	console.log(
-		`Starting upload test with concurrency: ${uploadConcurrency}, file size: 32MB`
+		`Starting upload test with concurrency: ${uploadConcurrency}, file size: ${
+			uploadFileSize / 1024 / 1024
+		}MB`
 	);
 
 	// Reset state
@@ -732,7 +1793,7 @@ async function measureUploadSpeed(onProgress) {
 	let speedWindowStartTime = testStartTime;
 
 	try {
-		// Generate upload data - this will now be a full 32MB buffer instead of small chunks
+		// Generate upload data - one buffer of uploadFileSize shared by all streams
 		console.log("Generating upload data...");
 		updateProgress({ progress: 0, currentSpeed: 0 });
 
@@ -840,6 +1901,14 @@ async function measureUploadSpeed(onProgress) {
 			`Total uploaded: ${(totalUploaded / (1024 * 1024)).toFixed(2)} MB`
 		);
 
+		// Cross-check against the server's combined view of all streams
+		const summary = await fetchSessionSummary();
+		if (summary) {
+			console.log(
+				`Server-measured upload: ${summary.upload.mbps.toFixed(2)} Mbps over ${summary.upload.streams} streams`
+			);
+		}
+
 		// Final progress update
 		onProgress({ progress: 100, currentSpeed: finalSpeed });
 
@@ -850,19 +1919,23 @@ async function measureUploadSpeed(onProgress) {
 		return getFallbackSpeed("upload");
 	}
 
-	// Function to generate upload data for 32MB
+	// Function to generate uploadFileSize bytes of upload data
 	async function generateUploadData() {
-		// This function now generates a full 32MB buffer instead of multiple small chunks
-		console.log("Generating 32MB of random data for upload test...");
+		console.log(
+			`Generating ${
+				uploadFileSize / 1024 / 1024
+			}MB of random data for upload test...`
+		);
 
 		// Generate data in chunks to avoid browser memory issues
 		const chunkSize = 4 * 1024 * 1024; // 4MB chunks
-		const numChunks = UPLOAD_FILE_SIZE / chunkSize;
-		const combinedBuffer = new ArrayBuffer(UPLOAD_FILE_SIZE);
+		const numChunks = Math.ceil(uploadFileSize / chunkSize);
+		const combinedBuffer = new ArrayBuffer(uploadFileSize);
 		const combinedView = new Uint8Array(combinedBuffer);
 
 		for (let i = 0; i < numChunks; i++) {
-			const chunk = generateRandomData(chunkSize);
+			const size = Math.min(chunkSize, uploadFileSize - i * chunkSize);
+			const chunk = generateRandomData(size);
 			combinedView.set(chunk, i * chunkSize);
 
 			// Update progress for data generation
@@ -878,11 +1951,11 @@ async function measureUploadSpeed(onProgress) {
 		return combinedBuffer;
 	}
 
-	// Function to start a single upload stream with the full 32MB data
+	// Function to start a single upload stream with the full upload data
 	async function startUploadStream(streamId, uploadData) {
 		return new Promise((resolve, reject) => {
 			// Create unique URL to avoid caching
-			const url = `/upload?i=${streamId}&t=${Date.now()}`;
+			const url = `${serverBase}/api/v1/upload?size=${uploadData.byteLength}&i=${streamId}${sessionParam()}&t=${Date.now()}`;
 
 			const xhr = new XMLHttpRequest();
 			activeXhrs.push(xhr);
@@ -1199,7 +2272,8 @@ function getFallbackSpeed(testType) {
 function updateUI() {
 	startButton.disabled = isRunning;
 	startButton.classList.toggle("disabled", isRunning);
-	startButton.textContent = isRunning ? "Running Test..." : "Start Speed Test";
+	startButton.textContent = t(isRunning ? "button.running" : "button.start");
+	serverSelect.disabled = isRunning;
 
 	startIcon.style.display =
 		isRunning || testStatus === TestStatus.COMPLETE ? "none" : "block";
@@ -1210,7 +2284,7 @@ function updateUI() {
 	// Show/hide info text
 	infoText.textContent =
 		!isRunning && testStatus !== TestStatus.COMPLETE
-			? "Click the button to test your internet connection speed."
+			? t("info.start")
 			: "";
 }
 
@@ -1221,22 +2295,26 @@ function updateStatus(status, data) {
 	// Update status label text
 	switch (status) {
 		case TestStatus.PROBING:
-			statusLabel.textContent = "Detecting Connection Speed...";
+			statusLabel.textContent = t("status.probing");
 			progressBarFill.style.backgroundColor = "#9ca3af"; // Gray
 			break;
 		case TestStatus.DOWNLOAD:
-			statusLabel.textContent = "Testing Download Speed (32 MB)...";
+			statusLabel.textContent = t("status.download", {
+				size: formatMB(downloadFileSize),
+			});
 			progressBarFill.style.backgroundColor = "#2563eb"; // Blue
 			break;
 		case TestStatus.UPLOAD:
-			statusLabel.textContent = "Testing Upload Speed (32 MB)..."; // Updated to 32 MB
+			statusLabel.textContent = t("status.upload", {
+				size: formatMB(uploadFileSize),
+			});
 			progressBarFill.style.backgroundColor = "#7c3aed"; // Purple
 			break;
 		case TestStatus.COMPLETE:
-			statusLabel.textContent = "Test Complete";
+			statusLabel.textContent = t("status.complete");
 			break;
 		default:
-			statusLabel.textContent = "Measuring Latency...";
+			statusLabel.textContent = t("status.latency");
 			progressBarFill.style.backgroundColor = "#6b7280"; // Gray
 	}
 
@@ -1252,25 +2330,37 @@ function updateStatus(status, data) {
 function updateProgress(data) {
 	// Update progress bar
 	progressBarFill.style.width = `${data.progress}%`;
+	lastProgress = data.progress;
+
+	// While the server reports progress, its rate drives the gauge until the
+	// browser shows its final result
+	if (
+		serverGaugeSpeed > 0 &&
+		!data.fromServer &&
+		data.currentSpeed > 0 &&
+		data.progress < 100
+	) {
+		return;
+	}
 
 	// Update speed display in the gauge
 	if (data.currentSpeed > 0) {
 		speedValue.textContent = formatSpeed(data.currentSpeed);
 		speedUnit.textContent =
 			testStatus === TestStatus.DOWNLOAD
-				? "Download"
+				? t("metric.download")
 				: testStatus === TestStatus.UPLOAD
-				? "Upload"
+				? t("metric.upload")
 				: "";
 		currentSpeed.textContent = formatSpeed(data.currentSpeed);
 	} else {
 		// If no speed value, show the test type
 		if (testStatus === TestStatus.PROBING) {
-			speedValue.textContent = "Detecting";
-			speedUnit.textContent = "Speed";
+			speedValue.textContent = t("gauge.detecting");
+			speedUnit.textContent = t("gauge.speed");
 		} else if (testStatus === TestStatus.IDLE) {
-			speedValue.textContent = "Measuring";
-			speedUnit.textContent = "Latency";
+			speedValue.textContent = t("gauge.measuring");
+			speedUnit.textContent = t("metric.latency");
 		}
 		currentSpeed.textContent = "";
 	}
@@ -1297,6 +2387,10 @@ function showResults() {
 	jitterResult.textContent = formatLatency(testResult.jitter);
 	jitterResult.className = `result-value ${getLatencyClass(testResult.jitter)}`;
 
+	const serverResult = document.getElementById("result-server");
+	serverResult.textContent = t("server.result", { server: serverLabel });
+	serverResult.style.display = serverLabel ? "block" : "none";
+
 	// Show the results container with animation
 	resultContainer.style.display = "block";
 
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation (sd_listen_fds)
+const systemdListenFD = 3
+
+// systemdListeners returns the sockets systemd opened for us through socket
+// activation, one per ListenStream= line, or nil when the server was started
+// some other way
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	// The sockets are meant for this process only, not for anything it starts
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	lns := make([]net.Listener, 0, fds)
+	for fd := systemdListenFD; fd < systemdListenFD+fds; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("using socket %d passed by systemd: %w", fd, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// sdNotify sends a state such as READY=1 to the service manager. It does
+// nothing when the server does not run under systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// systemdWatchdog pings the service manager at half the interval set by
+// WatchdogSec=, so systemd restarts the server if it ever hangs. It returns
+// straight away when no watchdog is configured.
+func systemdWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	logger.Info("Pinging systemd watchdog", "interval", interval)
+	for range time.Tick(interval) {
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logger.Warn("Pinging systemd watchdog failed", "err", err)
+		}
+	}
+}